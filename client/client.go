@@ -0,0 +1,504 @@
+// Package client is a Go client for Creek. It speaks RESP to the server, keeps a pool of
+// connections shared by concurrent goroutines and transparently replaces broken ones.
+package client
+
+import (
+	"context"
+	"creek/internal/commons"
+	"creek/internal/resp"
+	"creek/internal/utils"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultPoolSize = 8
+const DefaultDialTimeout = 5 * time.Second
+const DefaultMaxRetries = 1
+const DefaultMaxRedirects = 3
+
+// A partition handed over between nodes answers TRYAGAIN for a moment after an ASK redirect, the
+// command is retried every tryAgainDelay up to maxTryAgains times.
+const tryAgainDelay = 25 * time.Millisecond
+const maxTryAgains = 20
+
+// NoExpiration is the TTL of a key that never expires.
+const NoExpiration time.Duration = -1
+
+// Options configures a Client, only Address is required.
+type Options struct {
+	Address     string        // host:port of the server
+	PoolSize    int           // maximum number of open connections, DefaultPoolSize when 0
+	DialTimeout time.Duration // DefaultDialTimeout when 0
+	MaxRetries  int           // times a command is resent after a connection failure, see doOn, DefaultMaxRetries when 0, -1 disables retries
+	// MaxRedirects is how many MOVED and ASK replies are followed per command, DefaultMaxRedirects when 0, -1 disables redirects
+	MaxRedirects int
+}
+
+// Client is safe for concurrent use. Every command takes a context whose deadline bounds the
+// whole call, retries and redirects included. Writes sent to a follower are redirected to the
+// leader, so a client may be connected to any node of a cluster.
+type Client struct {
+	opts Options
+	pool *pool
+
+	mu     sync.Mutex
+	pools  map[string]*pool // pools of the nodes redirects pointed to, keyed by address
+	closed bool
+}
+
+// New creates a client, connections are dialed on first use.
+func New(opts Options) (*Client, error) {
+	if opts.Address == "" {
+		return nil, errors.New("creek: missing server address")
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultPoolSize
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.MaxRedirects == 0 {
+		opts.MaxRedirects = DefaultMaxRedirects
+	} else if opts.MaxRedirects < 0 {
+		opts.MaxRedirects = 0
+	}
+	return &Client{
+		opts:  opts,
+		pool:  newPool(opts.Address, opts.PoolSize, opts.DialTimeout),
+		pools: make(map[string]*pool),
+	}, nil
+}
+
+// Close closes every connection of the client.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	pools := c.pools
+	c.pools = make(map[string]*pool)
+	c.mu.Unlock()
+
+	for _, p := range pools {
+		_ = p.close()
+	}
+	return c.pool.close()
+}
+
+// poolFor returns the pool of the node at address, creating it on the first redirect there.
+func (c *Client) poolFor(address string) (*pool, error) {
+	if address == c.opts.Address {
+		return c.pool, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	p, exists := c.pools[address]
+	if !exists {
+		p = newPool(address, c.opts.PoolSize, c.opts.DialTimeout)
+		c.pools[address] = p
+	}
+	return p, nil
+}
+
+// Set stores value under key. A positive ttl expires the key after that many whole seconds.
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	args := []string{commons.CmdDataSet, key, value}
+	if ttl > 0 {
+		args = append(args, strconv.Itoa(ttlSeconds(ttl)))
+	}
+	_, err := c.do(ctx, args...)
+	return err
+}
+
+// SetNX stores value under key like Set when key holds no value, and tells whether it did.
+func (c *Client) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	args := []string{commons.CmdDataSet, key, value}
+	if ttl > 0 {
+		args = append(args, strconv.Itoa(ttlSeconds(ttl)))
+	}
+	reply, err := c.do(ctx, append(args, commons.SetNX)...)
+	if err != nil {
+		return false, err
+	}
+	return !reply.Null, nil
+}
+
+// CompareAndSwap stores value under key like Set when key was last written under version, as
+// KEYINFO reports it, 0 standing for a key without value. It returns the version of the write, 0
+// when key changed meanwhile.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, version int64, value string, ttl time.Duration) (int64, error) {
+	args := []string{commons.CmdDataCAS, key, strconv.FormatInt(version, 10), value}
+	if ttl > 0 {
+		args = append(args, strconv.Itoa(ttlSeconds(ttl)))
+	}
+	reply, err := c.do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Int, nil
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, err := c.do(ctx, commons.CmdDataGet, key)
+	if err != nil {
+		return "", err
+	}
+	if value.Null {
+		return "", ErrNotFound
+	}
+	return value.Str, nil
+}
+
+// MGet returns the values of the keys that hold one, read in a single request. Every key must be
+// served by the same node.
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	reply, err := c.do(ctx, append([]string{commons.CmdDataMGet}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(keys))
+	for i, elem := range reply.Elems {
+		if i < len(keys) && !elem.Null {
+			values[keys[i]] = elem.Str
+		}
+	}
+	return values, nil
+}
+
+// MSet stores every key-value pair of values without TTL in a single request, the pairs of a
+// partition are stored atomically. Every key must be served by the same node.
+func (c *Client) MSet(ctx context.Context, values map[string]string) error {
+	args := make([]string, 0, 1+2*len(values))
+	args = append(args, commons.CmdDataMSet)
+	for key, value := range values {
+		args = append(args, key, value)
+	}
+	_, err := c.do(ctx, args...)
+	return err
+}
+
+// MDelete removes keys in a single request and returns how many of them held a value.
+func (c *Client) MDelete(ctx context.Context, keys ...string) (int, error) {
+	reply, err := c.do(ctx, append([]string{commons.CmdDataMDel}, keys...)...)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, elem := range reply.Elems {
+		deleted += int(elem.Int)
+	}
+	return deleted, nil
+}
+
+// Scan lists a few keys matching a glob pattern, all keys when it is empty, starting at cursor. It
+// returns the cursor of the next call, 0 once every key was listed. count is how many keys the
+// server looks at, 0 for its default.
+func (c *Client) Scan(ctx context.Context, cursor uint64, match string, count int) ([]string, uint64, error) {
+	args := []string{commons.CmdDataScan, strconv.FormatUint(cursor, 10)}
+	if match != "" {
+		args = append(args, commons.ScanMatch, match)
+	}
+	if count > 0 {
+		args = append(args, commons.ScanCount, strconv.Itoa(count))
+	}
+	reply, err := c.do(ctx, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(reply.Elems) != 2 {
+		return nil, 0, fmt.Errorf("invalid SCAN reply")
+	}
+	next, err := strconv.ParseUint(reply.Elems[0].Str, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid SCAN cursor %q", reply.Elems[0].Str)
+	}
+	keys := make([]string, len(reply.Elems[1].Elems))
+	for i, elem := range reply.Elems[1].Elems {
+		keys[i] = elem.Str
+	}
+	return keys, next, nil
+}
+
+// KeyValue is a key along with its value, as listed by Range and Prefix.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Range returns in order up to limit keys from start on and before end, an empty end having no
+// bound, along with their values. The server, which must have the ordered_index option, walks a
+// bounded page of keys per request, Range requests pages until it has limit keys or the range is
+// over. limit 0 reads the whole range, a page of up to keys_limit keys at a time.
+func (c *Client) Range(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	return c.keyValues(ctx, limit, end, commons.CmdDataRange, start, end)
+}
+
+// Prefix returns in order up to limit keys starting with prefix along with their values, like Range.
+func (c *Client) Prefix(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	return c.keyValues(ctx, limit, utils.PrefixEnd(prefix), commons.CmdDataPrefix, prefix)
+}
+
+// keyValues sends a RANGE or PREFIX request then RANGE requests from where the previous reply
+// stopped to end, until limit keys were read or the range is over.
+func (c *Client) keyValues(ctx context.Context, limit int, end string, args ...string) ([]KeyValue, error) {
+	var pairs []KeyValue
+	for {
+		request := args
+		if limit > 0 {
+			request = append(request[:len(request):len(request)], commons.RangeLimit, strconv.Itoa(limit-len(pairs)))
+		}
+		reply, err := c.do(ctx, request...)
+		if err != nil {
+			return nil, err
+		}
+		if len(reply.Elems) != 2 || len(reply.Elems[1].Elems)%2 != 0 {
+			return nil, fmt.Errorf("invalid %s reply", args[0])
+		}
+		elems := reply.Elems[1].Elems
+		for i := 0; i+1 < len(elems); i += 2 {
+			pairs = append(pairs, KeyValue{Key: elems[i].Str, Value: elems[i+1].Str})
+		}
+		next := reply.Elems[0].Str
+		if next == "" || (limit > 0 && len(pairs) >= limit) {
+			return pairs, nil
+		}
+		args = []string{commons.CmdDataRange, next, end}
+	}
+}
+
+// DBSize returns how many keys hold a value on the server.
+func (c *Client) DBSize(ctx context.Context) (int64, error) {
+	reply, err := c.do(ctx, commons.CmdDataDBSize)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Int, nil
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, commons.CmdDataDel, key)
+	return err
+}
+
+// Expire sets the time to live of an existing key, in whole seconds.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := c.do(ctx, commons.CmdDataEXP, key, strconv.Itoa(ttlSeconds(ttl)))
+	return err
+}
+
+// TTL returns the remaining time to live of key, NoExpiration for a persistent key and
+// ErrNotFound when the key does not exist.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	value, err := c.do(ctx, commons.CmdDataTTL, key)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case value.Int == -2:
+		return 0, ErrNotFound
+	case value.Int < 0:
+		return NoExpiration, nil
+	default:
+		return time.Duration(value.Int) * time.Second, nil
+	}
+}
+
+// IncrBy adds delta to the integer stored at key and returns the result, a missing key counts as
+// 0. The key keeps its time to live.
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	value, err := c.do(ctx, commons.CmdDataIncrBy, key, strconv.FormatInt(delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	return value.Int, nil
+}
+
+// IncrByFloat adds delta to the number stored at key like IncrBy and returns the result.
+func (c *Client) IncrByFloat(ctx context.Context, key string, delta float64) (float64, error) {
+	value, err := c.do(ctx, commons.CmdDataIncrByFloat, key, strconv.FormatFloat(delta, 'f', -1, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(value.Str, 64)
+}
+
+// Ping checks that the server answers.
+func (c *Client) Ping(ctx context.Context) error {
+	value, err := c.do(ctx, commons.CmdSysPing)
+	if err != nil {
+		return err
+	}
+	if value.Str != commons.CmdSysPong {
+		return fmt.Errorf("creek: unexpected ping reply %q", value.Str)
+	}
+	return nil
+}
+
+// Version returns the version of the server.
+func (c *Client) Version(ctx context.Context) (string, error) {
+	value, err := c.do(ctx, commons.CmdSysVersion)
+	if err != nil {
+		return "", err
+	}
+	return value.Str, nil
+}
+
+// Do sends any command and returns its reply as a Go value: string for simple and bulk
+// strings, int64 for integers, nil for null replies and []any for arrays and maps.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	value, err := c.do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return toGoValue(value), nil
+}
+
+// do sends a command and follows the MOVED replies of nodes that do not serve it. An ASK reply,
+// sent while a partition is handed over to another node, redirects the command alone and it is
+// retried while the other node answers TRYAGAIN.
+func (c *Client) do(ctx context.Context, args ...string) (resp.Value, error) {
+	if len(args) == 0 {
+		return resp.Value{}, errors.New("creek: empty command")
+	}
+
+	p := c.pool
+	asking := false
+	for redirects, tryAgains := 0, 0; ; {
+		value, err := c.doOn(ctx, p, args, asking)
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) {
+			return value, err
+		}
+		switch serverErr.Code {
+		case string(commons.ErrCodeMoved), string(commons.ErrCodeAsk):
+			address, ok := movedAddress(serverErr)
+			if redirects >= c.opts.MaxRedirects || !ok {
+				return value, err
+			}
+			redirects++
+			asking = serverErr.Code == string(commons.ErrCodeAsk)
+			if p, err = c.poolFor(address); err != nil {
+				return resp.Value{}, err
+			}
+		case string(commons.ErrCodeTryAgain):
+			if !asking || tryAgains >= maxTryAgains {
+				return value, err
+			}
+			tryAgains++
+			select {
+			case <-time.After(tryAgainDelay):
+			case <-ctx.Done():
+				return resp.Value{}, ctx.Err()
+			}
+		default:
+			return value, err
+		}
+	}
+}
+
+// idempotentCommands only read, the server may run them twice when they are resent.
+var idempotentCommands = map[string]bool{
+	commons.CmdDataGet:     true,
+	commons.CmdDataMGet:    true,
+	commons.CmdDataTTL:     true,
+	commons.CmdDataKeyInfo: true,
+	commons.CmdDataScan:    true,
+	commons.CmdDataKeys:    true,
+	commons.CmdDataDBSize:  true,
+	commons.CmdDataRange:   true,
+	commons.CmdDataPrefix:  true,
+	commons.CmdSysPing:     true,
+	commons.CmdSysVersion:  true,
+}
+
+// doOn sends a command on a connection of p, preceded by ASKING after an ASK redirect. Error
+// replies become a *ServerError, while a connection failure discards the connection and the
+// command is resent on a new one. A command that may have reached the server is only resent when
+// it is idempotent, a write such as INCRBY or CAS could be applied twice otherwise.
+func (c *Client) doOn(ctx context.Context, p *pool, args []string, asking bool) (resp.Value, error) {
+	idempotent := idempotentCommands[strings.ToUpper(args[0])]
+	var lastErr error
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return resp.Value{}, err
+		}
+		cn, err := p.get(ctx)
+		if err != nil {
+			if errors.Is(err, ErrClosed) || ctx.Err() != nil {
+				return resp.Value{}, err
+			}
+			lastErr = err
+			continue
+		}
+
+		var value resp.Value
+		sent := false
+		if asking {
+			// ASKING only applies to the next command sent on the same connection
+			value, _, err = cn.roundTrip(ctx, []string{commons.CmdSysAsking})
+		}
+		if err == nil {
+			value, sent, err = cn.roundTrip(ctx, args)
+		}
+		p.put(cn, err != nil)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return resp.Value{}, ctxErr
+			}
+			if sent && !idempotent {
+				return resp.Value{}, fmt.Errorf("creek: %w, the command may have been applied", err)
+			}
+			lastErr = err
+			continue
+		}
+		if value.Type == resp.TypeError || value.Type == resp.TypeBlobError {
+			return resp.Value{}, parseServerError(value.Str)
+		}
+		return value, nil
+	}
+	return resp.Value{}, fmt.Errorf("creek: %w", lastErr)
+}
+
+// movedAddress returns the node a MOVED or ASK error points to, its message is the slot of the
+// key followed by the address.
+func movedAddress(err *ServerError) (string, bool) {
+	fields := strings.Fields(err.Message)
+	if len(fields) != 2 {
+		return "", false
+	}
+	return fields[1], true
+}
+
+func ttlSeconds(ttl time.Duration) int {
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+func toGoValue(value resp.Value) any {
+	if value.Null {
+		return nil
+	}
+	switch value.Type {
+	case resp.TypeInteger:
+		return value.Int
+	case resp.TypeArray, resp.TypeMap, resp.TypeSet, resp.TypePush:
+		elems := make([]any, len(value.Elems))
+		for i, elem := range value.Elems {
+			elems[i] = toGoValue(elem)
+		}
+		return elems
+	default:
+		return value.Str
+	}
+}
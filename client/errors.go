@@ -0,0 +1,31 @@
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNotFound is returned when the key of a command does not exist.
+var ErrNotFound = errors.New("creek: key not found")
+
+// ErrClosed is returned by commands issued after Close.
+var ErrClosed = errors.New("creek: client is closed")
+
+// ServerError is an error reply sent by the server, for instance an unknown command or a write
+// rejected by a follower. Connection failures are never reported as a ServerError.
+type ServerError struct {
+	Code    string // first word of the reply, e.g. ERR, READONLY or TRYAGAIN
+	Message string // rest of the reply
+}
+
+func (e *ServerError) Error() string {
+	return "creek: " + e.Code + " " + e.Message
+}
+
+func parseServerError(reply string) *ServerError {
+	code, message, found := strings.Cut(reply, " ")
+	if !found || code != strings.ToUpper(code) {
+		return &ServerError{Code: "ERR", Message: reply}
+	}
+	return &ServerError{Code: code, Message: message}
+}
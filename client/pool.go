@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"creek/internal/resp"
+	"net"
+	"sync"
+	"time"
+)
+
+// conn is a single RESP connection to the server.
+type conn struct {
+	netConn net.Conn
+	reader  *resp.Reader
+	writer  *resp.Writer
+}
+
+// roundTrip sends one command and reads its reply. The deadline of ctx applies to the whole
+// exchange and cancelling ctx interrupts it. sent tells whether the whole command was written,
+// the server may have run it even when reading the reply failed.
+func (cn *conn) roundTrip(ctx context.Context, args []string) (value resp.Value, sent bool, err error) {
+	deadline, _ := ctx.Deadline()
+	if err := cn.netConn.SetDeadline(deadline); err != nil {
+		return resp.Value{}, false, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = cn.netConn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := cn.writer.WriteCommand(args...); err != nil {
+		return resp.Value{}, false, err
+	}
+	if err := cn.writer.Flush(); err != nil {
+		return resp.Value{}, false, err
+	}
+	value, err = cn.reader.ReadValue()
+	return value, true, err
+}
+
+// pool keeps up to size connections open, idle ones are reused by the next command.
+type pool struct {
+	address     string
+	dialTimeout time.Duration
+
+	slots chan struct{} // one token per open or dialing connection
+	idle  chan *conn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newPool(address string, size int, dialTimeout time.Duration) *pool {
+	return &pool{
+		address:     address,
+		dialTimeout: dialTimeout,
+		slots:       make(chan struct{}, size),
+		idle:        make(chan *conn, size),
+	}
+}
+
+// get returns an idle connection, or dials a new one while the pool is not full. It waits for
+// a connection to be released otherwise.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-p.idle:
+		return cn, nil
+	default:
+	}
+
+	select {
+	case cn := <-p.idle:
+		return cn, nil
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if p.isClosed() {
+		<-p.slots
+		return nil, ErrClosed
+	}
+	dialer := net.Dialer{Timeout: p.dialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return &conn{
+		netConn: netConn,
+		reader:  resp.NewReader(bufio.NewReader(netConn)),
+		writer:  resp.NewWriter(bufio.NewWriter(netConn)),
+	}, nil
+}
+
+// put hands a connection back, broken connections are closed and their slot freed so the
+// next command dials again.
+func (p *pool) put(cn *conn, broken bool) {
+	if !broken && !p.isClosed() {
+		select {
+		case p.idle <- cn:
+			return
+		default:
+		}
+	}
+	_ = cn.netConn.Close()
+	<-p.slots
+}
+
+func (p *pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// close closes the idle connections, connections in use are closed when they are released.
+func (p *pool) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	for {
+		select {
+		case cn := <-p.idle:
+			_ = cn.netConn.Close()
+			<-p.slots
+		default:
+			return nil
+		}
+	}
+}
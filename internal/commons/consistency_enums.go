@@ -21,6 +21,31 @@ const (
 	Follower
 )
 
+type ElectionMode int
+
+const (
+	StaticElection ElectionMode = iota
+	RaftElection
+)
+
+type FsyncPolicy int
+
+const (
+	FsyncByConsistency FsyncPolicy = iota // FsyncAlways in strong consistency, FsyncInterval otherwise
+	FsyncAlways                           // a write is acknowledged once its record is fsynced
+	FsyncInterval                         // the commit log is fsynced periodically
+	FsyncNever                            // flushing to disk is left to the OS
+)
+
+// LagPolicy is what a leader does once a follower has more unacknowledged writes than the
+// replication max lag.
+type LagPolicy int
+
+const (
+	LagResync LagPolicy = iota // the follower is marked stale and resynced from a fresh snapshot
+	LagBlock                   // writers wait until the follower catches up
+)
+
 func GetConsistencyModeFromString(mode string) WriteConsistencyMode {
 	switch mode {
 	case "0":
@@ -53,3 +78,36 @@ func GetPartitionModeFromString(mode string) PartitionMode {
 		return Leader
 	}
 }
+
+func GetElectionModeFromString(mode string) ElectionMode {
+	switch mode {
+	case "0":
+		return StaticElection
+	case "1":
+		return RaftElection
+	default:
+		return StaticElection
+	}
+}
+
+func GetFsyncPolicyFromString(policy string) FsyncPolicy {
+	switch policy {
+	case "1":
+		return FsyncAlways
+	case "2":
+		return FsyncInterval
+	case "3":
+		return FsyncNever
+	default:
+		return FsyncByConsistency
+	}
+}
+
+func GetLagPolicyFromString(policy string) LagPolicy {
+	switch policy {
+	case "1":
+		return LagBlock
+	default:
+		return LagResync
+	}
+}
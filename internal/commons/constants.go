@@ -3,16 +3,112 @@ package commons
 const (
 	DefaultPort = 7690
 
+	// SlotCount is the number of hash slots keys are mapped to before being routed to a partition
+	SlotCount = 16384
+
 	CmdSysPing    = "PING"
 	CmdSysPong    = "PONG"
 	CmdSysVersion = "VERSION"
+	CmdSysHello   = "HELLO"
+	// CmdSysPeers describes the health of every peer as seen from this node
+	CmdSysPeers = "PEERS"
+	// CmdSysSnapshot snapshots every partition and compacts their commit logs before replying
+	CmdSysSnapshot = "SNAPSHOT"
+	// CmdSysBgSave does the same as CmdSysSnapshot in the background
+	CmdSysBgSave = "BGSAVE"
 
 	// CmdSysRep prefix of msg signifying it's a replica msg
 	CmdSysRep = "REP"
+	// CmdSysAck is the reply of a follower to a REP msg, followed by the partition id and the
+	// Version it durably applied
+	CmdSysAck = "ACK"
+	// RepMerkle and RepRange are the anti-entropy sub-commands of REP, they fetch the hashes of
+	// Merkle tree nodes and the entries under leaves of a partition of a peer
+	RepMerkle = "MERKLE"
+	RepRange  = "RANGE"
+	// CmdSysRepair compares every partition with its peers and repairs the keys that differ
+	CmdSysRepair = "REPAIR"
+	// CmdSysSync asks a follower which Version it last applied on a partition
+	CmdSysSync = "SYNC"
+	// CmdSysCluster changes and lists the nodes of the cluster at runtime. JOIN and LEAVE add and
+	// remove a node, NODES lists them and MEMBERS carries a membership change between nodes.
+	// PARTITIONS lists the slots of every partition and the node owning them
+	CmdSysCluster     = "CLUSTER"
+	ClusterJoin       = "JOIN"
+	ClusterLeave      = "LEAVE"
+	ClusterNodes      = "NODES"
+	ClusterMembers    = "MEMBERS"
+	ClusterPartitions = "PARTITIONS"
+	// CmdSysMigrate moves a partition to another node while it serves traffic. IMPORT and COMMIT
+	// are sent by the node the partition is moved from to prepare the target and hand it over
+	CmdSysMigrate = "MIGRATE"
+	MigrateImport = "IMPORT"
+	MigrateCommit = "COMMIT"
+	// CmdSysAsking tells that the next command of the connection follows an ASK redirect
+	CmdSysAsking = "ASKING"
+
+	// CmdSysRaft prefix of raft consensus RPCs exchanged between nodes
+	CmdSysRaft          = "RAFT"
+	RaftRequestVote     = "VOTE"
+	RaftAppendEntries   = "APPEND"
+	RaftInstallSnapshot = "SNAPSHOT"
 
 	CmdDataSet = "SET"
 	CmdDataGet = "GET"
 	CmdDataDel = "DELETE"
-	CmdDataTTL = "TTL"
-	CmdDataEXP = "EXPIRE"
+	// CmdDataDelAlias is the redis spelling of DELETE, sent by off-the-shelf redis clients
+	CmdDataDelAlias = "DEL"
+	CmdDataTTL      = "TTL"
+	CmdDataEXP      = "EXPIRE"
+	// CmdDataKeyInfo describes the write that last changed a key, tombstones included
+	CmdDataKeyInfo = "KEYINFO"
+	// CmdDataIncr and its variants add to the number stored at a key, they are logged as the SET of
+	// the result with SetPXAT
+	CmdDataIncr        = "INCR"
+	CmdDataDecr        = "DECR"
+	CmdDataIncrBy      = "INCRBY"
+	CmdDataDecrBy      = "DECRBY"
+	CmdDataIncrByFloat = "INCRBYFLOAT"
+
+	// CmdDataScan lists the keys of a node a few at a time, CmdDataKeys all at once and CmdDataDBSize
+	// counts them
+	CmdDataScan   = "SCAN"
+	CmdDataKeys   = "KEYS"
+	CmdDataDBSize = "DBSIZE"
+	ScanMatch     = "MATCH"
+	ScanCount     = "COUNT"
+
+	// CmdDataRange and CmdDataPrefix read keys in order, they require the ordered index
+	CmdDataRange  = "RANGE"
+	CmdDataPrefix = "PREFIX"
+	RangeLimit    = "LIMIT"
+
+	// CmdDataGetSet stores a value and returns the previous one, the key loses its TTL
+	CmdDataGetSet = "GETSET"
+	// CmdDataCAS stores a value when the key was last written under the given version
+	CmdDataCAS = "CAS"
+
+	// CmdDataMGet, CmdDataMSet and CmdDataMDel read, store and delete many keys in one request.
+	// MSET and MDEL are logged as a single record per partition with all the keys of the partition
+	CmdDataMGet = "MGET"
+	CmdDataMSet = "MSET"
+	CmdDataMDel = "MDEL"
+
+	// options of SET, SetKeepTTL is logged as well
+	SetNX  = "NX"
+	SetXX  = "XX"
+	SetGet = "GET"
+	SetEX  = "EX"
+	// SetKeepTTL replaces the TTL of a logged SET, the key keeps the expiration it had when the
+	// write was made. Logs only hold it from versions resolving it against the state of each node
+	SetKeepTTL = "KEEPTTL"
+	// SetPXAT replaces the TTL of a logged SET by the expiration that follows it, in Unix
+	// milliseconds, 0 for none
+	SetPXAT = "PXAT"
+
+	// CmdDataLoad replaces the state of a follower with a leader snapshot, sent when the writes it
+	// missed were compacted out of the commit log
+	CmdDataLoad = "LOAD"
+	// CmdDataNoop is logged by a newly elected raft leader to commit entries of earlier terms
+	CmdDataNoop = "NOOP"
 )
@@ -0,0 +1,83 @@
+package commons
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is the first word of an error reply. Clients branch on the code, the message after
+// it is meant for humans and may change between versions.
+type ErrorCode string
+
+const (
+	// ErrCodeGeneric is the code of errors without a more specific class, such as unknown commands
+	// or invalid arguments
+	ErrCodeGeneric ErrorCode = "ERR"
+	// ErrCodeWrongType is returned when a command is run against a value of the wrong kind
+	ErrCodeWrongType ErrorCode = "WRONGTYPE"
+	// ErrCodeReadOnly is returned when a write is sent to a node that does not accept writes for the key
+	ErrCodeReadOnly ErrorCode = "READONLY"
+	// ErrCodeMoved is returned when the key is served by another node, the message holds its address
+	ErrCodeMoved ErrorCode = "MOVED"
+	// ErrCodeAsk is returned while the partition of the key is handed over to another node, the message
+	// holds its address. Unlike MOVED it only redirects the command it answers
+	ErrCodeAsk ErrorCode = "ASK"
+	// ErrCodeTryAgain is returned for transient failures, the same command may succeed when retried
+	ErrCodeTryAgain ErrorCode = "TRYAGAIN"
+	// ErrCodeNoReplicas is returned when a write was applied locally but not acknowledged by its quorum
+	ErrCodeNoReplicas ErrorCode = "NOREPLICAS"
+)
+
+var (
+	ErrNoCommand      = NewError(ErrCodeGeneric, "no command received")
+	ErrUnknownCommand = NewError(ErrCodeGeneric, "unknown command")
+	ErrInvalidTTL     = NewError(ErrCodeGeneric, "invalid TTL value")
+	ErrSyntax         = NewError(ErrCodeGeneric, "syntax error")
+	ErrReadOnly       = NewError(ErrCodeReadOnly, "write mode is read-only for the follower partition")
+	ErrNotInteger     = NewError(ErrCodeGeneric, "value is not an integer or out of range")
+	ErrNotFloat       = NewError(ErrCodeGeneric, "value is not a valid float")
+	ErrOverflow       = NewError(ErrCodeGeneric, "increment or decrement would overflow")
+)
+
+// Error attaches an ErrorCode to an error. The message is the one of the wrapped error, so errors
+// can be matched with errors.Is and wrapped again without losing their code.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// NewError returns an error with the given code and message.
+func NewError(code ErrorCode, message string) error {
+	return &Error{Code: code, Err: errors.New(message)}
+}
+
+// Errorf formats an error like fmt.Errorf and attaches code to it.
+func Errorf(code ErrorCode, format string, args ...any) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// WithCode attaches code to err, keeping err in the chain.
+func WithCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// ErrorCodeOf returns the code of the outermost Error in the chain of err, ErrCodeGeneric if there is none.
+func ErrorCodeOf(err error) ErrorCode {
+	var codeErr *Error
+	if errors.As(err, &codeErr) {
+		return codeErr.Code
+	}
+	return ErrCodeGeneric
+}
+
+// FormatError returns the error reply sent to clients, the code followed by the message.
+func FormatError(err error) string {
+	return string(ErrorCodeOf(err)) + " " + err.Error()
+}
@@ -9,20 +9,52 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const DefaultConfigFile = "config/default.conf"
 const EnvConfigFile = "CREEK_CONF_FILE"
 
+const DefaultRaftElectionTimeout = 1000 * time.Millisecond
+const DefaultRaftHeartbeat = 100 * time.Millisecond
+const DefaultWriteQuorumTimeout = 2000 * time.Millisecond
+const DefaultFsyncInterval = 5000 * time.Millisecond
+const DefaultGCInterval = 10 * time.Second
+const DefaultTombstoneGCGrace = 24 * time.Hour
+const DefaultHeartbeatInterval = 1000 * time.Millisecond
+const DefaultPeerTimeout = 5000 * time.Millisecond
+const DefaultReplicationMaxLag = 100000
+const DefaultKeysLimit = 10000
+
 // Config holds application configuration
 type Config struct {
 	ServerAddress        string
 	LogLevel             string
 	PeerNodes            []string
 	DataStoreDirectory   string
+	PartitionCount       int
 	WriteConsistencyMode commons.WriteConsistencyMode
 	ReplicationMode      commons.ReplicaMode
-	ServerMode           commons.PartitionMode // For now, in future this config will be removed once data partition is introduced
+	ServerMode           commons.PartitionMode // For now, in future this config will be removed once data partition is introduced, ignored by multi-master nodes
+	ElectionMode         commons.ElectionMode  // With RaftElection leadership is elected per partition and ServerMode is ignored
+	RaftElectionTimeout  time.Duration
+	RaftHeartbeat        time.Duration
+	WriteQuorum          int // replicas, leader included, that must acknowledge a strong write. 0 means a majority
+	WriteQuorumTimeout   time.Duration
+	LogSegmentSize       int64         // bytes after which the active commit log segment is sealed, 0 never rotates
+	SnapshotInterval     time.Duration // how often partitions are snapshotted and their log compacted, 0 disables it
+	LogRepair            bool          // truncate a corrupt commit log at the first bad record instead of refusing to start
+	FsyncPolicy          commons.FsyncPolicy
+	FsyncInterval        time.Duration // how often the commit log is fsynced with FsyncInterval
+	GCInterval           time.Duration // how often expired keys and tombstones past their grace period are collected
+	TombstoneGCGrace     time.Duration // how long the tombstone of a deleted key is kept
+	AntiEntropyInterval  time.Duration // how often partitions are compared with their peers and repaired, 0 disables it
+	HeartbeatInterval    time.Duration // how often replication connections are pinged
+	PeerTimeout          time.Duration // how long a silent peer is considered down after
+	ReplicationMaxLag    int           // writes a follower may leave unacknowledged before ReplicationLagPolicy applies
+	ReplicationLagPolicy commons.LagPolicy
+	KeysLimit            int  // keys KEYS replies with at most, more matching keys fail it
+	OrderedIndex         bool // keep the keys of every partition sorted for RANGE and PREFIX
 }
 
 // LoadConfig initializes the configuration from a file
@@ -69,11 +101,83 @@ func LoadConfig() (*Config, error) {
 		nodes = strings.Split(val, ",")
 	}
 
+	partitionCount, err := parseOptionalInt(parsedConfig, "partition_count")
+	if err != nil {
+		return nil, err
+	}
+	electionTimeoutMs, err := parseOptionalInt(parsedConfig, "raft_election_timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+	heartbeatMs, err := parseOptionalInt(parsedConfig, "raft_heartbeat_interval_ms")
+	if err != nil {
+		return nil, err
+	}
+	writeQuorum, err := parseOptionalInt(parsedConfig, "write_quorum")
+	if err != nil {
+		return nil, err
+	}
+	writeQuorumTimeoutMs, err := parseOptionalInt(parsedConfig, "write_quorum_timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+
+	segmentSizeMb, err := parseOptionalInt(parsedConfig, "log_segment_size_mb")
+	if err != nil {
+		return nil, err
+	}
+	snapshotIntervalS, err := parseOptionalInt(parsedConfig, "snapshot_interval_s")
+	if err != nil {
+		return nil, err
+	}
+
+	logRepair, err := parseOptionalBool(parsedConfig, "log_repair")
+	if err != nil {
+		return nil, err
+	}
+	fsyncIntervalMs, err := parseOptionalInt(parsedConfig, "fsync_interval_ms")
+	if err != nil {
+		return nil, err
+	}
+	gcIntervalS, err := parseOptionalInt(parsedConfig, "key_expiry_routine_interval")
+	if err != nil {
+		return nil, err
+	}
+	tombstoneGraceS, err := parseOptionalInt(parsedConfig, "tombstone_gc_grace_s")
+	if err != nil {
+		return nil, err
+	}
+	antiEntropyIntervalS, err := parseOptionalInt(parsedConfig, "anti_entropy_interval_s")
+	if err != nil {
+		return nil, err
+	}
+	heartbeatIntervalMs, err := parseOptionalInt(parsedConfig, "heartbeat_interval_ms")
+	if err != nil {
+		return nil, err
+	}
+	peerTimeoutMs, err := parseOptionalInt(parsedConfig, "peer_timeout_ms")
+	if err != nil {
+		return nil, err
+	}
+	replicationMaxLag, err := parseOptionalInt(parsedConfig, "replication_max_lag")
+	if err != nil {
+		return nil, err
+	}
+	keysLimit, err := parseOptionalInt(parsedConfig, "keys_limit")
+	if err != nil {
+		return nil, err
+	}
+	orderedIndex, err := parseOptionalBool(parsedConfig, "ordered_index")
+	if err != nil {
+		return nil, err
+	}
+
 	conf := Config{
 		ServerAddress:      parsedConfig["server_address"],
 		LogLevel:           parsedConfig["log_level"],
 		DataStoreDirectory: parsedConfig["data_store_directory"],
 		PeerNodes:          nodes,
+		PartitionCount:     partitionCount,
 		WriteConsistencyMode: commons.GetConsistencyModeFromString(
 			parsedConfig["write_consistency_mode"],
 		),
@@ -83,6 +187,31 @@ func LoadConfig() (*Config, error) {
 		ServerMode: commons.GetPartitionModeFromString(
 			parsedConfig["server_mode"],
 		),
+		ElectionMode: commons.GetElectionModeFromString(
+			parsedConfig["election_mode"],
+		),
+		RaftElectionTimeout: time.Duration(electionTimeoutMs) * time.Millisecond,
+		RaftHeartbeat:       time.Duration(heartbeatMs) * time.Millisecond,
+		WriteQuorum:         writeQuorum,
+		WriteQuorumTimeout:  time.Duration(writeQuorumTimeoutMs) * time.Millisecond,
+		LogSegmentSize:      int64(segmentSizeMb) * 1024 * 1024,
+		SnapshotInterval:    time.Duration(snapshotIntervalS) * time.Second,
+		LogRepair:           logRepair,
+		FsyncPolicy: commons.GetFsyncPolicyFromString(
+			parsedConfig["fsync_policy"],
+		),
+		FsyncInterval:       time.Duration(fsyncIntervalMs) * time.Millisecond,
+		GCInterval:          time.Duration(gcIntervalS) * time.Second,
+		TombstoneGCGrace:    time.Duration(tombstoneGraceS) * time.Second,
+		AntiEntropyInterval: time.Duration(antiEntropyIntervalS) * time.Second,
+		HeartbeatInterval:   time.Duration(heartbeatIntervalMs) * time.Millisecond,
+		PeerTimeout:         time.Duration(peerTimeoutMs) * time.Millisecond,
+		ReplicationMaxLag:   replicationMaxLag,
+		ReplicationLagPolicy: commons.GetLagPolicyFromString(
+			parsedConfig["replication_lag_policy"],
+		),
+		KeysLimit:    keysLimit,
+		OrderedIndex: orderedIndex,
 	}
 	err = conf.populateConfig(parsedConfig)
 	return &conf, err
@@ -113,6 +242,17 @@ func (conf *Config) populateConfig(parsedConfig map[string]string) error {
 }
 
 func (conf *Config) fillUpDefaults() {
+	if conf.PartitionCount <= 0 {
+		conf.PartitionCount = 1
+	}
+
+	if conf.RaftElectionTimeout <= 0 {
+		conf.RaftElectionTimeout = DefaultRaftElectionTimeout
+	}
+	if conf.RaftHeartbeat <= 0 {
+		conf.RaftHeartbeat = DefaultRaftHeartbeat
+	}
+
 	if conf.ServerAddress == "" {
 		conf.ServerAddress = "localhost:" + strconv.Itoa(commons.DefaultPort)
 	}
@@ -133,8 +273,40 @@ func (conf *Config) validateConfig() error {
 	if conf.ServerAddress == "" {
 		return errors.New("missing required config: server_address")
 	}
-	if conf.ReplicationMode == commons.ReadAndWriteReplication && conf.ServerMode == commons.Follower {
-		return errors.New("followers cant accept writes right now")
+	if conf.ElectionMode == commons.RaftElection && conf.RaftHeartbeat >= conf.RaftElectionTimeout {
+		return errors.New("raft_heartbeat_interval_ms must be lower than raft_election_timeout_ms")
+	}
+	if conf.WriteQuorum < 0 || conf.WriteQuorum > len(conf.PeerNodes)+1 {
+		return fmt.Errorf("invalid write_quorum: %d, must be between 1 and %d replicas", conf.WriteQuorum, len(conf.PeerNodes)+1)
+	}
+	if conf.LogSegmentSize < 0 {
+		return errors.New("invalid log_segment_size_mb: must not be negative")
+	}
+	if conf.FsyncInterval < 0 {
+		return errors.New("invalid fsync_interval_ms: must not be negative")
+	}
+	if conf.SnapshotInterval < 0 {
+		return errors.New("invalid snapshot_interval_s: must not be negative")
+	}
+	if conf.GCInterval < 0 {
+		return errors.New("invalid key_expiry_routine_interval: must not be negative")
+	}
+	if conf.TombstoneGCGrace < 0 {
+		return errors.New("invalid tombstone_gc_grace_s: must not be negative")
+	}
+	if conf.AntiEntropyInterval < 0 {
+		return errors.New("invalid anti_entropy_interval_s: must not be negative")
+	}
+	if conf.HeartbeatInterval < 0 || conf.PeerTimeout < 0 || conf.ReplicationMaxLag < 0 {
+		return errors.New("invalid heartbeat_interval_ms, peer_timeout_ms or replication_max_lag: must not be negative")
+	}
+	if conf.HeartbeatIntervalOrDefault() >= conf.PeerTimeoutOrDefault() {
+		return errors.New("heartbeat_interval_ms must be lower than peer_timeout_ms")
+	}
+
+	if conf.PartitionCount > commons.SlotCount {
+		// every partition must own at least one hash slot
+		return fmt.Errorf("invalid partition_count: %d, must be at most %d", conf.PartitionCount, commons.SlotCount)
 	}
 
 	if conf.DataStoreDirectory == "" {
@@ -155,6 +327,131 @@ func isDirPathExists(dir string) bool {
 	return true
 }
 
+// RaftTimeouts returns the raft election timeout and heartbeat interval, falling back to the
+// defaults for configs that were not loaded from a file
+func (conf *Config) RaftTimeouts() (time.Duration, time.Duration) {
+	electionTimeout, heartbeat := conf.RaftElectionTimeout, conf.RaftHeartbeat
+	if electionTimeout <= 0 {
+		electionTimeout = DefaultRaftElectionTimeout
+	}
+	if heartbeat <= 0 {
+		heartbeat = DefaultRaftHeartbeat
+	}
+	return electionTimeout, heartbeat
+}
+
+// IsMultiMaster reports whether this node accepts writes and replicates them to every peer,
+// resolving conflicts with the writes of the other nodes by last-writer-wins
+func (conf *Config) IsMultiMaster() bool {
+	return conf.ReplicationMode == commons.ReadAndWriteReplication && conf.ElectionMode == commons.StaticElection
+}
+
+// PartitionCountOrDefault returns the number of partitions per node, a single one when unset
+func (conf *Config) PartitionCountOrDefault() int {
+	if conf.PartitionCount > 0 {
+		return conf.PartitionCount
+	}
+	return 1
+}
+
+// EffectiveFsyncPolicy resolves FsyncByConsistency to the policy of the write consistency mode
+func (conf *Config) EffectiveFsyncPolicy() commons.FsyncPolicy {
+	if conf.FsyncPolicy != commons.FsyncByConsistency {
+		return conf.FsyncPolicy
+	}
+	if conf.WriteConsistencyMode == commons.StrongConsistency {
+		return commons.FsyncAlways
+	}
+	return commons.FsyncInterval
+}
+
+// FsyncIntervalOrDefault returns how often the commit log is fsynced with FsyncInterval
+func (conf *Config) FsyncIntervalOrDefault() time.Duration {
+	if conf.FsyncInterval > 0 {
+		return conf.FsyncInterval
+	}
+	return DefaultFsyncInterval
+}
+
+// GCIntervalOrDefault returns how often expired keys and tombstones are collected
+func (conf *Config) GCIntervalOrDefault() time.Duration {
+	if conf.GCInterval > 0 {
+		return conf.GCInterval
+	}
+	return DefaultGCInterval
+}
+
+// TombstoneGCGraceOrDefault returns how long the tombstone of a deleted key is kept. Replicas
+// that were down for longer may bring a deleted key back once they reconnect.
+func (conf *Config) TombstoneGCGraceOrDefault() time.Duration {
+	if conf.TombstoneGCGrace > 0 {
+		return conf.TombstoneGCGrace
+	}
+	return DefaultTombstoneGCGrace
+}
+
+// HeartbeatIntervalOrDefault returns how often replication connections are pinged
+func (conf *Config) HeartbeatIntervalOrDefault() time.Duration {
+	if conf.HeartbeatInterval > 0 {
+		return conf.HeartbeatInterval
+	}
+	return DefaultHeartbeatInterval
+}
+
+// PeerTimeoutOrDefault returns how long a peer may stay silent before it is considered down
+func (conf *Config) PeerTimeoutOrDefault() time.Duration {
+	if conf.PeerTimeout > 0 {
+		return conf.PeerTimeout
+	}
+	return DefaultPeerTimeout
+}
+
+// ReplicationMaxLagOrDefault returns how many writes of a partition a follower may leave
+// unacknowledged before the lag policy applies
+func (conf *Config) ReplicationMaxLagOrDefault() int {
+	if conf.ReplicationMaxLag > 0 {
+		return conf.ReplicationMaxLag
+	}
+	return DefaultReplicationMaxLag
+}
+
+// KeysLimitOrDefault returns how many keys KEYS replies with at most
+func (conf *Config) KeysLimitOrDefault() int {
+	if conf.KeysLimit > 0 {
+		return conf.KeysLimit
+	}
+	return DefaultKeysLimit
+}
+
+// WriteQuorumSize returns how many replicas, the leader included, acknowledge a strong write
+func (conf *Config) WriteQuorumSize() int {
+	if conf.WriteQuorum > 0 {
+		return conf.WriteQuorum
+	}
+	return (len(conf.PeerNodes)+1)/2 + 1
+}
+
+// WriteQuorumTimeoutOrDefault returns how long a strong write waits for its quorum
+func (conf *Config) WriteQuorumTimeoutOrDefault() time.Duration {
+	if conf.WriteQuorumTimeout > 0 {
+		return conf.WriteQuorumTimeout
+	}
+	return DefaultWriteQuorumTimeout
+}
+
+// parseOptionalInt parses an integer config value, returning 0 when the key is absent
+func parseOptionalInt(parsedConfig map[string]string, key string) (int, error) {
+	val, exists := parsedConfig[key]
+	if !exists {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, val)
+	}
+	return n, nil
+}
+
 // getEnv fetches environment variables with a default fallback
 func getEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -171,3 +468,16 @@ func removeBOM(line string) string {
 	}
 	return line
 }
+
+// parseOptionalBool parses a boolean config value, returning false when the key is absent
+func parseOptionalBool(parsedConfig map[string]string, key string) (bool, error) {
+	val, exists := parsedConfig[key]
+	if !exists {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", key, val)
+	}
+	return b, nil
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"creek/internal/partition"
+)
+
+// keyGroup is the keys of a request that belong to one partition, by their position in the request.
+type keyGroup struct {
+	partition *partition.Partition
+	indexes   []int
+}
+
+// groupByPartition groups keys by the partition owning them, in the order of the partitions.
+func (s *StateMachine) groupByPartition(keys []string) []keyGroup {
+	byPartition := make([][]int, len(s.partitions))
+	for i, key := range keys {
+		id := s.PartitionIdForKey(key)
+		byPartition[id] = append(byPartition[id], i)
+	}
+	var groups []keyGroup
+	for id, indexes := range byPartition {
+		if len(indexes) > 0 {
+			groups = append(groups, keyGroup{partition: s.partitions[id], indexes: indexes})
+		}
+	}
+	return groups
+}
+
+// MGet returns the values of keys in order, found tells which keys hold a value. The keys of a
+// partition are read all at once. A partition served by another node fails the whole request.
+func (s *StateMachine) MGet(keys []string) (values []string, found []bool, err error) {
+	groups := s.groupByPartition(keys)
+	for _, group := range groups {
+		if err := s.checkOwner(keys[group.indexes[0]], group.partition.Id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	values, found = make([]string, len(keys)), make([]bool, len(keys))
+	for _, group := range groups {
+		groupKeys := make([]string, len(group.indexes))
+		for j, i := range group.indexes {
+			groupKeys[j] = keys[i]
+		}
+		groupValues, groupFound := group.partition.MGet(groupKeys)
+		for j, i := range group.indexes {
+			values[i], found[i] = groupValues[j], groupFound[j]
+		}
+	}
+	return values, found, nil
+}
+
+// MSet stores key-value pairs without TTL, pairs alternating keys and values. The pairs of a
+// partition are written atomically as one commit log record, those of different partitions are
+// not: when a partition fails, the pairs of the partitions written before it stay written. The
+// request is redirected before any write when a partition does not take writes on this node.
+func (s *StateMachine) MSet(pairs []string) error {
+	keys := make([]string, len(pairs)/2)
+	for i := range keys {
+		keys[i] = pairs[2*i]
+	}
+	groups := s.groupByPartition(keys)
+	if err := s.checkBatch(keys, groups); err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		groupPairs := make([]string, 0, 2*len(group.indexes))
+		for _, i := range group.indexes {
+			groupPairs = append(groupPairs, pairs[2*i], pairs[2*i+1])
+		}
+		err := s.write(keys[group.indexes[0]], func(p *partition.Partition) error {
+			return p.MSet(groupPairs)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MDelete deletes keys and tells in order which of them held a value, the keys of a partition
+// being deleted atomically like in MSet.
+func (s *StateMachine) MDelete(keys []string) ([]bool, error) {
+	groups := s.groupByPartition(keys)
+	if err := s.checkBatch(keys, groups); err != nil {
+		return nil, err
+	}
+
+	existed := make([]bool, len(keys))
+	for _, group := range groups {
+		groupKeys := make([]string, len(group.indexes))
+		for j, i := range group.indexes {
+			groupKeys[j] = keys[i]
+		}
+		var groupExisted []bool
+		err := s.write(groupKeys[0], func(p *partition.Partition) error {
+			var err error
+			groupExisted, err = p.MDelete(groupKeys)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range group.indexes {
+			existed[i] = groupExisted[j]
+		}
+	}
+	return existed, nil
+}
+
+// checkBatch redirects a batch of writes when one of its partitions does not take writes on this
+// node, so that none of them is applied.
+func (s *StateMachine) checkBatch(keys []string, groups []keyGroup) error {
+	for _, group := range groups {
+		if err := s.checkWritable(keys[group.indexes[0]], group.partition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
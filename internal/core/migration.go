@@ -0,0 +1,325 @@
+package core
+
+import (
+	"bufio"
+	"creek/internal/commons"
+	"creek/internal/partition"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OwnersFileName is the file in the data store directory recording the partitions moved to, or
+// being imported from, another node.
+const OwnersFileName = "partition.owners"
+
+// ownership tells which node serves a partition while it moves between nodes.
+type ownership int
+
+const (
+	ownedHere  ownership = iota // this node serves the partition
+	migrating                   // copied to another node, still served here
+	handingOff                  // writes stopped until the other node applied them, commands get ASK
+	moved                       // served by another node, commands get MOVED
+	importing                   // copied from another node, which serves it until it is handed over
+)
+
+func (o ownership) String() string {
+	switch o {
+	case migrating:
+		return "migrating"
+	case handingOff:
+		return "handoff"
+	case moved:
+		return "moved"
+	case importing:
+		return "importing"
+	default:
+		return "serving"
+	}
+}
+
+func parseOwnership(s string) (ownership, bool) {
+	switch s {
+	case moved.String():
+		return moved, true
+	case importing.String():
+		return importing, true
+	default:
+		return ownedHere, false
+	}
+}
+
+// partitionOwner is the ownership of a partition and the other node involved, it is the zero value
+// while the partition is owned here.
+type partitionOwner struct {
+	state   ownership
+	address string
+}
+
+// PartitionMover copies a partition to another node and hands it over.
+type PartitionMover interface {
+	// MovePartition streams a partition to target until it caught up, then calls freeze, which stops
+	// the writes of the partition and returns the Version of the last one. The partition is handed
+	// over once target applied it.
+	MovePartition(partitionId int, target string, freeze func() int) error
+}
+
+// ImportingError redirects a command to the node a partition is being imported from. It is sent
+// as a MOVED error, but a command following an ASK redirect is told to try again instead.
+type ImportingError struct {
+	Slot   int
+	Source string
+}
+
+func (e *ImportingError) Error() string {
+	return fmt.Sprintf("%d %s", e.Slot, e.Source)
+}
+
+// PartitionInfo describes the slots of a partition and the node serving them.
+type PartitionInfo struct {
+	Id        int
+	FirstSlot int
+	LastSlot  int
+	Owner     string
+	State     string
+}
+
+// AttachPartitionMover sets how partitions are moved to other nodes, see Migrate.
+func (s *StateMachine) AttachPartitionMover(mover PartitionMover) {
+	s.mover = mover
+}
+
+// checkMigrations tells whether partitions can move between this node and others, which takes
+// static leaders that do not share their writes.
+func (s *StateMachine) checkMigrations() error {
+	if s.mover == nil || s.conf.ElectionMode == commons.RaftElection || s.conf.IsMultiMaster() ||
+		s.conf.ServerMode != commons.Leader {
+		return commons.NewError(commons.ErrCodeGeneric, "partitions only move between static leaders")
+	}
+	return nil
+}
+
+// Migrate moves a partition to target while this node keeps serving it. Target gets a snapshot
+// of the partition then the writes made meanwhile, and once it caught up the writes are stopped
+// until it applied the last one. Commands get ASK during that handover, and MOVED once target
+// serves the partition.
+func (s *StateMachine) Migrate(partitionId int, target string) error {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return err
+	}
+	if err := s.checkMigrations(); err != nil {
+		return err
+	}
+	if target == "" || target == s.NodeId {
+		return commons.Errorf(commons.ErrCodeGeneric, "invalid node address: %q", target)
+	}
+
+	s.ownersMu.Lock()
+	if owner := s.owners[partitionId]; owner.state != ownedHere {
+		s.ownersMu.Unlock()
+		return commons.Errorf(commons.ErrCodeGeneric, "partition %d is %s (%s)", partitionId, owner.state, owner.address)
+	}
+	s.owners[partitionId] = partitionOwner{state: migrating, address: target}
+	s.ownersMu.Unlock()
+
+	s.log.Infof("Migrating partition %d to %s", partitionId, target)
+	err = s.mover.MovePartition(partitionId, target, func() int { return s.freeze(p, target) })
+
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+	if err != nil {
+		delete(s.owners, partitionId) // the writes resume here
+		return commons.Errorf(commons.ErrCodeGeneric, "migration of partition %d to %s failed: %v", partitionId, target, err)
+	}
+	s.owners[partitionId] = partitionOwner{state: moved, address: target}
+	if err := s.saveOwnersLocked(); err != nil {
+		return err
+	}
+	s.log.Infof("Partition %d moved to %s", partitionId, target)
+	return nil
+}
+
+// freeze waits for the writes of a partition in progress and turns the later ones away, it
+// returns the Version of the last write.
+func (s *StateMachine) freeze(p *partition.Partition, target string) int {
+	gate := &s.gates[p.Id]
+	gate.Lock()
+	defer gate.Unlock()
+	s.ownersMu.Lock()
+	s.owners[p.Id] = partitionOwner{state: handingOff, address: target}
+	s.ownersMu.Unlock()
+	return p.AppliedVersion()
+}
+
+// BeginImport prepares a partition to be migrated from source, which serves it meanwhile.
+func (s *StateMachine) BeginImport(partitionId int, source string) error {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return err
+	}
+	if err := s.checkMigrations(); err != nil {
+		return err
+	}
+
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+	owner := s.owners[partitionId]
+	resumed := owner == partitionOwner{state: importing, address: source}
+	if owner.state != ownedHere && !resumed {
+		return commons.Errorf(commons.ErrCodeGeneric, "partition %d is %s (%s)", partitionId, owner.state, owner.address)
+	}
+	if err := p.BeginImport(); err != nil {
+		return commons.WithCode(commons.ErrCodeGeneric, err)
+	}
+	s.owners[partitionId] = partitionOwner{state: importing, address: source}
+	if err := s.saveOwnersLocked(); err != nil {
+		return err
+	}
+	if !resumed {
+		s.log.Infof("Importing partition %d from %s", partitionId, source)
+	}
+	return nil
+}
+
+// CommitImport makes this node serve an imported partition once it applied every write up to
+// version. It is idempotent so that the node handing the partition over can retry it.
+func (s *StateMachine) CommitImport(partitionId, version int) error {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return err
+	}
+
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+	applied := p.AppliedVersion()
+	owner := s.owners[partitionId]
+	if owner.state == ownedHere && p.Mode() == commons.Leader && applied >= version {
+		return nil // committed already
+	}
+	if owner.state != importing {
+		return commons.Errorf(commons.ErrCodeGeneric, "partition %d is not being imported", partitionId)
+	}
+	if applied < version {
+		return commons.Errorf(commons.ErrCodeTryAgain, "partition %d applied %d of %d writes", partitionId, applied, version)
+	}
+	delete(s.owners, partitionId)
+	if err := s.saveOwnersLocked(); err != nil {
+		s.owners[partitionId] = owner
+		return err
+	}
+	p.EndImport()
+	s.log.Infof("Partition %d imported from %s at version %d", partitionId, owner.address, applied)
+	return nil
+}
+
+// checkOwner redirects a command on key when its partition is not served by this node.
+func (s *StateMachine) checkOwner(key string, partitionId int) error {
+	s.ownersMu.RLock()
+	owner := s.owners[partitionId]
+	s.ownersMu.RUnlock()
+
+	switch owner.state {
+	case handingOff:
+		return commons.Errorf(commons.ErrCodeAsk, "%d %s", KeySlot(key), owner.address)
+	case moved:
+		return commons.Errorf(commons.ErrCodeMoved, "%d %s", KeySlot(key), owner.address)
+	case importing:
+		return commons.WithCode(commons.ErrCodeMoved, &ImportingError{Slot: KeySlot(key), Source: owner.address})
+	default:
+		return nil
+	}
+}
+
+// Partitions describes the slots of every partition and the node serving them.
+func (s *StateMachine) Partitions() []PartitionInfo {
+	s.ownersMu.RLock()
+	defer s.ownersMu.RUnlock()
+	infos := make([]PartitionInfo, len(s.partitions))
+	for id := range s.partitions {
+		owner := s.owners[id]
+		info := PartitionInfo{Id: id, Owner: s.NodeId, State: owner.state.String()}
+		info.FirstSlot, info.LastSlot = partitionSlots(id, len(s.partitions))
+		if owner.state == moved || owner.state == importing {
+			info.Owner = owner.address
+		}
+		infos[id] = info
+	}
+	return infos
+}
+
+// loadOwners reads the partitions moved to or imported from other nodes, one per line as
+// <partition> <moved|importing> <address>.
+func loadOwners(dir string, partitionCount int) (map[int]partitionOwner, error) {
+	owners := make(map[int]partitionOwner)
+	file, err := os.Open(filepath.Join(dir, OwnersFileName))
+	if os.IsNotExist(err) {
+		return owners, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partition owners: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid partition owner in %s: %q", file.Name(), scanner.Text())
+		}
+		partitionId, err := strconv.Atoi(fields[0])
+		state, ok := parseOwnership(fields[1])
+		if err != nil || !ok || partitionId < 0 || partitionId >= partitionCount {
+			return nil, fmt.Errorf("invalid partition owner in %s: %q", file.Name(), scanner.Text())
+		}
+		owners[partitionId] = partitionOwner{state: state, address: fields[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read partition owners: %w", err)
+	}
+	return owners, nil
+}
+
+// saveOwnersLocked atomically replaces the partition owners file with the partitions moved or
+// being imported. The caller must hold s.ownersMu.
+func (s *StateMachine) saveOwnersLocked() error {
+	var ids []int
+	for id, owner := range s.owners {
+		if owner.state == moved || owner.state == importing {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	var content strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&content, "%d %s %s\n", id, s.owners[id].state, s.owners[id].address)
+	}
+
+	path := filepath.Join(s.conf.DataStoreDirectory, OwnersFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	_, err = file.WriteString(content.String())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace partition owners: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"creek/internal/commons"
+	"strings"
+)
+
+// KeySlot returns the hash slot of a key, computed the same way as redis cluster. If the key
+// contains a non-empty {hash tag}, only the tag is hashed, which lets related keys be forced
+// into the same partition.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % commons.SlotCount
+}
+
+// slotToPartition maps a slot onto one of partitionCount contiguous slot ranges. The slot of
+// a key never changes, only the slot to partition assignment depends on the partition count.
+func slotToPartition(slot, partitionCount int) int {
+	return slot * partitionCount / commons.SlotCount
+}
+
+// partitionSlots returns the first and last slot slotToPartition maps onto a partition.
+func partitionSlots(partitionId, partitionCount int) (int, int) {
+	first := (partitionId*commons.SlotCount + partitionCount - 1) / partitionCount
+	last := ((partitionId+1)*commons.SlotCount+partitionCount-1)/partitionCount - 1
+	return first, last
+}
+
+// crc16 implements CRC16-CCITT (XMODEM), the checksum redis cluster uses for key slots.
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"creek/internal/commons"
+	"creek/internal/datastore"
+	"creek/internal/utils"
+	"sort"
+)
+
+// DefaultScanCount is how many keys SCAN looks at when the request does not say.
+const DefaultScanCount = 10
+
+// scanCursor returns the SCAN cursor resuming a partition from a datastore.ScanHash, the id of the
+// partition being held in the high bits. Cursor 0 starts at the first partition and ends the scan.
+func scanCursor(partitionId int, from uint64) uint64 {
+	return uint64(partitionId)<<datastore.ScanHashBits + from
+}
+
+// Scan lists the keys of the partitions served by this node a few at a time, starting at cursor.
+// It looks at about count keys and returns those matching pattern, when it is not empty, along with
+// the cursor of the next call, 0 once every partition was listed. Every key holding a value during
+// the whole scan is listed at least once, a key written meanwhile may be listed or not.
+func (s *StateMachine) Scan(cursor uint64, pattern string, count int) (keys []string, next uint64, err error) {
+	partitionId := int(cursor >> datastore.ScanHashBits)
+	from := cursor & (1<<datastore.ScanHashBits - 1)
+	if partitionId >= len(s.partitions) {
+		return nil, 0, commons.NewError(commons.ErrCodeGeneric, "invalid cursor")
+	}
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+
+	keys = []string{}
+	for looked := 0; looked < count && partitionId < len(s.partitions); {
+		if !s.servesPartition(partitionId) {
+			partitionId, from = partitionId+1, 0
+			continue
+		}
+		batch, batchNext, done := s.partitions[partitionId].Scan(from, count-looked)
+		looked += len(batch)
+		for _, key := range batch {
+			if pattern == "" || utils.MatchGlob(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		if !done {
+			return keys, scanCursor(partitionId, batchNext), nil
+		}
+		partitionId, from = partitionId+1, 0
+	}
+	if partitionId == len(s.partitions) {
+		return keys, 0, nil
+	}
+	return keys, scanCursor(partitionId, from), nil
+}
+
+// Keys returns every key of the partitions served by this node matching a glob pattern. It fails
+// when more than the keys_limit option keys match, SCAN lists them instead.
+func (s *StateMachine) Keys(pattern string) ([]string, error) {
+	limit := s.conf.KeysLimitOrDefault()
+	keys := []string{}
+	for id, p := range s.partitions {
+		if !s.servesPartition(id) {
+			continue
+		}
+		partitionKeys, complete := p.Keys(pattern, limit-len(keys))
+		if !complete {
+			return nil, commons.Errorf(commons.ErrCodeGeneric, "more than %d keys match, use SCAN", limit)
+		}
+		keys = append(keys, partitionKeys...)
+	}
+	return keys, nil
+}
+
+// DBSize returns how many keys hold a value in the partitions served by this node.
+func (s *StateMachine) DBSize() int {
+	size := 0
+	for id, p := range s.partitions {
+		if s.servesPartition(id) {
+			size += p.Size()
+		}
+	}
+	return size
+}
+
+// servesPartition tells whether the keys of a partition are served by this node, and not by the
+// node it moved to or is being imported from.
+func (s *StateMachine) servesPartition(partitionId int) bool {
+	s.ownersMu.RLock()
+	defer s.ownersMu.RUnlock()
+	state := s.owners[partitionId].state
+	return state != moved && state != importing
+}
+
+// Range returns in order up to limit keys holding a value from start on and before end, an empty
+// end having no bound, along with their values, and the key the next call continues from, empty
+// once no key is left. The keys of the partitions served by this node are merged. Every partition
+// walks up to limit keys, tombstones and expired keys included, so fewer keys may be returned
+// before the end. limit defaults to, and may not exceed, the keys_limit option. It requires the
+// ordered_index option.
+func (s *StateMachine) Range(start, end string, limit int) (keys, values []string, next string, err error) {
+	if !s.conf.OrderedIndex {
+		return nil, nil, "", commons.NewError(commons.ErrCodeGeneric, "ranges require ordered_index = true")
+	}
+	maxLimit := s.conf.KeysLimitOrDefault()
+	if limit > maxLimit {
+		return nil, nil, "", commons.Errorf(commons.ErrCodeGeneric, "limit above keys_limit (%d)", maxLimit)
+	}
+	if limit <= 0 {
+		limit = maxLimit
+	}
+
+	type keyValue struct{ key, value string }
+	var merged []keyValue
+	for id, p := range s.partitions {
+		if !s.servesPartition(id) {
+			continue
+		}
+		partitionKeys, partitionValues, partitionNext := p.Range(start, end, limit)
+		for i, key := range partitionKeys {
+			merged = append(merged, keyValue{key: key, value: partitionValues[i]})
+		}
+		// the keys of the other partitions after where this one stopped wait for the next call
+		if partitionNext != "" && (next == "" || partitionNext < next) {
+			next = partitionNext
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].key < merged[j].key })
+	if next != "" {
+		merged = merged[:sort.Search(len(merged), func(i int) bool { return merged[i].key >= next })]
+	}
+	if len(merged) > limit {
+		next = merged[limit].key
+		merged = merged[:limit]
+	}
+
+	keys, values = make([]string, len(merged)), make([]string, len(merged))
+	for i, kv := range merged {
+		keys[i], values[i] = kv.key, kv.value
+	}
+	return keys, values, next, nil
+}
+
+// Prefix returns in order the keys starting with prefix along with their values, like Range. The
+// range continues with RANGE from next to utils.PrefixEnd(prefix).
+func (s *StateMachine) Prefix(prefix string, limit int) (keys, values []string, next string, err error) {
+	return s.Range(prefix, utils.PrefixEnd(prefix), limit)
+}
@@ -6,99 +6,311 @@ import (
 	"creek/internal/datastore"
 	"creek/internal/logger"
 	"creek/internal/partition"
+	"creek/internal/raft"
 	"creek/internal/replication"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrKeyNotFound is returned by Get for keys that do not exist or expired.
+var ErrKeyNotFound = datastore.ErrKeyNotFound
+
 type StateMachine struct {
-	p *partition.Partition
+	partitions []*partition.Partition
 
 	NodeId    string
 	WriteMode commons.ReplicaMode
 
+	leaderLocator LeaderLocator
+	peerLister    PeerLister
+
+	mover    PartitionMover
+	owners   map[int]partitionOwner // partitions moving to or from other nodes, guarded by ownersMu
+	ownersMu sync.RWMutex
+	gates    []sync.RWMutex // held by the writes of a partition, and by Migrate to stop them
+
+	repairRounds    atomic.Int64  // anti-entropy rounds run, see Repair
+	stopAntiEntropy chan struct{} // closed by Stop to end the background repairs
+
 	log  *logrus.Logger
 	conf *config.Config
 }
 
+// LeaderLocator returns the client address of the leader of a partition, empty when unknown.
+type LeaderLocator func(partitionId int) string
+
+// PeerLister returns the client addresses of the peers a multi-master node replicates with.
+type PeerLister func() []string
+
 func NewStateMachine(NodeId string, cfg *config.Config) (*StateMachine, error) {
+	log := logger.CreateLogger(cfg.LogLevel)
+
+	partitionCount := cfg.PartitionCountOrDefault()
+
+	err := migrateLegacyCommitLog(cfg, partitionCount, log)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]*partition.Partition, partitionCount)
+	for id := range partitions {
+		store := datastore.NewDataStore(cfg)
+		p, err := partition.NewPartition(id, NodeId, cfg, store)
+		if err != nil {
+			panic(err)
+		}
+		partitions[id] = p
+	}
 
-	store := datastore.NewDataStore(cfg)
-	p, err := partition.NewPartition(0, NodeId, cfg, store)
+	owners, err := loadOwners(cfg.DataStoreDirectory, partitionCount)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	for id, owner := range owners {
+		if owner.state == importing {
+			if err := partitions[id].BeginImport(); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	sm := &StateMachine{
-		p:      p,
-		log:    logger.CreateLogger(cfg.LogLevel),
-		conf:   cfg,
-		NodeId: NodeId,
+		partitions: partitions,
+		log:        log,
+		conf:       cfg,
+		NodeId:     NodeId,
+		owners:     owners,
+		gates:      make([]sync.RWMutex, partitionCount),
+
+		stopAntiEntropy: make(chan struct{}),
 	}
 	return sm, nil
 }
 
+// migrateLegacyCommitLog moves a commit log written before partitioning into the directory
+// of partition 0. This is only safe for a single partition, with more partitions the keys
+// of the old log would be routed elsewhere.
+func migrateLegacyCommitLog(cfg *config.Config, partitionCount int, log *logrus.Logger) error {
+	legacyPath := filepath.Join(cfg.DataStoreDirectory, partition.LogFileName)
+	if _, err := os.Stat(legacyPath); err != nil {
+		return nil
+	}
+	if partitionCount != 1 {
+		return fmt.Errorf("found unpartitioned commit log %s, it can only be migrated with partition_count = 1", legacyPath)
+	}
+
+	dir := partition.Dir(cfg, 0)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create partition directory: %w", err)
+	}
+	newPath := filepath.Join(dir, partition.LogFileName)
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("both %s and %s exist, refusing to migrate", legacyPath, newPath)
+	}
+	log.Infof("Migrating commit log %s to %s", legacyPath, newPath)
+	return os.Rename(legacyPath, newPath)
+}
+
 func (s *StateMachine) Start() error {
-	return s.p.Start()
+	for _, p := range s.partitions {
+		if err := p.Start(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *StateMachine) Stop() error {
 	// Perform any necessary cleanup or shutdown operations
-	return s.p.StopPartition()
+	close(s.stopAntiEntropy)
+	var errs []error
+	for _, p := range s.partitions {
+		if err := p.StopPartition(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AttachReplicatorToPartitions sets what streams the logged writes of every partition to the
+// followers, it must be called before writes are accepted.
+func (s *StateMachine) AttachReplicatorToPartitions(replicator partition.Replicator) {
+	for _, p := range s.partitions {
+		p.AttachReplicator(replicator)
+	}
+}
+
+// AttachLeaderLocator sets how the leader of a partition is found when it is not elected through
+// raft, writes rejected by a follower are redirected to it.
+func (s *StateMachine) AttachLeaderLocator(locator LeaderLocator) {
+	s.leaderLocator = locator
+}
+
+// AttachPeerLister sets how the peers of a multi-master node are found once the cluster membership
+// can change at runtime, peer_nodes is used until then.
+func (s *StateMachine) AttachPeerLister(lister PeerLister) {
+	s.peerLister = lister
+}
+
+// AttachRaftTransportToPartitions sets how partitions reach their peers when leadership is
+// elected through raft, it must be called before Start.
+func (s *StateMachine) AttachRaftTransportToPartitions(transport raft.Transport) {
+	for _, p := range s.partitions {
+		p.AttachRaftTransport(transport)
+	}
+}
+
+// AttachAntiEntropyTransportToPartitions sets how partitions reach their peers to compare and
+// repair their keys.
+func (s *StateMachine) AttachAntiEntropyTransportToPartitions(transport partition.AntiEntropyTransport) {
+	for _, p := range s.partitions {
+		p.AttachAntiEntropyTransport(transport)
+	}
 }
 
-func (s *StateMachine) AttachRepCmdWriteHandlerToPartitions(handler partition.RepCmdWriteHandler) {
-	// loop through all partitions
-	s.p.AttachRepCmdWriteHandler(handler)
+// PartitionCount returns the number of partitions hosted by this node.
+func (s *StateMachine) PartitionCount() int {
+	return len(s.partitions)
+}
+
+// PartitionIdForKey returns the id of the partition owning a key.
+func (s *StateMachine) PartitionIdForKey(key string) int {
+	return slotToPartition(KeySlot(key), len(s.partitions))
 }
 
 func (s *StateMachine) getPartitionFromKey(key string) (*partition.Partition, error) {
-	return s.p, nil
+	return s.partitions[s.PartitionIdForKey(key)], nil
 }
 
 func (s *StateMachine) getPartitionFromId(partitionId int) (*partition.Partition, error) {
-	return s.p, nil
+	if partitionId < 0 || partitionId >= len(s.partitions) {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "unknown partition %d", partitionId)
+	}
+	return s.partitions[partitionId], nil
 }
-
 func (s *StateMachine) Get(key string) (string, error) {
 	p, err := s.getPartitionFromKey(key)
 	if err != nil {
 		return "", err
 	}
+	if err := s.checkOwner(key, p.Id); err != nil {
+		return "", err
+	}
 	return p.Get(key)
 }
 
 func (s *StateMachine) Set(key, value string, ttl int) error {
+	return s.write(key, func(p *partition.Partition) error {
+		return p.Set(key, value, ttl)
+	})
+}
+
+// Delete deletes key and tells whether it held a value.
+func (s *StateMachine) Delete(key string) (bool, error) {
+	var existed bool
+	err := s.write(key, func(p *partition.Partition) error {
+		var err error
+		existed, err = p.Delete(key)
+		return err
+	})
+	return existed, err
+}
+
+// Expire sets the TTL of key and tells whether it held a value.
+func (s *StateMachine) Expire(key string, ttl int) (bool, error) {
+	var existed bool
+	err := s.write(key, func(p *partition.Partition) error {
+		var err error
+		existed, err = p.Expire(key, ttl)
+		return err
+	})
+	return existed, err
+}
+
+// SetIf stores value under key when cond holds, see Partition.SetIf.
+func (s *StateMachine) SetIf(key, value string, ttl int, keepTTL bool, cond partition.Condition) (partition.SetResult, error) {
+	var result partition.SetResult
+	err := s.write(key, func(p *partition.Partition) error {
+		var err error
+		result, err = p.SetIf(key, value, ttl, keepTTL, cond)
+		return err
+	})
+	return result, err
+}
+
+// IncrBy adds delta to the integer stored at key, see Partition.IncrBy.
+func (s *StateMachine) IncrBy(key string, delta int64) (int64, error) {
+	var result int64
+	err := s.write(key, func(p *partition.Partition) error {
+		var err error
+		result, err = p.IncrBy(key, delta)
+		return err
+	})
+	return result, err
+}
+
+// IncrByFloat adds delta to the number stored at key, see Partition.IncrByFloat.
+func (s *StateMachine) IncrByFloat(key string, delta float64) (string, error) {
+	var result string
+	err := s.write(key, func(p *partition.Partition) error {
+		var err error
+		result, err = p.IncrByFloat(key, delta)
+		return err
+	})
+	return result, err
+}
+
+// write applies a write on the partition owning key. Writes a follower does not accept are
+// redirected to the leader of the partition when it is known, and writes of a partition served by
+// another node to that node.
+func (s *StateMachine) write(key string, apply func(p *partition.Partition) error) error {
 	p, err := s.getPartitionFromKey(key)
 	if err != nil {
 		return err
 	}
-	if s.WriteMode == commons.ReadOnlyReplication && p.PartitionMode == commons.Follower {
-		return fmt.Errorf("write mode is read-only for the follower partition")
+	gate := &s.gates[p.Id]
+	gate.RLock()
+	defer gate.RUnlock()
+	if err := s.checkWritable(key, p); err != nil {
+		return err
+	}
+	err = apply(p)
+	if errors.Is(err, raft.ErrNotLeader) {
+		return s.redirect(key, p, err)
 	}
-	return p.Set(key, value, ttl)
+	return err
 }
 
-func (s *StateMachine) Delete(key string) error {
-	p, err := s.getPartitionFromKey(key)
-	if err != nil {
+// checkWritable redirects a write on key when p does not take it on this node.
+func (s *StateMachine) checkWritable(key string, p *partition.Partition) error {
+	if err := s.checkOwner(key, p.Id); err != nil {
 		return err
 	}
-	if s.WriteMode == commons.ReadOnlyReplication && p.PartitionMode == commons.Follower {
-		return fmt.Errorf("write mode is read-only for the follower partition")
+	if s.WriteMode == commons.ReadOnlyReplication && p.Mode() == commons.Follower {
+		return s.redirect(key, p, commons.ErrReadOnly)
 	}
-	return p.Delete(key)
+	return nil
 }
 
-func (s *StateMachine) Expire(key string, ttl int) error {
-	p, err := s.getPartitionFromKey(key)
-	if err != nil {
-		return err
+// redirect turns err into a MOVED error carrying the slot of key and the address of the leader
+// of p, like a redis cluster does. err is returned unchanged while the leader is unknown.
+func (s *StateMachine) redirect(key string, p *partition.Partition, err error) error {
+	leader := p.RaftLeader()
+	if leader == "" && s.leaderLocator != nil {
+		leader = s.leaderLocator(p.Id)
 	}
-	if s.WriteMode == commons.ReadOnlyReplication && p.PartitionMode == commons.Follower {
-		return fmt.Errorf("write mode is read-only for the follower partition")
+	if leader == "" || leader == s.NodeId {
+		return err
 	}
-	return p.Expire(key, ttl)
+	return commons.Errorf(commons.ErrCodeMoved, "%d %s", KeySlot(key), leader)
 }
 
 func (s *StateMachine) TTL(key string) (int, error) {
@@ -106,9 +318,24 @@ func (s *StateMachine) TTL(key string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if err := s.checkOwner(key, p.Id); err != nil {
+		return 0, err
+	}
 	return p.TTL(key)
 }
 
+// KeyInfo returns the entry of a key, see Partition.KeyInfo.
+func (s *StateMachine) KeyInfo(key string) (datastore.Entry, error) {
+	p, err := s.getPartitionFromKey(key)
+	if err != nil {
+		return datastore.Entry{}, err
+	}
+	if err := s.checkOwner(key, p.Id); err != nil {
+		return datastore.Entry{}, err
+	}
+	return p.KeyInfo(key)
+}
+
 func (s *StateMachine) ProcessRepCmd(cmd *replication.RepCmd) error {
 	p, err := s.getPartitionFromId(cmd.PartitionId)
 	if err != nil {
@@ -117,3 +344,204 @@ func (s *StateMachine) ProcessRepCmd(cmd *replication.RepCmd) error {
 
 	return p.ProcessRepCmd(cmd)
 }
+
+// HandleRaftRPC routes a RAFT system command, args being the kind followed by the partition id
+// and the kind specific arguments.
+func (s *StateMachine) HandleRaftRPC(args []string) ([]int64, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("RAFT requires a kind and a partition id")
+	}
+	partitionId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid partition id: %s", args[1])
+	}
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return nil, err
+	}
+	return p.HandleRaftRPC(strings.ToUpper(args[0]), args[1:])
+}
+
+// HandleRepAck records that a follower durably applied every write of a partition up to version.
+func (s *StateMachine) HandleRepAck(nodeId string, partitionId, version int) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		s.log.Warnf("Ack from %s for unknown partition %d", nodeId, partitionId)
+		return
+	}
+	p.RecordAck(nodeId, version)
+}
+
+// PartitionVersion returns the Version of the last write of origin applied to a partition.
+func (s *StateMachine) PartitionVersion(partitionId int, origin string) (int, error) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return 0, err
+	}
+	return p.ReplicatedVersion(origin), nil
+}
+
+// PartitionBacklog returns the writes of a partition logged after version.
+func (s *StateMachine) PartitionBacklog(partitionId, version int) ([]*replication.RepCmd, error) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return nil, err
+	}
+	return p.Backlog(version)
+}
+
+// OpenLogCursor returns a cursor reading the writes of a partition logged after version.
+func (s *StateMachine) OpenLogCursor(partitionId, version int) (replication.LogCursor, error) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return nil, err
+	}
+	return p.OpenCursor(version), nil
+}
+
+// ResyncLogCursor returns a cursor reading a fresh snapshot of a partition, then the writes
+// logged after it.
+func (s *StateMachine) ResyncLogCursor(partitionId int) (replication.LogCursor, error) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := p.ResyncCursor()
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// LoggedVersion returns the Version of the last write logged by a partition, 0 when it is unknown.
+func (s *StateMachine) LoggedVersion(partitionId int) int {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return 0
+	}
+	return p.AppliedVersion()
+}
+
+// Snapshot snapshots every partition and compacts their commit logs.
+func (s *StateMachine) Snapshot() error {
+	var errs []error
+	for _, p := range s.partitions {
+		if _, err := p.Snapshot(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BackgroundSnapshot runs Snapshot without waiting for it, failures are only logged.
+func (s *StateMachine) BackgroundSnapshot() {
+	go func() {
+		if err := s.Snapshot(); err != nil {
+			s.log.Errorf("Background snapshot failed: %v", err)
+		}
+	}()
+}
+
+// LogSyncCount returns how many commit log fsyncs were issued across all partitions.
+func (s *StateMachine) LogSyncCount() uint64 {
+	var count uint64
+	for _, p := range s.partitions {
+		count += p.LogSyncCount()
+	}
+	return count
+}
+
+// MerkleHashes returns the hashes of nodes at a level of the Merkle tree of a partition.
+func (s *StateMachine) MerkleHashes(partitionId, level int, nodes []int) ([]uint64, error) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return nil, err
+	}
+	return p.MerkleHashes(level, nodes)
+}
+
+// RangeEntries returns the entries under leaves of the Merkle tree of a partition.
+func (s *StateMachine) RangeEntries(partitionId int, leaves []int) ([]string, error) {
+	p, err := s.getPartitionFromId(partitionId)
+	if err != nil {
+		return nil, err
+	}
+	return p.RangeEntries(leaves)
+}
+
+// Repair runs an anti-entropy round: every partition is compared with the peers it replicates
+// from and the keys that differ are repaired, see Partition.Repair. Multi-master nodes repair from
+// every peer and followers from their leader, a leader is repaired by nobody. Peers that cannot be
+// reached do not stop the round, their errors are returned along with what was repaired.
+func (s *StateMachine) Repair() (partition.RepairStats, error) {
+	if s.conf.ElectionMode == commons.RaftElection {
+		return partition.RepairStats{}, commons.NewError(commons.ErrCodeGeneric, "raft replicas do not need repairs")
+	}
+	s.repairRounds.Add(1)
+
+	var stats partition.RepairStats
+	var errs []error
+	for _, p := range s.partitions {
+		for _, peer := range s.repairPeers(p) {
+			repaired, err := p.Repair(peer)
+			stats.Ranges += repaired.Ranges
+			stats.Keys += repaired.Keys
+			if err != nil {
+				errs = append(errs, fmt.Errorf("partition %d from %s: %w", p.Id, peer, err))
+			}
+		}
+	}
+	return stats, errors.Join(errs...)
+}
+
+func (s *StateMachine) repairPeers(p *partition.Partition) []string {
+	if s.conf.IsMultiMaster() {
+		if s.peerLister != nil {
+			return s.peerLister()
+		}
+		return s.conf.PeerNodes
+	}
+	if p.Mode() != commons.Follower || s.leaderLocator == nil {
+		return nil
+	}
+	if leader := s.leaderLocator(p.Id); leader != "" && leader != s.NodeId {
+		return []string{leader}
+	}
+	return nil
+}
+
+// RepairTotals returns how many anti-entropy rounds ran and the sum of what they repaired.
+func (s *StateMachine) RepairTotals() (int, partition.RepairStats) {
+	var totals partition.RepairStats
+	for _, p := range s.partitions {
+		repaired := p.RepairTotals()
+		totals.Ranges += repaired.Ranges
+		totals.Keys += repaired.Keys
+	}
+	return int(s.repairRounds.Load()), totals
+}
+
+// StartAntiEntropy runs Repair every AntiEntropyInterval until Stop, it must be called once the
+// anti-entropy transport and the leader locator are attached.
+func (s *StateMachine) StartAntiEntropy() {
+	interval := s.conf.AntiEntropyInterval
+	if interval <= 0 || s.conf.ElectionMode == commons.RaftElection {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Repair(); err != nil {
+					s.log.Warnf("Anti-entropy repair failed: %v", err)
+				}
+			case <-s.stopAntiEntropy:
+				return
+			}
+		}
+	}()
+}
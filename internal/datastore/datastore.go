@@ -3,31 +3,79 @@ package datastore
 import (
 	"creek/internal/config"
 	"creek/internal/logger"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"sync"
 	"time"
 )
 
-// Entry represents a key-value pair with an optional expiration time
+// ErrKeyNotFound is returned when reading a key that does not exist or expired
+var ErrKeyNotFound = errors.New("key not found")
+
+// Stamp identifies the write that last changed an entry
+type Stamp struct {
+	Timestamp int64  // hybrid logical clock timestamp of the write
+	Version   int    // partition Version the write was logged under
+	Origin    string // address of the node the write was made on, empty when unknown
+}
+
+// Entry represents a key-value pair with an optional expiration time. A deleted key is kept as a
+// tombstone until it is purged, so that writes replicated out of order can be resolved against it.
 type Entry struct {
 	Value      string
-	Expiration int64 // Unix timestamp, 0 means no expiration
+	Expiration int64 // Unix timestamp in milliseconds, 0 means no expiration
+	Deleted    bool  // tombstone left by a delete
+	Stamp
+}
+
+// live tells whether the entry holds a value at now, a Unix timestamp in milliseconds
+func (e Entry) live(now int64) bool {
+	return !e.Deleted && (e.Expiration <= 0 || e.Expiration > now)
+}
+
+// TTL returns the seconds left before the entry expires at now, rounded like redis does, -1
+// without expiration and -2 once it expired or was deleted
+func (e Entry) TTL(now int64) int {
+	if !e.live(now) {
+		return -2
+	}
+	if e.Expiration <= 0 {
+		return -1
+	}
+	return int((e.Expiration - now + 500) / 1000)
+}
+
+// ExpirationAt returns the expiration of a TTL counted from timestamp, a Unix timestamp in
+// nanoseconds. A TTL that is not positive has no expiration.
+func ExpirationAt(timestamp int64, ttlSeconds int) int64 {
+	if ttlSeconds <= 0 {
+		return 0
+	}
+	return timestamp/int64(time.Millisecond) + int64(ttlSeconds)*1000
 }
 
 // DataStore manages key-value storage with expiration
 type DataStore struct {
-	data map[string]Entry
-	mu   sync.Mutex
-	log  *logrus.Logger
-	conf *config.Config
+	data      map[string]Entry
+	index     *skipList // keys of data in order, nil unless the ordered_index option is set
+	scanIndex *skipList // keys of data in Scan order, see scanIndexKey
+	digests   []uint64  // see Digests
+	mu        sync.Mutex
+	log       *logrus.Logger
+	conf      *config.Config
 }
 
 // NewDataStore initializes a new datastore instance
 func NewDataStore(config *config.Config) *DataStore {
 	ds := &DataStore{
-		data: make(map[string]Entry),
-		log:  logger.CreateLogger(config.LogLevel),
-		conf: config,
+		data:      make(map[string]Entry),
+		scanIndex: newSkipList(),
+		digests:   make([]uint64, digestCount),
+		log:       logger.CreateLogger(config.LogLevel),
+		conf:      config,
+	}
+	if config.OrderedIndex {
+		ds.index = newSkipList()
 	}
 	return ds
 }
@@ -37,15 +85,60 @@ func (ds *DataStore) GetExpiredKeys() []string {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 	var expiredKeys []string
-	now := time.Now().Unix()
+	now := time.Now().UnixMilli()
 	for key, entry := range ds.data {
-		if entry.Expiration > 0 && entry.Expiration <= now {
+		if !entry.Deleted && entry.Expiration > 0 && entry.Expiration <= now {
 			expiredKeys = append(expiredKeys, key)
 		}
 	}
 	return expiredKeys
 }
 
+// PurgeTombstones removes the tombstones of deletes made before the given timestamp and returns
+// how many were removed
+func (ds *DataStore) PurgeTombstones(before int64) int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	purged := 0
+	for key, entry := range ds.data {
+		if entry.Deleted && entry.Timestamp < before {
+			ds.remove(key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Entries returns a copy of every key, including tombstones and expired keys that were not collected yet
+func (ds *DataStore) Entries() map[string]Entry {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	entries := make(map[string]Entry, len(ds.data))
+	for key, entry := range ds.data {
+		entries[key] = entry
+	}
+	return entries
+}
+
+// Load replaces the whole content of the datastore, skipping entries that already expired
+func (ds *DataStore) Load(entries map[string]Entry) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now().UnixMilli()
+	ds.data = make(map[string]Entry, len(entries))
+	ds.scanIndex = newSkipList()
+	ds.digests = make([]uint64, digestCount)
+	if ds.index != nil {
+		ds.index = newSkipList()
+	}
+	for key, entry := range entries {
+		if !entry.Deleted && entry.Expiration > 0 && entry.Expiration <= now {
+			continue
+		}
+		ds.put(key, entry)
+	}
+}
+
 // Stop gracefully shuts down the datastore and stops GC
 func (ds *DataStore) Stop() {
 
@@ -54,47 +147,110 @@ func (ds *DataStore) Stop() {
 
 // Set stores a key-value pair with an optional expiration time
 func (ds *DataStore) Set(key, value string, ttlSeconds int) {
+	ds.SetAt(key, value, ExpirationAt(time.Now().UnixNano(), ttlSeconds), Stamp{})
+}
+
+// SetAt stores a key-value pair expiring at expiration, see Entry, written by the write
+// identified by stamp
+func (ds *DataStore) SetAt(key, value string, expiration int64, stamp Stamp) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	expiration := int64(0)
-	if ttlSeconds > 0 {
-		expiration = time.Now().Unix() + int64(ttlSeconds)
+	ds.put(key, Entry{Value: value, Expiration: expiration, Stamp: stamp})
+}
+
+// SetManyAt stores key-value pairs without expiration all at once, readers see none or all of
+// them. pairs alternates keys and values.
+func (ds *DataStore) SetManyAt(pairs []string, stamp Stamp) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		ds.put(pairs[i], Entry{Value: pairs[i+1], Stamp: stamp})
 	}
-	ds.data[key] = Entry{Value: value, Expiration: expiration}
 }
 
-// Get retrieves a value by key
-func (ds *DataStore) Get(key string) string {
+// Lookup returns the entry of a key, tombstones and expired entries that were not collected yet included
+func (ds *DataStore) Lookup(key string) (Entry, bool) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 	entry, exists := ds.data[key]
-	if !exists {
-		return ""
+	return entry, exists
+}
+
+// Get retrieves a value by key, the flag is false for absent and expired keys
+func (ds *DataStore) Get(key string) (string, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	entry, exists := ds.data[key]
+	if !exists || !entry.live(time.Now().UnixMilli()) {
+		return "", false
 	}
-	// Check if key has expired
-	if entry.Expiration > 0 && entry.Expiration <= time.Now().Unix() {
-		return ""
+	return entry.Value, true
+}
+
+// GetAt returns the entry of a key when it holds a value at now, a Unix timestamp in milliseconds
+func (ds *DataStore) GetAt(key string, now int64) (Entry, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	entry, exists := ds.data[key]
+	if !exists || !entry.live(now) {
+		return Entry{}, false
 	}
-	return entry.Value
+	return entry, true
 }
 
-// Delete removes a key-value pair
+// GetMany retrieves the values of keys all at once, found tells which keys hold a value
+func (ds *DataStore) GetMany(keys []string) (values []string, found []bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now().UnixMilli()
+	values, found = make([]string, len(keys)), make([]bool, len(keys))
+	for i, key := range keys {
+		if entry, exists := ds.data[key]; exists && entry.live(now) {
+			values[i], found[i] = entry.Value, true
+		}
+	}
+	return values, found
+}
+
+// Delete removes a key-value pair without leaving a tombstone
 func (ds *DataStore) Delete(key string) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	delete(ds.data, key)
+	ds.remove(key)
+}
+
+// DeleteAt replaces a key with a tombstone of the delete identified by stamp
+func (ds *DataStore) DeleteAt(key string, stamp Stamp) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.put(key, Entry{Deleted: true, Stamp: stamp})
+}
+
+// DeleteManyAt replaces keys with tombstones of the delete identified by stamp all at once
+func (ds *DataStore) DeleteManyAt(keys []string, stamp Stamp) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, key := range keys {
+		ds.put(key, Entry{Deleted: true, Stamp: stamp})
+	}
 }
 
 // Expire sets a TTL on an existing key
 func (ds *DataStore) Expire(key string, ttlSeconds int) {
+	ds.ExpireAt(key, time.Now().UnixMilli()+int64(ttlSeconds)*1000, Stamp{})
+}
+
+// ExpireAt sets the expiration of an existing key for the expire identified by stamp
+func (ds *DataStore) ExpireAt(key string, expiration int64, stamp Stamp) {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 	entry, exists := ds.data[key]
-	if !exists {
+	if !exists || entry.Deleted {
 		return
 	}
-	entry.Expiration = time.Now().Unix() + int64(ttlSeconds)
-	ds.data[key] = entry
+	entry.Expiration = expiration
+	entry.Stamp = stamp
+	ds.put(key, entry)
 }
 
 // TTL retrieves the remaining time before a key expires
@@ -105,12 +261,5 @@ func (ds *DataStore) TTL(key string) int {
 	if !exists {
 		return -2
 	}
-	if entry.Expiration <= 0 {
-		return -1
-	}
-	remaining := entry.Expiration - time.Now().Unix()
-	if remaining <= 0 {
-		return -2
-	}
-	return int(remaining)
+	return entry.TTL(time.Now().UnixMilli())
 }
@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"creek/internal/utils"
+	"hash/fnv"
+	"strconv"
+)
+
+// DigestBits is the number of high ScanHash bits picking the digest range of a key, see Digests.
+const DigestBits = 10
+const digestCount = 1 << DigestBits
+
+// digestRange returns the digest range of a key of the given ScanHash.
+func digestRange(hash uint64) int {
+	return int(hash >> (ScanHashBits - DigestBits))
+}
+
+// EntryHash hashes what replicas holding the same write of a key agree on. The Version is left out
+// as multi-master nodes log the writes of their peers under their own Versions, and so is the
+// expiration which is derived from the timestamp.
+func EntryHash(key string, entry Entry) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(utils.JoinArgs([]string{
+		key,
+		entry.Value,
+		strconv.FormatInt(entry.Timestamp, 10),
+		entry.Origin,
+		strconv.FormatBool(entry.Deleted),
+	})))
+	return h.Sum64()
+}
+
+// Digests returns the digest of every range of keys sharing the DigestBits high bits of their
+// ScanHash, the XOR of the EntryHash of their entries, tombstones and expired keys that were not
+// collected yet included. Digests are kept up to date by every write, so they only depend on the
+// content of the datastore and cost nothing to read.
+func (ds *DataStore) Digests() []uint64 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return append([]uint64(nil), ds.digests...)
+}
+
+// RangeEntries returns the entries of the keys of the given digest ranges, see Digests.
+func (ds *DataStore) RangeEntries(ranges []int) map[string]Entry {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	entries := make(map[string]Entry)
+	for _, r := range ranges {
+		start := scanIndexKey(uint64(r)<<(ScanHashBits-DigestBits), "")
+		end := "" // the last range runs to the end of the index
+		if r+1 < digestCount {
+			end = scanIndexKey(uint64(r+1)<<(ScanHashBits-DigestBits), "")
+		}
+		for node := ds.scanIndex.seek(start); node != nil; node = node.next[0] {
+			if end != "" && node.key >= end {
+				break
+			}
+			key := node.key[ScanHashBits/4:]
+			entries[key] = ds.data[key]
+		}
+	}
+	return entries
+}
@@ -0,0 +1,63 @@
+package datastore
+
+import "time"
+
+// put stores the entry of a key, adding a new key to the indexes and updating its digest, see
+// Digests. The caller must hold ds.mu.
+func (ds *DataStore) put(key string, entry Entry) {
+	hash := ScanHash(key)
+	if current, exists := ds.data[key]; exists {
+		ds.digests[digestRange(hash)] ^= EntryHash(key, current)
+	} else {
+		ds.scanIndex.insert(scanIndexKey(hash, key))
+		if ds.index != nil {
+			ds.index.insert(key)
+		}
+	}
+	ds.data[key] = entry
+	ds.digests[digestRange(hash)] ^= EntryHash(key, entry)
+}
+
+// remove deletes a key from data, the indexes and its digest. The caller must hold ds.mu.
+func (ds *DataStore) remove(key string) {
+	current, exists := ds.data[key]
+	if !exists {
+		return
+	}
+	hash := ScanHash(key)
+	ds.digests[digestRange(hash)] ^= EntryHash(key, current)
+	delete(ds.data, key)
+	ds.scanIndex.remove(scanIndexKey(hash, key))
+	if ds.index != nil {
+		ds.index.remove(key)
+	}
+}
+
+// Range walks in order up to limit keys from start on and before end, an empty end having no
+// bound, and returns those holding a value along with their values. Tombstones and expired keys
+// count toward limit, so fewer keys may be returned, next is then the key the walk stopped at,
+// where the next call continues from, and empty once no key is left before end. It returns nothing
+// without the ordered index.
+func (ds *DataStore) Range(start, end string, limit int) (keys, values []string, next string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.index == nil {
+		return nil, nil, ""
+	}
+	now := time.Now().UnixMilli()
+	walked := 0
+	for node := ds.index.seek(start); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		if walked >= limit {
+			return keys, values, node.key
+		}
+		walked++
+		if entry := ds.data[node.key]; entry.live(now) {
+			keys = append(keys, node.key)
+			values = append(values, entry.Value)
+		}
+	}
+	return keys, values, ""
+}
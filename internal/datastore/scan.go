@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"creek/internal/utils"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// ScanHashBits is the size of the hashes Scan orders keys by.
+const ScanHashBits = 48
+
+// ScanHash returns the position of a key in the order Scan lists keys in. It only depends on the
+// key, so writes to other keys never move it.
+func ScanHash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64() & (1<<ScanHashBits - 1)
+}
+
+// scanIndexKey is the key of the scan index for a key of the given ScanHash, the hash in fixed
+// width hexadecimal followed by the key, so the index is in hash order then key order.
+func scanIndexKey(hash uint64, key string) string {
+	return fmt.Sprintf("%0*x%s", ScanHashBits/4, hash, key)
+}
+
+// Scan walks about count keys of the scan index whose ScanHash is at least from, in hash order,
+// and returns those holding a value along with the hash the next call continues from. Keys sharing
+// a hash are walked together, so a key holding a value from the first call to the last is listed
+// at least once whatever the writes in between. Tombstones and expired keys count toward count, a
+// call costs about count whatever the keys around, and may return fewer keys, even none, before
+// done is true once no key is left after the walked ones.
+func (ds *DataStore) Scan(from uint64, count int) (keys []string, next uint64, done bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now().UnixMilli()
+	count = max(count, 1)
+	walked := 0
+	var lastHash uint64
+	for node := ds.scanIndex.seek(scanIndexKey(from, "")); node != nil; node = node.next[0] {
+		hash, _ := strconv.ParseUint(node.key[:ScanHashBits/4], 16, 64)
+		if walked >= count && hash != lastHash {
+			return keys, hash, false
+		}
+		walked++
+		lastHash = hash
+		if key := node.key[ScanHashBits/4:]; ds.data[key].live(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, 0, true
+}
+
+// Keys returns the keys holding a value that match a glob pattern, see utils.MatchGlob. complete
+// is false when more than limit keys match, keys then holds limit of them.
+func (ds *DataStore) Keys(pattern string, limit int) (keys []string, complete bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now().UnixMilli()
+	for key, entry := range ds.data {
+		if entry.live(now) && utils.MatchGlob(pattern, key) {
+			if len(keys) == limit {
+				return keys, false
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, true
+}
+
+// Size returns how many keys hold a value.
+func (ds *DataStore) Size() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now().UnixMilli()
+	size := 0
+	for _, entry := range ds.data {
+		if entry.live(now) {
+			size++
+		}
+	}
+	return size
+}
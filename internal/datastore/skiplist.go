@@ -0,0 +1,80 @@
+package datastore
+
+import "math/rand"
+
+const skipListMaxLevel = 32
+
+// skipList keeps keys sorted. Every node links to the next node of each of its levels, a node
+// reaching level i+1 with probability 1/4 once it reaches level i. It is guarded by the mutex of
+// the datastore.
+type skipList struct {
+	head  skipNode
+	level int // levels in use, at least 1
+	rnd   *rand.Rand
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// path returns, for every level, the last node before key.
+func (l *skipList) path(key string) [skipListMaxLevel]*skipNode {
+	var path [skipListMaxLevel]*skipNode
+	node := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		path[i] = node
+	}
+	return path
+}
+
+// insert adds key, a key already present is left as is.
+func (l *skipList) insert(key string) {
+	path := l.path(key)
+	if next := path[0].next[0]; next != nil && next.key == key {
+		return
+	}
+	level := 1
+	for level < skipListMaxLevel && l.rnd.Intn(4) == 0 {
+		level++
+	}
+	for ; l.level < level; l.level++ {
+		path[l.level] = &l.head
+	}
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+}
+
+// remove deletes key when it is present.
+func (l *skipList) remove(key string) {
+	path := l.path(key)
+	node := path[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := range node.next {
+		path[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// seek returns the node of the first key from start on, nil when there is none.
+func (l *skipList) seek(start string) *skipNode {
+	return l.path(start)[0].next[0]
+}
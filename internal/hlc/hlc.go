@@ -0,0 +1,41 @@
+// Package hlc implements a hybrid logical clock. Timestamps are wall clock nanoseconds that never
+// go backwards and move past every timestamp observed from other nodes, so a write made after
+// another one was seen always gets a greater timestamp, whatever the clock skew between nodes.
+// The logical counter of the original algorithm is folded into the nanoseconds: when the wall
+// clock is behind, the clock advances by one nanosecond instead.
+package hlc
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func NewClock() *Clock {
+	return &Clock{}
+}
+
+// Now returns a timestamp greater than every timestamp returned or observed before.
+func (c *Clock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UnixNano()
+	if now <= c.last {
+		now = c.last + 1
+	}
+	c.last = now
+	return now
+}
+
+// Observe moves the clock past a timestamp received from another node or read back from disk.
+func (c *Clock) Observe(timestamp int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timestamp > c.last {
+		c.last = timestamp
+	}
+}
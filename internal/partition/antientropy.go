@@ -0,0 +1,181 @@
+package partition
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// merkleStride is how many levels of the Merkle tree a repair descends per round trip, every node
+// that differs from the peer is replaced by its 2^merkleStride descendants.
+const merkleStride = 5
+
+// rangeBatchSize is the number of leaves whose entries are fetched from the peer per request.
+const rangeBatchSize = 64
+
+// AntiEntropyTransport reaches the partitions of peers through the REP MERKLE and REP RANGE
+// requests.
+type AntiEntropyTransport interface {
+	MerkleHashes(peer string, partitionId, level int, nodes []int) ([]uint64, error)
+	RangeEntries(peer string, partitionId int, leaves []int) ([]string, error)
+}
+
+// RepairStats counts what anti-entropy found and fixed.
+type RepairStats struct {
+	Ranges int // leaves of the Merkle tree that differed from the peer
+	Keys   int // keys the entry of the peer won for and was applied
+}
+
+// repairCounters accumulates the RepairStats of every repair of a partition.
+type repairCounters struct {
+	ranges atomic.Int64
+	keys   atomic.Int64
+}
+
+// AttachAntiEntropyTransport sets how Repair reaches peers, it must be called before Repair.
+func (p *Partition) AttachAntiEntropyTransport(transport AntiEntropyTransport) {
+	p.antiEntropy = transport
+}
+
+// RepairTotals returns the sum of what every repair of the partition fixed since the start.
+func (p *Partition) RepairTotals() RepairStats {
+	return RepairStats{Ranges: int(p.repaired.ranges.Load()), Keys: int(p.repaired.keys.Load())}
+}
+
+// Repair pulls the keys of the partition that differ on peer. The Merkle trees of both nodes are
+// compared from the root down to the leaves that differ, then the entries under those leaves are
+// fetched and every one of them that wins under last-writer-wins is logged and applied, like a
+// write replicated by the peer. Keys only this node has are left alone, the peer repairs itself
+// from this node in turn, so a follower must not repair its leader.
+func (p *Partition) Repair(peer string) (RepairStats, error) {
+	if p.raft != nil {
+		return RepairStats{}, fmt.Errorf("partition replicates through raft and does not need repairs")
+	}
+	if p.antiEntropy == nil {
+		return RepairStats{}, fmt.Errorf("no anti-entropy transport attached")
+	}
+
+	leaves, err := p.differingLeaves(peer)
+	if err != nil || len(leaves) == 0 {
+		return RepairStats{}, err
+	}
+	stats := RepairStats{Ranges: len(leaves)}
+	for start := 0; start < len(leaves); start += rangeBatchSize {
+		batch := leaves[start:min(start+rangeBatchSize, len(leaves))]
+		args, err := p.antiEntropy.RangeEntries(peer, p.Id, batch)
+		if err != nil {
+			return stats, err
+		}
+		if len(args)%snapshotEntryFields != 0 {
+			return stats, fmt.Errorf("invalid range reply from %s: %d fields", peer, len(args))
+		}
+		repaired, err := p.repairEntries(args)
+		stats.Keys += repaired
+		if err != nil {
+			return stats, p.persistRepairs(stats.Keys, err)
+		}
+	}
+	if err := p.persistRepairs(stats.Keys, nil); err != nil {
+		return stats, err
+	}
+
+	p.repaired.ranges.Add(int64(stats.Ranges))
+	p.repaired.keys.Add(int64(stats.Keys))
+	if stats.Keys > 0 {
+		p.log.Infof("Partition %d: repaired %d keys in %d ranges from %s", p.Id, stats.Keys, stats.Ranges, peer)
+	}
+	return stats, nil
+}
+
+// differingLeaves walks down the Merkle trees of this node and of peer and returns the leaves whose
+// hashes differ.
+func (p *Partition) differingLeaves(peer string) ([]int, error) {
+	local := buildMerkleTree(p.ds.Digests())
+	level, nodes := 0, []int{0}
+	for {
+		remote, err := p.antiEntropy.MerkleHashes(peer, p.Id, level, nodes)
+		if err != nil {
+			return nil, err
+		}
+		if len(remote) != len(nodes) {
+			return nil, fmt.Errorf("invalid merkle reply from %s: %d hashes for %d nodes", peer, len(remote), len(nodes))
+		}
+		var differing []int
+		for i, node := range nodes {
+			if local[level][node] != remote[i] {
+				differing = append(differing, node)
+			}
+		}
+		if len(differing) == 0 || level == merkleDepth {
+			return differing, nil
+		}
+
+		next := min(level+merkleStride, merkleDepth)
+		width := 1 << (next - level)
+		nodes = make([]int, 0, len(differing)*width)
+		for _, node := range differing {
+			for child := node * width; child < (node+1)*width; child++ {
+				nodes = append(nodes, child)
+			}
+		}
+		level = next
+	}
+}
+
+// persistRepairs makes the keys a follower repaired survive a restart and returns err, or the error
+// of doing so. A follower logs them under its current Version, the Versions being those of its
+// leader, and the replay on start skips every entry a snapshot of that Version covers, so a
+// snapshot is taken right after. It waits for one already being written, which may predate them.
+func (p *Partition) persistRepairs(repaired int, err error) error {
+	if p.multiMaster || repaired == 0 {
+		return err
+	}
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	if _, snapErr := p.snapshotLocked(); snapErr != nil && err == nil {
+		return snapErr
+	}
+	return err
+}
+
+// repairEntries applies the entries of a peer that win over the local ones and returns how many
+// did. A multi-master node logs them under new Versions, which forwards them to its other peers.
+// A follower logs them under its current Version, the Versions being those of its leader, until
+// persistRepairs snapshots them.
+func (p *Partition) repairEntries(args []string) (int, error) {
+	entries, err := snapshotEntriesFromArgs(args)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	now := time.Now().UnixMilli()
+	var seq uint64
+	repaired := 0
+	for key, entry := range entries {
+		p.clock.Observe(entry.Timestamp)
+		operation, args, ok := entryWrite(key, entry, now)
+		if !ok || !p.supersedes(operation, args, entry.Timestamp) {
+			continue
+		}
+		if p.multiMaster {
+			p.Version++
+		}
+		seq, err = p.appendAndApply(LogEntry{
+			Timestamp: entry.Timestamp,
+			Version:   p.Version,
+			Origin:    entry.Origin,
+			Operation: operation,
+			Args:      args,
+		})
+		if err != nil {
+			break
+		}
+		repaired++
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return repaired, err
+	}
+	return repaired, p.waitDurable(seq)
+}
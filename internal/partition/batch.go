@@ -0,0 +1,32 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"time"
+)
+
+// MGet returns the values of keys read all at once, found tells which keys hold a value.
+func (p *Partition) MGet(keys []string) (values []string, found []bool) {
+	return p.ds.GetMany(keys)
+}
+
+// MSet stores key-value pairs without TTL as a single commit log record, so they are applied,
+// recovered and replicated all together. pairs alternates keys and values.
+func (p *Partition) MSet(pairs []string) error {
+	if p.raft != nil {
+		return p.proposeAndWait(commons.CmdDataMSet, pairs)
+	}
+	return p.write(commons.CmdDataMSet, pairs)
+}
+
+// MDelete deletes keys as a single commit log record like MSet and tells which of them held a value.
+func (p *Partition) MDelete(keys []string) ([]bool, error) {
+	existed := make([]bool, len(keys))
+	_, err := p.update(commons.CmdDataMDel, func(timestamp int64) ([]string, error) {
+		for i, key := range keys {
+			_, existed[i] = p.ds.GetAt(key, timestamp/int64(time.Millisecond))
+		}
+		return keys, nil
+	})
+	return existed, err
+}
@@ -0,0 +1,67 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"creek/internal/datastore"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Condition tells whether a conditional SET applies given the entry of its key, live being false
+// when the key holds no value.
+type Condition func(entry datastore.Entry, live bool) bool
+
+// Always lets a SET apply whatever the state of its key.
+func Always(datastore.Entry, bool) bool { return true }
+
+// IfAbsent lets a SET apply when its key holds no value, like SET NX.
+func IfAbsent(_ datastore.Entry, live bool) bool { return !live }
+
+// IfPresent lets a SET apply when its key holds a value, like SET XX.
+func IfPresent(_ datastore.Entry, live bool) bool { return live }
+
+// IfVersion lets a SET apply when its key was last written under version, as KEYINFO reports it.
+// Version 0 stands for a key that holds no value.
+func IfVersion(version int) Condition {
+	return func(entry datastore.Entry, live bool) bool {
+		if !live {
+			return version == 0
+		}
+		return entry.Version == version
+	}
+}
+
+// SetResult tells how a conditional SET went.
+type SetResult struct {
+	Previous string // value of the key before the SET
+	Existed  bool   // the key held a value before the SET
+	Applied  bool   // the condition held and the SET was logged
+	Version  int    // Version the SET was logged under when applied
+}
+
+// errNotApplied cancels a conditional SET whose condition does not hold.
+var errNotApplied = errors.New("condition not met")
+
+// SetIf stores value under key when cond holds for the current entry of the key, atomically with
+// respect to the other writes of the partition. The SET logged is a plain one, with ttl or the
+// expiration the key had, so followers apply it whatever the state they evaluate it against.
+func (p *Partition) SetIf(key, value string, ttl int, keepTTL bool, cond Condition) (SetResult, error) {
+	var result SetResult
+	version, err := p.update(commons.CmdDataSet, func(timestamp int64) ([]string, error) {
+		entry, live := p.ds.GetAt(key, timestamp/int64(time.Millisecond))
+		result.Previous, result.Existed = entry.Value, live
+		if !cond(entry, live) {
+			return nil, errNotApplied
+		}
+		if keepTTL {
+			return keepTTLArgs(key, value, entry, live), nil
+		}
+		return []string{key, value, strconv.Itoa(ttl)}, nil
+	})
+	if errors.Is(err, errNotApplied) {
+		return result, nil
+	}
+	result.Applied, result.Version = err == nil, version
+	return result, err
+}
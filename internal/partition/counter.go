@@ -0,0 +1,69 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"creek/internal/datastore"
+	"math"
+	"strconv"
+	"time"
+)
+
+// IncrBy adds delta to the integer stored at key and returns the result, a missing key counting
+// as 0. The result is logged as a SET with the expiration of the key, see keepTTLArgs. With
+// multi-master the SET resolves by last-writer-wins like any other, concurrent increments made on
+// different nodes are not added up and all but one are lost.
+func (p *Partition) IncrBy(key string, delta int64) (int64, error) {
+	var result int64
+	_, err := p.update(commons.CmdDataSet, func(timestamp int64) ([]string, error) {
+		var current int64
+		entry, live := p.ds.GetAt(key, timestamp/int64(time.Millisecond))
+		if live {
+			n, err := strconv.ParseInt(entry.Value, 10, 64)
+			if err != nil {
+				return nil, commons.ErrNotInteger
+			}
+			current = n
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return nil, commons.ErrOverflow
+		}
+		result = current + delta
+		return keepTTLArgs(key, strconv.FormatInt(result, 10), entry, live), nil
+	})
+	return result, err
+}
+
+// IncrByFloat adds delta to the number stored at key like IncrBy and returns the result formatted
+// the way it is stored.
+func (p *Partition) IncrByFloat(key string, delta float64) (string, error) {
+	var result string
+	_, err := p.update(commons.CmdDataSet, func(timestamp int64) ([]string, error) {
+		var current float64
+		entry, live := p.ds.GetAt(key, timestamp/int64(time.Millisecond))
+		if live {
+			f, err := strconv.ParseFloat(entry.Value, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, commons.ErrNotFloat
+			}
+			current = f
+		}
+		sum := current + delta
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			return nil, commons.NewError(commons.ErrCodeGeneric, "increment would produce NaN or Infinity")
+		}
+		result = strconv.FormatFloat(sum, 'f', -1, 64)
+		return keepTTLArgs(key, result, entry, live), nil
+	})
+	return result, err
+}
+
+// keepTTLArgs returns the args of a SET of value keeping the expiration of the current entry of
+// key, none when it holds no value. The expiration is logged as is, so that every node replaying
+// or receiving the SET ends up with the same one whatever its own entry.
+func keepTTLArgs(key, value string, entry datastore.Entry, live bool) []string {
+	var expiration int64
+	if live {
+		expiration = entry.Expiration
+	}
+	return []string{key, value, commons.SetPXAT, strconv.FormatInt(expiration, 10)}
+}
@@ -0,0 +1,207 @@
+package partition
+
+import (
+	"creek/internal/replication"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// backlogBatchSize is the number of writes Backlog reads from the commit log at a time.
+const backlogBatchSize = 1000
+
+// LogCursor reads the writes of a partition from its commit log, it is the replication queue of
+// one follower. Writes stay on disk until they are read, so a follower that is slow or unreachable
+// costs no memory and misses none of them. It is not safe for concurrent use.
+type LogCursor struct {
+	p       *Partition
+	version int                 // Version of the last write read
+	load    *replication.RepCmd // snapshot to return before the writes following it
+
+	file          *os.File // segment being read, it stays readable once sealed or compacted
+	path          string
+	formatVersion uint16
+	offset        int64 // end of the last record read from file
+	sealed        bool  // file is no longer the active segment, nothing is appended to it anymore
+}
+
+// OpenCursor returns a cursor reading the writes logged after version.
+func (p *Partition) OpenCursor(version int) *LogCursor {
+	return &LogCursor{p: p, version: version}
+}
+
+// ResyncCursor snapshots the partition and returns a cursor reading the snapshot, as a LOAD
+// command, then the writes logged after it. It catches up a follower lagging too far behind
+// without replaying the log. When a snapshot is already being written that one is read instead.
+func (p *Partition) ResyncCursor() (*LogCursor, error) {
+	if _, err := p.Snapshot(); err != nil && !errors.Is(err, ErrSnapshotInProgress) {
+		return nil, err
+	}
+
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	snap, err := readSnapshot(p.snapshotPath())
+	if err != nil {
+		return nil, err
+	}
+	if snap == nil {
+		return nil, fmt.Errorf("partition %d has no snapshot to resync from", p.Id)
+	}
+	return &LogCursor{p: p, version: snap.Version, load: p.loadCmdFromSnapshot(snap)}, nil
+}
+
+// Next returns up to max of the writes following the last one read, none once the cursor caught
+// up with the log.
+func (c *LogCursor) Next(max int) ([]*replication.RepCmd, error) {
+	var cmds []*replication.RepCmd
+	for len(cmds) < max {
+		if c.load != nil {
+			cmds = append(cmds, c.load)
+			c.load = nil
+			continue
+		}
+		if c.file == nil {
+			if err := c.seek(); err != nil || c.file == nil {
+				return cmds, err
+			}
+			continue // seek may have found a snapshot to load first
+		}
+
+		entry, err := c.read()
+		if err == io.EOF {
+			if c.sealed {
+				c.closeFile()
+				continue
+			}
+			// the writer may have sealed the segment since, its last records are read again
+			if c.sealed, err = c.p.lw.isSealed(c.file); err != nil || !c.sealed {
+				return cmds, err
+			}
+			continue
+		}
+		if err != nil {
+			return cmds, err
+		}
+		if entry.Version <= c.version {
+			continue
+		}
+		cmds = append(cmds, c.p.repCmdFromEntry(entry))
+		c.version = entry.Version
+	}
+	return cmds, nil
+}
+
+// Close releases the segment being read.
+func (c *LogCursor) Close() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+func (c *LogCursor) closeFile() {
+	if err := c.Close(); err != nil {
+		c.p.log.Warnf("Error closing commit log segment %s: %v", c.path, err)
+	}
+}
+
+// seek opens the segment holding the write following the last one read. When the writes in
+// between were compacted away the snapshot covering them is loaded first, as Backlog does.
+func (c *LogCursor) seek() error {
+	// segments must not be removed while the one holding the cursor is looked up
+	c.p.snapMu.Lock()
+	defer c.p.snapMu.Unlock()
+
+	file, err := c.p.lw.openSegmentAfter(c.version)
+	if err != nil {
+		return err
+	}
+	formatVersion, err := readSegmentHeader(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	c.file, c.path, c.formatVersion = file, file.Name(), formatVersion
+	c.offset, c.sealed = int64(logHeaderSize), false
+	if c.version >= c.p.snapshotVersion {
+		return nil
+	}
+
+	first, err := c.read()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	c.offset = int64(logHeaderSize)
+	if err == nil && first.Version <= c.version+1 {
+		return nil
+	}
+	snap, err := readSnapshot(c.p.snapshotPath())
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		return fmt.Errorf("commit log no longer holds version %d and there is no snapshot", c.version+1)
+	}
+	c.load = c.p.loadCmdFromSnapshot(snap)
+	c.version = snap.Version
+	return nil
+}
+
+// read returns the entry of the next record, io.EOF when no complete record follows yet.
+func (c *LogCursor) read() (LogEntry, error) {
+	for {
+		var header [recordHeaderSize]byte
+		if err := c.readAt(header[:], c.offset); err != nil {
+			return LogEntry{}, err
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecordSize {
+			return LogEntry{}, fmt.Errorf("%w at offset %d of %s", errCorruptRecord, c.offset, c.path)
+		}
+		payload := make([]byte, length)
+		if err := c.readAt(payload, c.offset+recordHeaderSize); err != nil {
+			return LogEntry{}, err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return LogEntry{}, fmt.Errorf("%w at offset %d of %s", errCorruptRecord, c.offset, c.path)
+		}
+		c.offset += recordHeaderSize + int64(length)
+
+		entry, err := parseLogLine(string(payload), c.formatVersion)
+		if err != nil {
+			c.p.log.Warnf("Skipping malformed log entry: %s", payload)
+			continue
+		}
+		return entry, nil
+	}
+}
+
+// readAt fills buf from offset, io.EOF means the record is not fully written yet.
+func (c *LogCursor) readAt(buf []byte, offset int64) error {
+	_, err := c.file.ReadAt(buf, offset)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading commit log: %w", err)
+	}
+	return err
+}
+
+// readSegmentHeader checks the header of a segment and returns its format version.
+func readSegmentHeader(file *os.File) (uint16, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:len(logMagic)]) != logMagic {
+		return 0, fmt.Errorf("%s is not a commit log segment", file.Name())
+	}
+	version := binary.BigEndian.Uint16(header[len(logMagic):])
+	if version < 1 || version > logFormatVersion {
+		return 0, fmt.Errorf("unsupported commit log format version %d in %s", version, file.Name())
+	}
+	return version, nil
+}
@@ -0,0 +1,250 @@
+package partition
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Every commit log segment starts with logMagic and the format version. Records follow as a
+// big endian uint32 payload length, the CRC32C of the payload and the payload itself, which is
+// the quoted "timestamp version term origin operation args..." line without its newline.
+// Segments of format version 1 have no origin and stay readable.
+const logMagic = "CRKLOG"
+const logFormatVersion = 2
+const logHeaderSize = len(logMagic) + 2
+const recordHeaderSize = 8
+const maxRecordSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// errTornRecord means the segment ends in the middle of a record, the tail of a write
+	// interrupted by a crash.
+	errTornRecord = errors.New("torn record at the end of the commit log")
+	// errCorruptRecord means a complete record does not match its checksum or its length is damaged.
+	errCorruptRecord = errors.New("corrupt record in the commit log")
+)
+
+func logHeader(version uint16) []byte {
+	header := make([]byte, logHeaderSize)
+	copy(header, logMagic)
+	binary.BigEndian.PutUint16(header[len(logMagic):], version)
+	return header
+}
+
+// encodeRecord frames a log entry with its length and checksum.
+func encodeRecord(entry LogEntry) []byte {
+	payload := []byte(formatLogLine(entry))
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+	return record
+}
+
+// segmentReader reads the records of a segment and tracks the offset of the last valid one.
+type segmentReader struct {
+	reader     *bufio.Reader
+	offset     int64 // end of the last record read successfully
+	size       int64
+	tornHeader bool
+	version    uint16 // format version of the segment
+}
+
+// openSegment checks the header of a segment and returns a reader positioned on its first record.
+func openSegment(file *os.File) (*segmentReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat commit log: %w", err)
+	}
+	r := &segmentReader{reader: bufio.NewReader(file), size: info.Size(), version: logFormatVersion}
+	if r.size == 0 {
+		return r, nil // created but its header was never written
+	}
+	if r.size < int64(logHeaderSize) {
+		r.tornHeader = true
+		return r, nil
+	}
+
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r.reader, header); err != nil || string(header[:len(logMagic)]) != logMagic {
+		return nil, fmt.Errorf("%s is not a commit log segment", file.Name())
+	}
+	r.version = binary.BigEndian.Uint16(header[len(logMagic):])
+	if r.version < 1 || r.version > logFormatVersion {
+		return nil, fmt.Errorf("unsupported commit log format version %d in %s", r.version, file.Name())
+	}
+	r.offset = int64(logHeaderSize)
+	return r, nil
+}
+
+// next returns the payload of the next record, io.EOF after the last one, errTornRecord when
+// the segment ends inside its last record and errCorruptRecord on a checksum mismatch or a
+// length running past the end of the segment with records after it.
+func (r *segmentReader) next() ([]byte, error) {
+	if r.tornHeader {
+		return nil, errTornRecord
+	}
+	if r.size == 0 {
+		return nil, io.EOF
+	}
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r.reader, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		if n > 0 && errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, errCorruptRecord
+	}
+	end := r.offset + recordHeaderSize + int64(length)
+	if end > r.size {
+		// a write interrupted by a crash is the last one, a record after it means the length
+		// itself is damaged
+		rest, err := io.ReadAll(r.reader)
+		if err != nil {
+			return nil, err
+		}
+		if containsRecord(rest) {
+			return nil, errCorruptRecord
+		}
+		return nil, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, payload); err != nil {
+		return nil, errTornRecord
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		if end == r.size {
+			// the last record was only partially persisted
+			return nil, errTornRecord
+		}
+		return nil, errCorruptRecord
+	}
+	r.offset = end
+	return payload, nil
+}
+
+// containsRecord tells whether a complete record matching its checksum starts anywhere in data.
+// Payloads are text, so the zero high bytes of a plausible length are rarely found outside a
+// record header and few positions get their checksum computed.
+func containsRecord(data []byte) bool {
+	for i := 0; i+recordHeaderSize < len(data); i++ {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		end := i + recordHeaderSize + length
+		if length == 0 || end > len(data) {
+			continue
+		}
+		if crc32.Checksum(data[i+recordHeaderSize:end], crcTable) == binary.BigEndian.Uint32(data[i+4:i+8]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacyTextLog tells whether a segment was written in the text format used before records
+// were framed, one "timestamp version term operation args..." line per entry.
+func isLegacyTextLog(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open commit log: %w", err)
+	}
+	defer file.Close()
+
+	prefix := make([]byte, len(logMagic))
+	n, err := io.ReadFull(file, prefix)
+	if n == 0 {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, fmt.Errorf("failed to read commit log: %w", err)
+	}
+	// text logs start with a timestamp, a partially written header is still a prefix of the magic
+	return !bytes.HasPrefix([]byte(logMagic), prefix[:n]), nil
+}
+
+// segmentFormatVersion returns the format version in the header of a segment, the current one
+// when the header was not written yet and 0 when the segment does not exist.
+func segmentFormatVersion(path string) (uint16, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open commit log: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return logFormatVersion, nil
+	}
+	return binary.BigEndian.Uint16(header[len(logMagic):]), nil
+}
+
+// migrateTextLog rewrites a text segment as framed records of format version 1, which has the
+// same lines, keeping every non empty line.
+func migrateTextLog(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read commit log: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.Write(logHeader(1))
+	count := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		payload := []byte(line)
+		var header [recordHeaderSize]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+		out.Write(header[:])
+		out.Write(payload)
+		count++
+	}
+
+	tmpPath := path + ".tmp"
+	if err := writeFileSync(tmpPath, out.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return 0, fmt.Errorf("failed to replace commit log: %w", err)
+	}
+	return count, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
@@ -1,16 +1,30 @@
 package partition
 
 import (
+	"creek/internal/utils"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// LogFileName is the name of the commit log inside a partition directory. It is the active
+// segment, sealed segments are renamed after the last Version they hold, see segmentFileName.
+const LogFileName = "commit.log"
+
+const segmentPrefix = "commit-"
+const segmentSuffix = ".log"
+
 // LogEntry represents a single operation in the transaction log.
 type LogEntry struct {
 	Timestamp int64 // timestamp
 	Version   int
+	Term      int    // raft term the entry was created in, 0 outside of raft
+	Origin    string // address of the node the write was made on, empty under raft
 	Operation string // e.g., "set", "delete"
 	Args      []string
 }
@@ -20,46 +34,325 @@ type LogEntryWriter struct {
 	mu          sync.Mutex
 	logFile     *os.File
 	logFilePath string
-	subscribers []chan LogEntry // subscribers to notify on every append
+
+	segmentSize int64 // size after which the active segment is sealed, 0 never rotates
+	size        int64 // bytes written to the active segment
+	lastVersion int   // Version of the last appended entry, names the segment once sealed
+	oldFormat   bool  // the active segment has an older format version, it is sealed before the next append
+
+	appended  uint64        // sequence number of the last appended record, guarded by mu
+	synced    atomic.Uint64 // sequence number of the last record known to be durable
+	syncMu    sync.Mutex    // one group commit fsync at a time, the writers waiting on it share it
+	syncCount atomic.Uint64 // fsyncs issued, to observe how well writes are grouped
 }
 
 // newLogEntryWriter initializes a transaction log and opens the file for writing.
-func newLogEntryWriter(filePath string) (*LogEntryWriter, error) {
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func newLogEntryWriter(filePath string, segmentSize int64) (*LogEntryWriter, error) {
+	version, err := segmentFormatVersion(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %w", err)
+		return nil, err
+	}
+	file, size, err := openLogFile(filePath)
+	if err != nil {
+		return nil, err
 	}
 
 	return &LogEntryWriter{
 		logFile:     file,
 		logFilePath: filePath,
+		segmentSize: segmentSize,
+		size:        size,
+		oldFormat:   version != 0 && version < logFormatVersion,
 	}, nil
 }
 
-// Append adds an operation to the transaction log.
-func (t *LogEntryWriter) Append(entry LogEntry) error {
+// segmentFileName names a sealed segment after the last Version it holds, zero padded so that
+// segments sort by name in log order.
+func segmentFileName(lastVersion int) string {
+	return fmt.Sprintf("%s%020d%s", segmentPrefix, lastVersion, segmentSuffix)
+}
+
+// sealedSegments returns the paths of the sealed segments with their last Version, oldest first.
+func (t *LogEntryWriter) sealedSegments() ([]string, []int, error) {
+	return sealedSegments(filepath.Dir(t.logFilePath))
+}
+
+func sealedSegments(dir string) ([]string, []int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list log segments: %w", err)
+	}
+
+	var paths []string
+	var versions []int
+	for _, file := range files { // ReadDir sorts by name
+		name := file.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+		if err != nil {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+		versions = append(versions, version)
+	}
+	return paths, versions, nil
+}
+
+// Segments returns the paths of every segment in log order, the active one last.
+func (t *LogEntryWriter) Segments() ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	paths, _, err := t.sealedSegments()
+	if err != nil {
+		return nil, err
+	}
+	return append(paths, t.logFilePath), nil
+}
+
+// openSegmentAfter opens the oldest segment holding writes logged after version for reading, the
+// active one when no sealed segment does.
+func (t *LogEntryWriter) openSegmentAfter(version int) (*os.File, error) {
+	// holding t.mu keeps the active segment from being sealed between the listing and the open
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	paths, versions, err := t.sealedSegments()
+	if err != nil {
+		return nil, err
+	}
+	path := t.logFilePath
+	for i, lastVersion := range versions {
+		if lastVersion > version {
+			path = paths[i]
+			break
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open commit log: %w", err)
+	}
+	return file, nil
+}
+
+// isSealed tells whether a segment opened for reading is no longer the active one.
+func (t *LogEntryWriter) isSealed(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat commit log: %w", err)
+	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	active, err := t.logFile.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat commit log: %w", err)
+	}
+	return !os.SameFile(info, active), nil
+}
 
-	// Format log entry as a string with timestamp and arguments
-	logLine := fmt.Sprintf("%d %d %s %s\n",
-		entry.Timestamp, entry.Version, entry.Operation, strings.Join(entry.Args, " "))
+// rotateLocked seals the active segment and starts a new one, the caller must hold t.mu.
+func (t *LogEntryWriter) rotateLocked() error {
+	if err := t.logFile.Sync(); err != nil {
+		return fmt.Errorf("failed to flush log file: %w", err)
+	}
+	t.syncCount.Add(1)
+	t.markSynced(t.appended)
+	if err := t.logFile.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	sealedPath := filepath.Join(filepath.Dir(t.logFilePath), segmentFileName(t.lastVersion))
+	if err := os.Rename(t.logFilePath, sealedPath); err != nil {
+		return fmt.Errorf("failed to seal log segment: %w", err)
+	}
 
-	if _, err := t.logFile.Write([]byte(logLine)); err != nil {
-		return fmt.Errorf("failed to write log buffer to file: %w", err)
+	file, size, err := openLogFile(t.logFilePath)
+	if err != nil {
+		return err
+	}
+	t.logFile = file
+	t.size = size
+	return nil
+}
+
+// upgradeFormatLocked makes the active segment use the current format before entry is appended,
+// the caller must hold t.mu. A segment holding records is sealed, an empty one is recreated.
+func (t *LogEntryWriter) upgradeFormatLocked(entry LogEntry) error {
+	t.oldFormat = false
+	if t.size > int64(logHeaderSize) {
+		// the Versions of the sealed records are all below the one of entry
+		t.lastVersion = entry.Version - 1
+		return t.rotateLocked()
 	}
 
-	for _, sub := range t.subscribers {
-		select {
-		case sub <- entry:
-		default:
-			// Optionally: log or drop if full
-			return fmt.Errorf("channel full buffer is full dropped")
+	if err := t.logFile.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	if err := os.Remove(t.logFilePath); err != nil {
+		return fmt.Errorf("failed to replace log file: %w", err)
+	}
+	file, size, err := openLogFile(t.logFilePath)
+	if err != nil {
+		return err
+	}
+	t.logFile = file
+	t.size = size
+	return nil
+}
+
+// TruncateBefore deletes the sealed segments holding only entries up to version, once a
+// snapshot covers them.
+func (t *LogEntryWriter) TruncateBefore(version int) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	paths, versions, err := t.sealedSegments()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for i, path := range paths {
+		if versions[i] > version {
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove log segment: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// openLogFile opens a segment for appending, writing the format header into a new one, and
+// returns its size.
+func openLogFile(filePath string) (*os.File, int64, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		n, err := file.Write(logHeader(logFormatVersion))
+		if err != nil {
+			_ = file.Close()
+			return nil, 0, fmt.Errorf("failed to write log header: %w", err)
+		}
+		size = int64(n)
+	}
+	return file, size, nil
+}
+
+// formatLogLine formats a log entry as a string with timestamp and arguments, the origin and args
+// are quoted so that values with spaces, newlines or binary data stay on a single line
+func formatLogLine(entry LogEntry) string {
+	return fmt.Sprintf("%d %d %d %s %s %s",
+		entry.Timestamp, entry.Version, entry.Term, utils.QuoteArg(entry.Origin), entry.Operation, utils.JoinArgs(entry.Args))
+}
+
+// Append adds an operation to the transaction log. It returns the sequence number of the record,
+// to be passed to WaitDurable.
+func (t *LogEntryWriter) Append(entry LogEntry) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.oldFormat {
+		if err := t.upgradeFormatLocked(entry); err != nil {
+			return 0, err
+		}
+	}
+	n, err := t.logFile.Write(encodeRecord(entry))
+	if err != nil {
+		return 0, fmt.Errorf("failed to write log buffer to file: %w", err)
+	}
+	t.size += int64(n)
+	t.appended++
+	t.lastVersion = entry.Version
+	if t.segmentSize > 0 && t.size >= t.segmentSize {
+		if err := t.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return t.appended, nil
+}
+
+// Rewrite atomically replaces the whole log, sealed segments included, with entries.
+func (t *LogEntryWriter) Rewrite(entries []LogEntry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tmpPath := t.logFilePath + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %w", err)
+	}
+	_, err = tmpFile.Write(logHeader(logFormatVersion))
+	for _, entry := range entries {
+		if err != nil {
+			break
+		}
+		_, err = tmpFile.Write(encodeRecord(entry))
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rewrite log file: %w", err)
+	}
+
+	if err := t.logFile.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	if err := os.Rename(tmpPath, t.logFilePath); err != nil {
+		return fmt.Errorf("failed to replace log file: %w", err)
+	}
+	t.logFile, t.size, err = openLogFile(t.logFilePath)
+	if err != nil {
+		return err
+	}
+	t.oldFormat = false
+
+	sealed, _, err := t.sealedSegments()
+	if err != nil {
+		return err
+	}
+	for _, path := range sealed {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove log segment: %w", err)
 		}
 	}
 	return nil
 }
 
+// truncate cuts a segment at offset, dropping a torn or corrupt tail found by recovery.
+func (t *LogEntryWriter) truncate(path string, offset int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset < int64(logHeaderSize) {
+		// nothing valid is left, not even the header
+		if err := writeFileSync(path, logHeader(logFormatVersion)); err != nil {
+			return err
+		}
+		offset = int64(logHeaderSize)
+		if path == t.logFilePath {
+			t.oldFormat = false
+		}
+	} else if err := os.Truncate(path, offset); err != nil {
+		return fmt.Errorf("failed to truncate commit log: %w", err)
+	}
+	if path == t.logFilePath {
+		t.size = offset
+	}
+	return nil
+}
+
 // Close releases resources related to the log file.
 func (t *LogEntryWriter) Close() error {
 	return t.logFile.Close()
@@ -73,12 +366,87 @@ func (t *LogEntryWriter) Flush() error {
 	if err := t.logFile.Sync(); err != nil {
 		return fmt.Errorf("failed to flush log file: %w", err)
 	}
+	t.syncCount.Add(1)
+	t.markSynced(t.appended)
+
+	return nil
+}
+
+// WaitDurable returns once the record with sequence number seq is fsynced. Appends are not
+// blocked while the fsync runs, and a single fsync covers every record appended before it, so
+// concurrent writers end up sharing one fsync.
+func (t *LogEntryWriter) WaitDurable(seq uint64) error {
+	if t.synced.Load() >= seq {
+		return nil
+	}
+
+	t.syncMu.Lock()
+	defer t.syncMu.Unlock()
+	if t.synced.Load() >= seq {
+		return nil // covered by the fsync this writer was waiting on
+	}
 
+	t.mu.Lock()
+	file, target := t.logFile, t.appended
+	t.mu.Unlock()
+
+	if err := file.Sync(); err != nil {
+		if !errors.Is(err, os.ErrClosed) {
+			return fmt.Errorf("failed to flush log file: %w", err)
+		}
+		// the segment was sealed meanwhile, rotation fsyncs it before closing
+	}
+	t.syncCount.Add(1)
+	t.markSynced(target)
 	return nil
 }
 
-func (t *LogEntryWriter) Subscribe() <-chan LogEntry {
-	ch := make(chan LogEntry, 100)
-	t.subscribers = append(t.subscribers, ch)
-	return ch
+func (t *LogEntryWriter) markSynced(seq uint64) {
+	for {
+		synced := t.synced.Load()
+		if synced >= seq || t.synced.CompareAndSwap(synced, seq) {
+			return
+		}
+	}
+}
+
+// LastSeq returns the sequence number of the last appended record.
+func (t *LogEntryWriter) LastSeq() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.appended
+}
+
+// SyncCount returns how many fsyncs were issued on the commit log.
+func (t *LogEntryWriter) SyncCount() uint64 {
+	return t.syncCount.Load()
+}
+
+// migrateTextSegments converts the segments of a commit log written in the text format into
+// framed records, returning how many entries were migrated.
+func migrateTextSegments(logFilePath string) (int, error) {
+	paths, _, err := sealedSegments(filepath.Dir(logFilePath))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(logFilePath); err == nil {
+		paths = append(paths, logFilePath)
+	}
+
+	migrated := 0
+	for _, path := range paths {
+		legacy, err := isLegacyTextLog(path)
+		if err != nil {
+			return migrated, err
+		}
+		if !legacy {
+			continue
+		}
+		count, err := migrateTextLog(path)
+		if err != nil {
+			return migrated, err
+		}
+		migrated += count
+	}
+	return migrated, nil
 }
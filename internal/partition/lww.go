@@ -0,0 +1,169 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"creek/internal/datastore"
+	"creek/internal/replication"
+	"strconv"
+	"time"
+)
+
+// supersedes reports whether a replicated write made at timestamp wins over the current entry of
+// its key under last-writer-wins, tombstones included. Writes made at the same timestamp on
+// different nodes are ordered like Cassandra does, a delete wins over a set and the greater value
+// wins between two sets, so every node keeps the same one. A write that changes nothing, like
+// expiring a deleted key or a delete received again, never wins so that it is not forwarded again.
+// The caller must hold p.mu.
+func (p *Partition) supersedes(operation string, args []string, timestamp int64) bool {
+	entry, exists := p.ds.Lookup(args[0])
+	switch operation {
+	case commons.CmdDataSet:
+		if exists && entry.Deleted {
+			return timestamp > entry.Timestamp
+		}
+		return !exists || timestamp > entry.Timestamp || (timestamp == entry.Timestamp && args[1] > entry.Value)
+	case commons.CmdDataDel:
+		if exists && entry.Deleted {
+			return timestamp > entry.Timestamp
+		}
+		// the tombstone of a key never seen here still wins over an older set received later
+		return !exists || timestamp >= entry.Timestamp
+	case commons.CmdDataEXP:
+		return exists && !entry.Deleted && timestamp > entry.Timestamp
+	default:
+		return false
+	}
+}
+
+// winningArgs returns the args of a replicated write reduced to the keys it wins, see supersedes,
+// or nil when it wins none. The caller must hold p.mu.
+func (p *Partition) winningArgs(operation string, args []string, timestamp int64) []string {
+	var winning []string
+	switch operation {
+	case commons.CmdDataMSet:
+		for i := 0; i+1 < len(args); i += 2 {
+			if p.supersedes(commons.CmdDataSet, args[i:i+2], timestamp) {
+				winning = append(winning, args[i], args[i+1])
+			}
+		}
+	case commons.CmdDataMDel:
+		for i := range args {
+			if p.supersedes(commons.CmdDataDel, args[i:i+1], timestamp) {
+				winning = append(winning, args[i])
+			}
+		}
+	default:
+		if p.supersedes(operation, args, timestamp) {
+			winning = args
+		}
+	}
+	return winning
+}
+
+// processMultiMasterCmd applies a write replicated by another multi-master node when it wins over
+// the local state. The write is logged under a local Version with its original timestamp, which
+// forwards it to the other peers in turn. Every node applies a write at most once, so the writes
+// echoed back by peers are dropped.
+func (p *Partition) processMultiMasterCmd(cmd *replication.RepCmd) error {
+	p.clock.Observe(cmd.Timestamp)
+	if cmd.Operation == commons.CmdDataLoad {
+		return p.mergeSnapshot(cmd)
+	}
+
+	p.mu.Lock()
+	args := p.winningArgs(cmd.Operation, cmd.Args, cmd.Timestamp)
+	if cmd.Version <= p.peerVersions[cmd.Origin] || args == nil {
+		p.peerVersions[cmd.Origin] = max(p.peerVersions[cmd.Origin], cmd.Version)
+		seq := p.lw.LastSeq()
+		p.mu.Unlock()
+		return p.waitDurable(seq)
+	}
+	p.Version++
+	entry := LogEntry{
+		Timestamp: cmd.Timestamp,
+		Version:   p.Version,
+		Origin:    cmd.WriteOrigin(),
+		Operation: cmd.Operation,
+		Args:      args,
+	}
+	seq, err := p.appendAndApply(entry)
+	if err == nil {
+		p.peerVersions[cmd.Origin] = cmd.Version
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return p.waitDurable(seq)
+}
+
+// mergeSnapshot merges the snapshot of another multi-master node key by key, every key keeps the
+// write that wins under last-writer-wins. Merged keys are logged as SETs and tombstones as DELETEs.
+func (p *Partition) mergeSnapshot(cmd *replication.RepCmd) error {
+	entries, err := snapshotEntriesFromArgs(cmd.Args)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if cmd.Version <= p.peerVersions[cmd.Origin] {
+		p.mu.Unlock()
+		return nil
+	}
+	now := time.Now().UnixMilli()
+	var seq uint64
+	merged := 0
+	for key, snapEntry := range entries {
+		p.clock.Observe(snapEntry.Timestamp)
+		operation, args, ok := entryWrite(key, snapEntry, now)
+		if !ok || !p.supersedes(operation, args, snapEntry.Timestamp) {
+			continue
+		}
+		p.Version++
+		seq, err = p.appendAndApply(LogEntry{
+			Timestamp: snapEntry.Timestamp,
+			Version:   p.Version,
+			Origin:    snapEntry.Origin,
+			Operation: operation,
+			Args:      args,
+		})
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		merged++
+	}
+	p.peerVersions[cmd.Origin] = cmd.Version
+	p.mu.Unlock()
+
+	p.log.Infof("Partition %d: merged %d of %d keys from the snapshot of %s", p.Id, merged, len(entries), cmd.Origin)
+	return p.waitDurable(seq)
+}
+
+// entryWrite returns the write recreating the entry of a key taken from another node, a SET or the
+// DELETE of a tombstone. ok is false for a key that expired as of now (Unix ms).
+func entryWrite(key string, entry datastore.Entry, now int64) (operation string, args []string, ok bool) {
+	if entry.Deleted {
+		return commons.CmdDataDel, []string{key}, true
+	}
+	if entry.Expiration <= 0 {
+		return commons.CmdDataSet, []string{key, entry.Value, "-1"}, true
+	}
+	if entry.Expiration <= now {
+		return "", nil, false
+	}
+	// a TTL in whole seconds would move the expiration, every node must keep the same entry
+	return commons.CmdDataSet, []string{key, entry.Value, commons.SetPXAT, strconv.FormatInt(entry.Expiration, 10)}, true
+}
+
+// ReplicatedVersion returns the Version of the last write this node applied from origin. A
+// follower applies the Versions of its leader, while multi-master nodes number their writes
+// independently and track the Version reached by every peer.
+func (p *Partition) ReplicatedVersion(origin string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.multiMaster {
+		return p.Version
+	}
+	return p.peerVersions[origin]
+}
@@ -0,0 +1,76 @@
+package partition
+
+import (
+	"creek/internal/datastore"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+)
+
+// merkleDepth is the depth of the Merkle tree of a partition, its leaves are the digests of the
+// datastore, see datastore.Digests.
+const merkleDepth = datastore.DigestBits
+const merkleLeafCount = 1 << merkleDepth
+
+// merkleTree holds the hashes of the nodes of every level, the root being level 0 and the node i
+// of a level having the nodes 2i and 2i+1 of the next level as children. A leaf combines the
+// hashes of the entries under it independently of their order, so the tree only depends on the
+// content of the partition.
+type merkleTree [][]uint64
+
+// buildMerkleTree hashes the levels above the leaves, the datastore keeps the leaves up to date
+// on every write.
+func buildMerkleTree(leaves []uint64) merkleTree {
+	tree := make(merkleTree, merkleDepth+1)
+	tree[merkleDepth] = leaves
+	for level := merkleDepth - 1; level >= 0; level-- {
+		children := tree[level+1]
+		nodes := make([]uint64, len(children)/2)
+		for i := range nodes {
+			nodes[i] = hashChildren(children[2*i], children[2*i+1])
+		}
+		tree[level] = nodes
+	}
+	return tree
+}
+
+// hashes returns the hashes of nodes at a level of the tree.
+func (t merkleTree) hashes(level int, nodes []int) ([]uint64, error) {
+	if level < 0 || level > merkleDepth {
+		return nil, fmt.Errorf("invalid merkle tree level %d", level)
+	}
+	hashes := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		if node < 0 || node >= len(t[level]) {
+			return nil, fmt.Errorf("invalid merkle tree node %d at level %d", node, level)
+		}
+		hashes[i] = t[level][node]
+	}
+	return hashes, nil
+}
+
+func hashChildren(left, right uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], left)
+	binary.BigEndian.PutUint64(buf[8:], right)
+	h := fnv.New64a()
+	_, _ = h.Write(buf[:])
+	return h.Sum64()
+}
+
+// MerkleHashes returns the hashes of nodes at a level of the Merkle tree of the partition, tombstones
+// included. It answers the REP MERKLE requests of peers repairing their copy.
+func (p *Partition) MerkleHashes(level int, nodes []int) ([]uint64, error) {
+	return buildMerkleTree(p.ds.Digests()).hashes(level, nodes)
+}
+
+// RangeEntries returns the entries of the keys under leaves of the Merkle tree, encoded like the
+// args of a LOAD command.
+func (p *Partition) RangeEntries(leaves []int) ([]string, error) {
+	for _, leaf := range leaves {
+		if leaf < 0 || leaf >= merkleLeafCount {
+			return nil, fmt.Errorf("invalid merkle tree leaf %d", leaf)
+		}
+	}
+	return snapshotArgs(p.ds.RangeEntries(leaves)), nil
+}
@@ -0,0 +1,33 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"fmt"
+)
+
+// BeginImport makes a partition follow the node it is migrated from, which streams it a snapshot
+// then its writes under its own Versions. Only a partition that never took a write can be imported,
+// unless it is already being imported and the migration resumes from the Version it reached.
+func (p *Partition) BeginImport() error {
+	if p.raft != nil || p.multiMaster {
+		return fmt.Errorf("partition %d does not have a single static leader to migrate to", p.Id)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Mode() == commons.Leader && p.Version > 0 {
+		return fmt.Errorf("partition %d already holds %d writes", p.Id, p.Version)
+	}
+	p.setMode(commons.Follower)
+	return nil
+}
+
+// EndImport makes this node lead an imported partition, its writes continue from the last
+// Version streamed by the node it was migrated from.
+func (p *Partition) EndImport() {
+	p.setMode(commons.Leader)
+	p.startGC()
+	if p.replicator != nil {
+		// the followers of this node get the imported writes from the commit log
+		p.replicator.NotifyAppended(p.Id, p.AppliedVersion())
+	}
+}
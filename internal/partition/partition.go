@@ -4,16 +4,26 @@ import (
 	"creek/internal/commons"
 	"creek/internal/config"
 	"creek/internal/datastore"
+	"creek/internal/hlc"
 	"creek/internal/logger"
+	"creek/internal/raft"
 	"creek/internal/replication"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 )
 
-type RepCmdWriteHandler func(cmd *replication.RepCmd) error
+// Replicator streams the commit log of the partitions this node leads to their followers.
+type Replicator interface {
+	// NotifyAppended tells that a write of a partition was logged, it must not block.
+	NotifyAppended(partitionId, version int)
+	// WaitForFollowers holds a write back while a follower lags too far behind it.
+	WaitForFollowers(partitionId, version int)
+}
 
 type Partition struct {
 	Id         int
@@ -23,95 +33,182 @@ type Partition struct {
 	ds *datastore.DataStore
 	mu sync.Mutex
 
-	PartitionMode commons.PartitionMode
+	PartitionMode commons.PartitionMode // read through Mode, raft changes it at runtime
 	WriteMode     commons.WriteConsistencyMode
+	fsyncPolicy   commons.FsyncPolicy
+	modeMu        sync.RWMutex
 
 	Version int
+	clock   *hlc.Clock // timestamps of local writes, multi-master conflicts are resolved on them
 
-	log *logrus.Logger
+	multiMaster  bool           // every node accepts writes, see config.IsMultiMaster
+	peerVersions map[string]int // multi-master only: Version of the last write applied from each peer, guarded by mu
 
-	writeChan   chan *replication.RepCmd
-	stopLWFlush chan struct{}
-	stopGC      chan struct{}
-}
+	log  *logrus.Logger
+	conf *config.Config
 
-func (p *Partition) SendWriteCommand(cmd *replication.RepCmd) {
-	cmd.PartitionId = p.Id
+	acks          *ackTracker
+	requiredAcks  int // follower acks a strong write waits for, the leader itself is not counted
+	quorumTimeout time.Duration
 
-	select {
-	case p.writeChan <- cmd:
-		// Successfully written
-	case <-time.After(1 * time.Second): // Timeout after 1 second
-		logrus.Error("WriteCommand timed out: channel full")
-	}
+	snapMu          sync.Mutex // held while a snapshot is written or the log is read for a follower
+	snapshotVersion int        // Version of the latest snapshot, guarded by snapMu
+
+	raft             *raft.Raft // nil unless leadership is elected through raft
+	raftTransport    raft.Transport
+	raftWriteTimeout time.Duration
+	raftMu           sync.RWMutex // held exclusively while an update computes its write, see update
+	raftApplied      int          // index of the last raft entry applied to the datastore, guarded by mu
+	raftAppliedTerm  int
+
+	antiEntropy AntiEntropyTransport // fetches the Merkle trees and entries of peers, see Repair
+	repaired    repairCounters
+
+	replicator Replicator // streams the logged writes of a leader, see AttachReplicator
+
+	stopLWFlush   chan struct{}
+	stopGC        chan struct{}
+	gcOnce        sync.Once // a partition imported from another node starts collecting once it leads
+	stopSnapshots chan struct{}
+}
+
+// Dir returns the directory holding the commit log of a partition.
+func Dir(cfg *config.Config, id int) string {
+	return filepath.Join(cfg.DataStoreDirectory, fmt.Sprintf("partition_%d", id))
 }
 
 // NewPartition initializes a Partition with a custom handler for processing commands.
 func NewPartition(id int, nodeId string, cfg *config.Config, ds *datastore.DataStore) (*Partition, error) {
-	logFileName := "commit.log"
-	logFilePath := cfg.DataStoreDirectory + "/" + logFileName
-	writer, err := newLogEntryWriter(logFilePath)
+	dir := Dir(cfg, id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create partition directory: %w", err)
+	}
+
+	log := logger.CreateLogger(cfg.LogLevel)
+	logFilePath := filepath.Join(dir, LogFileName)
+	migrated, err := migrateTextSegments(logFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate commit log: %w", err)
+	}
+	if migrated > 0 {
+		log.Infof("Partition %d: migrated %d commit log entries to the checksummed format", id, migrated)
+	}
+	writer, err := newLogEntryWriter(logFilePath, cfg.LogSegmentSize)
 	if err != nil {
 		return nil, err
 	}
 
+	mode := cfg.ServerMode
+	if cfg.ElectionMode == commons.RaftElection {
+		// every partition starts as a follower until an election is won
+		mode = commons.Follower
+	} else if cfg.IsMultiMaster() {
+		// every multi-master node leads its own writes
+		mode = commons.Leader
+	}
+
 	p := &Partition{
 		Id:            id,
 		SelfNodeId:    nodeId,
 		lw:            writer, // Assume LogEntryWriter is initialized elsewhere
 		ds:            ds,
-		PartitionMode: cfg.ServerMode,
-		log:           logger.CreateLogger(cfg.LogLevel),
+		PartitionMode: mode,
+		log:           log,
+		conf:          cfg,
+		acks:          newAckTracker(),
+		requiredAcks:  cfg.WriteQuorumSize() - 1,
+		quorumTimeout: cfg.WriteQuorumTimeoutOrDefault(),
 		Version:       0,
-		writeChan:     make(chan *replication.RepCmd, 100), // Buffered channel for async writes
+		clock:         hlc.NewClock(),
+		multiMaster:   cfg.IsMultiMaster(),
+		peerVersions:  make(map[string]int),
 		WriteMode:     cfg.WriteConsistencyMode,
+		fsyncPolicy:   cfg.EffectiveFsyncPolicy(),
 		stopLWFlush:   make(chan struct{}),
 		stopGC:        make(chan struct{}),
+		stopSnapshots: make(chan struct{}),
 	}
 
 	return p, nil
 }
 
 func (p *Partition) Start() error {
+	if p.conf.ElectionMode == commons.RaftElection {
+		err := p.startRaft()
+		if err != nil {
+			return err
+		}
+		p.startGC() // only the current leader collects expired keys, see cleanExpiredKeys
+		return nil
+	}
+
 	err := p.recoverOnStart()
 	if err != nil {
 		return err
 	}
 	p.startLWFlush()
+	p.startSnapshots()
 	if p.PartitionMode == commons.Leader {
 		p.startGC() // Start garbage collection only in leader mode. followers will receive expire deletes from leader
-		go p.replicateFromLog(p.lw.Subscribe())
 	}
 	return nil
 }
 
-func (p *Partition) AttachRepCmdWriteHandler(handler RepCmdWriteHandler) {
-	go p.listenForWrites(handler)
+// AttachRaftTransport sets how raft RPCs reach peers, it must be called before Start.
+func (p *Partition) AttachRaftTransport(transport raft.Transport) {
+	p.raftTransport = transport
 }
 
-// listenForWrites listens for commands and delegates handling to the provided function.
-func (p *Partition) listenForWrites(handler RepCmdWriteHandler) {
-	for cmd := range p.writeChan {
-		err := handler(cmd)
-		if err != nil {
-			p.log.Errorf("Error handling rep write command: %v", err)
-			continue
-		}
-	}
+// Mode returns whether this node currently leads or follows the partition.
+func (p *Partition) Mode() commons.PartitionMode {
+	p.modeMu.RLock()
+	defer p.modeMu.RUnlock()
+	return p.PartitionMode
+}
+
+func (p *Partition) setMode(mode commons.PartitionMode) {
+	p.modeMu.Lock()
+	defer p.modeMu.Unlock()
+	p.PartitionMode = mode
+}
+
+// AppliedVersion returns the Version of the last write applied to the partition.
+func (p *Partition) AppliedVersion() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Version
+}
+
+func (p *Partition) setVersion(version int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Version = version
+}
+
+// AttachReplicator sets what streams the writes of the partition to its followers once logged,
+// it must be called before the partition accepts writes.
+func (p *Partition) AttachReplicator(replicator Replicator) {
+	p.replicator = replicator
 }
 
 // StopPartition ensures graceful shutdown.
 func (p *Partition) StopPartition() error {
+	if p.raft != nil {
+		p.raft.Stop()
+	}
 	p.ds.Stop()
 	close(p.stopLWFlush)
 	close(p.stopGC)
-	close(p.writeChan)
+	close(p.stopSnapshots)
 	return p.lw.Close()
 }
 
 func (p *Partition) startLWFlush() {
+	if p.fsyncPolicy != commons.FsyncInterval {
+		return
+	}
 	go func() {
-		ticker := time.NewTicker(5 * time.Second) // Adjust interval as needed
+		ticker := time.NewTicker(p.conf.FsyncIntervalOrDefault())
 		defer ticker.Stop()
 
 		for {
@@ -131,28 +228,65 @@ func (p *Partition) startLWFlush() {
 }
 
 func (p *Partition) startGC() {
-	go func() {
-		ticker := time.NewTicker(10 * time.Second) // Adjust interval as needed
-		defer ticker.Stop()
+	p.gcOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(p.conf.GCIntervalOrDefault())
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					p.cleanExpiredKeys()
+					p.purgeTombstones()
+				case <-p.stopGC:
+					p.log.Info("Stopping datastore garbage collection...")
+					return
+				}
+			}
+		}()
+	})
+}
 
-		for {
-			select {
-			case <-ticker.C:
-				p.cleanExpiredKeys()
-			case <-p.stopGC:
-				p.log.Info("Stopping datastore garbage collection...")
+// purgeTombstones drops the tombstones older than the grace period, every node does so on its own
+// and nothing is logged. Replaying the log after a restart recreates them until the next purge.
+func (p *Partition) purgeTombstones() {
+	before := time.Now().Add(-p.conf.TombstoneGCGraceOrDefault()).UnixNano()
+	if purged := p.ds.PurgeTombstones(before); purged > 0 {
+		p.log.Debugf("Partition %d: purged %d tombstones", p.Id, purged)
+	}
+}
+
+func (p *Partition) cleanExpiredKeys() {
+	if p.raft != nil {
+		if !p.raft.IsLeader() {
+			return
+		}
+		// the expired keys are read once every write is applied and their deletes are proposed
+		// before any other write, so a key written again meanwhile is never deleted. Deletes are
+		// replicated like any write, there is no need to wait for them to commit
+		p.raftMu.Lock()
+		defer p.raftMu.Unlock()
+		if err := p.raft.WaitCaughtUp(p.raftWriteTimeout); err != nil {
+			return
+		}
+		for _, key := range p.ds.GetExpiredKeys() {
+			if _, _, err := p.raft.Propose(commons.CmdDataDel, []string{key}, time.Now().UnixNano()); err != nil {
+				p.log.Warnf("Error deleting expired key: %v", err)
 				return
 			}
 		}
-	}()
-}
+		return
+	}
 
-func (p *Partition) cleanExpiredKeys() {
+	if p.Mode() != commons.Leader {
+		return // imported from another node, which deletes the keys expiring meanwhile
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	expiredKeys := p.ds.GetExpiredKeys()
 	for _, key := range expiredKeys {
-		err := p.deleteWithoutLock(key)
+		expired, _ := p.ds.Lookup(key)
+		err := p.deleteWithoutLock(key, expired)
 		if err != nil {
 			p.log.Warnf("Error deleting expired key: %v", err)
 			continue
@@ -161,99 +295,166 @@ func (p *Partition) cleanExpiredKeys() {
 }
 
 func (p *Partition) Set(key, value string, ttl int) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.Version++
-
-	entry := LogEntry{
-		Timestamp: time.Now().UnixNano(),
-		Version:   p.Version,
-		Operation: commons.CmdDataSet,
-		Args:      []string{key, value, fmt.Sprintf("%d", ttl)},
+	if p.raft != nil {
+		return p.proposeAndWait(commons.CmdDataSet, []string{key, value, strconv.Itoa(ttl)})
 	}
-
-	err := p.lw.Append(entry)
-	if err != nil {
-		return err
-	}
-	if p.WriteMode == commons.StrongConsistency {
-		err := p.lw.Flush()
-		if err != nil {
-			return err
-		}
-	}
-
-	p.ds.Set(key, value, ttl)
-	return nil
+	return p.write(commons.CmdDataSet, []string{key, value, strconv.Itoa(ttl)})
 }
 
 func (p *Partition) Get(key string) (string, error) {
-	return p.ds.Get(key), nil
+	value, found := p.ds.Get(key)
+	if !found {
+		return "", datastore.ErrKeyNotFound
+	}
+	return value, nil
 }
 
-func (p *Partition) Delete(key string) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	return p.deleteWithoutLock(key)
+// Delete deletes key and tells whether it held a value. The delete is logged either way, so that
+// its tombstone wins over older writes of the key received later.
+func (p *Partition) Delete(key string) (bool, error) {
+	var existed bool
+	_, err := p.update(commons.CmdDataDel, func(timestamp int64) ([]string, error) {
+		_, existed = p.ds.GetAt(key, timestamp/int64(time.Millisecond))
+		return []string{key}, nil
+	})
+	return existed, err
 }
 
-func (p *Partition) deleteWithoutLock(key string) error {
+// deleteWithoutLock logs the delete of an expired key. The delete is stamped with the expiration
+// rather than the time of the collection, so a write made after the key expired and before it was
+// collected, here or on a peer, still wins over it.
+func (p *Partition) deleteWithoutLock(key string, expired datastore.Entry) error {
 	p.Version++
 	entry := LogEntry{
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: max(expired.Expiration*int64(time.Millisecond), expired.Timestamp),
 		Version:   p.Version,
+		Origin:    p.SelfNodeId,
 		Operation: commons.CmdDataDel,
 		Args:      []string{key},
 	}
+	// expired keys are deleted in the background, nobody waits for the delete to be durable
+	_, err := p.appendAndApply(entry)
+	return err
+}
 
-	err := p.lw.Append(entry)
-	if err != nil {
-		return err
+// Expire sets the TTL of key and tells whether it held a value, the EXPIRE is logged either way
+// like a delete.
+func (p *Partition) Expire(key string, ttl int) (bool, error) {
+	var existed bool
+	_, err := p.update(commons.CmdDataEXP, func(timestamp int64) ([]string, error) {
+		_, existed = p.ds.GetAt(key, timestamp/int64(time.Millisecond))
+		return []string{key, strconv.Itoa(ttl)}, nil
+	})
+	return existed, err
+}
+
+func (p *Partition) TTL(key string) (int, error) {
+	return p.ds.TTL(key), nil
+}
+
+// KeyInfo returns the entry of a key with the stamp of the write that last changed it, the
+// tombstone of a deleted key until it is purged.
+func (p *Partition) KeyInfo(key string) (datastore.Entry, error) {
+	entry, exists := p.ds.Lookup(key)
+	if !exists {
+		return datastore.Entry{}, datastore.ErrKeyNotFound
 	}
-	if p.WriteMode == commons.StrongConsistency {
-		err := p.lw.Flush()
+	return entry, nil
+}
+
+// write logs and applies a local write under the partition lock. Without holding the lock it
+// then waits for the record to be durable, and in strong consistency for the write quorum.
+func (p *Partition) write(operation string, args []string) error {
+	_, err := p.update(operation, func(int64) ([]string, error) { return args, nil })
+	return err
+}
+
+// update is write with the arguments computed by compute from the state of the partition at the
+// timestamp of the write, no other write is applied in between. An error returned by compute
+// cancels the write. With raft the writes of the partition are proposed one at a time meanwhile,
+// and compute runs once every write committed before is applied.
+// It returns the Version the write was logged under.
+func (p *Partition) update(operation string, compute func(timestamp int64) ([]string, error)) (int, error) {
+	if p.raft != nil {
+		p.raftMu.Lock()
+		defer p.raftMu.Unlock()
+		// a new leader may not have applied the writes committed by the previous one yet
+		if err := p.raft.WaitCaughtUp(p.raftWriteTimeout); err != nil {
+			return 0, err
+		}
+		timestamp := time.Now().UnixNano()
+		args, err := compute(timestamp)
 		if err != nil {
-			return err
+			return 0, err
 		}
+		return p.propose(operation, args, timestamp)
 	}
-	p.ds.Delete(key)
 
-	return nil
-}
-
-func (p *Partition) Expire(key string, ttl int) error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	timestamp := p.clock.Now()
+	args, err := compute(timestamp)
+	if err != nil {
+		p.mu.Unlock()
+		return 0, err
+	}
 	p.Version++
-
 	entry := LogEntry{
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: timestamp,
 		Version:   p.Version,
-		Operation: commons.CmdDataEXP,
-		Args:      []string{key, strconv.Itoa(ttl)},
+		Origin:    p.SelfNodeId,
+		Operation: operation,
+		Args:      args,
+	}
+	seq, err := p.appendAndApply(entry)
+	p.mu.Unlock()
+	if err != nil {
+		return 0, err
 	}
+	if err := p.waitDurable(seq); err != nil {
+		return entry.Version, err
+	}
+	if p.replicator != nil && p.raft == nil {
+		p.replicator.WaitForFollowers(p.Id, entry.Version)
+	}
+
+	if p.WriteMode == commons.StrongConsistency && p.Mode() == commons.Leader {
+		return entry.Version, p.acks.wait(entry.Version, p.requiredAcks, p.quorumTimeout)
+	}
+	return entry.Version, nil
+}
 
-	err := p.lw.Append(entry)
+// appendAndApply logs an entry and applies it to the datastore, returning the sequence number
+// of its record. The caller must hold p.mu.
+func (p *Partition) appendAndApply(entry LogEntry) (uint64, error) {
+	seq, err := p.lw.Append(entry)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if p.WriteMode == commons.StrongConsistency {
-		err := p.lw.Flush()
-		if err != nil {
-			return err
-		}
+	if p.replicator != nil && p.raft == nil && p.Mode() == commons.Leader {
+		// followers read the entry back from the commit log
+		p.replicator.NotifyAppended(p.Id, entry.Version)
 	}
-	p.ds.Expire(key, ttl)
 
-	return nil
+	p.processLogEntry(entry)
+	return seq, nil
 }
 
-func (p *Partition) TTL(key string) (int, error) {
-	return p.ds.TTL(key), nil
+// waitDurable blocks until a record is fsynced when the fsync policy is FsyncAlways. It must be
+// called without holding p.mu, so that concurrent writes are grouped into a single fsync.
+func (p *Partition) waitDurable(seq uint64) error {
+	if p.fsyncPolicy != commons.FsyncAlways {
+		return nil
+	}
+	return p.lw.WaitDurable(seq)
 }
 
+// ProcessRepCmd applies a write streamed by the leader, keeping the leader's Version so the
+// follower can acknowledge it. Multi-master nodes resolve it against their own writes instead.
 func (p *Partition) ProcessRepCmd(cmd *replication.RepCmd) error {
-	if p.PartitionMode == commons.Leader {
+	if p.raft != nil {
+		return fmt.Errorf("partition replicates through raft and does not accept replication commands")
+	}
+	if p.Mode() == commons.Leader && !p.multiMaster {
 		return fmt.Errorf("partition is not in follower mode to accept replication commands")
 	}
 
@@ -262,49 +463,105 @@ func (p *Partition) ProcessRepCmd(cmd *replication.RepCmd) error {
 		if len(cmd.Args) < 2 {
 			return fmt.Errorf("invalid args in rep command: %s", cmd.String())
 		}
-		key, value := cmd.Args[0], cmd.Args[1]
-		ttl := -1
-		if len(cmd.Args) > 2 {
-			parsedTTL, err := strconv.Atoi(cmd.Args[2])
-			if err == nil {
-				ttl = parsedTTL
-			}
-		}
-		return p.Set(key, value, ttl)
 
-	case commons.CmdDataDel:
+	case commons.CmdDataDel, commons.CmdDataMDel:
 		if len(cmd.Args) < 1 {
 			return fmt.Errorf("invalid args in rep command: %s", cmd.String())
 		}
-		return p.Delete(cmd.Args[0])
+
+	case commons.CmdDataMSet:
+		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+			return fmt.Errorf("invalid args in rep command: %s", cmd.String())
+		}
 
 	case commons.CmdDataEXP:
 		if len(cmd.Args) < 2 {
 			return fmt.Errorf("invalid args in rep command: %s", cmd.String())
 		}
-		key := cmd.Args[0]
-		ttl, err := strconv.Atoi(cmd.Args[1])
-		if err != nil {
+		if _, err := strconv.Atoi(cmd.Args[1]); err != nil {
 			return fmt.Errorf("invalid args in rep command: %s", cmd.String())
 		}
-		return p.Expire(key, ttl)
+
+	case commons.CmdDataLoad:
+		if len(cmd.Args)%snapshotEntryFields != 0 {
+			return fmt.Errorf("invalid args in rep command: %s %d", cmd.Operation, cmd.Version)
+		}
 
 	default:
 		return fmt.Errorf("invalid operation in rep command: %s", cmd.String())
 	}
+
+	if p.multiMaster {
+		return p.processMultiMasterCmd(cmd)
+	}
+	if cmd.Operation == commons.CmdDataLoad {
+		return p.installSnapshot(cmd)
+	}
+
+	p.mu.Lock()
+	if cmd.Version <= p.Version {
+		// sent again while the leader caught this follower up, it is acknowledged once the
+		// record applied the first time is durable
+		seq := p.lw.LastSeq()
+		p.mu.Unlock()
+		return p.waitDurable(seq)
+	}
+	// the timestamp of the leader keeps the stamps of both nodes equal, which anti-entropy compares
+	entry := LogEntry{
+		Timestamp: cmd.Timestamp,
+		Version:   cmd.Version,
+		Origin:    cmd.WriteOrigin(),
+		Operation: cmd.Operation,
+		Args:      cmd.Args,
+	}
+	seq, err := p.appendAndApply(entry)
+	if err == nil {
+		p.Version = cmd.Version
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return p.waitDurable(seq)
+}
+
+// LogSyncCount returns how many fsyncs were issued on the commit log of the partition.
+func (p *Partition) LogSyncCount() uint64 {
+	return p.lw.SyncCount()
+}
+
+// RecordAck registers that a replica durably stored every write up to version.
+func (p *Partition) RecordAck(nodeId string, version int) {
+	p.acks.record(nodeId, version)
+}
+
+func (p *Partition) repCmdFromEntry(entry LogEntry) *replication.RepCmd {
+	return &replication.RepCmd{
+		Origin:      p.SelfNodeId,
+		Writer:      entry.Origin,
+		PartitionId: p.Id,
+		Timestamp:   entry.Timestamp,
+		Version:     entry.Version,
+		Operation:   entry.Operation,
+		Args:        entry.Args,
+	}
 }
 
-func (p *Partition) replicateFromLog(entries <-chan LogEntry) {
-	for entry := range entries {
-		repCmd := &replication.RepCmd{
-			Origin:      p.SelfNodeId,
-			PartitionId: p.Id,
-			Timestamp:   entry.Timestamp,
-			Version:     entry.Version,
-			Operation:   entry.Operation,
-			Args:        entry.Args,
+// Backlog reads the writes logged after version from the commit log. When some of them were
+// compacted away the latest snapshot comes first, as a LOAD command.
+func (p *Partition) Backlog(version int) ([]*replication.RepCmd, error) {
+	cursor := p.OpenCursor(version)
+	defer cursor.Close()
+
+	var cmds []*replication.RepCmd
+	for {
+		batch, err := cursor.Next(backlogBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return cmds, nil
 		}
-		// Send to quorum or replication service
-		p.SendWriteCommand(repCmd)
+		cmds = append(cmds, batch...)
 	}
 }
@@ -0,0 +1,71 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"sync"
+	"time"
+)
+
+// ackTracker remembers the highest Version each replica durably acknowledged. Followers apply
+// writes in order, so an ack for a version covers every earlier version as well.
+type ackTracker struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	acked map[string]int
+}
+
+func newAckTracker() *ackTracker {
+	t := &ackTracker{acked: make(map[string]int)}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+func (t *ackTracker) record(nodeId string, version int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if version > t.acked[nodeId] {
+		t.acked[nodeId] = version
+		t.cond.Broadcast()
+	}
+}
+
+// countLocked returns how many replicas acknowledged version.
+func (t *ackTracker) countLocked(version int) int {
+	count := 0
+	for _, acked := range t.acked {
+		if acked >= version {
+			count++
+		}
+	}
+	return count
+}
+
+// wait blocks until required replicas acknowledged version or the timeout expires.
+func (t *ackTracker) wait(version, required int, timeout time.Duration) error {
+	if required <= 0 {
+		return nil
+	}
+
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		timedOut = true
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		count := t.countLocked(version)
+		if count >= required {
+			return nil
+		}
+		if timedOut {
+			return commons.Errorf(commons.ErrCodeNoReplicas, "timed out waiting for write quorum: %d of %d replicas acknowledged version %d",
+				count, required, version)
+		}
+		t.cond.Wait()
+	}
+}
@@ -0,0 +1,296 @@
+package partition
+
+import (
+	"creek/internal/commons"
+	"creek/internal/raft"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// raftStorage lets raft use the commit log as its log and the datastore as its state machine.
+// The raft log index is the partition Version.
+type raftStorage struct {
+	p *Partition
+}
+
+func logEntryFromRaft(e raft.Entry) LogEntry {
+	return LogEntry{
+		Timestamp: e.Timestamp,
+		Version:   e.Index,
+		Term:      e.Term,
+		Operation: e.Operation,
+		Args:      e.Args,
+	}
+}
+
+func (s raftStorage) AppendEntries(entries []raft.Entry) error {
+	p := s.p
+	for _, e := range entries {
+		if _, err := p.lw.Append(logEntryFromRaft(e)); err != nil {
+			return err
+		}
+	}
+	// raft only counts an entry once it is durable
+	if err := p.lw.Flush(); err != nil {
+		return err
+	}
+	p.setVersion(entries[len(entries)-1].Index)
+	return nil
+}
+
+// ReplaceLog rewrites the log with the entries following the snapshot, which covers the entries
+// it drops.
+func (s raftStorage) ReplaceLog(entries []raft.Entry) error {
+	p := s.p
+	logEntries := make([]LogEntry, len(entries))
+	for i, e := range entries {
+		logEntries[i] = logEntryFromRaft(e)
+	}
+	if err := p.lw.Rewrite(logEntries); err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		p.setVersion(entries[len(entries)-1].Index)
+	} else {
+		p.setVersion(p.lastSnapshotVersion())
+	}
+	return nil
+}
+
+// Apply applies an entry under the partition lock, so a snapshot copies the datastore along with
+// the index of the last entry it holds.
+func (s raftStorage) Apply(entry raft.Entry) {
+	p := s.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processLogEntry(logEntryFromRaft(entry))
+	p.raftApplied, p.raftAppliedTerm = entry.Index, entry.Term
+}
+
+// Snapshot reads the latest snapshot from disk for a follower lagging behind it.
+func (s raftStorage) Snapshot() (raft.Snapshot, error) {
+	p := s.p
+	p.snapMu.Lock()
+	snap, err := readSnapshot(p.snapshotPath())
+	p.snapMu.Unlock()
+	if err != nil {
+		return raft.Snapshot{}, err
+	}
+	if snap == nil {
+		return raft.Snapshot{}, fmt.Errorf("partition %d has no snapshot", p.Id)
+	}
+	return raft.Snapshot{Index: snap.Version, Term: snap.Term, Timestamp: snap.Timestamp, Data: snapshotArgs(snap.Entries)}, nil
+}
+
+// InstallSnapshot replaces the datastore with a snapshot sent by the leader. The snapshot is saved
+// before the log is rewritten, so a crash in between still restarts from it.
+func (s raftStorage) InstallSnapshot(snap raft.Snapshot, entries []raft.Entry) error {
+	p := s.p
+	loaded, err := snapshotEntriesFromArgs(snap.Data)
+	if err != nil {
+		return err
+	}
+
+	// same lock order as Snapshot
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err = writeSnapshot(p.snapshotPath(), &snapshot{Version: snap.Index, Term: snap.Term, Timestamp: snap.Timestamp, Entries: loaded})
+	if err != nil {
+		return err
+	}
+	p.snapshotVersion = snap.Index
+
+	logEntries := make([]LogEntry, len(entries))
+	for i, e := range entries {
+		logEntries[i] = logEntryFromRaft(e)
+	}
+	if err := p.lw.Rewrite(logEntries); err != nil {
+		return err
+	}
+	p.ds.Load(loaded)
+	p.raftApplied, p.raftAppliedTerm = snap.Index, snap.Term
+	p.Version = snap.Index + len(entries)
+	p.log.Infof("Partition %d: installed snapshot of %d keys at index %d from the raft leader", p.Id, len(loaded), snap.Index)
+	return nil
+}
+
+// snapshotRaft is Snapshot with raft election. The snapshot covers the applied entries, raft then
+// drops them from its log before the log segments holding them are deleted.
+func (p *Partition) snapshotRaft() (int, error) {
+	if !p.snapMu.TryLock() {
+		return 0, ErrSnapshotInProgress
+	}
+	p.mu.Lock()
+	snap := &snapshot{Version: p.raftApplied, Term: p.raftAppliedTerm, Timestamp: time.Now().UnixNano()}
+	if snap.Version > p.snapshotVersion {
+		snap.Entries = p.ds.Entries()
+	}
+	p.mu.Unlock()
+	if snap.Entries == nil {
+		// nothing was applied since the latest snapshot
+		version := p.snapshotVersion
+		p.snapMu.Unlock()
+		return version, nil
+	}
+	err := writeSnapshot(p.snapshotPath(), snap)
+	if err == nil {
+		p.snapshotVersion = snap.Version
+	}
+	// raft installs snapshots from the leader under its own lock, which it takes before snapMu
+	p.snapMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	p.raft.Compact(snap.Version)
+	removed, err := p.lw.TruncateBefore(snap.Version)
+	if err != nil {
+		return 0, err
+	}
+	p.log.Infof("Partition %d: snapshot of %d keys at raft index %d, %d log segments removed",
+		p.Id, len(snap.Entries), snap.Version, removed)
+	return snap.Version, nil
+}
+
+// startRaft loads the latest snapshot and the commit log following it as the raft log, then
+// starts taking part in elections. Entries are numbered by their position after the snapshot,
+// which is their Version for any log written in raft mode.
+func (p *Partition) startRaft() error {
+	if p.raftTransport == nil {
+		return fmt.Errorf("partition %d: raft election requires a transport", p.Id)
+	}
+
+	snap, err := readSnapshot(p.snapshotPath())
+	if err != nil {
+		return err
+	}
+	snapIndex, snapTerm := 0, 0
+	if snap != nil {
+		p.ds.Load(snap.Entries)
+		snapIndex, snapTerm = snap.Version, snap.Term
+		p.snapshotVersion = snap.Version
+		p.raftApplied, p.raftAppliedTerm = snapIndex, snapTerm
+		p.log.Infof("Partition %d: loaded snapshot of %d keys at raft index %d", p.Id, len(snap.Entries), snapIndex)
+	}
+
+	var entries []raft.Entry
+	err = p.recoverLog(func(entry LogEntry, now int64) {
+		if entry.Version <= snapIndex {
+			return
+		}
+		entries = append(entries, raft.Entry{
+			Index:     snapIndex + len(entries) + 1,
+			Term:      entry.Term,
+			Timestamp: entry.Timestamp,
+			Operation: entry.Operation,
+			Args:      entry.Args,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	p.setVersion(snapIndex + len(entries))
+
+	electionTimeout, heartbeat := p.conf.RaftTimeouts()
+	r, err := raft.New(raft.Config{
+		PartitionId:       p.Id,
+		SelfId:            p.SelfNodeId,
+		Peers:             p.conf.PeerNodes,
+		StatePath:         filepath.Join(Dir(p.conf, p.Id), raft.StateFileName),
+		ElectionTimeout:   electionTimeout,
+		HeartbeatInterval: heartbeat,
+		Log:               p.log,
+		OnRoleChange: func(role raft.Role, leaderId string) {
+			if role == raft.Leader {
+				p.setMode(commons.Leader)
+			} else {
+				p.setMode(commons.Follower)
+			}
+		},
+	}, p.raftTransport, raftStorage{p: p}, snapIndex, snapTerm, entries)
+	if err != nil {
+		return err
+	}
+
+	p.raft = r
+	p.raftWriteTimeout = 5 * electionTimeout
+	r.Start()
+	p.startSnapshots()
+	return nil
+}
+
+// proposeAndWait replicates a write through raft and returns once a majority stored it and
+// it has been applied locally.
+func (p *Partition) proposeAndWait(operation string, args []string) error {
+	p.raftMu.RLock()
+	defer p.raftMu.RUnlock()
+	_, err := p.propose(operation, args, time.Now().UnixNano())
+	return err
+}
+
+// propose is proposeAndWait for a write made at timestamp, it returns the raft index of the write.
+// The caller must hold p.raftMu.
+func (p *Partition) propose(operation string, args []string, timestamp int64) (int, error) {
+	index, term, err := p.raft.Propose(operation, args, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	return index, p.raft.WaitApplied(index, term, p.raftWriteTimeout)
+}
+
+// RaftLeader returns the id, which is the client address, of the raft leader of the partition.
+// It is empty without raft election or while an election is running.
+func (p *Partition) RaftLeader() string {
+	if p.raft == nil {
+		return ""
+	}
+	return p.raft.LeaderId()
+}
+
+// HandleRaftRPC answers a RAFT system command sent by a peer for this partition.
+func (p *Partition) HandleRaftRPC(kind string, args []string) ([]int64, error) {
+	if p.raft == nil {
+		return nil, fmt.Errorf("raft election is not enabled on this node")
+	}
+
+	switch kind {
+	case commons.RaftRequestVote:
+		req, err := raft.ParseRequestVote(args)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.raft.HandleRequestVote(req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Ints(), nil
+
+	case commons.RaftAppendEntries:
+		req, err := raft.ParseAppendEntries(args)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.raft.HandleAppendEntries(req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Ints(), nil
+
+	case commons.RaftInstallSnapshot:
+		req, err := raft.ParseInstallSnapshot(args)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.raft.HandleInstallSnapshot(req)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Ints(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown raft command: %s", kind)
+	}
+}
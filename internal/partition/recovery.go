@@ -1,13 +1,14 @@
 package partition
 
 import (
-	"bufio"
 	"creek/internal/commons"
+	"creek/internal/datastore"
+	"creek/internal/utils"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -16,7 +17,59 @@ func (p *Partition) recoverOnStart() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	logFile, err := os.OpenFile(p.lw.logFilePath, os.O_RDONLY, 0644)
+	// the newest snapshot holds the state up to its Version, only the log after it is replayed
+	snap, err := readSnapshot(p.snapshotPath())
+	if err != nil {
+		return err
+	}
+	if snap != nil {
+		for _, entry := range snap.Entries {
+			p.clock.Observe(entry.Timestamp)
+		}
+		p.ds.Load(snap.Entries)
+		p.Version = snap.Version
+		p.snapshotVersion = snap.Version
+		p.log.Infof("Partition %d: loaded snapshot of %d keys at version %d", p.Id, len(snap.Entries), snap.Version)
+	}
+
+	return p.recoverLog(func(entry LogEntry, now int64) {
+		// local writes must keep getting later timestamps even if the wall clock went back
+		p.clock.Observe(entry.Timestamp)
+		if entry.Version <= p.snapshotVersion {
+			return
+		}
+		p.processLogEntry(entry)
+		p.Version = entry.Version
+	})
+}
+
+// replayLog reads every segment of the commit log in order and hands every entry to handle.
+// It only reads, a torn record ends a segment and a corrupt one fails the replay.
+func (p *Partition) replayLog(handle func(entry LogEntry, now int64)) error {
+	return p.readLog(handle, false)
+}
+
+// recoverLog replays the commit log on start. A torn record at the end of a segment is
+// truncated, mid-file corruption refuses the start unless log_repair is set.
+func (p *Partition) recoverLog(handle func(entry LogEntry, now int64)) error {
+	return p.readLog(handle, true)
+}
+
+func (p *Partition) readLog(handle func(entry LogEntry, now int64), recovering bool) error {
+	segments, err := p.lw.Segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := p.replaySegment(segment, handle, recovering); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Partition) replaySegment(path string, handle func(entry LogEntry, now int64), recovering bool) error {
+	logFile, err := os.OpenFile(path, os.O_RDONLY, 0644)
 
 	if err != nil {
 		return fmt.Errorf("failed to open commit log: %w", err)
@@ -28,63 +81,121 @@ func (p *Partition) recoverOnStart() error {
 		}
 	}(logFile)
 
-	reader := bufio.NewReader(logFile)
+	reader, err := openSegment(logFile)
+	if err != nil {
+		return err
+	}
 	batchSize := 100 // Adjust based on available memory
 	var batch []string
 
 	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
+		payload, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			if recovering {
+				p.log.Warnf("Truncating torn record at offset %d of %s", reader.offset, path)
+				if err := p.lw.truncate(path, reader.offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if errors.Is(err, errCorruptRecord) {
+			if !recovering || !p.conf.LogRepair {
+				return fmt.Errorf("%w at offset %d of %s, start with log_repair = true to truncate it",
+					err, reader.offset, path)
 			}
+			p.log.Errorf("Repairing %s: truncating corrupt record at offset %d and everything after it", path, reader.offset)
+			if err := p.lw.truncate(path, reader.offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
 			return fmt.Errorf("error reading commit log: %w", err)
 		}
 
-		batch = append(batch, strings.TrimSpace(line))
+		batch = append(batch, string(payload))
 		if len(batch) >= batchSize {
-			p.processBatch(&batch)
+			p.processBatch(&batch, reader.version, handle)
 			batch = batch[:0] // Clear batch
 		}
 	}
 
 	// Process any remaining entries
 	if len(batch) > 0 {
-		p.processBatch(&batch)
+		p.processBatch(&batch, reader.version, handle)
 	}
 
 	return nil
 }
 
-func (p *Partition) processBatch(entries *[]string) {
+func (p *Partition) processBatch(entries *[]string, formatVersion uint16, handle func(entry LogEntry, now int64)) {
 	now := time.Now().UnixNano()
 
 	for _, line := range *entries {
-		parts := strings.Fields(line)
-		if len(parts) < 4 {
-			continue
-		}
-
-		timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+		entry, err := parseLogLine(line, formatVersion)
 		if err != nil {
 			p.log.Warnf("Skipping malformed log entry: %s", line)
 			continue
 		}
+		handle(entry, now)
+	}
+}
 
-		_, err = strconv.Atoi(parts[1])
-		if err != nil {
-			p.log.Warnf("Skipping malformed log entry: %s", line)
-		}
+// parseLogLine parses "timestamp version term origin operation args...". Lines of format version
+// 1 have no origin, and those written before raft was introduced have no term either, they are
+// recognized by a non-numeric third field.
+func parseLogLine(line string, formatVersion uint16) (LogEntry, error) {
+	parts, err := utils.SplitArgs(line)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	if len(parts) < 4 {
+		return LogEntry{}, fmt.Errorf("missing fields")
+	}
 
-		op := parts[2]
-		args := parts[3:]
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return LogEntry{}, err
+	}
 
-		p.processLogEntry(timestamp, op, args, now)
+	entry := LogEntry{Timestamp: timestamp, Version: version}
+	if formatVersion >= 2 {
+		if len(parts) < 5 {
+			return LogEntry{}, fmt.Errorf("missing fields")
+		}
+		if entry.Term, err = strconv.Atoi(parts[2]); err != nil {
+			return LogEntry{}, err
+		}
+		entry.Origin = parts[3]
+		entry.Operation = parts[4]
+		entry.Args = parts[5:]
+	} else if term, err := strconv.Atoi(parts[2]); err == nil {
+		entry.Term = term
+		entry.Operation = parts[3]
+		entry.Args = parts[4:]
+	} else {
+		entry.Operation = parts[2]
+		entry.Args = parts[3:]
 	}
+	return entry, nil
 }
 
-func (p *Partition) processLogEntry(timestamp int64, operation string, args []string, now int64) {
-	switch operation {
+// processLogEntry applies an entry to the datastore, stamping the keys it changes. TTLs count from
+// the timestamp of the entry, a SET with SetPXAT expires when it says and one with SetKeepTTL keeps
+// the expiration the key had at that timestamp. A key already expired keeps its stamped entry until it is deleted like any expired
+// key, so that older writes received later still lose to it.
+func (p *Partition) processLogEntry(entry LogEntry) {
+	timestamp, args := entry.Timestamp, entry.Args
+	stamp := datastore.Stamp{Timestamp: entry.Timestamp, Version: entry.Version, Origin: entry.Origin}
+	switch entry.Operation {
 	case commons.CmdDataSet:
 		if len(args) < 2 {
 			return
@@ -97,17 +208,29 @@ func (p *Partition) processLogEntry(timestamp int64, operation string, args []st
 				ttl = parsedTTL
 			}
 		}
-		if ttl > 0 && (timestamp+int64(ttl)*int64(time.Second)) <= now {
-			p.ds.Delete(key)
-		} else {
-			p.ds.Set(key, value, ttl-(int(now-timestamp)/int(time.Second)))
+		expiration := datastore.ExpirationAt(timestamp, ttl)
+		if len(args) > 3 && args[2] == commons.SetPXAT {
+			if at, err := strconv.ParseInt(args[3], 10, 64); err == nil {
+				expiration = at
+			}
+		} else if len(args) > 2 && args[2] == commons.SetKeepTTL {
+			if current, live := p.ds.GetAt(key, timestamp/int64(time.Millisecond)); live {
+				expiration = current.Expiration
+			}
 		}
+		p.ds.SetAt(key, value, expiration, stamp)
 
 	case commons.CmdDataDel:
 		if len(args) < 1 {
 			return
 		}
-		p.ds.Delete(args[0])
+		p.ds.DeleteAt(args[0], stamp)
+
+	case commons.CmdDataMSet:
+		p.ds.SetManyAt(args, stamp)
+
+	case commons.CmdDataMDel:
+		p.ds.DeleteManyAt(args, stamp)
 
 	case commons.CmdDataEXP:
 		if len(args) < 2 {
@@ -116,11 +239,8 @@ func (p *Partition) processLogEntry(timestamp int64, operation string, args []st
 		key := args[0]
 		ttl, err := strconv.Atoi(args[1])
 		if err == nil {
-			if (timestamp + int64(ttl)*int64(time.Second)) <= now {
-				p.ds.Delete(key)
-			} else {
-				p.ds.Expire(key, ttl-(int(now-timestamp)/int(time.Second)))
-			}
+			// unlike for a SET, a TTL that is not positive expires the key at once
+			p.ds.ExpireAt(key, timestamp/int64(time.Millisecond)+int64(ttl)*1000, stamp)
 		}
 	}
 }
@@ -0,0 +1,22 @@
+package partition
+
+// Scan lists the keys of the partition a few at a time, see datastore.DataStore.Scan.
+func (p *Partition) Scan(from uint64, count int) (keys []string, next uint64, done bool) {
+	return p.ds.Scan(from, count)
+}
+
+// Keys returns the keys of the partition matching a glob pattern, see datastore.DataStore.Keys.
+func (p *Partition) Keys(pattern string, limit int) (keys []string, complete bool) {
+	return p.ds.Keys(pattern, limit)
+}
+
+// Size returns how many keys of the partition hold a value.
+func (p *Partition) Size() int {
+	return p.ds.Size()
+}
+
+// Range returns the keys of the partition between start and end in order with their values, and
+// the key the next call continues from, see datastore.DataStore.Range.
+func (p *Partition) Range(start, end string, limit int) (keys, values []string, next string) {
+	return p.ds.Range(start, end, limit)
+}
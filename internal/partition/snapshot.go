@@ -0,0 +1,324 @@
+package partition
+
+import (
+	"bufio"
+	"creek/internal/commons"
+	"creek/internal/datastore"
+	"creek/internal/replication"
+	"creek/internal/utils"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotFileName is the name of the latest snapshot inside a partition directory.
+const SnapshotFileName = "snapshot.dat"
+
+const snapshotHeader = "CREEK-SNAPSHOT"
+const snapshotFormatVersion = 4
+
+// snapshotEntryFields is the number of fields of a snapshot entry, see snapshotEntryArgs
+const snapshotEntryFields = 7
+
+// ErrSnapshotInProgress is returned when a snapshot is requested while another one is written.
+var ErrSnapshotInProgress = commons.NewError(commons.ErrCodeTryAgain, "snapshot already in progress")
+
+// snapshot is the content of the datastore once every write up to Version was applied. With raft
+// election Term is the term of the entry at Version.
+type snapshot struct {
+	Version   int
+	Term      int
+	Timestamp int64
+	Entries   map[string]datastore.Entry
+}
+
+// writeSnapshot stores a snapshot as a "version timestamp count term" header line followed by one
+// quoted line per key, tombstones included, see snapshotEntryArgs. It is written to a temporary file first so a crash never leaves
+// a partial one.
+func writeSnapshot(path string, snap *snapshot) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	_, err = fmt.Fprintf(writer, "%s %d %d %d %d %d\n",
+		snapshotHeader, snapshotFormatVersion, snap.Version, snap.Timestamp, len(snap.Entries), snap.Term)
+	for key, entry := range snap.Entries {
+		if err != nil {
+			break
+		}
+		_, err = writer.WriteString(utils.JoinArgs(snapshotEntryArgs(key, entry)) + "\n")
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// readSnapshot loads a snapshot written by writeSnapshot, it returns nil when there is none.
+// Snapshots of format version 1 only have "key value expiration" and version 2 adds the timestamp,
+// the missing fields are zero so those entries lose every conflict. Both have expirations in seconds.
+// Headers before version 4 have no term.
+func readSnapshot(path string) (*snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot header: %w", err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) < 2 || fields[0] != snapshotHeader {
+		return nil, fmt.Errorf("invalid snapshot header: %q", strings.TrimSpace(header))
+	}
+	fieldCount, headerFields := snapshotEntryFields, 5
+	switch fields[1] {
+	case strconv.Itoa(snapshotFormatVersion):
+		headerFields = 6
+	case "3":
+	case "1":
+		fieldCount = 3
+	case "2":
+		fieldCount = 4
+	default:
+		return nil, fmt.Errorf("unsupported snapshot format version: %s", fields[1])
+	}
+	if len(fields) != headerFields {
+		return nil, fmt.Errorf("invalid snapshot header: %q", strings.TrimSpace(header))
+	}
+	fields = append(fields, "0")
+	version, err1 := strconv.Atoi(fields[2])
+	timestamp, err2 := strconv.ParseInt(fields[3], 10, 64)
+	count, err3 := strconv.Atoi(fields[4])
+	term, err4 := strconv.Atoi(fields[5])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, fmt.Errorf("invalid snapshot header: %w", err)
+	}
+
+	snap := &snapshot{Version: version, Term: term, Timestamp: timestamp, Entries: make(map[string]datastore.Entry, count)}
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		parts, err := utils.SplitArgs(strings.TrimSpace(line))
+		if err != nil || len(parts) != fieldCount {
+			return nil, fmt.Errorf("invalid snapshot entry: %q", strings.TrimSpace(line))
+		}
+		// fields missing from older formats: timestamp, version, origin and tombstone flag
+		parts = append(parts, []string{"0", "0", "", "0"}[fieldCount-3:]...)
+		if err := parseSnapshotEntry(parts, snap.Entries); err != nil {
+			return nil, err
+		}
+		if fieldCount < snapshotEntryFields {
+			entry := snap.Entries[parts[0]]
+			entry.Expiration *= 1000
+			snap.Entries[parts[0]] = entry
+		}
+	}
+	if len(snap.Entries) != count {
+		return nil, fmt.Errorf("incomplete snapshot: %d of %d keys", len(snap.Entries), count)
+	}
+	return snap, nil
+}
+
+func (p *Partition) snapshotPath() string {
+	return filepath.Join(Dir(p.conf, p.Id), SnapshotFileName)
+}
+
+// Snapshot writes the datastore as of the current Version to disk and deletes the sealed log
+// segments it covers. It returns the Version of the snapshot.
+func (p *Partition) Snapshot() (int, error) {
+	if p.raft != nil {
+		return p.snapshotRaft()
+	}
+	if !p.snapMu.TryLock() {
+		return 0, ErrSnapshotInProgress
+	}
+	defer p.snapMu.Unlock()
+	return p.snapshotLocked()
+}
+
+// snapshotLocked takes a snapshot of the current Version, the caller must hold p.snapMu.
+func (p *Partition) snapshotLocked() (int, error) {
+	// copying under the partition lock makes the snapshot consistent with its Version
+	p.mu.Lock()
+	snap := &snapshot{Version: p.Version, Timestamp: time.Now().UnixNano(), Entries: p.ds.Entries()}
+	p.mu.Unlock()
+
+	if err := p.saveSnapshotLocked(snap); err != nil {
+		return 0, err
+	}
+	return snap.Version, nil
+}
+
+// saveSnapshotLocked persists snap and compacts the log, the caller must hold p.snapMu.
+func (p *Partition) saveSnapshotLocked(snap *snapshot) error {
+	if err := writeSnapshot(p.snapshotPath(), snap); err != nil {
+		return err
+	}
+	p.snapshotVersion = snap.Version
+
+	removed, err := p.lw.TruncateBefore(snap.Version)
+	if err != nil {
+		return err
+	}
+	p.log.Infof("Partition %d: snapshot of %d keys at version %d, %d log segments removed",
+		p.Id, len(snap.Entries), snap.Version, removed)
+	return nil
+}
+
+func (p *Partition) startSnapshots() {
+	interval := p.conf.SnapshotInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if p.AppliedVersion() == p.lastSnapshotVersion() {
+					continue
+				}
+				if _, err := p.Snapshot(); err != nil && !errors.Is(err, ErrSnapshotInProgress) {
+					p.log.Errorf("Error taking snapshot: %v", err)
+				}
+			case <-p.stopSnapshots:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Partition) lastSnapshotVersion() int {
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	return p.snapshotVersion
+}
+
+// snapshotEntryArgs encodes an entry as "key value expiration timestamp version origin deleted",
+// deleted being 1 for a tombstone.
+func snapshotEntryArgs(key string, entry datastore.Entry) []string {
+	deleted := "0"
+	if entry.Deleted {
+		deleted = "1"
+	}
+	return []string{
+		key,
+		entry.Value,
+		strconv.FormatInt(entry.Expiration, 10),
+		strconv.FormatInt(entry.Timestamp, 10),
+		strconv.Itoa(entry.Version),
+		entry.Origin,
+		deleted,
+	}
+}
+
+// parseSnapshotEntry decodes the args built by snapshotEntryArgs into entries.
+func parseSnapshotEntry(args []string, entries map[string]datastore.Entry) error {
+	expiration, err1 := strconv.ParseInt(args[2], 10, 64)
+	timestamp, err2 := strconv.ParseInt(args[3], 10, 64)
+	version, err3 := strconv.Atoi(args[4])
+	deleted, err4 := strconv.ParseBool(args[6])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return fmt.Errorf("invalid snapshot entry %q: %w", utils.JoinArgs(args), err)
+	}
+	entries[args[0]] = datastore.Entry{
+		Value:      args[1],
+		Expiration: expiration,
+		Deleted:    deleted,
+		Stamp:      datastore.Stamp{Timestamp: timestamp, Version: version, Origin: args[5]},
+	}
+	return nil
+}
+
+// snapshotEntriesFromArgs decodes the args of a LOAD command or of a raft snapshot.
+func snapshotEntriesFromArgs(args []string) (map[string]datastore.Entry, error) {
+	entries := make(map[string]datastore.Entry, len(args)/snapshotEntryFields)
+	for i := 0; i+snapshotEntryFields <= len(args); i += snapshotEntryFields {
+		if err := parseSnapshotEntry(args[i:i+snapshotEntryFields], entries); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// snapshotArgs encodes entries as the fields of every entry one after the other, decoded by
+// snapshotEntriesFromArgs.
+func snapshotArgs(entries map[string]datastore.Entry) []string {
+	args := make([]string, 0, snapshotEntryFields*len(entries))
+	for key, entry := range entries {
+		args = append(args, snapshotEntryArgs(key, entry)...)
+	}
+	return args
+}
+
+// loadCmdFromSnapshot builds the replication command installing snap on a follower, see snapshotArgs.
+func (p *Partition) loadCmdFromSnapshot(snap *snapshot) *replication.RepCmd {
+	return &replication.RepCmd{
+		Origin:      p.SelfNodeId,
+		PartitionId: p.Id,
+		Timestamp:   snap.Timestamp,
+		Version:     snap.Version,
+		Operation:   commons.CmdDataLoad,
+		Args:        snapshotArgs(snap.Entries),
+	}
+}
+
+// installSnapshot replaces the state of a follower with a snapshot sent by the leader.
+func (p *Partition) installSnapshot(cmd *replication.RepCmd) error {
+	entries, err := snapshotEntriesFromArgs(cmd.Args)
+	if err != nil {
+		return err
+	}
+	snap := &snapshot{Version: cmd.Version, Timestamp: cmd.Timestamp, Entries: entries}
+
+	// same lock order as Snapshot
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cmd.Version <= p.Version {
+		return nil
+	}
+	if err := p.saveSnapshotLocked(snap); err != nil {
+		return err
+	}
+	p.ds.Load(snap.Entries)
+	p.Version = snap.Version
+	return nil
+}
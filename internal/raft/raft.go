@@ -0,0 +1,825 @@
+package raft
+
+import (
+	"creek/internal/commons"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tickInterval is how often timers are checked, it bounds the precision of timeouts
+const tickInterval = 10 * time.Millisecond
+
+// maxEntriesPerAppend caps the entries shipped in a single AppendEntries RPC
+const maxEntriesPerAppend = 256
+
+var (
+	ErrNotLeader      = commons.NewError(commons.ErrCodeReadOnly, "not the raft leader for this partition")
+	ErrStopped        = commons.NewError(commons.ErrCodeTryAgain, "raft is stopped")
+	ErrTimeout        = commons.NewError(commons.ErrCodeTryAgain, "timed out waiting for the write to be committed")
+	ErrLeadershipLost = commons.NewError(commons.ErrCodeTryAgain, "write was discarded after a leadership change")
+)
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Leader:
+		return "leader"
+	case Candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// Transport delivers RAFT system commands to a peer and returns the integers it replied with.
+type Transport interface {
+	Call(peer string, args []string) ([]int64, error)
+}
+
+// Storage persists the log and applies committed entries, it is implemented by the partition
+// on top of its commit log and datastore.
+type Storage interface {
+	// AppendEntries durably appends entries to the end of the log
+	AppendEntries(entries []Entry) error
+	// ReplaceLog durably rewrites the log so it holds exactly entries, which follow the latest
+	// snapshot. It is used when a follower drops an uncommitted suffix that conflicts with the leader
+	ReplaceLog(entries []Entry) error
+	// Apply applies a committed entry to the state machine, entries are applied in order
+	Apply(entry Entry)
+	// Snapshot returns the latest snapshot of the state machine, sent to followers missing the
+	// entries it replaced
+	Snapshot() (Snapshot, error)
+	// InstallSnapshot replaces the state machine with a snapshot sent by the leader and rewrites
+	// the log so it holds exactly entries, which follow the snapshot
+	InstallSnapshot(snap Snapshot, entries []Entry) error
+}
+
+type Config struct {
+	PartitionId       int
+	SelfId            string
+	Peers             []string
+	StatePath         string
+	ElectionTimeout   time.Duration // randomized between ElectionTimeout and twice its value
+	HeartbeatInterval time.Duration
+	Log               *logrus.Logger
+	OnRoleChange      func(role Role, leaderId string)
+}
+
+// Raft drives leader election and log replication for a single partition.
+type Raft struct {
+	mu        sync.Mutex
+	conf      Config
+	transport Transport
+	storage   Storage
+
+	role        Role
+	currentTerm int
+	votedFor    string
+	leaderId    string
+
+	log         []Entry // entries after the snapshot, log[i].Index == snapIndex+i+1
+	snapIndex   int     // index of the last entry the latest snapshot replaced, 0 without snapshot
+	snapTerm    int
+	compacted   []termStart // where every term starts among the entries Compact dropped, see termAt
+	commitIndex int
+	lastApplied int
+
+	nextIndex  map[string]int
+	matchIndex map[string]int
+	inflight   map[string]bool
+
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+
+	applyMu     sync.Mutex // held while entries or a snapshot are applied, before mu
+	applyCond   *sync.Cond // signals the applier when commitIndex advances
+	appliedCond *sync.Cond // signals writers when lastApplied advances
+	stopped     bool
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// New creates a raft instance over the entries recovered from the commit log, which follow the
+// snapshot of the entries up to snapIndex the state machine was loaded from. Entries up to the
+// persisted commit index are applied once Start is called.
+func New(conf Config, transport Transport, storage Storage, snapIndex, snapTerm int, entries []Entry) (*Raft, error) {
+	state, err := loadState(conf.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if e.Index != snapIndex+i+1 {
+			return nil, fmt.Errorf("raft log is not contiguous: entry %d has index %d", snapIndex+i+1, e.Index)
+		}
+	}
+
+	r := &Raft{
+		conf:        conf,
+		transport:   transport,
+		storage:     storage,
+		role:        Follower,
+		currentTerm: state.Term,
+		votedFor:    state.VotedFor,
+		log:         entries,
+		snapIndex:   snapIndex,
+		snapTerm:    snapTerm,
+		commitIndex: max(snapIndex, min(state.CommitIndex, snapIndex+len(entries))),
+		lastApplied: snapIndex,
+		nextIndex:   make(map[string]int),
+		matchIndex:  make(map[string]int),
+		inflight:    make(map[string]bool),
+		stopCh:      make(chan struct{}),
+	}
+	r.applyCond = sync.NewCond(&r.mu)
+	r.appliedCond = sync.NewCond(&r.mu)
+	return r, nil
+}
+
+func (r *Raft) Start() {
+	r.mu.Lock()
+	r.resetElectionDeadlineLocked()
+	r.mu.Unlock()
+
+	r.wg.Add(2)
+	go r.runTicker()
+	go r.runApplier()
+}
+
+// Stop halts timers and the applier. RPCs still in flight are dropped once they return.
+func (r *Raft) Stop() {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	r.persistLocked()
+	close(r.stopCh)
+	r.applyCond.Broadcast()
+	r.appliedCond.Broadcast()
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+func (r *Raft) IsLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == Leader
+}
+
+// LeaderId returns the id of the last known leader, empty while an election is running.
+func (r *Raft) LeaderId() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leaderId
+}
+
+func (r *Raft) Role() Role {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role
+}
+
+func (r *Raft) Term() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.currentTerm
+}
+
+// Propose appends a new entry to the leader's log and starts replicating it. It returns the
+// index and term the entry was stored at, to be passed on to WaitApplied.
+func (r *Raft) Propose(operation string, args []string, timestamp int64) (int, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return 0, 0, ErrStopped
+	}
+	if r.role != Leader {
+		return 0, 0, ErrNotLeader
+	}
+
+	entry := Entry{
+		Index:     r.lastIndex() + 1,
+		Term:      r.currentTerm,
+		Timestamp: timestamp,
+		Operation: operation,
+		Args:      args,
+	}
+	if err := r.appendLocked([]Entry{entry}); err != nil {
+		return 0, 0, err
+	}
+	r.advanceCommitLocked()
+	r.broadcastLocked()
+	return entry.Index, entry.Term, nil
+}
+
+// WaitApplied blocks until the entry proposed at index and term has been committed and applied.
+func (r *Raft) WaitApplied(index, term int, timeout time.Duration) error {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		timedOut = true
+		r.appliedCond.Broadcast()
+		r.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if index > r.lastIndex() || r.termAt(index) != term {
+			return ErrLeadershipLost
+		}
+		if r.lastApplied >= index {
+			return nil
+		}
+		if r.stopped {
+			return ErrStopped
+		}
+		if timedOut {
+			return ErrTimeout
+		}
+		r.appliedCond.Wait()
+	}
+}
+
+// WaitCaughtUp blocks while this node is leader until every entry of its log, among which the
+// noop entry of its term, has been applied. The state applied then reflects every write committed
+// so far, which writes computed from that state must wait for.
+func (r *Raft) WaitCaughtUp(timeout time.Duration) error {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		timedOut = true
+		r.appliedCond.Broadcast()
+		r.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if r.stopped {
+			return ErrStopped
+		}
+		if r.role != Leader {
+			return ErrNotLeader
+		}
+		if r.lastApplied >= r.lastIndex() {
+			return nil
+		}
+		if timedOut {
+			return ErrTimeout
+		}
+		r.appliedCond.Wait()
+	}
+}
+
+// termStart is the index of the first entry of a term.
+type termStart struct {
+	index int
+	term  int
+}
+
+// Compact drops the entries up to index from the log once a snapshot of the state machine
+// replaced them. Entries not applied yet are kept.
+func (r *Raft) Compact(index int) {
+	// entries being applied are applied by the time applyMu is released
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index <= r.snapIndex || index > r.lastApplied {
+		return
+	}
+	// writers waiting for dropped entries still check they were not replaced by another leader
+	for _, e := range r.log[:index-r.snapIndex] {
+		if n := len(r.compacted); n == 0 || r.compacted[n-1].term != e.Term {
+			r.compacted = append(r.compacted, termStart{index: e.Index, term: e.Term})
+		}
+	}
+	r.snapTerm = r.termAt(index)
+	r.log = append([]Entry(nil), r.log[index-r.snapIndex:]...)
+	r.snapIndex = index
+}
+
+// HandleRequestVote answers a candidate asking for this node's vote.
+func (r *Raft) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil, ErrStopped
+	}
+
+	if req.Term < r.currentTerm {
+		return &RequestVoteResponse{Term: r.currentTerm}, nil
+	}
+	if req.Term > r.currentTerm {
+		r.becomeFollowerLocked(req.Term, "")
+	}
+
+	lastIndex := r.lastIndex()
+	lastTerm := r.termAt(lastIndex)
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= lastIndex)
+	if (r.votedFor == "" || r.votedFor == req.CandidateId) && upToDate {
+		r.votedFor = req.CandidateId
+		r.persistLocked()
+		r.resetElectionDeadlineLocked()
+		return &RequestVoteResponse{Term: r.currentTerm, VoteGranted: true}, nil
+	}
+	return &RequestVoteResponse{Term: r.currentTerm}, nil
+}
+
+// HandleAppendEntries stores entries sent by the leader and advances the commit index.
+func (r *Raft) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil, ErrStopped
+	}
+
+	if req.Term < r.currentTerm {
+		return &AppendEntriesResponse{Term: r.currentTerm}, nil
+	}
+	if req.Term > r.currentTerm || r.role != Follower || r.leaderId != req.LeaderId {
+		r.becomeFollowerLocked(req.Term, req.LeaderId)
+	}
+	r.resetElectionDeadlineLocked()
+
+	lastNewIndex := req.PrevLogIndex + len(req.Entries)
+	if req.PrevLogIndex < r.snapIndex {
+		// the entries a snapshot replaced are committed, they match those of any leader
+		skipped := min(r.snapIndex-req.PrevLogIndex, len(req.Entries))
+		req.Entries = req.Entries[skipped:]
+		req.PrevLogIndex += skipped
+		if req.PrevLogIndex < r.snapIndex {
+			return &AppendEntriesResponse{Term: r.currentTerm, Success: true, ConflictIndex: lastNewIndex}, nil
+		}
+		req.PrevLogTerm = r.snapTerm
+	}
+	if req.PrevLogIndex > r.lastIndex() {
+		return &AppendEntriesResponse{Term: r.currentTerm, ConflictIndex: r.lastIndex() + 1}, nil
+	}
+	if prevTerm := r.termAt(req.PrevLogIndex); prevTerm != req.PrevLogTerm {
+		// skip back over the whole conflicting term at once
+		conflict := req.PrevLogIndex
+		for conflict > r.snapIndex+1 && r.termAt(conflict-1) == prevTerm {
+			conflict--
+		}
+		return &AppendEntriesResponse{Term: r.currentTerm, ConflictIndex: conflict}, nil
+	}
+
+	for i, e := range req.Entries {
+		index := req.PrevLogIndex + 1 + i
+		if index <= r.lastIndex() {
+			if r.termAt(index) == e.Term {
+				continue
+			}
+			if index <= r.commitIndex {
+				return nil, fmt.Errorf("leader %s tried to overwrite committed entry %d", req.LeaderId, index)
+			}
+			kept := append([]Entry(nil), r.log[:index-r.snapIndex-1]...)
+			if err := r.storage.ReplaceLog(kept); err != nil {
+				return nil, err
+			}
+			r.log = kept
+		}
+		if err := r.appendLocked(req.Entries[i:]); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if newCommit := min(req.LeaderCommit, lastNewIndex); newCommit > r.commitIndex {
+		r.commitIndex = newCommit
+		r.applyCond.Broadcast()
+	}
+	return &AppendEntriesResponse{Term: r.currentTerm, Success: true, ConflictIndex: lastNewIndex}, nil
+}
+
+// HandleInstallSnapshot replaces the state of a follower lagging behind the snapshot of the leader.
+// The entries of its log following the snapshot are kept when the log agrees with it.
+func (r *Raft) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil, ErrStopped
+	}
+
+	if req.Term < r.currentTerm {
+		return &InstallSnapshotResponse{Term: r.currentTerm}, nil
+	}
+	if req.Term > r.currentTerm || r.role != Follower || r.leaderId != req.LeaderId {
+		r.becomeFollowerLocked(req.Term, req.LeaderId)
+	}
+	r.resetElectionDeadlineLocked()
+	if req.Snapshot.Index <= r.lastApplied {
+		return &InstallSnapshotResponse{Term: r.currentTerm}, nil
+	}
+
+	var kept []Entry
+	if index := req.Snapshot.Index; index < r.lastIndex() && r.termAt(index) == req.Snapshot.Term {
+		kept = append(kept, r.log[index-r.snapIndex:]...)
+	}
+	if err := r.storage.InstallSnapshot(req.Snapshot, kept); err != nil {
+		return nil, err
+	}
+	r.log = kept
+	r.snapIndex, r.snapTerm = req.Snapshot.Index, req.Snapshot.Term
+	r.compacted = nil // the terms of the entries the snapshot replaced are unknown
+	r.commitIndex = max(r.commitIndex, r.snapIndex)
+	r.lastApplied = r.snapIndex
+	r.persistLocked()
+	r.appliedCond.Broadcast()
+	r.applyCond.Broadcast()
+	return &InstallSnapshotResponse{Term: r.currentTerm}, nil
+}
+
+func (r *Raft) runTicker() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.tick()
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+func (r *Raft) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+
+	if r.role == Leader {
+		if time.Since(r.lastBroadcast) >= r.conf.HeartbeatInterval {
+			r.broadcastLocked()
+		}
+		return
+	}
+	if time.Now().After(r.electionDeadline) {
+		r.startElectionLocked()
+	}
+}
+
+func (r *Raft) runApplier() {
+	defer r.wg.Done()
+	for {
+		r.mu.Lock()
+		for !r.stopped && r.lastApplied >= r.commitIndex {
+			r.applyCond.Wait()
+		}
+		r.mu.Unlock()
+
+		// a snapshot installed meanwhile may have applied the entries already
+		r.applyMu.Lock()
+		r.mu.Lock()
+		if r.stopped {
+			r.mu.Unlock()
+			r.applyMu.Unlock()
+			return
+		}
+		entries := append([]Entry(nil), r.log[r.lastApplied-r.snapIndex:r.commitIndex-r.snapIndex]...)
+		r.mu.Unlock()
+
+		for _, e := range entries {
+			r.storage.Apply(e)
+		}
+
+		if len(entries) > 0 {
+			r.mu.Lock()
+			r.lastApplied = entries[len(entries)-1].Index
+			r.appliedCond.Broadcast()
+			r.mu.Unlock()
+		}
+		r.applyMu.Unlock()
+	}
+}
+
+func (r *Raft) startElectionLocked() {
+	r.role = Candidate
+	r.currentTerm++
+	r.votedFor = r.conf.SelfId
+	r.leaderId = ""
+	r.persistLocked()
+	r.resetElectionDeadlineLocked()
+	r.notifyRoleChangeLocked()
+
+	term := r.currentTerm
+	lastIndex := r.lastIndex()
+	req := &RequestVoteRequest{
+		PartitionId:  r.conf.PartitionId,
+		Term:         term,
+		CandidateId:  r.conf.SelfId,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  r.termAt(lastIndex),
+	}
+	r.conf.Log.Debugf("Partition %d starting election for term %d", r.conf.PartitionId, term)
+
+	votes := 1
+	if votes >= r.majority() {
+		r.becomeLeaderLocked()
+		return
+	}
+	for _, peer := range r.conf.Peers {
+		go func(peer string) {
+			resp, err := r.requestVote(peer, req)
+			if err != nil {
+				r.conf.Log.Tracef("Request vote to %s failed: %v", peer, err)
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.stopped {
+				return
+			}
+			if resp.Term > r.currentTerm {
+				r.becomeFollowerLocked(resp.Term, "")
+				return
+			}
+			if r.role != Candidate || r.currentTerm != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= r.majority() {
+				r.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (r *Raft) becomeLeaderLocked() {
+	r.role = Leader
+	r.leaderId = r.conf.SelfId
+	for _, peer := range r.conf.Peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+	}
+	r.conf.Log.Infof("Partition %d elected leader for term %d", r.conf.PartitionId, r.currentTerm)
+	r.notifyRoleChangeLocked()
+
+	// entries of earlier terms can only be committed through an entry of the current term
+	noop := Entry{Index: r.lastIndex() + 1, Term: r.currentTerm, Timestamp: time.Now().UnixNano(), Operation: commons.CmdDataNoop}
+	if err := r.appendLocked([]Entry{noop}); err != nil {
+		r.conf.Log.Errorf("Partition %d failed to append noop entry: %v", r.conf.PartitionId, err)
+	}
+	r.advanceCommitLocked()
+	r.broadcastLocked()
+}
+
+func (r *Raft) becomeFollowerLocked(term int, leaderId string) {
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.persistLocked()
+	}
+	changed := r.role != Follower || r.leaderId != leaderId
+	r.role = Follower
+	r.leaderId = leaderId
+	if changed {
+		r.notifyRoleChangeLocked()
+		r.appliedCond.Broadcast() // leaders waiting in WaitCaughtUp give up
+	}
+}
+
+func (r *Raft) broadcastLocked() {
+	r.lastBroadcast = time.Now()
+	for _, peer := range r.conf.Peers {
+		if r.inflight[peer] {
+			continue
+		}
+		r.inflight[peer] = true
+		go r.replicateTo(peer)
+	}
+}
+
+// replicateTo keeps sending AppendEntries to a peer until it has caught up with the log.
+// At most one replicateTo runs per peer, guarded by the inflight flag.
+func (r *Raft) replicateTo(peer string) {
+	for {
+		r.mu.Lock()
+		if r.stopped || r.role != Leader {
+			r.inflight[peer] = false
+			r.mu.Unlock()
+			return
+		}
+		term := r.currentTerm
+		if r.nextIndex[peer] <= r.snapIndex {
+			r.mu.Unlock()
+			if !r.sendSnapshot(peer, term) {
+				return
+			}
+			continue
+		}
+		req := r.appendRequestLocked(peer)
+		r.mu.Unlock()
+
+		resp, err := r.appendEntries(peer, req)
+
+		r.mu.Lock()
+		if err != nil || r.stopped || r.role != Leader || r.currentTerm != term {
+			if err != nil {
+				r.conf.Log.Tracef("Append entries to %s failed: %v", peer, err)
+			}
+			r.inflight[peer] = false
+			r.mu.Unlock()
+			return
+		}
+		if resp.Term > r.currentTerm {
+			r.becomeFollowerLocked(resp.Term, "")
+			r.inflight[peer] = false
+			r.mu.Unlock()
+			return
+		}
+
+		if resp.Success {
+			match := req.PrevLogIndex + len(req.Entries)
+			if match > r.matchIndex[peer] {
+				r.matchIndex[peer] = match
+			}
+			r.nextIndex[peer] = match + 1
+			r.advanceCommitLocked()
+			if r.nextIndex[peer] > r.lastIndex() {
+				r.inflight[peer] = false
+				r.mu.Unlock()
+				return
+			}
+		} else {
+			r.nextIndex[peer] = max(1, min(resp.ConflictIndex, r.nextIndex[peer]-1))
+		}
+		r.mu.Unlock()
+	}
+}
+
+// sendSnapshot sends the latest snapshot to a peer missing the entries it replaced, on behalf of
+// replicateTo. It returns false when replicateTo must stop, having cleared the inflight flag.
+func (r *Raft) sendSnapshot(peer string, term int) bool {
+	snap, err := r.storage.Snapshot()
+	if err == nil {
+		req := &InstallSnapshotRequest{PartitionId: r.conf.PartitionId, Term: term, LeaderId: r.conf.SelfId, Snapshot: snap}
+		var resp *InstallSnapshotResponse
+		if resp, err = r.installSnapshot(peer, req); err == nil {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if resp.Term > r.currentTerm {
+				r.becomeFollowerLocked(resp.Term, "")
+			} else if !r.stopped && r.role == Leader && r.currentTerm == term {
+				r.matchIndex[peer] = max(r.matchIndex[peer], snap.Index)
+				r.nextIndex[peer] = snap.Index + 1
+				r.advanceCommitLocked()
+				return true
+			}
+			r.inflight[peer] = false
+			return false
+		}
+	}
+	r.conf.Log.Tracef("Install snapshot on %s failed: %v", peer, err)
+	r.mu.Lock()
+	r.inflight[peer] = false
+	r.mu.Unlock()
+	return false
+}
+
+func (r *Raft) appendRequestLocked(peer string) *AppendEntriesRequest {
+	next := r.nextIndex[peer]
+	end := min(r.lastIndex(), next-1+maxEntriesPerAppend)
+	var entries []Entry
+	if next <= end {
+		entries = append(entries, r.log[next-r.snapIndex-1:end-r.snapIndex]...)
+	}
+	return &AppendEntriesRequest{
+		PartitionId:  r.conf.PartitionId,
+		Term:         r.currentTerm,
+		LeaderId:     r.conf.SelfId,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.termAt(next - 1),
+		LeaderCommit: r.commitIndex,
+		Entries:      entries,
+	}
+}
+
+// advanceCommitLocked commits the highest entry of the current term stored on a majority.
+func (r *Raft) advanceCommitLocked() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.termAt(n) != r.currentTerm {
+			// terms never decrease along the log, so no earlier entry qualifies either
+			return
+		}
+		count := 1
+		for _, peer := range r.conf.Peers {
+			if r.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commitIndex = n
+			r.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (r *Raft) appendLocked(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := r.storage.AppendEntries(entries); err != nil {
+		return err
+	}
+	r.log = append(r.log, entries...)
+	return nil
+}
+
+func (r *Raft) requestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	ints, err := r.transport.Call(peer, req.Args())
+	if err != nil {
+		return nil, err
+	}
+	return parseRequestVoteResponse(ints)
+}
+
+func (r *Raft) appendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	ints, err := r.transport.Call(peer, req.Args())
+	if err != nil {
+		return nil, err
+	}
+	return parseAppendEntriesResponse(ints)
+}
+
+func (r *Raft) installSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	ints, err := r.transport.Call(peer, req.Args())
+	if err != nil {
+		return nil, err
+	}
+	return parseInstallSnapshotResponse(ints)
+}
+
+func (r *Raft) persistLocked() {
+	err := saveState(r.conf.StatePath, persistentState{
+		Term:        r.currentTerm,
+		VotedFor:    r.votedFor,
+		CommitIndex: r.commitIndex,
+	})
+	if err != nil {
+		r.conf.Log.Errorf("Partition %d failed to persist raft state: %v", r.conf.PartitionId, err)
+	}
+}
+
+func (r *Raft) notifyRoleChangeLocked() {
+	if r.conf.OnRoleChange != nil {
+		r.conf.OnRoleChange(r.role, r.leaderId)
+	}
+}
+
+func (r *Raft) resetElectionDeadlineLocked() {
+	timeout := r.conf.ElectionTimeout + time.Duration(rand.Int63n(int64(r.conf.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+func (r *Raft) majority() int {
+	return (len(r.conf.Peers)+1)/2 + 1
+}
+
+func (r *Raft) lastIndex() int {
+	return r.snapIndex + len(r.log)
+}
+
+// termAt returns the term of the entry at index, 0 when it is unknown. The terms of the entries
+// the snapshot replaced are only known when this node compacted them itself since it started.
+func (r *Raft) termAt(index int) int {
+	if index == r.snapIndex {
+		return r.snapTerm
+	}
+	if index < r.snapIndex {
+		i := sort.Search(len(r.compacted), func(i int) bool { return r.compacted[i].index > index })
+		if i == 0 {
+			return 0
+		}
+		return r.compacted[i-1].term
+	}
+	if index > r.lastIndex() {
+		return 0
+	}
+	return r.log[index-r.snapIndex-1].Term
+}
@@ -0,0 +1,280 @@
+package raft
+
+import (
+	"creek/internal/commons"
+	"fmt"
+	"strconv"
+)
+
+// Entry is a single record of the replicated log. Index doubles as the partition Version.
+type Entry struct {
+	Index     int
+	Term      int
+	Timestamp int64
+	Operation string
+	Args      []string
+}
+
+// RequestVoteRequest is sent by candidates to gather votes.
+type RequestVoteRequest struct {
+	PartitionId  int
+	Term         int
+	CandidateId  string
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteResponse struct {
+	Term        int
+	VoteGranted bool
+}
+
+// AppendEntriesRequest is sent by the leader to replicate entries, and empty as a heartbeat.
+type AppendEntriesRequest struct {
+	PartitionId  int
+	Term         int
+	LeaderId     string
+	PrevLogIndex int
+	PrevLogTerm  int
+	LeaderCommit int
+	Entries      []Entry
+}
+
+// AppendEntriesResponse carries the index the follower matched on success. On failure
+// ConflictIndex tells the leader where to resume, saving one round trip per mismatched entry.
+type AppendEntriesResponse struct {
+	Term          int
+	Success       bool
+	ConflictIndex int
+}
+
+// Snapshot is the state machine once every entry up to Index was applied. Data is opaque to raft,
+// the storage encodes and decodes it.
+type Snapshot struct {
+	Index     int
+	Term      int
+	Timestamp int64
+	Data      []string
+}
+
+// InstallSnapshotRequest is sent by the leader to a follower missing entries replaced by its snapshot.
+type InstallSnapshotRequest struct {
+	PartitionId int
+	Term        int
+	LeaderId    string
+	Snapshot    Snapshot
+}
+
+type InstallSnapshotResponse struct {
+	Term int
+}
+
+// Args encodes the request as a RAFT system command.
+func (req *RequestVoteRequest) Args() []string {
+	return []string{
+		commons.CmdSysRaft,
+		commons.RaftRequestVote,
+		strconv.Itoa(req.PartitionId),
+		strconv.Itoa(req.Term),
+		req.CandidateId,
+		strconv.Itoa(req.LastLogIndex),
+		strconv.Itoa(req.LastLogTerm),
+	}
+}
+
+// Args encodes the request as a RAFT system command, each entry is flattened as
+// index, term, timestamp, operation, arg count and the args themselves.
+func (req *AppendEntriesRequest) Args() []string {
+	args := []string{
+		commons.CmdSysRaft,
+		commons.RaftAppendEntries,
+		strconv.Itoa(req.PartitionId),
+		strconv.Itoa(req.Term),
+		req.LeaderId,
+		strconv.Itoa(req.PrevLogIndex),
+		strconv.Itoa(req.PrevLogTerm),
+		strconv.Itoa(req.LeaderCommit),
+		strconv.Itoa(len(req.Entries)),
+	}
+	for _, e := range req.Entries {
+		args = append(args,
+			strconv.Itoa(e.Index),
+			strconv.Itoa(e.Term),
+			strconv.FormatInt(e.Timestamp, 10),
+			e.Operation,
+			strconv.Itoa(len(e.Args)),
+		)
+		args = append(args, e.Args...)
+	}
+	return args
+}
+
+// Args encodes the request as a RAFT system command, the snapshot data follows its header.
+func (req *InstallSnapshotRequest) Args() []string {
+	args := []string{
+		commons.CmdSysRaft,
+		commons.RaftInstallSnapshot,
+		strconv.Itoa(req.PartitionId),
+		strconv.Itoa(req.Term),
+		req.LeaderId,
+		strconv.Itoa(req.Snapshot.Index),
+		strconv.Itoa(req.Snapshot.Term),
+		strconv.FormatInt(req.Snapshot.Timestamp, 10),
+	}
+	return append(args, req.Snapshot.Data...)
+}
+
+func (resp *RequestVoteResponse) Ints() []int64 {
+	return []int64{int64(resp.Term), boolToInt(resp.VoteGranted)}
+}
+
+func (resp *AppendEntriesResponse) Ints() []int64 {
+	return []int64{int64(resp.Term), boolToInt(resp.Success), int64(resp.ConflictIndex)}
+}
+
+func (resp *InstallSnapshotResponse) Ints() []int64 {
+	return []int64{int64(resp.Term)}
+}
+
+// ParseRequestVote decodes the arguments following "RAFT VOTE".
+func ParseRequestVote(args []string) (*RequestVoteRequest, error) {
+	if len(args) != 5 {
+		return nil, fmt.Errorf("invalid request vote: expected 5 arguments, got %d", len(args))
+	}
+	ints, err := atoiAll(args[0], args[1], args[3], args[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid request vote: %v", err)
+	}
+	return &RequestVoteRequest{
+		PartitionId:  ints[0],
+		Term:         ints[1],
+		CandidateId:  args[2],
+		LastLogIndex: ints[2],
+		LastLogTerm:  ints[3],
+	}, nil
+}
+
+// ParseAppendEntries decodes the arguments following "RAFT APPEND".
+func ParseAppendEntries(args []string) (*AppendEntriesRequest, error) {
+	if len(args) < 7 {
+		return nil, fmt.Errorf("invalid append entries: expected at least 7 arguments, got %d", len(args))
+	}
+	ints, err := atoiAll(args[0], args[1], args[3], args[4], args[5], args[6])
+	if err != nil {
+		return nil, fmt.Errorf("invalid append entries: %v", err)
+	}
+	// every entry takes at least 5 arguments, a count off the wire must not size the slice alone
+	if ints[5] < 0 || ints[5] > len(args[7:])/5 {
+		return nil, fmt.Errorf("invalid append entries: %d entries in %d arguments", ints[5], len(args[7:]))
+	}
+	req := &AppendEntriesRequest{
+		PartitionId:  ints[0],
+		Term:         ints[1],
+		LeaderId:     args[2],
+		PrevLogIndex: ints[2],
+		PrevLogTerm:  ints[3],
+		LeaderCommit: ints[4],
+		Entries:      make([]Entry, 0, ints[5]),
+	}
+
+	rest := args[7:]
+	for i := 0; i < ints[5]; i++ {
+		if len(rest) < 5 {
+			return nil, fmt.Errorf("invalid append entries: truncated entry %d", i)
+		}
+		header, err := atoiAll(rest[0], rest[1], rest[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid append entries: %v", err)
+		}
+		timestamp, err := strconv.ParseInt(rest[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid append entries: %v", err)
+		}
+		argCount := header[2]
+		if argCount < 0 || len(rest) < 5+argCount {
+			return nil, fmt.Errorf("invalid append entries: truncated entry %d", i)
+		}
+		var entryArgs []string
+		if argCount > 0 {
+			entryArgs = append([]string(nil), rest[5:5+argCount]...)
+		}
+		req.Entries = append(req.Entries, Entry{
+			Index:     header[0],
+			Term:      header[1],
+			Timestamp: timestamp,
+			Operation: rest[3],
+			Args:      entryArgs,
+		})
+		rest = rest[5+argCount:]
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid append entries: %d trailing arguments", len(rest))
+	}
+	return req, nil
+}
+
+// ParseInstallSnapshot decodes the arguments following "RAFT SNAPSHOT".
+func ParseInstallSnapshot(args []string) (*InstallSnapshotRequest, error) {
+	if len(args) < 6 {
+		return nil, fmt.Errorf("invalid install snapshot: expected at least 6 arguments, got %d", len(args))
+	}
+	ints, err := atoiAll(args[0], args[1], args[3], args[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid install snapshot: %v", err)
+	}
+	timestamp, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid install snapshot: %v", err)
+	}
+	return &InstallSnapshotRequest{
+		PartitionId: ints[0],
+		Term:        ints[1],
+		LeaderId:    args[2],
+		Snapshot: Snapshot{
+			Index:     ints[2],
+			Term:      ints[3],
+			Timestamp: timestamp,
+			Data:      append([]string(nil), args[6:]...),
+		},
+	}, nil
+}
+
+func parseRequestVoteResponse(ints []int64) (*RequestVoteResponse, error) {
+	if len(ints) != 2 {
+		return nil, fmt.Errorf("invalid request vote response: %v", ints)
+	}
+	return &RequestVoteResponse{Term: int(ints[0]), VoteGranted: ints[1] == 1}, nil
+}
+
+func parseAppendEntriesResponse(ints []int64) (*AppendEntriesResponse, error) {
+	if len(ints) != 3 {
+		return nil, fmt.Errorf("invalid append entries response: %v", ints)
+	}
+	return &AppendEntriesResponse{Term: int(ints[0]), Success: ints[1] == 1, ConflictIndex: int(ints[2])}, nil
+}
+
+func parseInstallSnapshotResponse(ints []int64) (*InstallSnapshotResponse, error) {
+	if len(ints) != 1 {
+		return nil, fmt.Errorf("invalid install snapshot response: %v", ints)
+	}
+	return &InstallSnapshotResponse{Term: int(ints[0])}, nil
+}
+
+func atoiAll(values ...string) ([]int, error) {
+	ints := make([]int, len(values))
+	for i, v := range values {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
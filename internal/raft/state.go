@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StateFileName is the file inside a partition directory holding the persistent raft state.
+const StateFileName = "raft_state"
+
+// persistentState is what raft must not forget across restarts. CommitIndex is not required
+// for safety, it only lets a restarted node apply its committed entries without waiting for
+// a leader.
+type persistentState struct {
+	Term        int
+	VotedFor    string
+	CommitIndex int
+}
+
+func loadState(path string) (persistentState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return persistentState{}, nil
+		}
+		return persistentState{}, fmt.Errorf("failed to read raft state: %w", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return persistentState{}, fmt.Errorf("invalid raft state in %s", path)
+	}
+	term, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return persistentState{}, fmt.Errorf("invalid raft term: %v", err)
+	}
+	commitIndex, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return persistentState{}, fmt.Errorf("invalid raft commit index: %v", err)
+	}
+	votedFor := fields[1]
+	if votedFor == "-" {
+		votedFor = ""
+	}
+	return persistentState{Term: term, VotedFor: votedFor, CommitIndex: commitIndex}, nil
+}
+
+// saveState atomically replaces the state file, it is synced before the rename so a crash
+// never leaves a vote behind that was not persisted.
+func saveState(path string, state persistentState) error {
+	votedFor := state.VotedFor
+	if votedFor == "" {
+		votedFor = "-"
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write raft state: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d %s %d\n", state.Term, votedFor, state.CommitIndex)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write raft state: %w", err)
+	}
+	return os.Rename(tmpPath, path)
+}
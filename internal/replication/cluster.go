@@ -0,0 +1,201 @@
+package replication
+
+import (
+	"creek/internal/commons"
+	"creek/internal/config"
+	"slices"
+	"time"
+)
+
+// ClusterNode describes a node of the cluster as seen from this node.
+type ClusterNode struct {
+	Address   string
+	Myself    bool
+	Monitored bool       // this node tracks the health of the node, a follower only tracks its leader
+	Health    PeerHealth // meaningful when Monitored
+	Connected bool       // this node has a replication connection open to the node
+}
+
+// replicates tells whether a node streams its writes to its peers, as a static leader or a
+// multi-master node. Only those change the membership of the cluster.
+func replicates(conf *config.Config) bool {
+	if conf.ElectionMode == commons.RaftElection {
+		return false
+	}
+	return conf.ServerMode == commons.Leader || conf.IsMultiMaster()
+}
+
+// Membership returns the nodes of the cluster, this node included.
+func (qs *RepService) Membership() Membership {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.membership
+}
+
+// ClusterNodes describes every node of the cluster, ordered by address.
+func (qs *RepService) ClusterNodes() []ClusterNode {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	now := time.Now()
+	nodes := make([]ClusterNode, 0, len(qs.membership.Nodes))
+	for _, address := range qs.membership.Nodes {
+		node := ClusterNode{Address: address, Myself: address == qs.Conf.ServerAddress}
+		if node.Myself {
+			node.Monitored, node.Health = true, PeerUp
+		} else if p, known := qs.peers[address]; known {
+			node.Monitored, node.Health = true, qs.healthLocked(p, now)
+		}
+		_, node.Connected = qs.Nodes[address]
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// ReplicatedPeers returns the addresses of the peers this node streams its writes to.
+func (qs *RepService) ReplicatedPeers() []string {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	var addresses []string
+	for address, p := range qs.peers {
+		if p.replicated {
+			addresses = append(addresses, address)
+		}
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+// Join adds a node to the cluster. This node streams its writes to the new one, which catches up
+// from the commit log or from a snapshot like a follower that was down, and the new membership is
+// sent to every node.
+func (qs *RepService) Join(address string) error {
+	return qs.changeMembership(address, true)
+}
+
+// Leave removes a node from the cluster. This node stops streaming its writes to it, and the new
+// membership is sent to every node, the removed one included.
+func (qs *RepService) Leave(address string) error {
+	return qs.changeMembership(address, false)
+}
+
+func (qs *RepService) changeMembership(address string, join bool) error {
+	if qs.Conf.ElectionMode == commons.RaftElection {
+		return commons.NewError(commons.ErrCodeGeneric, "cluster membership cannot change with raft election")
+	}
+	if !replicates(qs.Conf) {
+		return commons.NewError(commons.ErrCodeReadOnly, "cluster membership is changed on the leader")
+	}
+	if address == "" || address == qs.Conf.ServerAddress {
+		return commons.Errorf(commons.ErrCodeGeneric, "invalid node address: %q", address)
+	}
+
+	qs.membershipMu.Lock()
+	defer qs.membershipMu.Unlock()
+	current := qs.Membership()
+	if current.Has(address) == join {
+		return nil
+	}
+	nodes := slices.DeleteFunc(slices.Clone(current.Nodes), func(node string) bool { return node == address })
+	if join {
+		nodes = append(nodes, address)
+	}
+	m := newMembership(current.Epoch+1, nodes)
+	if err := qs.applyMembershipLocked(m); err != nil {
+		return err
+	}
+	qs.log.Infof("Cluster membership changed to %v at epoch %d", m.Nodes, m.Epoch)
+	return nil
+}
+
+// ApplyMembership takes a membership sent by another node unless this node has a newer one.
+func (qs *RepService) ApplyMembership(m Membership) error {
+	qs.membershipMu.Lock()
+	defer qs.membershipMu.Unlock()
+	if !m.newerThan(qs.Membership()) {
+		return nil
+	}
+	if err := qs.applyMembershipLocked(m); err != nil {
+		return err
+	}
+	if !m.Has(qs.Conf.ServerAddress) {
+		qs.log.Warnf("This node was removed from the cluster at epoch %d", m.Epoch)
+	}
+	qs.log.Infof("Cluster membership is now %v at epoch %d", m.Nodes, m.Epoch)
+	return nil
+}
+
+// applyMembershipLocked saves m and makes the peers this node streams to match it, then sends it
+// to every connected node. The caller must hold qs.membershipMu.
+func (qs *RepService) applyMembershipLocked(m Membership) error {
+	if err := saveMembership(qs.Conf.DataStoreDirectory, m); err != nil {
+		return err
+	}
+
+	qs.mu.Lock()
+	qs.membership = m
+	var added []string
+	var removed []*Node
+	if replicates(qs.Conf) {
+		added, removed = qs.reconcilePeersLocked(m)
+	}
+	notified := make([]*Node, 0, len(qs.Nodes)+len(removed))
+	for _, node := range qs.Nodes {
+		notified = append(notified, node)
+	}
+	qs.mu.Unlock()
+
+	// the removed nodes learn the change before being disconnected
+	msg := FormatMembers(m)
+	for _, node := range append(notified, removed...) {
+		if err := node.send(msg); err != nil {
+			qs.log.Debugf("Failed to send the cluster membership to %s: %v", node, err)
+		}
+	}
+	for _, node := range removed {
+		_ = node.Close()
+	}
+	for _, address := range added {
+		go qs.connectOrRetry(address)
+	}
+	return nil
+}
+
+// reconcilePeersLocked starts replicating to the nodes of m this node does not stream to yet and
+// stops replicating to the peers m no longer has, all of them once this node itself was removed.
+// It returns the addresses to connect to and the nodes to disconnect. The caller must hold qs.mu.
+func (qs *RepService) reconcilePeersLocked(m Membership) ([]string, []*Node) {
+	self := qs.Conf.ServerAddress
+	member := func(address string) bool { return m.Has(self) && m.Has(address) }
+
+	var added []string
+	for _, address := range m.Nodes {
+		if address == self || !member(address) {
+			continue
+		}
+		p, known := qs.peers[address]
+		if !known {
+			p = newPeer(address)
+			qs.peers[address] = p
+		}
+		if !p.replicated {
+			p.replicated = true
+			added = append(added, address)
+		}
+	}
+
+	var removed []*Node
+	for address, p := range qs.peers {
+		if member(address) || !p.replicated {
+			continue
+		}
+		delete(qs.peers, address)
+		if node, connected := qs.Nodes[address]; connected {
+			delete(qs.Nodes, address)
+			removed = append(removed, node)
+		}
+	}
+	if len(removed) > 0 {
+		qs.lagChanged.Broadcast()
+	}
+	return added, removed
+}
@@ -0,0 +1,127 @@
+package replication
+
+import (
+	"bufio"
+	"creek/internal/commons"
+	"creek/internal/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MembershipFileName is the file in the data store directory holding the nodes of the cluster once
+// they changed at runtime, it takes precedence over peer_nodes on start.
+const MembershipFileName = "cluster.nodes"
+
+// Membership is the set of nodes of the cluster, this node included. Every change bumps its
+// Epoch, a node only takes a membership newer than the one it has.
+type Membership struct {
+	Epoch int
+	Nodes []string // sorted client addresses
+}
+
+func newMembership(epoch int, nodes []string) Membership {
+	nodes = slices.Clone(nodes)
+	slices.Sort(nodes)
+	return Membership{Epoch: epoch, Nodes: slices.Compact(nodes)}
+}
+
+// newerThan tells whether m replaces other. Two changes made concurrently on different nodes have
+// the same Epoch, the one listing the greatest nodes wins so every node settles on the same one.
+func (m Membership) newerThan(other Membership) bool {
+	if m.Epoch != other.Epoch {
+		return m.Epoch > other.Epoch
+	}
+	return slices.Compare(m.Nodes, other.Nodes) > 0
+}
+
+// Has tells whether address is a node of the cluster.
+func (m Membership) Has(address string) bool {
+	_, found := slices.BinarySearch(m.Nodes, address)
+	return found
+}
+
+// FormatMembers builds the message carrying a membership to another node:
+// CLUSTER MEMBERS <epoch> <address>...
+func FormatMembers(m Membership) string {
+	args := append([]string{commons.CmdSysCluster, commons.ClusterMembers, strconv.Itoa(m.Epoch)}, m.Nodes...)
+	return utils.JoinArgs(args) + "\n"
+}
+
+// ParseMembers parses the arguments following CLUSTER MEMBERS.
+func ParseMembers(args []string) (Membership, error) {
+	if len(args) < 1 {
+		return Membership{}, fmt.Errorf("missing membership epoch")
+	}
+	epoch, err := strconv.Atoi(args[0])
+	if err != nil || epoch < 0 {
+		return Membership{}, fmt.Errorf("invalid membership epoch: %s", args[0])
+	}
+	return newMembership(epoch, args[1:]), nil
+}
+
+func membershipPath(dir string) string {
+	return filepath.Join(dir, MembershipFileName)
+}
+
+// loadMembership reads the membership saved in dir, ok is false when it never changed at runtime.
+// The file holds the epoch on its first line and one address per line after it.
+func loadMembership(dir string) (Membership, bool, error) {
+	file, err := os.Open(membershipPath(dir))
+	if os.IsNotExist(err) {
+		return Membership{}, false, nil
+	}
+	if err != nil {
+		return Membership{}, false, fmt.Errorf("failed to open cluster membership: %w", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Membership{}, false, fmt.Errorf("failed to read cluster membership: %w", err)
+	}
+	m, err := ParseMembers(lines)
+	if err != nil {
+		return Membership{}, false, fmt.Errorf("invalid cluster membership in %s: %w", file.Name(), err)
+	}
+	return m, true, nil
+}
+
+// saveMembership atomically replaces the membership saved in dir.
+func saveMembership(dir string, m Membership) error {
+	var content strings.Builder
+	content.WriteString(strconv.Itoa(m.Epoch) + "\n")
+	for _, node := range m.Nodes {
+		content.WriteString(node + "\n")
+	}
+
+	path := membershipPath(dir)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	_, err = file.WriteString(content.String())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace cluster membership: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package replication
+
+import (
+	"bufio"
+	"creek/internal/commons"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commitAttempts is how many times the handover of a migrated partition is sent before giving up,
+// the target takes it again once it committed.
+const commitAttempts = 3
+
+// migration streams a partition to the node it moves to, over a connection of its own.
+type migration struct {
+	node   *Node
+	acked  int   // Version of the last write of the partition the target applied, guarded by qs.mu
+	failed error // why the stream stopped, guarded by qs.mu
+}
+
+// ImportArgs builds the request preparing target to import a partition from source.
+func ImportArgs(partitionId int, source string) []string {
+	return []string{commons.CmdSysMigrate, commons.MigrateImport, strconv.Itoa(partitionId), source}
+}
+
+// CommitArgs builds the request handing a partition over to the node it was migrated to, once it
+// applied every write up to version.
+func CommitArgs(partitionId, version int) []string {
+	return []string{commons.CmdSysMigrate, commons.MigrateCommit, strconv.Itoa(partitionId), strconv.Itoa(version)}
+}
+
+// MovePartition streams a partition to target like to a follower, starting with a snapshot unless
+// target resumes an earlier migration. Once target caught up, freeze stops the writes of the
+// partition and the partition is handed over when target applied the last one. The writes are
+// stopped for at most the peer timeout.
+func (qs *RepService) MovePartition(partitionId int, target string, freeze func() int) error {
+	client := qs.getRPCClient(target)
+	if _, err := client.Call(ImportArgs(partitionId, qs.Conf.ServerAddress)); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return err
+	}
+	node := &Node{
+		Id:           target,
+		Address:      target,
+		conn:         conn,
+		writeTimeout: qs.Conf.PeerTimeoutOrDefault(),
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	defer node.Close()
+	reader := bufio.NewReader(conn)
+	node.sent, err = qs.syncVersions(node, reader, []int{partitionId}, "")
+	if err != nil {
+		return err
+	}
+
+	m := &migration{node: node, acked: node.sent[partitionId]}
+	cursors := make(map[int]LogCursor)
+	if m.acked == 0 {
+		cursor, err := qs.logSource.ResyncLogCursor(partitionId)
+		if err != nil {
+			return err
+		}
+		cursors[partitionId] = cursor
+	}
+	qs.mu.Lock()
+	if _, exists := qs.migrations[partitionId]; exists {
+		qs.mu.Unlock()
+		return fmt.Errorf("partition %d is already migrating", partitionId)
+	}
+	qs.migrations[partitionId] = m
+	caughtUp := qs.logged[partitionId]
+	qs.mu.Unlock()
+	defer func() {
+		qs.mu.Lock()
+		delete(qs.migrations, partitionId)
+		qs.mu.Unlock()
+	}()
+	go qs.readMigrationAcks(m, reader, partitionId)
+	go qs.stream(node, cursors)
+
+	if err := qs.waitMigrated(m, caughtUp, 0); err != nil {
+		return err
+	}
+	version := freeze()
+	if err := qs.waitMigrated(m, version, qs.Conf.PeerTimeoutOrDefault()); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		_, err = client.Call(CommitArgs(partitionId, version))
+		if err == nil || attempt == commitAttempts {
+			return err
+		}
+		qs.log.Warnf("Failed to hand partition %d over to %s: %v", partitionId, target, err)
+	}
+}
+
+// waitMigrated blocks until the target of a migration applied every write up to version, the
+// stream failed or timeout elapsed when it is positive.
+func (qs *RepService) waitMigrated(m *migration, version int, timeout time.Duration) error {
+	expired := false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			qs.mu.Lock()
+			expired = true
+			qs.lagChanged.Broadcast()
+			qs.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	for m.acked < version {
+		select {
+		case <-qs.stopped:
+			return fmt.Errorf("replication service stopped")
+		default:
+		}
+		if m.failed != nil {
+			return m.failed
+		}
+		if expired {
+			return fmt.Errorf("%s applied %d of %d writes after %v", m.node, m.acked, version, timeout)
+		}
+		qs.lagChanged.Wait()
+	}
+	return nil
+}
+
+// readMigrationAcks reads the acks of the node a partition migrates to. Any error it replies
+// with fails the migration, like the connection breaking.
+func (qs *RepService) readMigrationAcks(m *migration, reader *bufio.Reader, partitionId int) {
+	fail := func(err error) {
+		qs.mu.Lock()
+		defer qs.mu.Unlock()
+		if m.failed == nil {
+			m.failed = err
+		}
+		qs.lagChanged.Broadcast()
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			fail(fmt.Errorf("connection to %s closed: %w", m.node, err))
+			return
+		}
+		line = strings.TrimSpace(line)
+		ackedPartition, version, err := ParseAck(line)
+		if err != nil || ackedPartition != partitionId {
+			qs.log.Warnf("Migration of partition %d to %s failed: %s", partitionId, m.node, line)
+			fail(fmt.Errorf("%s replied: %s", m.node, line))
+			_ = m.node.Close()
+			return
+		}
+		qs.mu.Lock()
+		m.acked = max(m.acked, version)
+		qs.lagChanged.Broadcast()
+		qs.mu.Unlock()
+	}
+}
@@ -3,6 +3,8 @@ package replication
 import (
 	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
 type Node struct {
@@ -11,6 +13,14 @@ type Node struct {
 	conn     net.Conn
 	IsSelf   bool
 	IsLeader bool
+
+	mu           sync.Mutex    // serializes sends so every partition reaches the follower in version order
+	sent         map[int]int   // highest version sent per partition, starting at the version the follower reported
+	writeTimeout time.Duration // a write blocked for longer fails, so an unresponsive follower is dropped
+
+	wake      chan struct{} // signals the stream of the follower that writes were logged
+	done      chan struct{} // closed with the connection
+	closeOnce sync.Once
 }
 
 func (n *Node) String() string {
@@ -21,6 +31,9 @@ func (n *Node) writeData(msg string) error {
 	if msg == "" {
 		return nil
 	}
+	if n.writeTimeout > 0 {
+		_ = n.conn.SetWriteDeadline(time.Now().Add(n.writeTimeout))
+	}
 	_, err := n.conn.Write([]byte(msg))
 	return err
 }
@@ -30,6 +43,11 @@ func (n *Node) IsConnected() bool {
 }
 
 func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		if n.done != nil {
+			close(n.done)
+		}
+	})
 	return n.conn.Close()
 }
 
@@ -40,3 +58,30 @@ func (n *Node) SendRepCmd(cmd *RepCmd) error {
 
 	return n.writeData(cmd.String())
 }
+
+// send writes a message on the replication connection between the writes streamed to the follower.
+func (n *Node) send(msg string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.writeData(msg)
+}
+
+// sendAll sends the writes of a partition read from the commit log, in order.
+func (n *Node) sendAll(partitionId int, cmds []*RepCmd) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, cmd := range cmds {
+		if err := n.SendRepCmd(cmd); err != nil {
+			return err
+		}
+		n.sent[partitionId] = cmd.Version
+	}
+	return nil
+}
+
+// sentVersion returns the Version of the last write of a partition sent to the follower.
+func (n *Node) sentVersion(partitionId int) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sent[partitionId]
+}
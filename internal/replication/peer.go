@@ -0,0 +1,64 @@
+package replication
+
+import (
+	"time"
+)
+
+// PeerHealth is how a peer looks from this node, judged by how long ago it was last heard from.
+type PeerHealth int
+
+const (
+	PeerDown    PeerHealth = iota // never heard from, or silent for longer than the peer timeout
+	PeerSuspect                   // missed heartbeats but did not time out yet
+	PeerUp
+)
+
+func (h PeerHealth) String() string {
+	switch h {
+	case PeerUp:
+		return "up"
+	case PeerSuspect:
+		return "suspect"
+	default:
+		return "down"
+	}
+}
+
+// PeerStatus describes a peer as seen from this node.
+type PeerStatus struct {
+	Address    string
+	Health     PeerHealth
+	LastSeen   time.Time // zero when the peer was never heard from
+	Connected  bool      // this node has a replication connection open to the peer
+	Lag        int       // writes logged by this node the peer did not acknowledge yet, over every partition
+	Stale      bool      // the peer lagged too far behind and is being resynced from a snapshot
+	Resyncs    int       // times the peer was resynced from a snapshot
+	Reconnects int       // times the replication connection to the peer was re-established
+}
+
+// peer is what this node knows about another node: when it was last heard from, through replies
+// on the replication connection or requests it sent, and how far it got in the commit log of every
+// partition. It is guarded by RepService.mu.
+type peer struct {
+	address    string
+	replicated bool // this node streams its writes to the peer
+	lastSeen   time.Time
+	reconnects int
+
+	acked   map[int]int // Version of the last write of each partition the peer acknowledged
+	stale   map[int]int // partitions the peer is resynced on, with the Version it must acknowledge
+	resyncs int
+}
+
+func newPeer(address string) *peer {
+	return &peer{address: address, acked: make(map[int]int), stale: make(map[int]int)}
+}
+
+// lag returns how many of the writes logged per partition the peer did not acknowledge.
+func (p *peer) lag(logged map[int]int) int {
+	lag := 0
+	for partitionId, version := range logged {
+		lag += max(version-p.acked[partitionId], 0)
+	}
+	return lag
+}
@@ -1,29 +1,57 @@
 package replication
 
 import (
+	"bufio"
 	"creek/internal/commons"
 	"creek/internal/config"
 	"creek/internal/logger"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"net"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-const maxAttempts = 5
-const delayBetweenAttempts = time.Second * 5
+// An unreachable follower is dialed again after minReconnectDelay, the delay doubling after every
+// failed attempt up to maxReconnectDelay.
+const minReconnectDelay = 200 * time.Millisecond
+const maxReconnectDelay = 5 * time.Second
+const syncTimeout = time.Second * 5
+
+// AckHandler is notified when a follower acknowledges every write of a partition up to version.
+type AckHandler func(nodeId string, partitionId, version int)
 
 // RepService represents a replication service that manages the communication between nodes in a distributed system.
 type RepService struct {
-	Nodes map[string]*Node // A map of connected nodes, keyed by their IDs.
-	Conf  *config.Config   // The configuration for this replication service.
-	mu    sync.Mutex       // A mutex to protect access to the Nodes map.
-	log   *logrus.Logger   // A logger for logging messages related to this replication service.
+	Nodes      map[string]*Node      // A map of connected nodes, keyed by their IDs.
+	Conf       *config.Config        // The configuration for this replication service.
+	mu         sync.Mutex            // A mutex to protect access to the Nodes map.
+	log        *logrus.Logger        // A logger for logging messages related to this replication service.
+	rpcClients map[string]*RPCClient // Request/response connections to peers, keyed by address.
+	ackHandler AckHandler            // Receives acks read back from follower connections.
+	logSource  LogSource             // Reads the writes streamed to followers from the commit log.
+	stopped    chan struct{}         // Closed by Stop so followers are no longer reconnected.
+	leader     *Node                 // The leader that last synced with this follower, nil until then.
+	peers      map[string]*peer      // What is known about every other node, keyed by address.
+	logged     map[int]int           // Version of the last write logged per partition.
+	lagChanged *sync.Cond            // Signaled on qs.mu when a follower acks or disconnects.
+
+	membership   Membership // The nodes of the cluster, guarded by mu.
+	membershipMu sync.Mutex // Serializes membership changes, held while they are saved.
+
+	migrations map[int]*migration // Partitions being moved to another node, keyed by id.
 }
 
 // GetNodes returns all nodes right now, once data partition is introduced this result will be based on partitionId.
 func (qs *RepService) GetNodes(partitionId int) []*Node {
+	return qs.connectedNodes()
+}
+
+// connectedNodes returns the followers this node has a replication connection to.
+func (qs *RepService) connectedNodes() []*Node {
 	qs.mu.Lock()
 	defer qs.mu.Unlock()
 
@@ -34,70 +62,452 @@ func (qs *RepService) GetNodes(partitionId int) []*Node {
 	return nodes
 }
 
-// NewRepService creates a new replication service with the given configuration.
+// NewRepService creates a new replication service with the given configuration. The membership
+// saved by a runtime change replaces peer_nodes for a node that replicates its writes.
 func NewRepService(cfg *config.Config) (*RepService, error) {
+	membership, saved, err := loadMembership(cfg.DataStoreDirectory)
+	if err != nil {
+		return nil, err
+	}
+	peers := cfg.PeerNodes
+	if !saved {
+		membership = newMembership(0, append([]string{cfg.ServerAddress}, cfg.PeerNodes...))
+	} else if replicates(cfg) {
+		peers = slices.DeleteFunc(slices.Clone(membership.Nodes), func(node string) bool {
+			return node == cfg.ServerAddress || !membership.Has(cfg.ServerAddress)
+		})
+	}
+
 	qs := &RepService{
-		Nodes: make(map[string]*Node),
-		Conf:  cfg,
-		log:   logger.CreateLogger(cfg.LogLevel),
+		Nodes:      make(map[string]*Node),
+		Conf:       cfg,
+		log:        logger.CreateLogger(cfg.LogLevel),
+		rpcClients: make(map[string]*RPCClient),
+		stopped:    make(chan struct{}),
+		peers:      make(map[string]*peer),
+		logged:     make(map[int]int),
+		membership: membership,
+		migrations: make(map[int]*migration),
+	}
+	qs.lagChanged = sync.NewCond(&qs.mu)
+	for _, address := range peers {
+		qs.peers[address] = newPeer(address)
 	}
 	return qs, nil
 }
 
-// ConnectToFollowers connects to all follower nodes in the distributed system.
+// ConnectToFollowers connects to all follower nodes in the distributed system, multi-master
+// nodes connect to every peer. Followers that are not reachable yet are retried in the background
+// until the service stops, and connected ones are pinged every heartbeat interval.
 func (qs *RepService) ConnectToFollowers() {
-	if qs.Conf.ServerMode != commons.Leader {
+	if !replicates(qs.Conf) {
+		return
+	}
+
+	logged := make(map[int]int)
+	for partitionId := 0; partitionId < qs.Conf.PartitionCountOrDefault(); partitionId++ {
+		logged[partitionId] = qs.logSource.LoggedVersion(partitionId)
+	}
+	qs.mu.Lock()
+	for partitionId, version := range logged {
+		qs.logged[partitionId] = max(qs.logged[partitionId], version)
+	}
+	var addresses []string
+	for address, p := range qs.peers {
+		p.replicated = true
+		addresses = append(addresses, address)
+	}
+	qs.mu.Unlock()
+	go qs.heartbeat()
+
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			qs.connectOrRetry(address)
+		}(address)
+	}
+	wg.Wait()
+}
+
+// connectOrRetry connects to a follower, retrying in the background when it is not reachable.
+func (qs *RepService) connectOrRetry(address string) {
+	if err := qs.connectToFollower(address); err != nil {
+		qs.log.Warnf("Failed to connect to peer %s: %v", address, err)
+		go qs.reconnect(address)
+	}
+}
+
+// AttachAckHandler sets the handler receiving follower acks, it must be called before
+// ConnectToFollowers.
+func (qs *RepService) AttachAckHandler(handler AckHandler) {
+	qs.ackHandler = handler
+}
+
+// SetLeader records the address of the leader replicating to this node, it is the target of
+// the writes this node redirects.
+func (qs *RepService) SetLeader(address string) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.leader != nil && qs.leader.Address == address {
 		return
 	}
+	qs.log.Infof("Following leader %s", address)
+	if _, known := qs.peers[address]; !known {
+		qs.peers[address] = newPeer(address)
+	}
+	qs.peers[address].lastSeen = time.Now()
+	qs.leader = &Node{
+		Id:       address,
+		Address:  address,
+		IsSelf:   false,
+		IsLeader: true,
+	}
+}
 
-	for _, address := range qs.Conf.PeerNodes {
-		attempts := 0
-		for attempts < maxAttempts {
-			conn, err := net.Dial("tcp", address)
+// LeaderAddress returns the address of the leader of a partition, empty while no leader synced
+// with this node or once it has been silent for longer than the peer timeout. With static
+// election the same leader replicates every partition.
+func (qs *RepService) LeaderAddress(partitionId int) string {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.leader == nil || qs.healthLocked(qs.peers[qs.leader.Address], time.Now()) == PeerDown {
+		return ""
+	}
+	return qs.leader.Address
+}
+
+// RecordHeartbeat notes that a known peer was just heard from, through a request it sent.
+// Replies read on the connections this node opened are recorded the same way.
+func (qs *RepService) RecordHeartbeat(address string) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if p, known := qs.peers[address]; known {
+		p.lastSeen = time.Now()
+	}
+}
+
+// PeerStatuses describes every known peer, ordered by address.
+func (qs *RepService) PeerStatuses() []PeerStatus {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	now := time.Now()
+	statuses := make([]PeerStatus, 0, len(qs.peers))
+	for address, p := range qs.peers {
+		_, connected := qs.Nodes[address]
+		status := PeerStatus{
+			Address:    address,
+			Health:     qs.healthLocked(p, now),
+			LastSeen:   p.lastSeen,
+			Connected:  connected,
+			Stale:      len(p.stale) > 0,
+			Resyncs:    p.resyncs,
+			Reconnects: p.reconnects,
+		}
+		if p.replicated {
+			status.Lag = p.lag(qs.logged)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+	return statuses
+}
+
+// healthLocked judges a peer by how long ago it was heard from. It is suspect once it missed two
+// heartbeats and down after the peer timeout. The caller must hold qs.mu.
+func (qs *RepService) healthLocked(p *peer, now time.Time) PeerHealth {
+	if p == nil || p.lastSeen.IsZero() {
+		return PeerDown
+	}
+	silence := now.Sub(p.lastSeen)
+	switch {
+	case silence > qs.Conf.PeerTimeoutOrDefault():
+		return PeerDown
+	case silence > 2*qs.Conf.HeartbeatIntervalOrDefault():
+		return PeerSuspect
+	default:
+		return PeerUp
+	}
+}
+
+// heartbeat pings every connected follower each heartbeat interval, the pongs read back by
+// readReplies keep them up. A follower silent for longer than the peer timeout is disconnected,
+// which reconnects it.
+func (qs *RepService) heartbeat() {
+	ticker := time.NewTicker(qs.Conf.HeartbeatIntervalOrDefault())
+	defer ticker.Stop()
+	ping := FormatPing(qs.Conf.ServerAddress)
+
+	for {
+		select {
+		case <-qs.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		for _, node := range qs.connectedNodes() {
+			if qs.health(node.Id) == PeerDown {
+				qs.log.Warnf("Peer %s did not answer for %v, reconnecting", node, qs.Conf.PeerTimeoutOrDefault())
+				_ = node.Close() // readReplies notices the closed connection and reconnects
+				continue
+			}
+			// a node busy sending writes does not need a ping, its acks show it is alive
+			if !node.mu.TryLock() {
+				continue
+			}
+			err := node.writeData(ping)
+			node.mu.Unlock()
 			if err != nil {
-				qs.log.Warnf("Failed to connect to peer %s: %v", address, err)
-				attempts++
-				time.Sleep(delayBetweenAttempts)
-			} else {
-				node := &Node{
-					Id:       address,
-					Address:  address,
-					conn:     conn,
-					IsSelf:   false,
-					IsLeader: false,
-				}
-				qs.addNode(node)
-				break
+				qs.log.Debugf("Failed to ping %s: %v", node, err)
+				_ = node.Close()
 			}
 		}
 	}
 }
 
-// addNode adds a new node to the replication service.
-func (qs *RepService) addNode(node *Node) {
+func (qs *RepService) health(address string) PeerHealth {
 	qs.mu.Lock()
 	defer qs.mu.Unlock()
-	qs.Nodes[node.Id] = node
+	return qs.healthLocked(qs.peers[address], time.Now())
 }
 
-// HandleRepCmdWrite handles a write command by sending it to all nodes in the distributed system.
-func (qs *RepService) HandleRepCmdWrite(cmd *RepCmd) error {
-	nodes := qs.GetNodes(cmd.PartitionId)
-	for _, node := range nodes {
-		qs.log.Tracef("Sending write command to node: %v", node)
-		err := node.SendRepCmd(cmd)
-		if err != nil {
-			return err
+// reconnect dials a follower until it is reachable again, it left the cluster or the service
+// stops, backing off exponentially between attempts.
+func (qs *RepService) reconnect(address string) {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-qs.stopped:
+			return
+		case <-time.After(delay):
+		}
+		if !qs.isReplicated(address) {
+			return
+		}
+
+		err := qs.connectToFollower(address)
+		if err == nil {
+			qs.mu.Lock()
+			if p, known := qs.peers[address]; known {
+				p.reconnects++
+			}
+			qs.mu.Unlock()
+			return
+		}
+		qs.log.Debugf("Failed to reconnect to peer %s: %v", address, err)
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// isReplicated tells whether this node streams its writes to a peer.
+func (qs *RepService) isReplicated(address string) bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	p, known := qs.peers[address]
+	return known && p.replicated
+}
+
+// connectToFollower dials a follower, asks which version it applied on every partition and
+// starts streaming it the writes logged since.
+func (qs *RepService) connectToFollower(address string) error {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	node := &Node{
+		Id:           address,
+		Address:      address,
+		conn:         conn,
+		IsSelf:       false,
+		IsLeader:     false,
+		writeTimeout: qs.Conf.PeerTimeoutOrDefault(),
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+
+	reader := bufio.NewReader(conn)
+	node.sent, err = qs.syncVersions(node, reader, qs.partitionIds(), qs.Conf.ServerAddress)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	qs.RecordHeartbeat(address)
+	if !qs.addNode(node) {
+		return conn.Close()
+	}
+	if m := qs.Membership(); m.Epoch > 0 {
+		// the follower may have missed membership changes while unreachable
+		if err := node.send(FormatMembers(m)); err != nil {
+			qs.log.Debugf("Failed to send the cluster membership to %s: %v", node, err)
 		}
 	}
+	go qs.readReplies(node, reader)
+	go qs.stream(node, make(map[int]LogCursor))
 	return nil
 }
 
+func (qs *RepService) partitionIds() []int {
+	ids := make([]int, qs.Conf.PartitionCountOrDefault())
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
+
+// syncVersions sends a SYNC request per partition and collects the versions the follower acks.
+// The follower takes leader as the node it follows unless it is empty.
+func (qs *RepService) syncVersions(node *Node, reader *bufio.Reader, partitionIds []int, leader string) (map[int]int, error) {
+	partitionCount := len(partitionIds)
+	var request strings.Builder
+	for _, partitionId := range partitionIds {
+		request.WriteString(FormatSync(partitionId, leader))
+	}
+	if err := node.writeData(request.String()); err != nil {
+		return nil, err
+	}
+
+	_ = node.conn.SetReadDeadline(time.Now().Add(syncTimeout))
+	defer node.conn.SetReadDeadline(time.Time{})
+
+	versions := make(map[int]int, partitionCount)
+	for len(versions) < partitionCount {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sync reply: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		partitionId, version, err := ParseAck(line)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected sync reply: %s", line)
+		}
+		versions[partitionId] = version
+	}
+	qs.log.Infof("Connected to %s, applied versions %v", node, versions)
+	return versions, nil
+}
+
+// readReplies consumes everything a follower writes back on the replication connection and
+// forwards acks to the ack handler. When the connection breaks the follower is dropped and
+// reconnected, catching up on the writes it missed.
+func (qs *RepService) readReplies(node *Node, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			qs.log.Debugf("Replication connection to %s closed: %v", node, err)
+			if qs.removeNode(node) {
+				_ = node.Close()
+				go qs.reconnect(node.Address)
+			}
+			return
+		}
+		qs.RecordHeartbeat(node.Id)
+		line = strings.TrimSpace(line)
+		if line == commons.CmdSysPong {
+			continue
+		}
+		if !strings.HasPrefix(line, commons.CmdSysAck+" ") {
+			// an error reported by the follower
+			qs.log.Debugf("Reply from %s: %s", node, line)
+			continue
+		}
+
+		partitionId, version, err := ParseAck(line)
+		if err != nil {
+			qs.log.Warnf("Invalid ack from %s: %v", node, err)
+			continue
+		}
+		qs.recordAck(node.Id, partitionId, version)
+		if qs.ackHandler != nil {
+			qs.ackHandler(node.Id, partitionId, version)
+		}
+	}
+}
+
+// addNode adds a new node to the replication service, it returns false once the service stopped
+// or the node left the cluster. The versions the node synced are what it acknowledged so far, and
+// it is no longer stale.
+func (qs *RepService) addNode(node *Node) bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	select {
+	case <-qs.stopped:
+		return false
+	default:
+	}
+	p, known := qs.peers[node.Id]
+	if !known || !p.replicated {
+		return false
+	}
+	qs.Nodes[node.Id] = node
+	for partitionId, version := range node.sent {
+		p.acked[partitionId] = version
+	}
+	clear(p.stale)
+	qs.lagChanged.Broadcast()
+	return true
+}
+
+// removeNode drops a node unless it was already replaced or the service stopped.
+func (qs *RepService) removeNode(node *Node) bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if qs.Nodes[node.Id] != node {
+		return false
+	}
+	delete(qs.Nodes, node.Id)
+	qs.lagChanged.Broadcast()
+	return true
+}
+
+// Call sends a RAFT system command to a peer and returns the integers it replied with.
+// It makes RepService usable as the raft transport of every partition.
+func (qs *RepService) Call(peer string, args []string) ([]int64, error) {
+	return qs.getRPCClient(peer).CallInts(args)
+}
+
+// MerkleHashes asks a peer for the hashes of nodes at a level of the Merkle tree of a partition.
+func (qs *RepService) MerkleHashes(peer string, partitionId, level int, nodes []int) ([]uint64, error) {
+	ints, err := qs.getRPCClient(peer).CallInts(MerkleArgs(partitionId, level, nodes))
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]uint64, len(ints))
+	for i, n := range ints {
+		hashes[i] = uint64(n)
+	}
+	return hashes, nil
+}
+
+// RangeEntries asks a peer for the entries under leaves of the Merkle tree of a partition.
+func (qs *RepService) RangeEntries(peer string, partitionId int, leaves []int) ([]string, error) {
+	return qs.getRPCClient(peer).CallStrings(RangeArgs(partitionId, leaves))
+}
+
+func (qs *RepService) getRPCClient(peer string) *RPCClient {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	client, exists := qs.rpcClients[peer]
+	if !exists {
+		timeout, _ := qs.Conf.RaftTimeouts()
+		client = NewRPCClient(peer, timeout)
+		qs.rpcClients[peer] = client
+	}
+	return client
+}
+
 // Stop stops the replication service and disconnects from all nodes in the distributed system.
 func (qs *RepService) Stop() error {
 	qs.mu.Lock()
 	defer qs.mu.Unlock()
 
+	select {
+	case <-qs.stopped:
+	default:
+		close(qs.stopped)
+		qs.lagChanged.Broadcast()
+	}
+
 	isError := false
 
 	for id, node := range qs.Nodes {
@@ -109,6 +519,12 @@ func (qs *RepService) Stop() error {
 		}
 		delete(qs.Nodes, id)
 	}
+	for peer, client := range qs.rpcClients {
+		if err := client.Close(); err != nil {
+			qs.log.Warnf("Error closing rpc connection to %s: %v", peer, err)
+		}
+		delete(qs.rpcClients, peer)
+	}
 	qs.log.Info("Disconnected from all nodes.")
 	if isError {
 		return fmt.Errorf("error closing few nodes")
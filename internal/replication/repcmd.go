@@ -2,6 +2,7 @@ package replication
 
 import (
 	"creek/internal/commons"
+	"creek/internal/utils"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -10,111 +11,42 @@ import (
 
 type RepCmd struct {
 	PartitionId int
-	Origin      string
+	Origin      string // node streaming the command, whose log the Version belongs to
+	Writer      string // node the write was made on, the Origin when empty
 	Timestamp   int64
 	Operation   string
 	Args        []string
 	Version     int
 }
 
+// String encodes the command as a single REP line. Args are quoted so that values containing
+// spaces, newlines or binary data survive the trip over the text protocol.
 func (rm *RepCmd) String() string {
 	return fmt.Sprintf(
-		"%s %d %s %d %d %s %s\n",
+		"%s %d %s %s %d %d %s %s\n",
 		commons.CmdSysRep,
 		rm.PartitionId,
-		rm.Origin,
+		utils.QuoteArg(rm.Origin),
+		utils.QuoteArg(rm.WriteOrigin()),
 		rm.Timestamp,
 		rm.Version,
 		rm.Operation,
-		strings.Join(rm.Args, " "),
+		utils.JoinArgs(rm.Args),
 	)
 }
 
 func RepCmdFromString(s string) (*RepCmd, error) {
-	s = strings.TrimSpace(s)
-
-	// Extract CmdSysRep
-	sysRepEnd := strings.IndexByte(s, ' ')
-	if sysRepEnd == -1 {
-		return nil, fmt.Errorf("invalid format: missing fields")
-	}
-	sysRepMsg := s[:sysRepEnd]
-	if sysRepMsg != commons.CmdSysRep {
-		return nil, fmt.Errorf("invalid format: invalid CmdSysRep")
-	}
-
-	// Extract PartitionId
-	partitionStart := sysRepEnd + 1
-	partitionEnd := strings.IndexByte(s[partitionStart:], ' ')
-	if partitionEnd == -1 {
-		return nil, fmt.Errorf("invalid format: missing fields")
-	}
-	partitionEnd += partitionStart
-	partitionId, err := strconv.Atoi(s[partitionStart:partitionEnd])
+	parts, err := utils.SplitArgs(strings.TrimSpace(s))
 	if err != nil {
-		return nil, fmt.Errorf("invalid PartitionId: %v", err)
+		return nil, fmt.Errorf("invalid format: %v", err)
 	}
-
-	// Extract Origin
-	nodeIdStart := partitionEnd + 1
-	nodeIdEnd := strings.IndexByte(s[nodeIdStart:], ' ')
-	if nodeIdEnd == -1 {
-		return nil, fmt.Errorf("invalid format: missing fields")
-	}
-	nodeIdEnd += nodeIdStart
-	nodeId := s[nodeIdStart:nodeIdEnd]
-
-	// Extract Timestamp
-	timestampStart := nodeIdEnd + 1
-	timestampEnd := strings.IndexByte(s[timestampStart:], ' ')
-	if timestampEnd == -1 {
+	if len(parts) < 7 {
 		return nil, fmt.Errorf("invalid format: missing fields")
 	}
-	timestampEnd += timestampStart
-	timestamp, err := strconv.ParseInt(s[timestampStart:timestampEnd], 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("invalid Timestamp: %v", err)
-	}
-
-	versionStart := timestampEnd + 1
-	versionEnd := strings.IndexByte(s[versionStart:], ' ')
-	if versionEnd == -1 {
-		return nil, fmt.Errorf("invalid format: missing fields")
-	}
-	versionEnd += versionStart
-	version, err := strconv.Atoi(s[versionStart:versionEnd])
-	if err != nil {
-		return nil, fmt.Errorf("invalid Version: %v", err)
-	}
-
-	// Extract Operation
-	operationStart := versionEnd + 1
-	operationEnd := strings.IndexByte(s[operationStart:], ' ')
-	if operationEnd == -1 {
-		// No arguments, only operation
-		return &RepCmd{
-			PartitionId: partitionId,
-			Origin:      nodeId,
-			Timestamp:   timestamp,
-			Operation:   s[operationStart:],
-			Version:     version,
-			Args:        nil,
-		}, nil
+	if parts[0] != commons.CmdSysRep {
+		return nil, fmt.Errorf("invalid format: invalid CmdSysRep")
 	}
-	operationEnd += operationStart
-	operation := s[operationStart:operationEnd]
-
-	// Extract Args (if any)
-	args := strings.Fields(s[operationEnd+1:])
-
-	return &RepCmd{
-		PartitionId: partitionId,
-		Origin:      nodeId,
-		Timestamp:   timestamp,
-		Operation:   operation,
-		Args:        args,
-		Version:     version,
-	}, nil
+	return RepCmdFromArgs(parts[1:])
 }
 
 func (rm *RepCmd) Equals(other *RepCmd) bool {
@@ -123,6 +55,7 @@ func (rm *RepCmd) Equals(other *RepCmd) bool {
 	}
 	return rm.PartitionId == other.PartitionId &&
 		rm.Origin == other.Origin &&
+		rm.WriteOrigin() == other.WriteOrigin() &&
 		rm.Timestamp == other.Timestamp &&
 		rm.Operation == other.Operation &&
 		reflect.DeepEqual(rm.Args, other.Args) &&
@@ -141,23 +74,92 @@ func RepCmdFromArgs(args []string) (*RepCmd, error) {
 	}
 
 	// Extract Timestamp
-	timestamp, err := strconv.ParseInt(args[2], 10, 64)
+	timestamp, err := strconv.ParseInt(args[3], 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("invalid Timestamp: %v", err)
 	}
 
 	// Extract Version
-	version, err := strconv.Atoi(args[3])
+	version, err := strconv.Atoi(args[4])
 	if err != nil {
 		return nil, fmt.Errorf("invalid Version: %v", err)
 	}
 
+	var cmdArgs []string
+	if len(args) > 6 {
+		cmdArgs = args[6:]
+	}
+
 	return &RepCmd{
 		PartitionId: partitionId,
 		Origin:      args[1],
+		Writer:      args[2],
 		Timestamp:   timestamp,
-		Operation:   args[4],
-		Args:        args[5:],
+		Operation:   args[5],
+		Args:        cmdArgs,
 		Version:     version,
 	}, nil
 }
+
+// WriteOrigin returns the node the write was made on.
+func (rm *RepCmd) WriteOrigin() string {
+	if rm.Writer == "" {
+		return rm.Origin
+	}
+	return rm.Writer
+}
+
+// FormatAck builds the reply a follower sends once a REP command is durably applied.
+func FormatAck(partitionId, version int) string {
+	return fmt.Sprintf("%s %d %d", commons.CmdSysAck, partitionId, version)
+}
+
+// ParseAck parses a reply built by FormatAck.
+func ParseAck(line string) (int, int, error) {
+	parts := strings.Fields(line)
+	if len(parts) != 3 || parts[0] != commons.CmdSysAck {
+		return 0, 0, fmt.Errorf("invalid ack: %q", line)
+	}
+	partitionId, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ack partition id: %v", err)
+	}
+	version, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ack version: %v", err)
+	}
+	return partitionId, version, nil
+}
+
+// FormatSync builds the request asking a follower for the last Version it applied on a partition,
+// the follower answers with an ack. leader is the client address of the sender, the follower
+// redirects the writes it rejects there.
+func FormatSync(partitionId int, leader string) string {
+	return fmt.Sprintf("%s %d %s\n", commons.CmdSysSync, partitionId, leader)
+}
+
+// FormatPing builds the heartbeat a node sends on its replication connections, the peer answers
+// with a pong. address is the client address of the sender, the peer records it as alive.
+func FormatPing(address string) string {
+	return fmt.Sprintf("%s %s\n", commons.CmdSysPing, address)
+}
+
+// MerkleArgs builds the request asking a peer for the hashes of nodes at a level of the Merkle tree
+// of a partition, the peer answers with one integer per node.
+func MerkleArgs(partitionId, level int, nodes []int) []string {
+	args := []string{commons.CmdSysRep, commons.RepMerkle, strconv.Itoa(partitionId), strconv.Itoa(level)}
+	for _, node := range nodes {
+		args = append(args, strconv.Itoa(node))
+	}
+	return args
+}
+
+// RangeArgs builds the request asking a peer for the entries under leaves of the Merkle tree of a
+// partition, the peer answers with the fields of every entry one after the other, like a LOAD.
+func RangeArgs(partitionId int, leaves []int) []string {
+	args := []string{commons.CmdSysRep, commons.RepRange, strconv.Itoa(partitionId)}
+	for _, leaf := range leaves {
+		args = append(args, strconv.Itoa(leaf))
+	}
+	return args
+}
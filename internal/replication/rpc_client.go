@@ -0,0 +1,121 @@
+package replication
+
+import (
+	"bufio"
+	"creek/internal/resp"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RPCClient sends request/response system commands to a single peer. It speaks RESP so
+// arguments are binary safe. The connection is dialed lazily and re-dialed after any failure.
+type RPCClient struct {
+	address string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *resp.Reader
+	writer *resp.Writer
+}
+
+func NewRPCClient(address string, timeout time.Duration) *RPCClient {
+	return &RPCClient{address: address, timeout: timeout}
+}
+
+// Call sends args as a single command and waits for the reply. Error replies are returned
+// as errors.
+func (c *RPCClient) Call(args []string) (resp.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		c.conn = conn
+		c.reader = resp.NewReader(bufio.NewReader(conn))
+		c.writer = resp.NewWriter(bufio.NewWriter(conn))
+	}
+
+	value, err := c.roundTrip(args)
+	if err != nil {
+		c.closeLocked()
+		return resp.Value{}, err
+	}
+	if value.Type == resp.TypeError {
+		return resp.Value{}, fmt.Errorf("peer %s: %s", c.address, value.Str)
+	}
+	return value, nil
+}
+
+// CallInts is Call for commands replying with an array of integers.
+func (c *RPCClient) CallInts(args []string) ([]int64, error) {
+	value, err := c.Call(args)
+	if err != nil {
+		return nil, err
+	}
+	if value.Type != resp.TypeArray {
+		return nil, fmt.Errorf("peer %s: expected array reply, got '%c'", c.address, value.Type)
+	}
+	ints := make([]int64, len(value.Elems))
+	for i, elem := range value.Elems {
+		if elem.Type != resp.TypeInteger {
+			return nil, fmt.Errorf("peer %s: expected integer reply, got '%c'", c.address, elem.Type)
+		}
+		ints[i] = elem.Int
+	}
+	return ints, nil
+}
+
+// CallStrings is Call for commands replying with an array of bulk strings.
+func (c *RPCClient) CallStrings(args []string) ([]string, error) {
+	value, err := c.Call(args)
+	if err != nil {
+		return nil, err
+	}
+	if value.Type != resp.TypeArray {
+		return nil, fmt.Errorf("peer %s: expected array reply, got '%c'", c.address, value.Type)
+	}
+	strs := make([]string, len(value.Elems))
+	for i, elem := range value.Elems {
+		if elem.Type != resp.TypeBulkString && elem.Type != resp.TypeSimpleString {
+			return nil, fmt.Errorf("peer %s: expected string reply, got '%c'", c.address, elem.Type)
+		}
+		strs[i] = elem.Str
+	}
+	return strs, nil
+}
+
+func (c *RPCClient) roundTrip(args []string) (resp.Value, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return resp.Value{}, err
+	}
+	if err := c.writer.WriteCommand(args...); err != nil {
+		return resp.Value{}, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return resp.Value{}, err
+	}
+	return c.reader.ReadValue()
+}
+
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeLocked()
+}
+
+func (c *RPCClient) closeLocked() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.reader = nil
+	c.writer = nil
+	return err
+}
@@ -0,0 +1,233 @@
+package replication
+
+import (
+	"creek/internal/commons"
+	"time"
+)
+
+// streamBatchSize is the number of writes read from the commit log at a time for a follower.
+const streamBatchSize = 100
+
+// LogCursor reads the writes of a partition a follower did not get yet from the commit log.
+type LogCursor interface {
+	// Next returns up to max of the writes following the last one read, none once caught up.
+	Next(max int) ([]*RepCmd, error)
+	Close() error
+}
+
+// LogSource gives access to the commit logs of the partitions this node leads.
+type LogSource interface {
+	// OpenLogCursor returns a cursor reading the writes of a partition logged after version.
+	OpenLogCursor(partitionId, version int) (LogCursor, error)
+	// ResyncLogCursor returns a cursor reading a fresh snapshot of a partition first.
+	ResyncLogCursor(partitionId int) (LogCursor, error)
+	// LoggedVersion returns the Version of the last write logged by a partition.
+	LoggedVersion(partitionId int) int
+}
+
+// AttachLogSource sets where the writes streamed to followers are read from, it must be called
+// before ConnectToFollowers.
+func (qs *RepService) AttachLogSource(source LogSource) {
+	qs.logSource = source
+}
+
+// NotifyAppended tells that a write of a partition was logged, it wakes up the streams of every
+// connected follower and of the node the partition migrates to. It is called with the partition
+// locked so it must not block.
+func (qs *RepService) NotifyAppended(partitionId, version int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if version > qs.logged[partitionId] {
+		qs.logged[partitionId] = version
+	}
+	for _, node := range qs.Nodes {
+		wakeUp(node)
+	}
+	if m, migrating := qs.migrations[partitionId]; migrating {
+		wakeUp(m.node)
+	}
+}
+
+func wakeUp(node *Node) {
+	select {
+	case node.wake <- struct{}{}:
+	default: // already woken up, the stream reads every write logged since
+	}
+}
+
+// WaitForFollowers blocks a write of a partition while a connected follower has more than
+// replication_max_lag writes of it unacknowledged, under the LagBlock policy. A follower that
+// disconnects stops holding writes back, it reads what it missed from the commit log once back.
+// So does a follower that did not catch up within peer_timeout_ms, it is marked stale until it
+// acknowledges the writes logged so far.
+func (qs *RepService) WaitForFollowers(partitionId, version int) {
+	if qs.Conf.ReplicationLagPolicy != commons.LagBlock {
+		return
+	}
+	minAcked := version - qs.Conf.ReplicationMaxLagOrDefault()
+	timeout := qs.Conf.PeerTimeoutOrDefault()
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		qs.mu.Lock()
+		expired = true
+		qs.lagChanged.Broadcast()
+		qs.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	for {
+		lagging := qs.laggingLocked(partitionId, minAcked)
+		if len(lagging) == 0 {
+			return
+		}
+		if expired {
+			logged := qs.logged[partitionId]
+			for _, p := range lagging {
+				qs.log.Warnf("Peer %s did not catch up with partition %d within %v, no longer holding writes back for it",
+					p.address, partitionId, timeout)
+				p.stale[partitionId] = logged
+			}
+			return
+		}
+		qs.lagChanged.Wait()
+	}
+}
+
+// laggingLocked returns the connected followers that acknowledged less than minAcked of a
+// partition, leaving out those already stale on it. The caller must hold qs.mu.
+func (qs *RepService) laggingLocked(partitionId, minAcked int) []*peer {
+	select {
+	case <-qs.stopped:
+		return nil
+	default:
+	}
+	var lagging []*peer
+	for address := range qs.Nodes {
+		p := qs.peers[address]
+		if _, stale := p.stale[partitionId]; stale {
+			continue
+		}
+		if p.acked[partitionId] < minAcked {
+			lagging = append(lagging, p)
+		}
+	}
+	return lagging
+}
+
+// recordAck notes that a follower applied every write of a partition up to version.
+func (qs *RepService) recordAck(address string, partitionId, version int) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	p, known := qs.peers[address]
+	if !known {
+		return // the follower left the cluster
+	}
+	if version > p.acked[partitionId] {
+		p.acked[partitionId] = version
+	}
+	if resyncedAt, stale := p.stale[partitionId]; stale && p.acked[partitionId] >= resyncedAt {
+		delete(p.stale, partitionId)
+		qs.log.Infof("Peer %s caught up with partition %d, it is no longer stale", address, partitionId)
+	}
+	qs.lagChanged.Broadcast()
+}
+
+// stream sends a follower every write it did not get yet, reading them from the commit log with a
+// cursor per partition that starts at the Version the follower reported, unless one is given. It
+// runs until the connection is closed, woken up by NotifyAppended.
+func (qs *RepService) stream(node *Node, cursors map[int]LogCursor) {
+	defer func() {
+		for partitionId, cursor := range cursors {
+			if err := cursor.Close(); err != nil {
+				qs.log.Warnf("Error closing the log cursor of partition %d for %s: %v", partitionId, node, err)
+			}
+		}
+	}()
+
+	for {
+		for partitionId := range node.sent {
+			if err := qs.sendPending(node, cursors, partitionId); err != nil {
+				qs.log.Errorf("Error streaming partition %d to %s: %v", partitionId, node, err)
+				_ = node.Close() // readReplies notices the closed connection and reconnects
+				return
+			}
+		}
+
+		select {
+		case <-node.wake:
+		case <-node.done:
+			return
+		case <-qs.stopped:
+			return
+		}
+	}
+}
+
+// sendPending sends a follower the writes of a partition logged since the last one it was sent.
+func (qs *RepService) sendPending(node *Node, cursors map[int]LogCursor, partitionId int) error {
+	for {
+		logged, resync := qs.checkLag(node.Id, partitionId)
+		if resync {
+			if cursor := cursors[partitionId]; cursor != nil {
+				_ = cursor.Close()
+			}
+			delete(cursors, partitionId)
+			cursor, err := qs.logSource.ResyncLogCursor(partitionId)
+			if err != nil {
+				return err
+			}
+			cursors[partitionId] = cursor
+		} else if logged <= node.sentVersion(partitionId) {
+			return nil
+		}
+
+		cursor := cursors[partitionId]
+		if cursor == nil {
+			var err error
+			if cursor, err = qs.logSource.OpenLogCursor(partitionId, node.sentVersion(partitionId)); err != nil {
+				return err
+			}
+			cursors[partitionId] = cursor
+		}
+		cmds, err := cursor.Next(streamBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(cmds) == 0 {
+			return nil
+		}
+		if err := node.sendAll(partitionId, cmds); err != nil {
+			return err
+		}
+	}
+}
+
+// checkLag returns the Version of the last write logged by a partition, and whether a follower
+// lags so far behind it that it must be resynced under the LagResync policy. The follower is then
+// marked stale until it acknowledges the writes logged so far.
+func (qs *RepService) checkLag(address string, partitionId int) (int, bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	logged := qs.logged[partitionId]
+	if qs.Conf.ReplicationLagPolicy != commons.LagResync {
+		return logged, false
+	}
+	p, known := qs.peers[address]
+	if !known {
+		return logged, false
+	}
+	if _, stale := p.stale[partitionId]; stale {
+		return logged, false
+	}
+	lag := logged - p.acked[partitionId]
+	if lag <= qs.Conf.ReplicationMaxLagOrDefault() {
+		return logged, false
+	}
+	qs.log.Warnf("Peer %s lags %d writes behind on partition %d, resyncing it from a snapshot", address, lag, partitionId)
+	p.stale[partitionId] = logged
+	p.resyncs++
+	return logged, true
+}
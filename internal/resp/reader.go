@@ -0,0 +1,217 @@
+package resp
+
+import (
+	"bufio"
+	"creek/internal/utils"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Type prefixes used on the wire by RESP2 and RESP3.
+const (
+	TypeSimpleString = '+'
+	TypeError        = '-'
+	TypeInteger      = ':'
+	TypeBulkString   = '$'
+	TypeArray        = '*'
+	TypeNull         = '_'
+	TypeBoolean      = '#'
+	TypeDouble       = ','
+	TypeMap          = '%'
+	TypeSet          = '~'
+	TypePush         = '>'
+	TypeVerbatim     = '='
+	TypeBigNumber    = '('
+	TypeBlobError    = '!'
+)
+
+// maxBulkLength caps a single bulk string so a corrupt length cannot exhaust memory.
+const maxBulkLength = 512 * 1024 * 1024
+
+// maxArrayLength caps the number of elements accepted in a single array header.
+const maxArrayLength = 1024 * 1024
+
+var ErrProtocol = errors.New("protocol error")
+
+// Value is a decoded RESP reply. Only the fields relevant to Type are populated.
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Null  bool
+	Elems []Value
+}
+
+// Reader decodes RESP commands and replies from a buffered stream.
+type Reader struct {
+	rd *bufio.Reader
+}
+
+func NewReader(rd *bufio.Reader) *Reader {
+	return &Reader{rd: rd}
+}
+
+// ReadCommand reads a single client command. Commands are normally sent as an array of
+// bulk strings, but inline commands (a plain line) are accepted as well, same as redis.
+func (r *Reader) ReadCommand() ([]string, error) {
+	prefix, err := r.rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != TypeArray {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return utils.SplitArgs(line)
+	}
+
+	_, _ = r.rd.ReadByte()
+	count, err := r.readLength(maxArrayLength)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		b, err := r.rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != TypeBulkString {
+			return nil, fmt.Errorf("%w: expected '$', got '%c'", ErrProtocol, b)
+		}
+		arg, null, err := r.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			return nil, fmt.Errorf("%w: null bulk string in command", ErrProtocol)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// ReadValue reads a single reply of any RESP2 or RESP3 type.
+func (r *Reader) ReadValue() (Value, error) {
+	b, err := r.rd.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch b {
+	case TypeSimpleString, TypeError, TypeDouble, TypeBigNumber:
+		line, err := r.readLine()
+		return Value{Type: b, Str: line}, err
+
+	case TypeInteger:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("%w: invalid integer %q", ErrProtocol, line)
+		}
+		return Value{Type: b, Int: n}, nil
+
+	case TypeBoolean:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		v := Value{Type: b}
+		if line == "t" {
+			v.Int = 1
+		}
+		return v, nil
+
+	case TypeNull:
+		_, err := r.readLine()
+		return Value{Type: b, Null: true}, err
+
+	case TypeBulkString, TypeVerbatim, TypeBlobError:
+		s, null, err := r.readBulk()
+		return Value{Type: b, Str: s, Null: null}, err
+
+	case TypeArray, TypeSet, TypePush, TypeMap:
+		count, err := r.readSignedLength(maxArrayLength)
+		if err != nil {
+			return Value{}, err
+		}
+		if count < 0 {
+			return Value{Type: b, Null: true}, nil
+		}
+		if b == TypeMap {
+			count *= 2
+		}
+		elems := make([]Value, 0, count)
+		for i := 0; i < count; i++ {
+			elem, err := r.ReadValue()
+			if err != nil {
+				return Value{}, err
+			}
+			elems = append(elems, elem)
+		}
+		return Value{Type: b, Elems: elems}, nil
+
+	default:
+		return Value{}, fmt.Errorf("%w: unknown reply type '%c'", ErrProtocol, b)
+	}
+}
+
+func (r *Reader) readBulk() (string, bool, error) {
+	n, err := r.readSignedLength(maxBulkLength)
+	if err != nil {
+		return "", false, err
+	}
+	if n < 0 {
+		return "", true, nil
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		return "", false, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", false, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return string(buf[:n]), false, nil
+}
+
+func (r *Reader) readLength(limit int) (int, error) {
+	n, err := r.readSignedLength(limit)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%w: negative length", ErrProtocol)
+	}
+	return n, nil
+}
+
+func (r *Reader) readSignedLength(limit int) (int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(line)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, line)
+	}
+	if n > limit {
+		return 0, fmt.Errorf("%w: length %d exceeds limit", ErrProtocol, n)
+	}
+	return n, nil
+}
+
+// readLine reads up to the next LF and strips the trailing CRLF (or bare LF).
+func (r *Reader) readLine() (string, error) {
+	line, err := r.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
@@ -0,0 +1,93 @@
+package resp
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// lineBreaks turns the CR and LF of an error message into spaces, a simple error is a single line
+// and a message quoting client input must not be able to end it early and inject another reply.
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// Writer encodes RESP replies and commands onto a buffered stream. Callers must call Flush
+// once a complete reply has been written.
+type Writer struct {
+	wr *bufio.Writer
+}
+
+func NewWriter(wr *bufio.Writer) *Writer {
+	return &Writer{wr: wr}
+}
+
+func (w *Writer) WriteSimpleString(s string) error {
+	return w.writeLine(TypeSimpleString, s)
+}
+
+func (w *Writer) WriteError(msg string) error {
+	return w.writeLine(TypeError, lineBreaks.Replace(msg))
+}
+
+func (w *Writer) WriteInteger(n int64) error {
+	return w.writeLine(TypeInteger, strconv.FormatInt(n, 10))
+}
+
+func (w *Writer) WriteBulkString(s string) error {
+	if err := w.writeLine(TypeBulkString, strconv.Itoa(len(s))); err != nil {
+		return err
+	}
+	if _, err := w.wr.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// WriteNull writes a null reply, encoded as a null bulk string in RESP2 and as '_' in RESP3.
+func (w *Writer) WriteNull(protocol int) error {
+	if protocol >= 3 {
+		return w.writeLine(TypeNull, "")
+	}
+	return w.writeLine(TypeBulkString, "-1")
+}
+
+func (w *Writer) WriteArrayHeader(n int) error {
+	return w.writeLine(TypeArray, strconv.Itoa(n))
+}
+
+// WriteMapHeader writes the header of a map with n key/value pairs. RESP2 has no map type,
+// so the pairs are sent as a flat array instead.
+func (w *Writer) WriteMapHeader(n int, protocol int) error {
+	if protocol >= 3 {
+		return w.writeLine(TypeMap, strconv.Itoa(n))
+	}
+	return w.WriteArrayHeader(n * 2)
+}
+
+// WriteCommand encodes args as an array of bulk strings, the form used for client requests.
+func (w *Writer) WriteCommand(args ...string) error {
+	if err := w.WriteArrayHeader(len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.WriteBulkString(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *Writer) writeLine(prefix byte, s string) error {
+	if err := w.wr.WriteByte(prefix); err != nil {
+		return err
+	}
+	if _, err := w.wr.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
@@ -3,49 +3,386 @@ package server
 import (
 	"creek/internal/commons"
 	"creek/internal/core"
+	"creek/internal/partition"
 	"errors"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// handleSet stores a key-value pair
-func handleSet(sm *core.StateMachine, args []string) error {
+// handleSet stores a key-value pair. The TTL in seconds follows the value, alone or after EX, and
+// NX, XX, GET and KEEPTTL work like in redis: a SET whose condition does not hold is a null reply,
+// with GET the reply is the previous value whether the SET applied or not
+func handleSet(sm *core.StateMachine, args []string) (Reply, error) {
 	if len(args) < 3 {
-		return errors.New("SET requires a key and a value")
+		return nil, commons.NewError(commons.ErrCodeGeneric, "SET requires a key and a value")
 	}
 
+	ttl, hasTTL, keepTTL, withGet := -1, false, false, false
+	var cond partition.Condition // nil without NX or XX
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); {
+		case option == commons.SetNX || option == commons.SetXX:
+			if cond != nil {
+				return nil, commons.ErrSyntax
+			}
+			cond = partition.IfAbsent
+			if option == commons.SetXX {
+				cond = partition.IfPresent
+			}
+		case option == commons.SetGet:
+			withGet = true
+		case option == commons.SetKeepTTL:
+			keepTTL = true
+		case option == commons.SetEX && i+1 < len(args):
+			i++
+			parsed, err := strconv.Atoi(args[i])
+			if err != nil || parsed <= 0 || hasTTL {
+				return nil, commons.ErrInvalidTTL
+			}
+			ttl, hasTTL = parsed, true
+		case i == 3:
+			// the TTL alone right after the value
+			parsed, err := strconv.Atoi(args[i])
+			if err != nil {
+				return nil, commons.ErrInvalidTTL
+			}
+			ttl, hasTTL = parsed, true
+		default:
+			return nil, commons.ErrSyntax
+		}
+	}
+	if hasTTL && keepTTL {
+		return nil, commons.ErrSyntax
+	}
+
+	if cond == nil {
+		if !withGet && !keepTTL {
+			return SimpleString("OK"), sm.Set(args[1], args[2], ttl)
+		}
+		cond = partition.Always
+	}
+	result, err := sm.SetIf(args[1], args[2], ttl, keepTTL, cond)
+	if err != nil {
+		return nil, err
+	}
+	if withGet {
+		return previousValue(result), nil
+	}
+	if !result.Applied {
+		return NullReply{}, nil
+	}
+	return SimpleString("OK"), nil
+}
+
+// previousValue is the reply of a SET returning the value it replaced, null for a key without one
+func previousValue(result partition.SetResult) Reply {
+	if !result.Existed {
+		return NullReply{}
+	}
+	return BulkString(result.Previous)
+}
+
+// handleGetSet stores a value without TTL and returns the previous one
+func handleGetSet(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 3 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "GETSET requires a key and a value")
+	}
+	result, err := sm.SetIf(args[1], args[2], -1, false, partition.Always)
+	if err != nil {
+		return nil, err
+	}
+	return previousValue(result), nil
+}
+
+// handleCAS stores a value when the key was last written under the expected version, 0 standing
+// for a key without value. The reply is the version of the write, 0 when the key changed meanwhile
+func handleCAS(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 4 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "CAS requires a key, a version and a value")
+	}
+	version, err := strconv.Atoi(args[2])
+	if err != nil || version < 0 {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "invalid version: %s", args[2])
+	}
 	ttl := -1
-	if len(args) > 3 {
-		ttlParsed, err := strconv.Atoi(args[3])
+	if len(args) > 4 {
+		ttl, err = strconv.Atoi(args[4])
 		if err != nil {
-			return errors.New("invalid TTL value")
+			return nil, commons.ErrInvalidTTL
 		}
-		ttl = ttlParsed
 	}
-	return sm.Set(args[1], args[2], ttl)
+	result, err := sm.SetIf(args[1], args[3], ttl, false, partition.IfVersion(version))
+	if err != nil {
+		return nil, err
+	}
+	return Integer(result.Version), nil
 }
 
-// handleGet retrieves a value by key
-func handleGet(sm *core.StateMachine, args []string) (string, error) {
+// handleGet retrieves a value by key, a missing key is a null reply
+func handleGet(sm *core.StateMachine, args []string) (Reply, error) {
 	if len(args) < 2 {
-		return "", errors.New("GET requires a key")
+		return nil, commons.NewError(commons.ErrCodeGeneric, "GET requires a key")
 	}
 	value, err := sm.Get(args[1])
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return NullReply{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return BulkString(value), nil
+}
+
+// handleKeyInfo describes the write that last changed a key, a key that was never written or
+// whose tombstone was purged is a null reply
+func handleKeyInfo(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 2 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "KEYINFO requires a key")
+	}
+	entry, err := sm.KeyInfo(args[1])
+	if errors.Is(err, core.ErrKeyNotFound) {
+		return NullReply{}, nil
+	}
 	if err != nil {
-		return "", nil // most likely coz of key not present
+		return nil, err
+	}
+	deleted := 0
+	if entry.Deleted {
+		deleted = 1
 	}
-	return value, nil
+	return MapReply{
+		BulkString("version"), Integer(entry.Version),
+		BulkString("timestamp"), Integer(entry.Timestamp),
+		BulkString("origin"), BulkString(entry.Origin),
+		BulkString("expiration_ms"), Integer(entry.Expiration),
+		BulkString("ttl"), Integer(entry.TTL(time.Now().UnixMilli())),
+		BulkString("deleted"), Integer(deleted),
+	}, nil
 }
 
-// handleDelete removes a key-value pair
-func handleDelete(sm *core.StateMachine, args []string) error {
+// handleDelete removes keys and returns how many of them held a value. Many keys are deleted like
+// MDEL, each partition at once.
+func handleDelete(sm *core.StateMachine, args []string) (Reply, error) {
 	if len(args) < 2 {
-		return errors.New("DELETE requires a key")
+		return nil, commons.NewError(commons.ErrCodeGeneric, "DELETE requires a key")
+	}
+	var existed []bool
+	if len(args) == 2 {
+		deleted, err := sm.Delete(args[1])
+		if err != nil {
+			return nil, err
+		}
+		existed = []bool{deleted}
+	} else {
+		var err error
+		if existed, err = sm.MDelete(args[1:]); err != nil {
+			return nil, err
+		}
+	}
+	count := 0
+	for _, deleted := range existed {
+		if deleted {
+			count++
+		}
+	}
+	return LegacyInteger(count), nil
+}
+
+// handleIncr adds to the integer stored at a key and returns the result, INCR and DECR by one,
+// INCRBY and DECRBY by their argument
+func handleIncr(sm *core.StateMachine, args []string) (Reply, error) {
+	command := strings.ToUpper(args[0])
+	byArg := command == commons.CmdDataIncrBy || command == commons.CmdDataDecrBy
+	if len(args) < 2 || (byArg && len(args) < 3) {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "%s requires a key", command)
+	}
+
+	delta := int64(1)
+	if byArg {
+		parsed, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, commons.ErrNotInteger
+		}
+		delta = parsed
+	}
+	if command == commons.CmdDataDecr || command == commons.CmdDataDecrBy {
+		if delta == math.MinInt64 {
+			return nil, commons.ErrOverflow
+		}
+		delta = -delta
+	}
+	result, err := sm.IncrBy(args[1], delta)
+	if err != nil {
+		return nil, err
+	}
+	return Integer(result), nil
+}
+
+// handleIncrByFloat adds a floating point increment to the number stored at a key and returns the result
+func handleIncrByFloat(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 3 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "INCRBYFLOAT requires a key and an increment")
+	}
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return nil, commons.ErrNotFloat
 	}
-	err := sm.Delete(args[1])
+	result, err := sm.IncrByFloat(args[1], delta)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return BulkString(result), nil
+}
+
+// handleMGet returns the values of many keys in order, null for the keys without value
+func handleMGet(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 2 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "MGET requires at least one key")
+	}
+	values, found, err := sm.MGet(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	reply := make(ArrayReply, len(values))
+	for i, value := range values {
+		reply[i] = NullReply{}
+		if found[i] {
+			reply[i] = BulkString(value)
+		}
+	}
+	return reply, nil
+}
+
+// handleMSet stores many key-value pairs without TTL
+func handleMSet(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "MSET requires keys and values")
+	}
+	if err := sm.MSet(args[1:]); err != nil {
+		return nil, err
+	}
+	return SimpleString("OK"), nil
+}
+
+// handleMDelete deletes many keys, the reply tells in order with 1 or 0 whether each held a value
+func handleMDelete(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 2 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "MDEL requires at least one key")
+	}
+	existed, err := sm.MDelete(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	reply := make(ArrayReply, len(existed))
+	for i, deleted := range existed {
+		reply[i] = Integer(0)
+		if deleted {
+			reply[i] = Integer(1)
+		}
+	}
+	return reply, nil
+}
+
+// handleScan lists keys a few at a time, SCAN cursor [MATCH pattern] [COUNT count]. The reply is
+// the cursor of the next call, 0 at the end, followed by the keys
+func handleScan(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 2 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "SCAN requires a cursor")
+	}
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "invalid cursor")
+	}
+	pattern, count := "", core.DefaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return nil, commons.ErrSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case commons.ScanMatch:
+			pattern = args[i+1]
+		case commons.ScanCount:
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				return nil, commons.ErrNotInteger
+			}
+		default:
+			return nil, commons.ErrSyntax
+		}
+	}
+
+	keys, next, err := sm.Scan(cursor, pattern, count)
+	if err != nil {
+		return nil, err
+	}
+	return ArrayReply{BulkString(strconv.FormatUint(next, 10)), bulkStrings(keys)}, nil
+}
+
+// handleKeys returns every key matching a glob pattern, refused when too many keys match
+func handleKeys(sm *core.StateMachine, args []string) (Reply, error) {
+	if len(args) < 2 {
+		return nil, commons.NewError(commons.ErrCodeGeneric, "KEYS requires a pattern")
+	}
+	keys, err := sm.Keys(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(keys), nil
+}
+
+// handleRange reads keys in order with their values, RANGE start end [LIMIT n] from start included
+// to end excluded, "" standing for no end, and PREFIX prefix [LIMIT n]. The reply is the key the
+// range continues from with RANGE, "" once it is over, then the keys alternating with their values
+func handleRange(sm *core.StateMachine, args []string) (Reply, error) {
+	command := strings.ToUpper(args[0])
+	bounds := 2
+	if command == commons.CmdDataPrefix {
+		bounds = 1
+	}
+	if len(args) != 1+bounds && len(args) != 3+bounds {
+		if bounds == 1 {
+			return nil, commons.NewError(commons.ErrCodeGeneric, "usage: PREFIX <prefix> [LIMIT <n>]")
+		}
+		return nil, commons.NewError(commons.ErrCodeGeneric, "usage: RANGE <start> <end> [LIMIT <n>]")
+	}
+	limit := 0
+	if len(args) > 1+bounds {
+		if strings.ToUpper(args[1+bounds]) != commons.RangeLimit {
+			return nil, commons.ErrSyntax
+		}
+		parsed, err := strconv.Atoi(args[2+bounds])
+		if err != nil || parsed <= 0 {
+			return nil, commons.ErrNotInteger
+		}
+		limit = parsed
+	}
+
+	var keys, values []string
+	var next string
+	var err error
+	if bounds == 1 {
+		keys, values, next, err = sm.Prefix(args[1], limit)
+	} else {
+		keys, values, next, err = sm.Range(args[1], args[2], limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pairs := make(ArrayReply, 0, 2*len(keys))
+	for i, key := range keys {
+		pairs = append(pairs, BulkString(key), BulkString(values[i]))
+	}
+	return ArrayReply{BulkString(next), pairs}, nil
+}
+
+func bulkStrings(values []string) ArrayReply {
+	reply := make(ArrayReply, len(values))
+	for i, value := range values {
+		reply[i] = BulkString(value)
+	}
+	return reply
 }
 
 // handleVersion returns the server commons
@@ -53,30 +390,33 @@ func handleVersion() (string, error) {
 	return commons.Version, nil
 }
 
-// handleExpire sets a TTL on an existing key
-func handleExpire(sm *core.StateMachine, args []string) error {
+// handleExpire sets a TTL on an existing key, the reply is 1 when it held a value and 0 otherwise
+func handleExpire(sm *core.StateMachine, args []string) (Reply, error) {
 	if len(args) < 3 {
-		return errors.New("EXPIRE requires a key and TTL")
+		return nil, commons.NewError(commons.ErrCodeGeneric, "EXPIRE requires a key and TTL")
 	}
 	ttl, err := strconv.Atoi(args[2])
 	if err != nil {
-		return errors.New("invalid TTL value")
+		return nil, commons.ErrInvalidTTL
 	}
-	err = sm.Expire(args[1], ttl)
+	existed, err := sm.Expire(args[1], ttl)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if existed {
+		return LegacyInteger(1), nil
 	}
-	return nil
+	return LegacyInteger(0), nil
 }
 
 // handleTTL retrieves the TTL for a key
-func handleTTL(sm *core.StateMachine, args []string) (string, error) {
+func handleTTL(sm *core.StateMachine, args []string) (int, error) {
 	if len(args) < 2 {
-		return "", errors.New("TTL requires a key")
+		return 0, commons.NewError(commons.ErrCodeGeneric, "TTL requires a key")
 	}
 	ttl, err := sm.TTL(args[1])
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	return strconv.Itoa(ttl), nil
+	return ttl, nil
 }
@@ -4,60 +4,117 @@ import (
 	"creek/internal/commons"
 	"creek/internal/core"
 	"creek/internal/logger"
+	"creek/internal/utils"
 	"errors"
 	"strings"
 )
 
+// session is what a client connection carries over from one command to the next
+type session struct {
+	asking bool // the next command follows an ASK redirect
+}
+
 // handleMessage processes incoming messages from clients
-func handleMessage(s *Server, message string) (string, error) {
-	// Trim and split input into arguments
-	args := strings.Fields(strings.TrimSpace(message))
+func handleMessage(s *Server, sess *session, message string) (Reply, error) {
+	// Trim and split input into arguments, quoted arguments may contain spaces and escapes
+	args, err := utils.SplitArgs(strings.TrimSpace(message))
+	if err != nil {
+		return nil, err
+	}
+	return handleArgs(s, sess, args)
+}
+
+// handleArgs routes an already tokenized command, shared by the text and RESP protocols
+func handleArgs(s *Server, sess *session, args []string) (Reply, error) {
 	if len(args) == 0 {
-		return "", errors.New("no command received")
+		return nil, commons.ErrNoCommand
 	}
 
 	// Extract command
 	command := strings.ToUpper(args[0])
+	if command == commons.CmdSysAsking {
+		sess.asking = true
+		return SimpleString("OK"), nil
+	}
+	asking := sess.asking
+	sess.asking = false
 
 	// Route to appropriate command handler
-	return handleCommand(s, command, args)
+	reply, err := handleCommand(s, command, args)
+	var importing *core.ImportingError
+	if asking && errors.As(err, &importing) {
+		// the partition is handed over from the node that sent ASK, it serves it in a moment
+		return nil, commons.Errorf(commons.ErrCodeTryAgain, "slot %d is still being imported from %s", importing.Slot, importing.Source)
+	}
+	return reply, err
 }
 
-type handlerFunc func(sm *core.StateMachine, args []string) (string, error)
-type systemCommandHandlerFunc func(s *Server, args []string) (string, error)
+type handlerFunc func(sm *core.StateMachine, args []string) (Reply, error)
+type systemCommandHandlerFunc func(s *Server, args []string) (Reply, error)
 
 var commandHandlers = map[string]handlerFunc{
-	commons.CmdDataSet: func(sm *core.StateMachine, args []string) (string, error) { return "OK", handleSet(sm, args) },
+	commons.CmdDataSet:    handleSet,
+	commons.CmdDataGetSet: handleGetSet,
+	commons.CmdDataCAS:    handleCAS,
 
-	commons.CmdDataDel: func(sm *core.StateMachine, args []string) (string, error) {
-		return "OK", handleDelete(sm, args)
+	commons.CmdDataDel:      handleDelete,
+	commons.CmdDataDelAlias: handleDelete,
+	commons.CmdDataEXP:      handleExpire,
+	commons.CmdDataTTL: func(sm *core.StateMachine, args []string) (Reply, error) {
+		ttl, err := handleTTL(sm, args)
+		return Integer(ttl), err
 	},
-	commons.CmdDataEXP: func(sm *core.StateMachine, args []string) (string, error) {
-		return "OK", handleExpire(sm, args)
+	commons.CmdDataGet:     handleGet,
+	commons.CmdDataKeyInfo: handleKeyInfo,
+	commons.CmdDataScan:    handleScan,
+	commons.CmdDataKeys:    handleKeys,
+	commons.CmdDataDBSize: func(sm *core.StateMachine, args []string) (Reply, error) {
+		return Integer(sm.DBSize()), nil
 	},
-	commons.CmdDataTTL: handleTTL,
-	commons.CmdDataGet: handleGet,
+	commons.CmdDataRange:       handleRange,
+	commons.CmdDataPrefix:      handleRange,
+	commons.CmdDataMGet:        handleMGet,
+	commons.CmdDataMSet:        handleMSet,
+	commons.CmdDataMDel:        handleMDelete,
+	commons.CmdDataIncr:        handleIncr,
+	commons.CmdDataDecr:        handleIncr,
+	commons.CmdDataIncrBy:      handleIncr,
+	commons.CmdDataDecrBy:      handleIncr,
+	commons.CmdDataIncrByFloat: handleIncrByFloat,
 }
 
 var systemCommandHandlers = map[string]systemCommandHandlerFunc{
-	"SHUTDOWN": func(s *Server, args []string) (string, error) {
+	"SHUTDOWN": func(s *Server, args []string) (Reply, error) {
 		defer s.Stop()
-		return "OK", nil
+		return SimpleString("OK"), nil
 	},
 
-	commons.CmdSysRep: func(s *Server, args []string) (string, error) {
-		return "OK", handleRepCommand(s, args)
-	},
+	commons.CmdSysRep:  handleRepCommand,
+	commons.CmdSysSync: handleSyncCommand,
+
+	commons.CmdSysRaft: handleRaftCommand,
 
-	commons.CmdSysVersion: func(s *Server, args []string) (string, error) {
-		return handleVersion()
+	commons.CmdSysRepair: handleRepair,
+
+	commons.CmdSysSnapshot: func(s *Server, args []string) (Reply, error) {
+		return SimpleString("OK"), s.sm.Snapshot()
+	},
+	commons.CmdSysBgSave: func(s *Server, args []string) (Reply, error) {
+		s.sm.BackgroundSnapshot()
+		return SimpleString("Background saving started"), nil
 	},
-	commons.CmdSysPing: func(s *Server, args []string) (string, error) {
-		return commons.CmdSysPong, nil
+
+	commons.CmdSysVersion: func(s *Server, args []string) (Reply, error) {
+		version, err := handleVersion()
+		return BulkString(version), err
 	},
+	commons.CmdSysPing:    handlePing,
+	commons.CmdSysPeers:   handlePeers,
+	commons.CmdSysCluster: handleCluster,
+	commons.CmdSysMigrate: handleMigrate,
 }
 
-func handleCommand(s *Server, command string, args []string) (string, error) {
+func handleCommand(s *Server, command string, args []string) (Reply, error) {
 	log := logger.GetLogger()
 	if handler, exists := commandHandlers[command]; exists {
 		return handler(s.sm, args)
@@ -68,5 +125,5 @@ func handleCommand(s *Server, command string, args []string) (string, error) {
 	}
 
 	log.Warn("Unknown command received: ", command)
-	return "", errors.New("unknown command")
+	return nil, commons.ErrUnknownCommand
 }
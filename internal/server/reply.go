@@ -0,0 +1,100 @@
+package server
+
+import (
+	"creek/internal/resp"
+	"creek/internal/utils"
+	"strconv"
+	"strings"
+)
+
+// Reply is the typed result of a command handler. Text clients receive String() as a single
+// line while RESP clients receive the matching RESP type.
+type Reply interface {
+	String() string
+}
+
+// SimpleString is a short status reply such as OK or PONG.
+type SimpleString string
+
+// BulkString carries user data such as values read from the datastore.
+type BulkString string
+
+// Integer is a numeric reply such as a TTL.
+type Integer int64
+
+// LegacyInteger is an Integer for RESP clients, such as the count of keys DEL removed. Text clients
+// keep receiving OK, which these commands replied before.
+type LegacyInteger int64
+
+// NullReply signals the absence of a value.
+type NullReply struct{}
+
+// ArrayReply is an ordered list of replies.
+type ArrayReply []Reply
+
+// MapReply is an ordered list of key/value pairs, sent as a map to RESP3 clients.
+type MapReply []Reply
+
+func (r SimpleString) String() string { return string(r) }
+
+func (r BulkString) String() string { return utils.FormatLine(string(r)) }
+
+func (r Integer) String() string { return strconv.FormatInt(int64(r), 10) }
+
+func (r LegacyInteger) String() string { return "OK" }
+
+func (r NullReply) String() string { return utils.NilLine }
+
+func (r ArrayReply) String() string { return joinReplies(r) }
+
+func (r MapReply) String() string { return joinReplies(r) }
+
+func joinReplies(replies []Reply) string {
+	parts := make([]string, 0, len(replies))
+	for _, r := range replies {
+		if bulk, ok := r.(BulkString); ok {
+			parts = append(parts, utils.QuoteArg(string(bulk)))
+			continue
+		}
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// writeReply encodes a reply for a RESP client speaking the given protocol version.
+func writeReply(w *resp.Writer, r Reply, protocol int) error {
+	switch v := r.(type) {
+	case SimpleString:
+		return w.WriteSimpleString(string(v))
+	case BulkString:
+		return w.WriteBulkString(string(v))
+	case Integer:
+		return w.WriteInteger(int64(v))
+	case LegacyInteger:
+		return w.WriteInteger(int64(v))
+	case NullReply, nil:
+		return w.WriteNull(protocol)
+	case ArrayReply:
+		if err := w.WriteArrayHeader(len(v)); err != nil {
+			return err
+		}
+		for _, elem := range v {
+			if err := writeReply(w, elem, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	case MapReply:
+		if err := w.WriteMapHeader(len(v)/2, protocol); err != nil {
+			return err
+		}
+		for _, elem := range v {
+			if err := writeReply(w, elem, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return w.WriteBulkString(r.String())
+	}
+}
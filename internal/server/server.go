@@ -7,9 +7,13 @@ import (
 	"creek/internal/core"
 	"creek/internal/logger"
 	"creek/internal/replication"
-	"fmt"
+	"creek/internal/resp"
+	"creek/internal/utils"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -54,15 +58,21 @@ func New(cfg *config.Config) *Server {
 func (s *Server) Start() {
 	var err error
 
+	s.sm.AttachRaftTransportToPartitions(s.rs)
 	err = s.sm.Start()
 	if err != nil {
 		panic(err)
 	}
 
+	s.sm.AttachLeaderLocator(s.rs.LeaderAddress)
+	s.sm.AttachPeerLister(s.rs.ReplicatedPeers)
+	s.sm.AttachPartitionMover(s.rs)
+	s.rs.AttachAckHandler(s.sm.HandleRepAck)
+	s.rs.AttachLogSource(s.sm)
+	s.sm.AttachReplicatorToPartitions(s.rs)
 	s.rs.ConnectToFollowers()
-	s.sm.AttachRepCmdWriteHandlerToPartitions(func(cmd *replication.RepCmd) error {
-		return s.rs.HandleRepCmdWrite(cmd)
-	})
+	s.sm.AttachAntiEntropyTransportToPartitions(s.rs)
+	s.sm.StartAntiEntropy()
 
 	s.listener, err = net.Listen("tcp", s.address)
 	if err != nil {
@@ -133,33 +143,116 @@ func (s *Server) handleClient(conn net.Conn) {
 		}
 	}(conn)
 
-	versionMsg := fmt.Sprintf("Connected to Server Version: %s\n", commons.Version)
+	// RESP commands are arrays, anything else opens a line of the text protocol. A client may stay
+	// silent for as long as it likes before its first command, like a pooled connection does
+	reader := bufio.NewReader(conn)
+	if prefix, err := reader.Peek(1); err != nil {
+		// closed before sending anything
+	} else if prefix[0] == resp.TypeArray {
+		s.log.Debugf("Client %v speaks RESP", conn.RemoteAddr())
+		s.serveRESP(conn, reader)
+	} else {
+		s.serveText(conn, reader)
+	}
 
-	s.SendMsg(conn, versionMsg)
+	s.log.Debug("Client disconnected: ", conn.RemoteAddr())
+	s.mu.Lock()
+	delete(s.clients, conn)
+	s.mu.Unlock()
+}
 
-	reader := bufio.NewReader(conn)
+// serveText speaks the legacy newline delimited text protocol. Clients are not greeted, the
+// port also speaks RESP where a greeting is not a valid reply, VERSION tells the version instead.
+func (s *Server) serveText(conn net.Conn, reader *bufio.Reader) {
+	sess := &session{}
 	for {
 		message, err := reader.ReadString('\n')
 		if err != nil {
-			s.log.Debug("Client disconnected: ", conn.RemoteAddr())
-			s.mu.Lock()
-			delete(s.clients, conn)
-			s.mu.Unlock()
 			return
 		}
 
 		s.log.Trace("Received from ", conn.RemoteAddr(), ": ", message)
 
 		// Process and respond to message
-		response, err := handleMessage(s, message)
+		response, err := handleMessage(s, sess, message)
 		if err != nil {
 			s.log.Warnf("Error handling message: %v", err)
-			s.SendMsg(conn, err.Error())
+			s.SendMsg(conn, utils.ErrorLinePrefix+commons.FormatError(err))
 			continue
 		}
 		s.log.Tracef("Sending response: %v to client %v", response, conn.RemoteAddr())
-		s.SendMsg(conn, response)
+		s.SendMsg(conn, response.String())
+	}
+}
+
+// serveRESP speaks RESP2, or RESP3 once the client negotiates it through HELLO
+func (s *Server) serveRESP(conn net.Conn, reader *bufio.Reader) {
+	respReader := resp.NewReader(reader)
+	respWriter := resp.NewWriter(bufio.NewWriter(conn))
+	protocol := 2
+	sess := &session{}
+
+	for {
+		args, err := respReader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, resp.ErrProtocol) {
+				_ = respWriter.WriteError(commons.FormatError(err))
+				_ = respWriter.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		s.log.Trace("Received from ", conn.RemoteAddr(), ": ", args)
+
+		var response Reply
+		if strings.ToUpper(args[0]) == commons.CmdSysHello {
+			response, err = s.handleHello(args, &protocol)
+		} else {
+			response, err = handleArgs(s, sess, args)
+		}
+
+		if err != nil {
+			s.log.Warnf("Error handling message: %v", err)
+			err = respWriter.WriteError(commons.FormatError(err))
+		} else {
+			s.log.Tracef("Sending response: %v to client %v", response, conn.RemoteAddr())
+			err = writeReply(respWriter, response, protocol)
+		}
+		if err == nil {
+			err = respWriter.Flush()
+		}
+		if err != nil {
+			s.log.Warnf("Error sending msg to client %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// handleHello negotiates the RESP version for the connection and describes the server
+func (s *Server) handleHello(args []string, protocol *int) (Reply, error) {
+	if len(args) > 1 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 2 || version > 3 {
+			return nil, commons.NewError(commons.ErrCodeGeneric, "unsupported protocol version")
+		}
+		*protocol = version
+	}
+
+	role := "leader"
+	if s.Conf.ServerMode == commons.Follower {
+		role = "follower"
 	}
+	return MapReply{
+		BulkString("server"), BulkString("creek"),
+		BulkString("version"), BulkString(commons.Version),
+		BulkString("proto"), Integer(*protocol),
+		BulkString("mode"), BulkString("standalone"),
+		BulkString("role"), BulkString(role),
+		BulkString("modules"), ArrayReply{},
+	}, nil
 }
 
 func (s *Server) SendMsg(conn net.Conn, response string) {
@@ -1,15 +1,312 @@
 package server
 
 import (
+	"creek/internal/commons"
 	"creek/internal/replication"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func handleRepCommand(s *Server, args []string) error {
+// handleSyncCommand reports the Version this node last applied on a partition, so the leader
+// knows which writes to stream to it. The leader sends its address along, it is where rejected
+// writes are redirected and, between multi-master nodes, whose writes the Version refers to.
+func handleSyncCommand(s *Server, args []string) (Reply, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "usage: %s <partition> [leader]", commons.CmdSysSync)
+	}
+	partitionId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "invalid partition id: %s", args[1])
+	}
+	origin := ""
+	if len(args) == 3 {
+		origin = args[2]
+	}
+	version, err := s.sm.PartitionVersion(partitionId, origin)
+	if err != nil {
+		return nil, err
+	}
+	if origin != "" && !s.Conf.IsMultiMaster() {
+		s.rs.SetLeader(origin)
+	}
+	s.rs.RecordHeartbeat(origin)
+	return SimpleString(replication.FormatAck(partitionId, version)), nil
+}
+
+// handleRepCommand applies a write streamed by the leader and acknowledges its Version, or answers
+// an anti-entropy request of a peer
+func handleRepCommand(s *Server, args []string) (Reply, error) {
+	if len(args) > 1 {
+		switch strings.ToUpper(args[1]) {
+		case commons.RepMerkle:
+			return handleRepMerkle(s, args)
+		case commons.RepRange:
+			return handleRepRange(s, args)
+		}
+	}
 	repCmd, err := replication.RepCmdFromArgs(args[1:])
 	if err != nil {
-		return err
+		return nil, err
 	}
+	s.rs.RecordHeartbeat(repCmd.Origin)
 
 	err = s.sm.ProcessRepCmd(repCmd)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return SimpleString(replication.FormatAck(repCmd.PartitionId, repCmd.Version)), nil
+}
+
+// handleRepMerkle replies with the hash of every requested node at a level of the Merkle tree of a
+// partition: REP MERKLE <partition> <level> <node>...
+func handleRepMerkle(s *Server, args []string) (Reply, error) {
+	if len(args) < 4 {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "usage: %s %s <partition> <level> <node>...", commons.CmdSysRep, commons.RepMerkle)
+	}
+	ints, err := parseInts(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := s.sm.MerkleHashes(ints[0], ints[1], ints[2:])
+	if err != nil {
+		return nil, err
+	}
+	reply := make(ArrayReply, len(hashes))
+	for i, hash := range hashes {
+		reply[i] = Integer(int64(hash))
+	}
+	return reply, nil
+}
+
+// handleRepRange replies with the entries under leaves of the Merkle tree of a partition, the
+// fields of every entry one after the other: REP RANGE <partition> <leaf>...
+func handleRepRange(s *Server, args []string) (Reply, error) {
+	if len(args) < 3 {
+		return nil, commons.Errorf(commons.ErrCodeGeneric, "usage: %s %s <partition> <leaf>...", commons.CmdSysRep, commons.RepRange)
+	}
+	ints, err := parseInts(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	fields, err := s.sm.RangeEntries(ints[0], ints[1:])
+	if err != nil {
+		return nil, err
+	}
+	reply := make(ArrayReply, len(fields))
+	for i, field := range fields {
+		reply[i] = BulkString(field)
+	}
+	return reply, nil
+}
+
+// handleRepair runs an anti-entropy round and reports what it repaired along with the totals since
+// the start, REPAIR STATS only reports the totals
+func handleRepair(s *Server, args []string) (Reply, error) {
+	var reply MapReply
+	if len(args) > 1 {
+		if len(args) != 2 || strings.ToUpper(args[1]) != "STATS" {
+			return nil, commons.Errorf(commons.ErrCodeGeneric, "usage: %s [STATS]", commons.CmdSysRepair)
+		}
+	} else {
+		stats, err := s.sm.Repair()
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply,
+			BulkString("keys_repaired"), Integer(stats.Keys),
+			BulkString("ranges_repaired"), Integer(stats.Ranges),
+		)
+	}
+	rounds, totals := s.sm.RepairTotals()
+	return append(reply,
+		BulkString("rounds"), Integer(rounds),
+		BulkString("total_keys_repaired"), Integer(totals.Keys),
+		BulkString("total_ranges_repaired"), Integer(totals.Ranges),
+	), nil
+}
+
+// handlePing answers PONG. Peers send their address along as a heartbeat, see replication.FormatPing
+func handlePing(s *Server, args []string) (Reply, error) {
+	if len(args) == 2 {
+		s.rs.RecordHeartbeat(args[1])
+	}
+	return SimpleString(commons.CmdSysPong), nil
+}
+
+// handlePeers describes every peer: its address, its health (up, suspect or down), whether a
+// replication connection to it is open, how many milliseconds ago it was last heard from (-1 for
+// never), how many writes it did not acknowledge yet, whether it is stale and being resynced from a
+// snapshot, how many times it was resynced and how many times it was reconnected
+func handlePeers(s *Server, args []string) (Reply, error) {
+	now := time.Now()
+	statuses := s.rs.PeerStatuses()
+	reply := make(ArrayReply, len(statuses))
+	for i, status := range statuses {
+		connected, stale, lastSeen := 0, 0, int64(-1)
+		if status.Connected {
+			connected = 1
+		}
+		if status.Stale {
+			stale = 1
+		}
+		if !status.LastSeen.IsZero() {
+			lastSeen = now.Sub(status.LastSeen).Milliseconds()
+		}
+		reply[i] = MapReply{
+			BulkString("address"), BulkString(status.Address),
+			BulkString("health"), BulkString(status.Health.String()),
+			BulkString("connected"), Integer(connected),
+			BulkString("last_seen_ms"), Integer(lastSeen),
+			BulkString("lag"), Integer(status.Lag),
+			BulkString("stale"), Integer(stale),
+			BulkString("resyncs"), Integer(status.Resyncs),
+			BulkString("reconnects"), Integer(status.Reconnects),
+		}
+	}
+	return reply, nil
+}
+
+// handleCluster changes or describes the cluster membership. CLUSTER JOIN and CLUSTER LEAVE add or
+// remove a node through the leader, CLUSTER NODES describes every node: its address, whether it is
+// this node, its health (unknown for the nodes this node does not monitor) and whether a
+// replication connection to it is open. CLUSTER MEMBERS is sent by the leader to replicate a change.
+// CLUSTER PARTITIONS describes every partition: its id, its first and last slot, the node serving
+// it and whether it is migrating, handed over, moved or imported
+func handleCluster(s *Server, args []string) (Reply, error) {
+	usage := commons.Errorf(commons.ErrCodeGeneric, "usage: %s %s|%s <address> | %s %s|%s",
+		commons.CmdSysCluster, commons.ClusterJoin, commons.ClusterLeave,
+		commons.CmdSysCluster, commons.ClusterNodes, commons.ClusterPartitions)
+	if len(args) < 2 {
+		return nil, usage
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case commons.ClusterJoin, commons.ClusterLeave:
+		if len(args) != 3 {
+			return nil, usage
+		}
+		change := s.rs.Join
+		if strings.ToUpper(args[1]) == commons.ClusterLeave {
+			change = s.rs.Leave
+		}
+		if err := change(args[2]); err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
+	case commons.ClusterNodes:
+		nodes := s.rs.ClusterNodes()
+		reply := make(ArrayReply, len(nodes))
+		for i, node := range nodes {
+			myself, connected, health := 0, 0, "unknown"
+			if node.Myself {
+				myself = 1
+			}
+			if node.Connected {
+				connected = 1
+			}
+			if node.Monitored {
+				health = node.Health.String()
+			}
+			reply[i] = MapReply{
+				BulkString("address"), BulkString(node.Address),
+				BulkString("myself"), Integer(myself),
+				BulkString("health"), BulkString(health),
+				BulkString("connected"), Integer(connected),
+			}
+		}
+		return reply, nil
+	case commons.ClusterPartitions:
+		partitions := s.sm.Partitions()
+		reply := make(ArrayReply, len(partitions))
+		for i, info := range partitions {
+			reply[i] = MapReply{
+				BulkString("partition"), Integer(info.Id),
+				BulkString("first_slot"), Integer(info.FirstSlot),
+				BulkString("last_slot"), Integer(info.LastSlot),
+				BulkString("owner"), BulkString(info.Owner),
+				BulkString("state"), BulkString(info.State),
+			}
+		}
+		return reply, nil
+	case commons.ClusterMembers:
+		m, err := replication.ParseMembers(args[2:])
+		if err != nil {
+			return nil, commons.Errorf(commons.ErrCodeGeneric, "%v", err)
+		}
+		if err := s.rs.ApplyMembership(m); err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
+	default:
+		return nil, usage
+	}
+}
+
+// handleMigrate moves a partition to another node, MIGRATE <partition> <address> replies once the
+// node serves it. MIGRATE IMPORT and MIGRATE COMMIT are sent by the node a partition moves from
+func handleMigrate(s *Server, args []string) (Reply, error) {
+	usage := commons.Errorf(commons.ErrCodeGeneric, "usage: %s <partition> <address>", commons.CmdSysMigrate)
+	if len(args) != 3 && len(args) != 4 {
+		return nil, usage
+	}
+
+	var err error
+	switch strings.ToUpper(args[1]) {
+	case commons.MigrateImport, commons.MigrateCommit:
+		if len(args) != 4 {
+			return nil, usage
+		}
+		partitionId, convErr := strconv.Atoi(args[2])
+		if convErr != nil {
+			return nil, commons.Errorf(commons.ErrCodeGeneric, "invalid partition id: %s", args[2])
+		}
+		if strings.ToUpper(args[1]) == commons.MigrateImport {
+			err = s.sm.BeginImport(partitionId, args[3])
+		} else {
+			version, convErr := strconv.Atoi(args[3])
+			if convErr != nil {
+				return nil, commons.Errorf(commons.ErrCodeGeneric, "invalid version: %s", args[3])
+			}
+			err = s.sm.CommitImport(partitionId, version)
+		}
+	default:
+		if len(args) != 3 {
+			return nil, usage
+		}
+		partitionId, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return nil, commons.Errorf(commons.ErrCodeGeneric, "invalid partition id: %s", args[1])
+		}
+		err = s.sm.Migrate(partitionId, args[2])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return SimpleString("OK"), nil
+}
+
+func parseInts(args []string) ([]int, error) {
+	ints := make([]int, len(args))
+	for i, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, commons.Errorf(commons.ErrCodeGeneric, "invalid integer: %s", arg)
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+// handleRaftCommand answers a raft RPC sent by a peer with an array of integers
+func handleRaftCommand(s *Server, args []string) (Reply, error) {
+	ints, err := s.sm.HandleRaftRPC(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	reply := make(ArrayReply, len(ints))
+	for i, n := range ints {
+		reply[i] = Integer(n)
+	}
+	return reply, nil
 }
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+const hexDigits = "0123456789abcdef"
+
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes in arguments")
+
+// QuoteArg encodes a single argument so it survives a round trip through SplitArgs. Plain
+// tokens are returned as is, anything containing whitespace, quotes, backslashes or control
+// bytes is double-quoted with C style escapes, which keeps every encoded argument on one line.
+func QuoteArg(arg string) string {
+	if arg != "" && !needsQuoting(arg) {
+		return arg
+	}
+	return quote(arg)
+}
+
+func quote(arg string) string {
+	var sb strings.Builder
+	sb.Grow(len(arg) + 2)
+	sb.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\a':
+			sb.WriteString(`\a`)
+		case '\b':
+			sb.WriteString(`\b`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				sb.WriteString(`\x`)
+				sb.WriteByte(hexDigits[c>>4])
+				sb.WriteByte(hexDigits[c&0x0f])
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// JoinArgs quotes every argument and joins them with single spaces.
+func JoinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = QuoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// NilLine is the text protocol reply for a missing value, an empty value is an empty line.
+const NilLine = "(nil)"
+
+// ErrorLinePrefix starts every error reply of the text protocol, it is followed by the error code.
+const ErrorLinePrefix = "(error) "
+
+// FormatLine returns s unchanged when it can be written as a single unambiguous line, and the
+// quoted form otherwise. Used for text protocol replies, where values with spaces stay readable.
+func FormatLine(s string) string {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, `'`) || s == NilLine || strings.HasPrefix(s, ErrorLinePrefix) {
+		return quote(s)
+	}
+	for i := 0; i < len(s); i++ {
+		if isControl(s[i]) {
+			return QuoteArg(s)
+		}
+	}
+	return s
+}
+
+// SplitArgs tokenizes a line the way redis-cli does. Tokens are separated by whitespace and may
+// be wrapped in double quotes, supporting \n \r \t \a \b \\ \" and \xHH escapes, or in single
+// quotes, supporting only \'. Unquoted tokens are taken literally.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var sb strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 'r':
+						sb.WriteByte('\r')
+					case 't':
+						sb.WriteByte('\t')
+					case 'a':
+						sb.WriteByte('\a')
+					case 'b':
+						sb.WriteByte('\b')
+					case 'x':
+						if i+2 < len(line) && isHex(line[i+1]) && isHex(line[i+2]) {
+							sb.WriteByte(fromHex(line[i+1])<<4 | fromHex(line[i+2]))
+							i += 2
+						} else {
+							sb.WriteByte('x')
+						}
+					default:
+						sb.WriteByte(line[i])
+					}
+				} else {
+					sb.WriteByte(c)
+				}
+				i++
+			}
+			if i < len(line) && !isSpace(line[i]) {
+				return nil, ErrUnbalancedQuotes
+			}
+
+		case '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				sb.WriteByte(c)
+				i++
+			}
+			if i < len(line) && !isSpace(line[i]) {
+				return nil, ErrUnbalancedQuotes
+			}
+
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				sb.WriteByte(line[i])
+				i++
+			}
+		}
+		args = append(args, sb.String())
+	}
+}
+
+func needsQuoting(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isControl(c) || c == ' ' || c == '"' || c == '\'' || c == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
+func isControl(c byte) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func fromHex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+// MatchGlob reports whether s matches a glob pattern the way redis matches keys: * matches any
+// sequence, ? any single byte, [abc], [^abc] and [a-z] a set of bytes, and \ escapes the byte
+// after it. Unlike path.Match, * also matches /. On a mismatch only the last * is retried one byte
+// further, the earlier ones can not match differently, so a match costs at most len(pattern) *
+// len(s) steps.
+func MatchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				starP, starI = p, i
+				continue
+			case '?':
+				p, i = p+1, i+1
+				continue
+			case '[':
+				if matched, rest := matchSet(pattern[p+1:], s[i]); matched {
+					p, i = len(pattern)-len(rest), i+1
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p, i = p+2, i+1
+					continue
+				}
+				if p+1 == len(pattern) && s[i] == '\\' {
+					p, i = p+1, i+1
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p, i = p+1, i+1
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		// let the last * match one more byte and retry what follows it
+		starI++
+		p, i = starP, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchSet matches c against the set starting after a [ and returns the pattern after the closing
+// ], a set left open runs to the end of the pattern.
+func matchSet(pattern string, c byte) (bool, string) {
+	negated := len(pattern) > 0 && pattern[0] == '^'
+	if negated {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+			matched = matched || (c >= low && c <= high)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:] // the closing ]
+	}
+	return matched != negated, pattern
+}
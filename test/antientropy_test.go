@@ -0,0 +1,327 @@
+package test
+
+import (
+	"creek/internal/core"
+	"creek/internal/datastore"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// localTransport answers the anti-entropy requests of a state machine from other state machines
+// of the same process, keyed by node id.
+type localTransport map[string]*core.StateMachine
+
+func (lt localTransport) MerkleHashes(peer string, partitionId, level int, nodes []int) ([]uint64, error) {
+	return lt[peer].MerkleHashes(partitionId, level, nodes)
+}
+
+func (lt localTransport) RangeEntries(peer string, partitionId int, leaves []int) ([]string, error) {
+	return lt[peer].RangeEntries(partitionId, leaves)
+}
+
+// merkleRoots returns the root hash of the Merkle tree of every partition
+func merkleRoots(t *testing.T, sm *core.StateMachine) []uint64 {
+	roots := make([]uint64, sm.PartitionCount())
+	for pid := range roots {
+		hashes, err := sm.MerkleHashes(pid, 0, []int{0})
+		if err != nil {
+			t.Fatalf("Failed to hash partition %d: %v", pid, err)
+		}
+		roots[pid] = hashes[0]
+	}
+	return roots
+}
+
+func expectSameRoots(t *testing.T, a, b *core.StateMachine) {
+	rootsA, rootsB := merkleRoots(t, a), merkleRoots(t, b)
+	for pid := range rootsA {
+		if rootsA[pid] != rootsB[pid] {
+			t.Errorf("Partition %d still differs after the repair", pid)
+		}
+	}
+}
+
+func TestDataStore_Digests(t *testing.T) {
+	ds := datastore.NewDataStore(&SimpleServerConfig)
+	now := time.Now().UnixNano()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%d", rnd.Intn(800))
+		stamp := datastore.Stamp{Timestamp: now + int64(i), Version: i, Origin: "node"}
+		switch rnd.Intn(5) {
+		case 0:
+			ds.DeleteAt(key, stamp)
+		case 1:
+			ds.Delete(key)
+		case 2:
+			ds.ExpireAt(key, time.Now().Add(time.Hour).UnixMilli(), stamp)
+		default:
+			ds.SetAt(key, fmt.Sprint(i), -1, stamp)
+		}
+	}
+	ds.PurgeTombstones(now + 2500)
+
+	// the digests kept on every write match those of the entries hashed from scratch
+	expected := make([]uint64, 1<<datastore.DigestBits)
+	ranges := make(map[int]map[string]bool)
+	for key, entry := range ds.Entries() {
+		r := int(datastore.ScanHash(key) >> (datastore.ScanHashBits - datastore.DigestBits))
+		expected[r] ^= datastore.EntryHash(key, entry)
+		if ranges[r] == nil {
+			ranges[r] = make(map[string]bool)
+		}
+		ranges[r][key] = true
+	}
+	if digests := ds.Digests(); !slices.Equal(digests, expected) {
+		t.Errorf("Digests diverged from the entries")
+	}
+	for _, r := range []int{0, 17, 1023} {
+		entries := ds.RangeEntries([]int{r})
+		if len(entries) != len(ranges[r]) {
+			t.Errorf("RangeEntries %d returned %d keys, expected %d", r, len(entries), len(ranges[r]))
+		}
+		for key := range entries {
+			if !ranges[r][key] {
+				t.Errorf("RangeEntries %d returned %s of another range", r, key)
+			}
+		}
+	}
+}
+
+func TestStateMachine_AntiEntropyMultiMaster(t *testing.T) {
+	configs := multiMasterConfigs()[:2]
+	nodes := make([]*core.StateMachine, len(configs))
+	transport := localTransport{}
+	for i, conf := range configs {
+		conf.PeerNodes = []string{configs[1-i].ServerAddress}
+		setupTest(conf)
+		defer cleanupAfterTest(conf)
+		sm, err := startStateMachine(t, conf)
+		if err != nil {
+			t.Fatalf("Failed to start state machine: %v", err)
+		}
+		defer sm.Stop()
+		sm.AttachAntiEntropyTransportToPartitions(transport)
+		transport[conf.ServerAddress] = sm
+		nodes[i] = sm
+	}
+	a, b := nodes[0], nodes[1]
+
+	// none of these writes is replicated, as if every message between the nodes was dropped
+	steps := []struct {
+		sm    *core.StateMachine
+		write func(sm *core.StateMachine) error
+	}{
+		{b, func(sm *core.StateMachine) error { return sm.Set("shared", "old", -1) }},
+		{a, func(sm *core.StateMachine) error { return sm.Set("shared", "new", -1) }},
+		{a, func(sm *core.StateMachine) error { return sm.Set("mine", "a", -1) }},
+		{b, func(sm *core.StateMachine) error { return sm.Set("mine", "b", -1) }},
+		{b, func(sm *core.StateMachine) error { return sm.Set("gone", "b", -1) }},
+		{a, func(sm *core.StateMachine) error { _, err := sm.Delete("gone"); return err }},
+	}
+	for i, step := range steps {
+		if err := step.write(step.sm); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if err := a.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 100); err != nil {
+			t.Fatalf("SET key%d failed: %v", i, err)
+		}
+	}
+	// the increment keeps the expiration of the key, which no longer falls a whole number of
+	// seconds after the write
+	if err := a.Set("counter", "1", 100); err != nil {
+		t.Fatalf("SET counter failed: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := a.IncrBy("counter", 1); err != nil {
+		t.Fatalf("INCR counter failed: %v", err)
+	}
+
+	stats, err := b.Repair()
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	// the 21 keys only A has, the later set of shared and the delete of gone
+	if stats.Keys != 23 {
+		t.Errorf("Expected 23 keys repaired on B, got %+v", stats)
+	}
+	expectKeys(t, b, 0, 20, true)
+	if ttl, _ := b.TTL("key0"); ttl < 99 || ttl > 100 {
+		t.Errorf("Expected the TTL of key0 to be repaired, got %d", ttl)
+	}
+	infoA, errA := a.KeyInfo("counter")
+	infoB, errB := b.KeyInfo("counter")
+	if errA != nil || errB != nil || infoB.Expiration != infoA.Expiration {
+		t.Errorf("Expected the expiration of counter to be repaired as is: %d on A, %d on B (%v, %v)",
+			infoA.Expiration, infoB.Expiration, errA, errB)
+	}
+	for key, expected := range map[string]string{"shared": "new", "mine": "b"} {
+		if value, err := b.Get(key); err != nil || value != expected {
+			t.Errorf("GET %s on B: %q expected %q (%v)", key, value, expected, err)
+		}
+	}
+	if _, err := b.Get("gone"); !errors.Is(err, core.ErrKeyNotFound) {
+		t.Errorf("Expected the delete of gone to be repaired, got %v", err)
+	}
+
+	// A only lacks the later set of mine, then both nodes hold the same keys
+	if stats, err := a.Repair(); err != nil || stats.Keys != 1 {
+		t.Errorf("Expected 1 key repaired on A, got %+v: %v", stats, err)
+	}
+	expectSameRoots(t, a, b)
+	if stats, err := b.Repair(); err != nil || stats.Keys != 0 || stats.Ranges != 0 {
+		t.Errorf("Expected nothing left to repair, got %+v: %v", stats, err)
+	}
+	if rounds, totals := b.RepairTotals(); rounds != 2 || totals.Keys != 23 {
+		t.Errorf("Expected 2 rounds repairing 23 keys on B, got %d rounds %+v", rounds, totals)
+	}
+}
+
+func TestStateMachine_AntiEntropyFollower(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+
+	leader, err := startStateMachine(t, leaderConf)
+	if err != nil {
+		t.Fatalf("Failed to start leader: %v", err)
+	}
+	defer leader.Stop()
+	follower, err := startStateMachine(t, followerConf)
+	if err != nil {
+		t.Fatalf("Failed to start follower: %v", err)
+	}
+	defer func() { _ = follower.Stop() }()
+	follower.AttachAntiEntropyTransportToPartitions(localTransport{leaderConf.ServerAddress: leader})
+	follower.AttachLeaderLocator(func(partitionId int) string { return leaderConf.ServerAddress })
+
+	for i := 0; i < 10; i++ {
+		if err := leader.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), -1); err != nil {
+			t.Fatalf("SET key%d failed: %v", i, err)
+		}
+	}
+	// the follower gets every write but the one of key5
+	versions := make([]int, leader.PartitionCount())
+	for pid := range versions {
+		cmds, err := leader.PartitionBacklog(pid, 0)
+		if err != nil {
+			t.Fatalf("Failed to read the backlog of partition %d: %v", pid, err)
+		}
+		for _, cmd := range cmds {
+			if cmd.Args[0] == "key5" {
+				continue
+			}
+			if err := follower.ProcessRepCmd(cmd); err != nil {
+				t.Fatalf("Failed to apply %s: %v", cmd.String(), err)
+			}
+		}
+		versions[pid], _ = follower.PartitionVersion(pid, "")
+	}
+	if _, err := follower.Get("key5"); !errors.Is(err, core.ErrKeyNotFound) {
+		t.Fatalf("Expected key5 to be missing on the follower, got %v", err)
+	}
+	// the repair is logged under the Version a snapshot already covers
+	if err := follower.Snapshot(); err != nil {
+		t.Fatalf("Failed to snapshot the follower: %v", err)
+	}
+
+	stats, err := follower.Repair()
+	if err != nil || stats.Keys != 1 || stats.Ranges != 1 {
+		t.Fatalf("Expected key5 to be repaired, got %+v: %v", stats, err)
+	}
+	expectKeys(t, follower, 0, 10, true)
+
+	// the repaired key survives a restart
+	if err := follower.Stop(); err != nil {
+		t.Fatalf("Failed to stop follower: %v", err)
+	}
+	follower, err = startStateMachine(t, followerConf)
+	if err != nil {
+		t.Fatalf("Failed to restart follower: %v", err)
+	}
+	expectKeys(t, follower, 0, 10, true)
+	expectSameRoots(t, leader, follower)
+	for pid, version := range versions {
+		// the Versions of the follower stay those of the leader
+		if repaired, _ := follower.PartitionVersion(pid, ""); repaired != version {
+			t.Errorf("Partition %d moved from version %d to %d on repair", pid, version, repaired)
+		}
+	}
+
+	// the leader accepts writes so it compares itself with the follower too, which only has its writes
+	leader.AttachAntiEntropyTransportToPartitions(localTransport{followerConf.ServerAddress: follower})
+	if stats, err := leader.Repair(); err != nil || stats.Keys != 0 {
+		t.Errorf("Expected nothing to repair on the leader, got %+v: %v", stats, err)
+	}
+}
+
+// repairReply sends a REPAIR request and returns the fields of its reply by name
+func repairReply(t *testing.T, conn net.Conn, request string) map[string]string {
+	response, err := sendRequest(conn, request)
+	if err != nil {
+		t.Fatalf("%s failed: %v", request, err)
+	}
+	args, err := utils.SplitArgs(response)
+	if err != nil || len(args)%2 != 0 {
+		t.Fatalf("Invalid %s reply %q: %v", request, response, err)
+	}
+	fields := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	return fields
+}
+
+func TestServer_Repair(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+
+	// the follower listens first so the leader connects to it right away
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for _, request := range []string{"set user alice", "set session abc 100", "set temp x", "delete temp"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || response != "OK" {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// replicated writes carry the stamps of the leader, so the trees of both nodes match
+	followerConn := dialServer(t, followerConf.ServerAddress)
+	defer followerConn.Close()
+	fields := repairReply(t, followerConn, "repair")
+	expected := map[string]string{"keys_repaired": "0", "ranges_repaired": "0", "rounds": "1", "total_keys_repaired": "0"}
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("REPAIR: %s is %q expected %q (%v)", name, fields[name], value, fields)
+		}
+	}
+	fields = repairReply(t, followerConn, "repair stats")
+	if _, ran := fields["keys_repaired"]; ran || fields["rounds"] != "1" {
+		t.Errorf("REPAIR STATS should only report the totals of 1 round, got %v", fields)
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"context"
+	"creek/client"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_BatchCommands(t *testing.T) {
+	conf := &PartitionedServerConfig
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	srv := server.New(conf)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, conf.ServerAddress)
+	first, second := keysOfPartition(0, conf.PartitionCount, 3), keysOfPartition(2, conf.PartitionCount, 3)
+	keys := []string{first[0], second[0], first[1], second[1], first[2], second[2]}
+	var pairs, values []string
+	for _, key := range keys {
+		pairs = append(pairs, key, key+"-value")
+		values = append(values, key+"-value")
+	}
+	if response, err := sendRequest(conn, "set "+first[0]+" old 100"); err != nil || response != "OK" {
+		t.Fatalf("SET failed: %v, response: %s", err, response)
+	}
+	if response, err := sendRequest(conn, "mset "+strings.Join(pairs, " ")); err != nil || response != "OK" {
+		t.Fatalf("MSET failed: %v, response: %s", err, response)
+	}
+
+	// the values come back in the order of the keys
+	expected := strings.Join(values, " ") + " " + utils.NilLine
+	if response, err := sendRequest(conn, "mget "+strings.Join(keys, " ")+" missing"); err != nil || response != expected {
+		t.Errorf("MGET failed: %v, response: %s expected %s", err, response, expected)
+	}
+	if response, err := sendRequest(conn, "ttl "+first[0]); err != nil || response != "-1" {
+		t.Errorf("MSET should drop the TTL: %v, response: %s", err, response)
+	}
+
+	// the keys of a partition are written by one commit log record
+	for _, group := range [][]string{first, second} {
+		version := keyInfo(t, conn, group[0])["version"]
+		for _, key := range group[1:] {
+			if other := keyInfo(t, conn, key)["version"]; other != version {
+				t.Errorf("Keys of one partition written under versions %s and %s", version, other)
+			}
+		}
+	}
+
+	for _, request := range []string{"mset a", "mset a 1 b", "mget", "mdel"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+			t.Errorf("Expected %s to fail, got %v, response: %s", request, err, response)
+		}
+	}
+
+	if response, err := sendRequest(conn, fmt.Sprintf("mdel %s missing %s", second[2], first[2])); err != nil || response != "1 0 1" {
+		t.Errorf("MDEL failed: %v, response: %s", err, response)
+	}
+	expected = fmt.Sprintf("%s %s", utils.NilLine, values[0])
+	if response, err := sendRequest(conn, fmt.Sprintf("mget %s %s", second[2], first[0])); err != nil || response != expected {
+		t.Errorf("MGET after MDEL failed: %v, response: %s expected %s", err, response, expected)
+	}
+
+	// the client sends the same commands
+	c, err := client.New(client.Options{Address: conf.ServerAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.MSet(ctx, map[string]string{"x": "1", "y": "2"}); err != nil {
+		t.Errorf("Client MSET failed: %v", err)
+	}
+	if got, err := c.MGet(ctx, "x", "y", "z"); err != nil || len(got) != 2 || got["x"] != "1" || got["y"] != "2" {
+		t.Errorf("Client MGET failed: %v, got %v", err, got)
+	}
+	if deleted, err := c.MDelete(ctx, "x", "z"); err != nil || deleted != 1 {
+		t.Errorf("Client MDEL failed: %v, deleted %d", err, deleted)
+	}
+
+	// the batches are replayed from the commit log on restart
+	conn.Close()
+	srv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	srv = server.New(conf)
+	go srv.Start()
+	defer func() { srv.Stop() }()
+	time.Sleep(1 * time.Second)
+	conn = dialServer(t, conf.ServerAddress)
+	defer func() { conn.Close() }()
+	expected = strings.Join(values[:4], " ") + fmt.Sprintf(" %s %s", utils.NilLine, utils.NilLine)
+	if response, err := sendRequest(conn, "mget "+strings.Join(keys, " ")); err != nil || response != expected {
+		t.Errorf("MGET after a restart failed: %v, response: %s expected %s", err, response, expected)
+	}
+}
+
+func TestServer_BatchCommandsReplicate(t *testing.T) {
+	leaderConf, followerConf := quorumConfigs()
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for _, request := range []string{"mset a 1 b 2 c 3", "mdel b"} {
+		if response, err := sendRequest(conn, request); err != nil || strings.HasPrefix(response, utils.ErrorLinePrefix) {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+
+	// the follower acknowledged every write before the leader replied
+	followerConn := dialServer(t, followerConf.ServerAddress)
+	defer followerConn.Close()
+	if response, err := sendRequest(followerConn, "mget a b c"); err != nil || response != "1 "+utils.NilLine+" 3" {
+		t.Errorf("MGET on the follower failed: %v, response: %s", err, response)
+	}
+	response, err := sendRequest(followerConn, "mset a 2")
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"READONLY ") && !strings.HasPrefix(response, utils.ErrorLinePrefix+"MOVED ") {
+		t.Errorf("Expected MSET on the follower to be refused, got %v, response: %s", err, response)
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"bufio"
+	"creek/internal/resp"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var binaryValues = []string{
+	"hello world",
+	"line1\nline2",
+	"crlf\r\nvalue",
+	"nul\x00byte",
+	"",
+	"\"quoted\"",
+	"'single'",
+	"back\\slash",
+	"\xff\xfe\x00\x7f",
+	"tab\tseparated  spaces ",
+}
+
+func TestArgsQuotingRoundTrip(t *testing.T) {
+	joined := utils.JoinArgs(binaryValues)
+	output, err := utils.SplitArgs(joined)
+	if err != nil {
+		t.Fatalf("Failed to split joined args: %v", err)
+	}
+	if !reflect.DeepEqual(output, binaryValues) {
+		t.Errorf("Expected %q, got %q", binaryValues, output)
+	}
+
+	for _, value := range binaryValues {
+		output, err := utils.SplitArgs(utils.QuoteArg(value))
+		if err != nil || len(output) != 1 || output[0] != value {
+			t.Errorf("Round trip failed for %q: %q, %v", value, output, err)
+		}
+	}
+
+	if _, err := utils.SplitArgs(`set a "unterminated`); err == nil {
+		t.Errorf("Unbalanced quotes should fail to split")
+	}
+}
+
+func TestServer_BinarySafeValues(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+
+	// Text clients quote values containing spaces
+	response, err := sendRequest(conn, `set greeting "hello world"`)
+	if err != nil || response != "OK" {
+		t.Errorf("SET command failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "get greeting")
+	if err != nil || response != "hello world" {
+		t.Errorf("GET command failed: %v, response: %s", err, response)
+	}
+
+	// Values that cannot be printed on one line come back quoted
+	response, err = sendRequest(conn, `set multiline "a\nb"`)
+	if err != nil || response != "OK" {
+		t.Errorf("SET command failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "get multiline")
+	if err != nil || response != `"a\nb"` {
+		t.Errorf("GET command failed: %v, response: %s", err, response)
+	}
+
+	// An empty value is an empty line, a missing key is (nil) and a literal "(nil)" is quoted
+	_, _ = sendRequest(conn, `set empty ""`)
+	response, err = sendRequest(conn, "get empty")
+	if err != nil || response != "" {
+		t.Errorf("GET of an empty value failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "get missing")
+	if err != nil || response != utils.NilLine {
+		t.Errorf("GET of a missing key failed: %v, response: %s", err, response)
+	}
+	_, _ = sendRequest(conn, "set literal (nil)")
+	response, err = sendRequest(conn, "get literal")
+	if err != nil || response != `"(nil)"` {
+		t.Errorf("GET of a literal (nil) failed: %v, response: %s", err, response)
+	}
+	_ = conn.Close()
+
+	conn, err = net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	respReader := resp.NewReader(bufio.NewReader(conn))
+	for i, value := range binaryValues {
+		key := "key " + value
+		response, err := sendRESPCommand(conn, respReader, "SET", key, value)
+		if err != nil || response.Str != "OK" {
+			t.Errorf("SET of value %d failed: %v, response: %+v", i, err, response)
+		}
+	}
+	_ = conn.Close()
+
+	// Restart the server so values are recovered from the commit log
+	srv.Stop()
+	time.Sleep(1 * time.Second)
+	srv = server.New(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err = net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to reconnect to server: %v", err)
+	}
+	defer conn.Close()
+	respReader = resp.NewReader(bufio.NewReader(conn))
+	for i, value := range binaryValues {
+		response, err := sendRESPCommand(conn, respReader, "GET", "key "+value)
+		if err != nil || response.Str != value {
+			t.Errorf("Recovered value %d mismatch: %v, expected %q, got %q", i, err, value, response.Str)
+		}
+	}
+	response2, err := sendRESPCommand(conn, respReader, "GET", "greeting")
+	if err != nil || response2.Str != "hello world" {
+		t.Errorf("Recovered text value mismatch: %v, got %q", err, response2.Str)
+	}
+}
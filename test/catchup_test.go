@@ -0,0 +1,82 @@
+package test
+
+import (
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// reconnectWait covers the delay before the leader retries an unreachable follower
+const reconnectWait = 7 * time.Second
+
+func dialServer(t *testing.T, address string) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	return conn
+}
+
+func TestServer_FollowerCatchUp(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+
+	// the leader starts alone and logs writes the follower never received
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET command failed: %v, response: %s", err, response)
+		}
+	}
+
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	time.Sleep(reconnectWait)
+
+	followerConn := dialServer(t, followerConf.ServerAddress)
+	for i := 0; i < 10; i++ {
+		response, err := sendRequest(followerConn, fmt.Sprintf("get key%d", i))
+		if err != nil || response != fmt.Sprintf("value%d", i) {
+			t.Errorf("GET key%d on late follower failed: %v, response: %s", i, err, response)
+		}
+	}
+	_ = followerConn.Close()
+
+	// writes made while the follower restarts reach it once it is reconnected
+	followerSrv.Stop()
+	time.Sleep(200 * time.Millisecond)
+	for _, request := range []string{"set key0 changed", "delete key1", "set key10 value10"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || response != "OK" {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+
+	followerSrv = server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(reconnectWait)
+
+	followerConn = dialServer(t, followerConf.ServerAddress)
+	defer followerConn.Close()
+	expected := map[string]string{"key0": "changed", "key1": utils.NilLine, "key2": "value2", "key10": "value10"}
+	for key, value := range expected {
+		response, err := sendRequest(followerConn, "get "+key)
+		if err != nil || response != value {
+			t.Errorf("GET %s on restarted follower failed: %v, response: %s expected %s", key, err, response, value)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"creek/client"
+	"creek/internal/commons"
+	"creek/internal/resp"
+	"creek/internal/server"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newClientTestServer() *server.Server {
+	conf := SimpleServerConfig
+	conf.DataStoreDirectory = testDataDir + "/client"
+	setupTest(&conf)
+	return server.New(&conf)
+}
+
+func newTestClient(t *testing.T, opts client.Options) *client.Client {
+	opts.Address = SimpleServerConfig.ServerAddress
+	c, err := client.New(opts)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return c
+}
+
+func TestClient_Commands(t *testing.T) {
+	srv := newClientTestServer()
+	defer cleanupAfterTest(srv.Conf)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	c := newTestClient(t, client.Options{})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+	if version, err := c.Version(ctx); err != nil || version != commons.Version {
+		t.Errorf("Version failed: %v, version: %s", err, version)
+	}
+
+	if err := c.Set(ctx, "client key", "value\r\nwith\x00binary", 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if value, err := c.Get(ctx, "client key"); err != nil || value != "value\r\nwith\x00binary" {
+		t.Errorf("Get failed: %v, value: %q", err, value)
+	}
+	if ttl, err := c.TTL(ctx, "client key"); err != nil || ttl != client.NoExpiration {
+		t.Errorf("TTL failed: %v, ttl: %v", err, ttl)
+	}
+	if err := c.Expire(ctx, "client key", 10*time.Second); err != nil {
+		t.Errorf("Expire failed: %v", err)
+	}
+	if ttl, err := c.TTL(ctx, "client key"); err != nil || ttl <= 0 || ttl > 10*time.Second {
+		t.Errorf("TTL after Expire failed: %v, ttl: %v", err, ttl)
+	}
+	if err := c.Delete(ctx, "client key"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if _, err := c.TTL(ctx, "client key"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("TTL of a deleted key should be ErrNotFound, got %v", err)
+	}
+	if _, err := c.Get(ctx, "client key"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Get of a deleted key should be ErrNotFound, got %v", err)
+	}
+	if err := c.Set(ctx, "empty", "", 0); err != nil {
+		t.Fatalf("Set of an empty value failed: %v", err)
+	}
+	if value, err := c.Get(ctx, "empty"); err != nil || value != "" {
+		t.Errorf("Get of an empty value failed: %v, value: %q", err, value)
+	}
+
+	// error replies are server errors, not connection failures
+	_, err := c.Do(ctx, "NOSUCHCOMMAND")
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "ERR" {
+		t.Errorf("Expected a server error for an unknown command, got %v", err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("Ping after a server error failed: %v", err)
+	}
+}
+
+func TestClient_PoolAndContext(t *testing.T) {
+	srv := newClientTestServer()
+	defer cleanupAfterTest(srv.Conf)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	c := newTestClient(t, client.Options{PoolSize: 4})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 20; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("pool%d_%d", w, i)
+				if err := c.Set(ctx, key, key, 0); err != nil {
+					t.Errorf("Set %s failed: %v", key, err)
+					return
+				}
+				if value, err := c.Get(ctx, key); err != nil || value != key {
+					t.Errorf("Get %s failed: %v, value: %s", key, err, value)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled context error, got %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := c.Ping(context.Background()); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	srv := newClientTestServer()
+	defer cleanupAfterTest(srv.Conf)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	c := newTestClient(t, client.Options{PoolSize: 1})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Set(ctx, "reconnect", "before", 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// the pooled connection breaks with the restart and is replaced transparently
+	srv.Stop()
+	time.Sleep(1 * time.Second)
+	srv = newClientTestServer()
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	if value, err := c.Get(ctx, "reconnect"); err != nil || value != "before" {
+		t.Errorf("Get after restart failed: %v, value: %s", err, value)
+	}
+}
+
+func TestClient_WritesAreNotResent(t *testing.T) {
+	// a server that reads each command and drops the connection before replying, as if it
+	// crashed right after applying it
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	var mu sync.Mutex
+	received := make(map[string]int)
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			args, err := resp.NewReader(bufio.NewReader(netConn)).ReadCommand()
+			if err == nil && len(args) > 0 {
+				mu.Lock()
+				received[args[0]]++
+				mu.Unlock()
+			}
+			_ = netConn.Close()
+		}
+	}()
+
+	c, err := client.New(client.Options{Address: listener.Addr().String(), MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.IncrBy(ctx, "counter", 1); err == nil {
+		t.Errorf("Expected INCRBY to fail")
+	}
+	if _, err := c.Get(ctx, "counter"); err == nil {
+		t.Errorf("Expected GET to fail")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if received[commons.CmdDataIncrBy] != 1 {
+		t.Errorf("Expected INCRBY to be sent once, the server received it %d times", received[commons.CmdDataIncrBy])
+	}
+	if received[commons.CmdDataGet] != 3 {
+		t.Errorf("Expected GET to be retried twice, the server received it %d times", received[commons.CmdDataGet])
+	}
+}
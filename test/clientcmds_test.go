@@ -1,9 +1,9 @@
 package test
 
 import (
-	"bufio"
 	"creek/internal/commons"
 	"creek/internal/server"
+	"creek/internal/utils"
 	"net"
 	"testing"
 	"time"
@@ -23,13 +23,6 @@ func TestServer_Commands(t *testing.T) {
 	}
 	defer conn.Close()
 
-	// Read and discard the initial welcome message
-	reader := bufio.NewReader(conn)
-	_, err = reader.ReadString('\n')
-	if err != nil {
-		t.Fatalf("Failed to read initial server response: %v", err)
-	}
-
 	// Test SET and GET
 	response, err := sendRequest(conn, "set a b")
 	if err != nil || response != "OK" {
@@ -48,7 +41,7 @@ func TestServer_Commands(t *testing.T) {
 	}
 	time.Sleep(6 * time.Second)
 	response, err = sendRequest(conn, "get a")
-	if err != nil || response != "" {
+	if err != nil || response != utils.NilLine {
 		t.Errorf("Key should be expired but still exists, response: %s", response)
 	}
 
@@ -59,8 +52,8 @@ func TestServer_Commands(t *testing.T) {
 		t.Errorf("DELETE command failed: %v, response: %s", err, response)
 	}
 	response, err = sendRequest(conn, "get a")
-	if err != nil || response != "" {
-		t.Errorf("GET should return empty for deleted key, response: %s", response)
+	if err != nil || response != utils.NilLine {
+		t.Errorf("GET should return nil for deleted key, response: %s", response)
 	}
 
 	// Test PING
@@ -75,4 +68,19 @@ func TestServer_Commands(t *testing.T) {
 		t.Errorf("VERSION response incorrect: %s", response)
 	}
 
+	// Errors carry a code and cannot be mistaken for values
+	response, err = sendRequest(conn, "nope")
+	if err != nil || response != "(error) ERR unknown command" {
+		t.Errorf("Unknown command should return an error reply, response: %s", response)
+	}
+	response, err = sendRequest(conn, "expire a soon")
+	if err != nil || response != "(error) ERR invalid TTL value" {
+		t.Errorf("EXPIRE with an invalid TTL should return an error reply, response: %s", response)
+	}
+	_, _ = sendRequest(conn, `set a "(error) ERR value"`)
+	response, err = sendRequest(conn, "get a")
+	if err != nil || response != `"(error) ERR value"` {
+		t.Errorf("A value looking like an error should be quoted, response: %s", response)
+	}
+
 }
@@ -0,0 +1,149 @@
+package test
+
+import (
+	"creek/internal/config"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clusterNodes sends CLUSTER NODES and returns the fields of every node by name, keyed by address
+func clusterNodes(t *testing.T, conn net.Conn) map[string]map[string]string {
+	response, err := sendRequest(conn, "cluster nodes")
+	if err != nil {
+		t.Fatalf("CLUSTER NODES failed: %v", err)
+	}
+	args, err := utils.SplitArgs(response)
+	if err != nil || len(args)%8 != 0 {
+		t.Fatalf("Invalid CLUSTER NODES reply %q: %v", response, err)
+	}
+	nodes := make(map[string]map[string]string)
+	for i := 0; i < len(args); i += 8 {
+		fields := make(map[string]string, 4)
+		for j := i; j < i+8; j += 2 {
+			fields[args[j]] = args[j+1]
+		}
+		nodes[fields["address"]] = fields
+	}
+	return nodes
+}
+
+func expectClusterNodes(t *testing.T, conn net.Conn, expected ...string) {
+	nodes := clusterNodes(t, conn)
+	var addresses []string
+	for address := range nodes {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+	slices.Sort(expected)
+	if !slices.Equal(addresses, expected) {
+		t.Errorf("CLUSTER NODES lists %v expected %v", addresses, expected)
+	}
+}
+
+func TestServer_ClusterJoinAndLeave(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	joinerConf := &config.Config{}
+	*joinerConf = *followerConf
+	joinerConf.ServerAddress = "localhost:7703"
+	joinerConf.DataStoreDirectory = testDataDir + "/cluster_joiner"
+	for _, conf := range []*config.Config{leaderConf, followerConf, joinerConf} {
+		setupTest(conf)
+		defer cleanupAfterTest(conf)
+	}
+	leaderAddress, followerAddress, joinerAddress :=
+		leaderConf.ServerAddress, followerConf.ServerAddress, joinerConf.ServerAddress
+
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	joinerSrv := server.New(joinerConf)
+	go joinerSrv.Start()
+	defer joinerSrv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderAddress)
+	for i := 0; i < 10; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET key%d failed: %v, response: %s", i, err, response)
+		}
+	}
+	expectClusterNodes(t, conn, leaderAddress, followerAddress)
+
+	// a follower does not change the membership
+	followerConn := dialServer(t, followerAddress)
+	defer followerConn.Close()
+	response, err := sendRequest(followerConn, "cluster join "+joinerAddress)
+	if err != nil || !strings.Contains(response, "READONLY") {
+		t.Errorf("Expected CLUSTER JOIN on a follower to be rejected, got %v, response: %s", err, response)
+	}
+
+	// the joined node is bootstrapped from the leader and every node learns about it
+	response, err = sendRequest(conn, "cluster join "+joinerAddress)
+	if err != nil || response != "OK" {
+		t.Fatalf("CLUSTER JOIN failed: %v, response: %s", err, response)
+	}
+	time.Sleep(1 * time.Second)
+	joinerConn := dialServer(t, joinerAddress)
+	defer joinerConn.Close()
+	for i := 0; i < 10; i++ {
+		response, err := sendRequest(joinerConn, fmt.Sprintf("get key%d", i))
+		if err != nil || response != fmt.Sprintf("value%d", i) {
+			t.Errorf("GET key%d on the joined node failed: %v, response: %s", i, err, response)
+		}
+	}
+	expectClusterNodes(t, conn, leaderAddress, followerAddress, joinerAddress)
+	expectClusterNodes(t, followerConn, leaderAddress, followerAddress, joinerAddress)
+	expectClusterNodes(t, joinerConn, leaderAddress, followerAddress, joinerAddress)
+	if fields := clusterNodes(t, conn)[joinerAddress]; fields["connected"] != "1" || fields["myself"] != "0" {
+		t.Errorf("Expected the leader to replicate to the joined node, got %v", fields)
+	}
+	if fields := clusterNodes(t, joinerConn)[joinerAddress]; fields["myself"] != "1" {
+		t.Errorf("Expected the joined node to describe itself, got %v", fields)
+	}
+
+	// the membership survives a restart of the leader
+	conn.Close()
+	leaderSrv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	leaderSrv = server.New(leaderConf)
+	go leaderSrv.Start()
+	defer func() { leaderSrv.Stop() }()
+	time.Sleep(1 * time.Second)
+	conn = dialServer(t, leaderAddress)
+	defer func() { conn.Close() }()
+	expectClusterNodes(t, conn, leaderAddress, followerAddress, joinerAddress)
+	expectPeer(t, conn, joinerAddress, map[string]string{"connected": "1"})
+
+	// the node that left is no longer replicated to
+	response, err = sendRequest(conn, "cluster leave "+joinerAddress)
+	if err != nil || response != "OK" {
+		t.Fatalf("CLUSTER LEAVE failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "set key10 value10")
+	if err != nil || response != "OK" {
+		t.Fatalf("SET key10 failed: %v, response: %s", err, response)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, listed := peerStatuses(t, conn)[joinerAddress]; listed {
+		t.Errorf("Expected PEERS not to list the node that left")
+	}
+	expectClusterNodes(t, conn, leaderAddress, followerAddress)
+	expectClusterNodes(t, followerConn, leaderAddress, followerAddress)
+	expectClusterNodes(t, joinerConn, leaderAddress, followerAddress)
+	if response, _ := sendRequest(followerConn, "get key10"); response != "value10" {
+		t.Errorf("GET key10 on the follower failed, response: %s", response)
+	}
+	if response, _ := sendRequest(joinerConn, "get key10"); response == "value10" {
+		t.Errorf("Expected the node that left not to get key10")
+	}
+}
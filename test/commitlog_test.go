@@ -0,0 +1,254 @@
+package test
+
+import (
+	"bytes"
+	"creek/internal/config"
+	"creek/internal/core"
+	"creek/internal/partition"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func commitLogConfig() *config.Config {
+	conf := SimpleServerConfig
+	conf.DataStoreDirectory = testDataDir + "/commitlog"
+	return &conf
+}
+
+func commitLogPath(conf *config.Config) string {
+	return filepath.Join(partition.Dir(conf, 0), partition.LogFileName)
+}
+
+// writeKeys starts a state machine on conf, sets key0..key<count-1> and stops it
+func writeKeys(t *testing.T, conf *config.Config, count int) {
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to start state machine: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		if err := sm.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 0); err != nil {
+			t.Fatalf("SET key%d failed: %v", i, err)
+		}
+	}
+	if err := sm.Stop(); err != nil {
+		t.Fatalf("Failed to stop state machine: %v", err)
+	}
+}
+
+// startStateMachine recovers a state machine from conf, the caller stops it. There are no
+// followers, writes are only logged like on a server without peers.
+func startStateMachine(t *testing.T, conf *config.Config) (*core.StateMachine, error) {
+	sm, err := core.NewStateMachine(conf.ServerAddress, conf)
+	if err != nil {
+		t.Fatalf("Failed to create state machine: %v", err)
+	}
+	err = sm.Start()
+	return sm, err
+}
+
+func expectKeys(t *testing.T, sm *core.StateMachine, from, to int, present bool) {
+	for i := from; i < to; i++ {
+		value, err := sm.Get(fmt.Sprintf("key%d", i))
+		if !present {
+			if !errors.Is(err, core.ErrKeyNotFound) {
+				t.Errorf("GET key%d should not find the key, err: %v, value: %q", i, err, value)
+			}
+			continue
+		}
+		if expected := fmt.Sprintf("value%d", i); err != nil || value != expected {
+			t.Errorf("GET key%d failed: %v, value: %q expected %q", i, err, value, expected)
+		}
+	}
+}
+
+func TestCommitLog_TornTailIsTruncated(t *testing.T) {
+	conf := commitLogConfig()
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	writeKeys(t, conf, 10)
+
+	// a crash in the middle of a write leaves half a record behind
+	logFile, err := os.OpenFile(commitLogPath(conf), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open commit log: %v", err)
+	}
+	_, _ = logFile.Write([]byte{0, 0, 0, 42, 1, 2})
+	_ = logFile.Close()
+
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery with a torn record failed: %v", err)
+	}
+	expectKeys(t, sm, 0, 10, true)
+	// writes after the truncation must be readable on the next start
+	if err := sm.Set("key10", "value10", 0); err != nil {
+		t.Fatalf("SET after recovery failed: %v", err)
+	}
+	_ = sm.Stop()
+
+	sm, err = startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery after truncation failed: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, 11, true)
+}
+
+func TestCommitLog_CorruptionRefusesStart(t *testing.T) {
+	conf := commitLogConfig()
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	writeKeys(t, conf, 10)
+
+	// flip a byte inside the record of key5, records after it are intact
+	content, err := os.ReadFile(commitLogPath(conf))
+	if err != nil {
+		t.Fatalf("Failed to read commit log: %v", err)
+	}
+	index := bytes.Index(content, []byte("value5"))
+	if index < 0 {
+		t.Fatalf("Record of key5 not found in commit log")
+	}
+	content[index] ^= 0xff
+	if err := os.WriteFile(commitLogPath(conf), content, 0644); err != nil {
+		t.Fatalf("Failed to write commit log: %v", err)
+	}
+
+	sm, err := startStateMachine(t, conf)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Expected recovery to refuse a corrupt commit log, got: %v", err)
+	}
+	_ = sm.Stop()
+
+	conf.LogRepair = true
+	sm, err = startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery with log_repair failed: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, 5, true)
+	expectKeys(t, sm, 5, 10, false)
+}
+
+func TestCommitLog_CorruptLengthRefusesStart(t *testing.T) {
+	conf := commitLogConfig()
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	writeKeys(t, conf, 10)
+
+	// damage the length of the record of key5 so that it runs past the end of the file, which
+	// looks like a torn tail although valid records follow
+	content, err := os.ReadFile(commitLogPath(conf))
+	if err != nil {
+		t.Fatalf("Failed to read commit log: %v", err)
+	}
+	offset := len("CRKLOG") + 2
+	for offset < len(content) && !bytes.Contains(content[offset:offset+8+int(binary.BigEndian.Uint32(content[offset:]))], []byte(" key5 ")) {
+		offset += 8 + int(binary.BigEndian.Uint32(content[offset:]))
+	}
+	if offset >= len(content) {
+		t.Fatalf("Record of key5 not found in commit log")
+	}
+	content[offset+1] ^= 0x01
+	if err := os.WriteFile(commitLogPath(conf), content, 0644); err != nil {
+		t.Fatalf("Failed to write commit log: %v", err)
+	}
+
+	sm, err := startStateMachine(t, conf)
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Fatalf("Expected recovery to refuse a commit log with a damaged length, got: %v", err)
+	}
+	_ = sm.Stop()
+	if info, err := os.Stat(commitLogPath(conf)); err != nil || info.Size() != int64(len(content)) {
+		t.Fatalf("Expected the commit log to be left as is: %v", err)
+	}
+
+	conf.LogRepair = true
+	sm, err = startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery with log_repair failed: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, 5, true)
+	expectKeys(t, sm, 5, 10, false)
+}
+
+func TestCommitLog_TextLogIsMigrated(t *testing.T) {
+	conf := commitLogConfig()
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+
+	dir := partition.Dir(conf, 0)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatalf("Failed to create partition directory: %v", err)
+	}
+	now := time.Now().UnixNano()
+	textLog := fmt.Sprintf("%d 1 0 SET key0 value0 -1\n%d 2 SET key1 value1 -1\n%d 3 0 SET key2 \"value 2\" -1\n", now, now, now)
+	if err := os.WriteFile(commitLogPath(conf), []byte(textLog), 0644); err != nil {
+		t.Fatalf("Failed to write text commit log: %v", err)
+	}
+
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery of a text commit log failed: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, 2, true)
+	if value, _ := sm.Get("key2"); value != "value 2" {
+		t.Errorf("GET key2 failed, value: %q", value)
+	}
+
+	content, err := os.ReadFile(commitLogPath(conf))
+	if err != nil || !bytes.HasPrefix(content, []byte("CRKLOG")) {
+		t.Errorf("Expected the commit log to be migrated to the framed format: %v", err)
+	}
+}
+
+func TestCommitLog_FormatUpgrade(t *testing.T) {
+	conf := commitLogConfig()
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+
+	// a text log is migrated to format version 1, whose records have no origin
+	dir := partition.Dir(conf, 0)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatalf("Failed to create partition directory: %v", err)
+	}
+	now := time.Now().UnixNano()
+	textLog := fmt.Sprintf("%d 1 0 SET key0 value0 -1\n%d 2 0 SET key1 value1 -1\n", now, now)
+	if err := os.WriteFile(commitLogPath(conf), []byte(textLog), 0644); err != nil {
+		t.Fatalf("Failed to write text commit log: %v", err)
+	}
+
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery of a text commit log failed: %v", err)
+	}
+	// the first write seals the old segment and starts one of the current format
+	if err := sm.Set("key2", "value2", 0); err != nil {
+		t.Fatalf("SET key2 failed: %v", err)
+	}
+	_ = sm.Stop()
+	if count := segmentCount(t, dir); count != 1 {
+		t.Errorf("Expected the old segment to be sealed, got %d sealed segments", count)
+	}
+
+	sm, err = startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery of an upgraded commit log failed: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, 3, true)
+	for key, origin := range map[string]string{"key0": "", "key2": conf.ServerAddress} {
+		entry, err := sm.KeyInfo(key)
+		if err != nil || entry.Origin != origin {
+			t.Errorf("KEYINFO %s: origin %q expected %q, err: %v", key, entry.Origin, origin, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"context"
+	"creek/client"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_ConditionalSet(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, SimpleServerConfig.ServerAddress)
+	defer conn.Close()
+	for _, step := range []struct{ request, expected string }{
+		{"set lock a nx", "OK"},
+		{"set lock b nx", utils.NilLine},
+		{"get lock", "a"},
+		{"set missing x xx", utils.NilLine},
+		{"get missing", utils.NilLine},
+		{"set lock c xx get", "a"},
+		{"set lock d nx get", "c"},
+		{"get lock", "c"},
+		{"set fresh v get", utils.NilLine},
+		{"getset lock e", "c"},
+		{"getset other v", utils.NilLine},
+		{"get lock", "e"},
+	} {
+		response, err := sendRequest(conn, step.request)
+		if err != nil || response != step.expected {
+			t.Errorf("%s failed: %v, response: %s expected %s", step.request, err, response, step.expected)
+		}
+	}
+	for _, request := range []string{"set k v nx xx", "set k v 5 keepttl", "set k v ex", "set k v ex 5 ex 6", "set k v unknown"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+			t.Errorf("Expected %s to fail, got %v, response: %s", request, err, response)
+		}
+	}
+
+	// TTLs
+	ttl := func(key string) int {
+		response, err := sendRequest(conn, "ttl "+key)
+		if err != nil {
+			t.Fatalf("TTL %s failed: %v", key, err)
+		}
+		ttl, _ := strconv.Atoi(response)
+		return ttl
+	}
+	for _, request := range []string{"set timed v 100", "set timed w keepttl", "set ex v ex 50", "set lock f 100", "getset lock g"} {
+		if response, err := sendRequest(conn, request); err != nil || strings.HasPrefix(response, utils.ErrorLinePrefix) {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	if remaining := ttl("timed"); remaining < 90 || remaining > 100 {
+		t.Errorf("SET KEEPTTL should keep the TTL, got %d", remaining)
+	}
+	// the expiration is logged as is, not resolved again when the record is applied
+	expiration := keyInfo(t, conn, "timed")["expiration_ms"]
+	if response, err := sendRequest(conn, "set timed x keepttl"); err != nil || response != "OK" {
+		t.Fatalf("SET KEEPTTL failed: %v, response: %s", err, response)
+	}
+	if kept := keyInfo(t, conn, "timed")["expiration_ms"]; kept != expiration || expiration == "0" {
+		t.Errorf("SET KEEPTTL should keep the expiration %s, got %s", expiration, kept)
+	}
+	if remaining := ttl("ex"); remaining < 40 || remaining > 50 {
+		t.Errorf("SET EX should set the TTL, got %d", remaining)
+	}
+	if remaining := ttl("lock"); remaining != -1 {
+		t.Errorf("GETSET should drop the TTL, got %d", remaining)
+	}
+
+	// CAS on the version KEYINFO reports
+	version := keyInfo(t, conn, "lock")["version"]
+	response, err := sendRequest(conn, fmt.Sprintf("cas lock %s h", version))
+	if newVersion, _ := strconv.Atoi(response); err != nil || strconv.Itoa(newVersion) != response || response == version || newVersion == 0 {
+		t.Errorf("CAS with the current version failed: %v, response: %s", err, response)
+	}
+	if fields := keyInfo(t, conn, "lock"); fields["version"] != response {
+		t.Errorf("CAS replied version %s, KEYINFO reports %v", response, fields)
+	}
+	if response, err := sendRequest(conn, fmt.Sprintf("cas lock %s i", version)); err != nil || response != "0" {
+		t.Errorf("CAS with a stale version should not apply: %v, response: %s", err, response)
+	}
+	if response, err := sendRequest(conn, "get lock"); err != nil || response != "h" {
+		t.Errorf("GET after CAS failed: %v, response: %s", err, response)
+	}
+	if response, err := sendRequest(conn, "cas created 0 v 100"); err != nil || response == "0" || strings.HasPrefix(response, utils.ErrorLinePrefix) {
+		t.Errorf("CAS of a key without value failed: %v, response: %s", err, response)
+	}
+	if response, err := sendRequest(conn, "cas created 0 w"); err != nil || response != "0" {
+		t.Errorf("CAS with version 0 of an existing key should not apply: %v, response: %s", err, response)
+	}
+	if remaining := ttl("created"); remaining < 90 || remaining > 100 {
+		t.Errorf("CAS should set the TTL, got %d", remaining)
+	}
+
+	// exactly one of concurrent conditional writes applies
+	c, err := client.New(client.Options{Address: SimpleServerConfig.ServerAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	current, _ := strconv.ParseInt(keyInfo(t, conn, "lock")["version"], 10, 64)
+	var locked, swapped atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.Background()
+			if ok, err := c.SetNX(ctx, "mutex", fmt.Sprint(i), client.NoExpiration); err != nil {
+				t.Errorf("SET NX failed: %v", err)
+			} else if ok {
+				locked.Add(1)
+			}
+			if version, err := c.CompareAndSwap(ctx, "lock", current, fmt.Sprint(i), client.NoExpiration); err != nil {
+				t.Errorf("CAS failed: %v", err)
+			} else if version != 0 {
+				swapped.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if locked.Load() != 1 || swapped.Load() != 1 {
+		t.Errorf("Expected exactly one SET NX and one CAS to apply, got %d and %d", locked.Load(), swapped.Load())
+	}
+}
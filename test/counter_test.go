@@ -0,0 +1,181 @@
+package test
+
+import (
+	"context"
+	"creek/client"
+	"creek/internal/commons"
+	"creek/internal/replication"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_Counters(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, SimpleServerConfig.ServerAddress)
+	for _, step := range []struct{ request, expected string }{
+		{"incr counter", "1"},
+		{"incrby counter 10", "11"},
+		{"decr counter", "10"},
+		{"decrby counter 3", "7"},
+		{"incrbyfloat counter 0.5", "7.5"},
+		{"incrbyfloat counter -0.5", "7"},
+		{"incrby counter -9", "-2"},
+		{"get counter", "-2"},
+		{"incrbyfloat floating 1.25", "1.25"},
+		{"set text abc", "OK"},
+		{"set max 9223372036854775807", "OK"},
+	} {
+		response, err := sendRequest(conn, step.request)
+		if err != nil || response != step.expected {
+			t.Errorf("%s failed: %v, response: %s expected %s", step.request, err, response, step.expected)
+		}
+	}
+	for _, request := range []string{"incr text", "incr floating", "incrbyfloat text 1", "incrby counter x", "incr max"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+			t.Errorf("Expected %s to fail, got %v, response: %s", request, err, response)
+		}
+	}
+	if response, err := sendRequest(conn, "get text"); err != nil || response != "abc" {
+		t.Errorf("A failed INCR changed the value: %v, response: %s", err, response)
+	}
+
+	// the key keeps its TTL
+	if response, err := sendRequest(conn, "set expiring 5 100"); err != nil || response != "OK" {
+		t.Fatalf("SET with TTL failed: %v, response: %s", err, response)
+	}
+	if response, err := sendRequest(conn, "incr expiring"); err != nil || response != "6" {
+		t.Errorf("INCR of a key with a TTL failed: %v, response: %s", err, response)
+	}
+	response, err := sendRequest(conn, "ttl expiring")
+	if ttl, _ := strconv.Atoi(response); err != nil || ttl < 90 || ttl > 100 {
+		t.Errorf("INCR should keep the TTL: %v, response: %s", err, response)
+	}
+
+	// concurrent increments are not lost
+	c, err := client.New(client.Options{Address: SimpleServerConfig.ServerAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := c.IncrBy(context.Background(), "hits", 2); err != nil {
+					t.Errorf("INCRBY failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, err := c.IncrBy(context.Background(), "hits", 0); err != nil || value != 800 {
+		t.Errorf("Expected 800 hits after concurrent increments, got %d: %v", value, err)
+	}
+
+	// the results are replayed from the commit log on restart
+	conn.Close()
+	srv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	srv = server.New(&SimpleServerConfig)
+	go srv.Start()
+	defer func() { srv.Stop() }()
+	time.Sleep(1 * time.Second)
+	conn = dialServer(t, SimpleServerConfig.ServerAddress)
+	defer func() { conn.Close() }()
+	for key, expected := range map[string]string{"counter": "-2", "floating": "1.25", "hits": "800", "expiring": "6"} {
+		if response, err := sendRequest(conn, "get "+key); err != nil || response != expected {
+			t.Errorf("GET %s after a restart failed: %v, response: %s expected %s", key, err, response, expected)
+		}
+	}
+	response, err = sendRequest(conn, "ttl expiring")
+	if ttl, _ := strconv.Atoi(response); err != nil || ttl < 90 || ttl > 100 {
+		t.Errorf("The TTL kept by INCR was lost on restart: %v, response: %s", err, response)
+	}
+}
+
+func TestServer_CountersReplicate(t *testing.T) {
+	leaderConf, followerConf := quorumConfigs()
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for _, request := range []string{"set replicated 1 100", "incrby replicated 41", "incrbyfloat replicated 0.5"} {
+		if response, err := sendRequest(conn, request); err != nil || strings.HasPrefix(response, utils.ErrorLinePrefix) {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+
+	// the follower acknowledged every write before the leader replied
+	followerConn := dialServer(t, followerConf.ServerAddress)
+	defer followerConn.Close()
+	if response, err := sendRequest(followerConn, "get replicated"); err != nil || response != "42.5" {
+		t.Errorf("GET on the follower failed: %v, response: %s", err, response)
+	}
+	response, err := sendRequest(followerConn, "ttl replicated")
+	if ttl, _ := strconv.Atoi(response); err != nil || ttl < 90 || ttl > 100 {
+		t.Errorf("The follower should keep the TTL: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(followerConn, "incr replicated")
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"READONLY ") && !strings.HasPrefix(response, utils.ErrorLinePrefix+"MOVED ") {
+		t.Errorf("Expected INCR on the follower to be refused, got %v, response: %s", err, response)
+	}
+}
+
+func TestStateMachine_CounterExpirationReplicates(t *testing.T) {
+	conf := multiMasterConfigs()[0]
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to start state machine: %v", err)
+	}
+	defer sm.Stop()
+
+	if err := sm.Set("hits", "1", 100); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	before, _ := sm.KeyInfo("hits")
+	if result, err := sm.IncrBy("hits", 1); err != nil || result != 2 {
+		t.Fatalf("INCR failed: %v, result: %d", err, result)
+	}
+	if entry, err := sm.KeyInfo("hits"); err != nil || entry.Expiration != before.Expiration {
+		t.Errorf("Expected INCR to keep the expiration %d, got %+v: %v", before.Expiration, entry, err)
+	}
+
+	// the increment of another node carries its expiration, whatever the one of the key here
+	expiration := time.Now().Add(time.Hour).UnixMilli()
+	cmd := &replication.RepCmd{PartitionId: sm.PartitionIdForKey("hits"), Origin: "nodeB", Timestamp: time.Now().UnixNano(),
+		Version: 1, Operation: commons.CmdDataSet, Args: []string{"hits", "7", commons.SetPXAT, strconv.FormatInt(expiration, 10)}}
+	if err := sm.ProcessRepCmd(cmd); err != nil {
+		t.Fatalf("Failed to apply SET: %v", err)
+	}
+	if entry, err := sm.KeyInfo("hits"); err != nil || entry.Value != "7" || entry.Expiration != expiration {
+		t.Errorf("Expected the replicated increment to expire at %d, got %+v: %v", expiration, entry, err)
+	}
+}
@@ -18,5 +18,40 @@ func TestExpireAndTTL(t *testing.T) {
 
 	time.Sleep(4 * time.Second)
 
-	_ = ds.Get("session")
+	if _, found := ds.Get("session"); found {
+		t.Fatalf("Expected session to be expired")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	ds := datastore.NewDataStore(&SimpleServerConfig)
+
+	now := time.Now().UnixNano()
+	ds.SetAt("user", "alice", -1, datastore.Stamp{Timestamp: now, Version: 1, Origin: "nodeA"})
+	ds.DeleteAt("user", datastore.Stamp{Timestamp: now + 1, Version: 2, Origin: "nodeB"})
+
+	if _, found := ds.Get("user"); found {
+		t.Fatalf("Expected deleted key not to be found")
+	}
+	if ttl := ds.TTL("user"); ttl != -2 {
+		t.Errorf("Expected TTL -2 for a deleted key, got %d", ttl)
+	}
+	ds.ExpireAt("user", 100, datastore.Stamp{Timestamp: now + 2, Version: 3, Origin: "nodeA"})
+	entry, exists := ds.Lookup("user")
+	if !exists || !entry.Deleted || entry.Version != 2 || entry.Origin != "nodeB" {
+		t.Fatalf("Expected the tombstone of version 2 from nodeB, got %+v (exists: %v)", entry, exists)
+	}
+	if keys := ds.GetExpiredKeys(); len(keys) != 0 {
+		t.Errorf("Tombstones must not be collected as expired keys: %v", keys)
+	}
+
+	if purged := ds.PurgeTombstones(now); purged != 0 {
+		t.Errorf("Expected a tombstone newer than the grace period to be kept, %d purged", purged)
+	}
+	if purged := ds.PurgeTombstones(now + 2); purged != 1 {
+		t.Errorf("Expected the tombstone to be purged, %d purged", purged)
+	}
+	if _, exists := ds.Lookup("user"); exists {
+		t.Errorf("Expected the purged tombstone to be gone")
+	}
 }
@@ -0,0 +1,34 @@
+package test
+
+import (
+	"creek/internal/commons"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	wrapped := fmt.Errorf("partition 0: %w", commons.ErrReadOnly)
+	if code := commons.ErrorCodeOf(wrapped); code != commons.ErrCodeReadOnly {
+		t.Errorf("Expected the code of a wrapped error to be kept, got %s", code)
+	}
+	if !errors.Is(wrapped, commons.ErrReadOnly) {
+		t.Errorf("Expected a wrapped coded error to match errors.Is")
+	}
+	if reply := commons.FormatError(wrapped); reply != "READONLY partition 0: write mode is read-only for the follower partition" {
+		t.Errorf("Unexpected error reply: %s", reply)
+	}
+
+	plain := errors.New("something failed")
+	if reply := commons.FormatError(plain); reply != "ERR something failed" {
+		t.Errorf("Errors without a code should be generic, got: %s", reply)
+	}
+
+	timeout := commons.WithCode(commons.ErrCodeTryAgain, plain)
+	if commons.ErrorCodeOf(timeout) != commons.ErrCodeTryAgain || !errors.Is(timeout, plain) {
+		t.Errorf("WithCode should attach a code and keep the error in the chain: %v", timeout)
+	}
+	if commons.WithCode(commons.ErrCodeTryAgain, nil) != nil {
+		t.Errorf("WithCode of a nil error should be nil")
+	}
+}
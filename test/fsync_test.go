@@ -0,0 +1,69 @@
+package test
+
+import (
+	"creek/internal/commons"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCommitLog_GroupCommit(t *testing.T) {
+	conf := commitLogConfig()
+	conf.FsyncPolicy = commons.FsyncAlways
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to start state machine: %v", err)
+	}
+
+	const writers = 16
+	const writesPerWriter = 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writesPerWriter; i++ {
+				key := fmt.Sprintf("key%d", w*writesPerWriter+i)
+				if err := sm.Set(key, fmt.Sprintf("value%d", w*writesPerWriter+i), 0); err != nil {
+					t.Errorf("SET %s failed: %v", key, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// every SET returned after its record was fsynced, concurrent ones sharing an fsync
+	syncs := sm.LogSyncCount()
+	if syncs == 0 || syncs >= writers*writesPerWriter {
+		t.Errorf("Expected concurrent writes to share fsyncs, got %d fsyncs for %d writes", syncs, writers*writesPerWriter)
+	}
+	_ = sm.Stop()
+
+	sm, err = startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to recover state machine: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, writers*writesPerWriter, true)
+}
+
+func TestCommitLog_FsyncLeftToOS(t *testing.T) {
+	conf := commitLogConfig()
+	conf.FsyncPolicy = commons.FsyncNever
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+
+	writeKeys(t, conf, 10)
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to recover state machine: %v", err)
+	}
+	defer sm.Stop()
+	if syncs := sm.LogSyncCount(); syncs != 0 {
+		t.Errorf("Expected no fsync with the OS managed policy, got %d", syncs)
+	}
+	expectKeys(t, sm, 0, 10, true)
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"creek/internal/server"
+	"creek/internal/utils"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// keyInfo sends KEYINFO and returns its fields by name
+func keyInfo(t *testing.T, conn net.Conn, key string) map[string]string {
+	response, err := sendRequest(conn, "keyinfo "+key)
+	if err != nil {
+		t.Fatalf("KEYINFO %s failed: %v", key, err)
+	}
+	if response == utils.NilLine {
+		return nil
+	}
+	args, err := utils.SplitArgs(response)
+	if err != nil || len(args)%2 != 0 {
+		t.Fatalf("Invalid KEYINFO reply %q: %v", response, err)
+	}
+	fields := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	return fields
+}
+
+func expectKeyInfo(t *testing.T, conn net.Conn, key string, expected map[string]string) {
+	fields := keyInfo(t, conn, key)
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("KEYINFO %s: %s is %q expected %q (%v)", key, name, fields[name], value, fields)
+		}
+	}
+}
+
+func TestServer_KeyInfo(t *testing.T) {
+	conf := SimpleServerConfig
+	conf.DataStoreDirectory = testDataDir + "/keyinfo"
+	conf.GCInterval = 500 * time.Millisecond
+	conf.TombstoneGCGrace = time.Hour
+	setupTest(&conf)
+	defer cleanupAfterTest(&conf)
+
+	srv := server.New(&conf)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, conf.ServerAddress)
+	for _, request := range []string{"set user alice", "set session abc 100", "delete user"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || response != "OK" {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	if fields := keyInfo(t, conn, "missing"); fields != nil {
+		t.Errorf("Expected (nil) for a key never written, got %v", fields)
+	}
+	expected := map[string]map[string]string{
+		"session": {"version": "2", "origin": conf.ServerAddress, "deleted": "0"},
+		"user":    {"version": "3", "origin": conf.ServerAddress, "deleted": "1", "ttl": "-2", "expiration_ms": "0"},
+	}
+	for key, fields := range expected {
+		expectKeyInfo(t, conn, key, fields)
+	}
+	fields := keyInfo(t, conn, "session")
+	expiration, _ := strconv.ParseInt(fields["expiration_ms"], 10, 64)
+	ttl, _ := strconv.ParseInt(fields["ttl"], 10, 64)
+	if remaining := expiration - time.Now().UnixMilli(); remaining < 98000 || remaining > 100000 || ttl < 98 || ttl > 100 {
+		t.Errorf("Expected session to expire in 100 seconds, got %v", fields)
+	}
+	if response, _ := sendRequest(conn, "get user"); response != utils.NilLine {
+		t.Errorf("GET of a deleted key: %s", response)
+	}
+	_ = conn.Close()
+
+	// the stamps and the tombstone are recovered from the commit log
+	srv.Stop()
+	time.Sleep(1 * time.Second)
+	conf.TombstoneGCGrace = time.Second
+	srv = server.New(&conf)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn = dialServer(t, conf.ServerAddress)
+	defer conn.Close()
+	expectKeyInfo(t, conn, "session", expected["session"])
+
+	// the tombstone is purged once the grace period is over, the key is unknown again
+	time.Sleep(2 * time.Second)
+	if fields := keyInfo(t, conn, "user"); fields != nil {
+		t.Errorf("Expected the tombstone of user to be purged, got %v", fields)
+	}
+	expectKeyInfo(t, conn, "session", expected["session"])
+}
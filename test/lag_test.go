@@ -0,0 +1,200 @@
+package test
+
+import (
+	"bufio"
+	"creek/internal/commons"
+	"creek/internal/replication"
+	"creek/internal/server"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFollower accepts the replication connection of a leader, syncs at version 0 and answers
+// pings, but only acknowledges the writes it is told to on acks.
+func fakeFollower(t *testing.T, address string, acks <-chan string) net.Listener {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			for ack := range acks {
+				_, _ = conn.Write([]byte(ack + "\n"))
+			}
+		}()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args := strings.Fields(line)
+			switch {
+			case args[0] == commons.CmdSysSync:
+				_, _ = conn.Write([]byte(replication.FormatAck(0, 0) + "\n"))
+			case args[0] == commons.CmdSysPing:
+				_, _ = conn.Write([]byte(commons.CmdSysPong + "\n"))
+			}
+		}
+	}()
+	return listener
+}
+
+func TestServer_LagBlocksWriters(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	leaderConf.PartitionCount = 1
+	leaderConf.ReplicationMaxLag = 5
+	leaderConf.ReplicationLagPolicy = commons.LagBlock
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+
+	acks := make(chan string)
+	defer close(acks)
+	listener := fakeFollower(t, followerConf.ServerAddress, acks)
+	defer listener.Close()
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for i := 1; i <= 5; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET key%d failed: %v, response: %s", i, err, response)
+		}
+	}
+
+	// the follower acknowledged none of the 5 writes, the next one waits for it
+	done := make(chan string, 1)
+	go func() {
+		response, _ := sendRequest(conn, "set key6 value6")
+		done <- response
+	}()
+	select {
+	case response := <-done:
+		t.Fatalf("Expected the write to be held back, got %s", response)
+	case <-time.After(500 * time.Millisecond):
+	}
+	statusConn := dialServer(t, leaderConf.ServerAddress)
+	defer statusConn.Close()
+	expectPeer(t, statusConn, followerConf.ServerAddress, map[string]string{"connected": "1", "lag": "6", "stale": "0"})
+
+	acks <- replication.FormatAck(0, 3)
+	select {
+	case response := <-done:
+		if response != "OK" {
+			t.Errorf("SET key6 failed once the follower caught up: %s", response)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the write to go through once the follower acknowledged it")
+	}
+	expectPeer(t, statusConn, followerConf.ServerAddress, map[string]string{"lag": "3"})
+}
+
+func TestServer_LagBlockGivesUpOnStalledFollower(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	leaderConf.PartitionCount = 1
+	leaderConf.ReplicationMaxLag = 2
+	leaderConf.ReplicationLagPolicy = commons.LagBlock
+	leaderConf.HeartbeatInterval = 200 * time.Millisecond
+	leaderConf.PeerTimeout = 1 * time.Second
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+
+	acks := make(chan string)
+	defer close(acks)
+	listener := fakeFollower(t, followerConf.ServerAddress, acks)
+	defer listener.Close()
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	_, _ = sendRequest(conn, "set key1 value1")
+	_, _ = sendRequest(conn, "set key2 value2")
+
+	// the follower answers pings but never acknowledges, the write is held back for peer_timeout_ms
+	start := time.Now()
+	response, err := sendRequest(conn, "set key3 value3")
+	if err != nil || response != "OK" {
+		t.Fatalf("SET key3 failed: %v, response: %s", err, response)
+	}
+	if elapsed := time.Since(start); elapsed < leaderConf.PeerTimeout || elapsed > 3*leaderConf.PeerTimeout {
+		t.Errorf("Expected the write to be held back for about %v, it took %v", leaderConf.PeerTimeout, elapsed)
+	}
+	statusConn := dialServer(t, leaderConf.ServerAddress)
+	defer statusConn.Close()
+	expectPeer(t, statusConn, followerConf.ServerAddress, map[string]string{"connected": "1", "stale": "1"})
+
+	// a stale follower no longer holds writes back
+	start = time.Now()
+	response, err = sendRequest(conn, "set key4 value4")
+	if err != nil || response != "OK" || time.Since(start) > leaderConf.PeerTimeout/2 {
+		t.Errorf("SET key4 should not wait for a stale follower: %v, response: %s", err, response)
+	}
+
+	// it is no longer stale once it acknowledged the writes logged when it was marked
+	acks <- replication.FormatAck(0, 3)
+	time.Sleep(200 * time.Millisecond)
+	expectPeer(t, statusConn, followerConf.ServerAddress, map[string]string{"stale": "0", "lag": "1"})
+}
+
+func TestServer_LagResyncsFollower(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	leaderConf.ReplicationMaxLag = 5
+	leaderConf.ReplicationLagPolicy = commons.LagResync
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+
+	// the follower joins after more writes than the max lag were made, it is resynced from a snapshot
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for i := 0; i < 30; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET key%d failed: %v, response: %s", i, err, response)
+		}
+	}
+	expectPeer(t, conn, followerConf.ServerAddress, map[string]string{"connected": "0", "lag": "30"})
+
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(3 * time.Second) // covers the backoff between reconnect attempts
+	expectPeer(t, conn, followerConf.ServerAddress,
+		map[string]string{"connected": "1", "lag": "0", "stale": "0", "resyncs": "2"})
+
+	// once resynced the follower is streamed the log again
+	response, err := sendRequest(conn, "set key30 value30")
+	if err != nil || response != "OK" {
+		t.Fatalf("SET key30 failed: %v, response: %s", err, response)
+	}
+	time.Sleep(200 * time.Millisecond)
+	followerConn := dialServer(t, followerConf.ServerAddress)
+	defer followerConn.Close()
+	for i := 0; i <= 30; i++ {
+		response, err := sendRequest(followerConn, fmt.Sprintf("get key%d", i))
+		if err != nil || response != fmt.Sprintf("value%d", i) {
+			t.Errorf("GET key%d on the resynced follower failed: %v, response: %s", i, err, response)
+		}
+	}
+	expectPeer(t, conn, followerConf.ServerAddress, map[string]string{"lag": "0", "resyncs": "2"})
+}
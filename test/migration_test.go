@@ -0,0 +1,239 @@
+package test
+
+import (
+	"context"
+	"creek/client"
+	"creek/internal/commons"
+	"creek/internal/config"
+	"creek/internal/core"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var migrationAddresses = []string{"localhost:7704", "localhost:7705"}
+
+// migrationConfigs returns two static leaders without peers, partitions move from the first
+// to the second
+func migrationConfigs() (*config.Config, *config.Config) {
+	configs := make([]*config.Config, len(migrationAddresses))
+	for i, address := range migrationAddresses {
+		configs[i] = &config.Config{
+			ServerAddress:        address,
+			DataStoreDirectory:   fmt.Sprintf("%s/migration_%d", testDataDir, i),
+			LogLevel:             "warn",
+			WriteConsistencyMode: commons.EventualConsistency,
+			ServerMode:           commons.Leader,
+			PartitionCount:       2,
+		}
+	}
+	return configs[0], configs[1]
+}
+
+// keysOfPartition returns count keys routed to a partition of partitionCount
+func keysOfPartition(partitionId, partitionCount, count int) []string {
+	var keys []string
+	for i := 0; len(keys) < count; i++ {
+		key := fmt.Sprintf("mkey%d", i)
+		if core.KeySlot(key)*partitionCount/commons.SlotCount == partitionId {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// partitionFields sends CLUSTER PARTITIONS and returns the fields of a partition by name
+func partitionFields(t *testing.T, conn net.Conn, partitionId int) map[string]string {
+	response, err := sendRequest(conn, "cluster partitions")
+	if err != nil {
+		t.Fatalf("CLUSTER PARTITIONS failed: %v", err)
+	}
+	args, err := utils.SplitArgs(response)
+	if err != nil || len(args)%10 != 0 {
+		t.Fatalf("Invalid CLUSTER PARTITIONS reply %q: %v", response, err)
+	}
+	for i := 0; i < len(args); i += 10 {
+		fields := make(map[string]string, 5)
+		for j := i; j < i+10; j += 2 {
+			fields[args[j]] = args[j+1]
+		}
+		if fields["partition"] == fmt.Sprint(partitionId) {
+			return fields
+		}
+	}
+	t.Fatalf("CLUSTER PARTITIONS does not list partition %d: %q", partitionId, response)
+	return nil
+}
+
+func TestServer_MigratePartition(t *testing.T) {
+	sourceConf, targetConf := migrationConfigs()
+	for _, conf := range []*config.Config{sourceConf, targetConf} {
+		setupTest(conf)
+		defer cleanupAfterTest(conf)
+	}
+	sourceAddress, targetAddress := sourceConf.ServerAddress, targetConf.ServerAddress
+
+	sourceSrv := server.New(sourceConf)
+	go sourceSrv.Start()
+	targetSrv := server.New(targetConf)
+	go targetSrv.Start()
+	defer targetSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, sourceAddress)
+	moving, staying := keysOfPartition(1, 2, 20), keysOfPartition(0, 2, 5)
+	for _, key := range append(slices.Clone(moving[:10]), staying...) {
+		response, err := sendRequest(conn, fmt.Sprintf("set %s %s-0", key, key))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET %s failed: %v, response: %s", key, err, response)
+		}
+	}
+	if fields := partitionFields(t, conn, 1); fields["first_slot"] != "8192" || fields["last_slot"] != "16383" ||
+		fields["owner"] != sourceAddress || fields["state"] != "serving" {
+		t.Errorf("Unexpected partition 1 before the migration: %v", fields)
+	}
+
+	// a client keeps writing to the migrated partition, following the redirects
+	c, err := client.New(client.Options{Address: sourceAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	written := make(map[string]string)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := moving[i%len(moving)]
+			value := fmt.Sprintf("%s-%d", key, i)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := c.Set(ctx, key, value, client.NoExpiration)
+			cancel()
+			if err != nil {
+				t.Errorf("SET %s during the migration failed: %v", key, err)
+				return
+			}
+			written[key] = value
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	response, err := sendRequest(conn, "migrate 1 "+targetAddress)
+	if err != nil || response != "OK" {
+		t.Fatalf("MIGRATE failed: %v, response: %s", err, response)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	// the source redirects the moved partition and keeps serving the other one
+	response, err = sendRequest(conn, "get "+moving[0])
+	if expected := fmt.Sprintf("%sMOVED %d %s", utils.ErrorLinePrefix, core.KeySlot(moving[0]), targetAddress); err != nil || response != expected {
+		t.Errorf("Expected GET on the source to be redirected, got %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "get "+staying[0])
+	if err != nil || response != staying[0]+"-0" {
+		t.Errorf("GET %s on the source failed: %v, response: %s", staying[0], err, response)
+	}
+	if fields := partitionFields(t, conn, 1); fields["owner"] != targetAddress || fields["state"] != "moved" {
+		t.Errorf("Unexpected partition 1 on the source: %v", fields)
+	}
+
+	// the target serves every write made before and during the migration
+	targetConn := dialServer(t, targetAddress)
+	defer targetConn.Close()
+	for _, key := range moving[:10] {
+		if _, rewritten := written[key]; !rewritten {
+			written[key] = key + "-0"
+		}
+	}
+	for key, value := range written {
+		response, err := sendRequest(targetConn, "get "+key)
+		if err != nil || response != value {
+			t.Errorf("GET %s on the target failed: %v, response: %s expected %s", key, err, response, value)
+		}
+	}
+	if fields := partitionFields(t, targetConn, 1); fields["owner"] != targetAddress || fields["state"] != "serving" {
+		t.Errorf("Unexpected partition 1 on the target: %v", fields)
+	}
+	response, err = sendRequest(targetConn, fmt.Sprintf("set %s after", moving[0]))
+	if err != nil || response != "OK" {
+		t.Errorf("SET on the target failed: %v, response: %s", err, response)
+	}
+
+	// the ownership survives a restart of the source
+	conn.Close()
+	sourceSrv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	sourceSrv = server.New(sourceConf)
+	go sourceSrv.Start()
+	defer func() { sourceSrv.Stop() }()
+	time.Sleep(1 * time.Second)
+	conn = dialServer(t, sourceAddress)
+	defer func() { conn.Close() }()
+	response, err = sendRequest(conn, fmt.Sprintf("set %s again", moving[1]))
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"MOVED ") {
+		t.Errorf("Expected SET on the restarted source to be redirected, got %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "migrate 1 "+targetAddress)
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+		t.Errorf("Expected migrating a moved partition to fail, got %v, response: %s", err, response)
+	}
+}
+
+func TestServer_ImportingPartitionRedirects(t *testing.T) {
+	sourceConf, targetConf := migrationConfigs()
+	setupTest(targetConf)
+	defer cleanupAfterTest(targetConf)
+	targetSrv := server.New(targetConf)
+	go targetSrv.Start()
+	defer targetSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, targetConf.ServerAddress)
+	defer conn.Close()
+	key := keysOfPartition(0, 2, 1)[0]
+	response, err := sendRequest(conn, "migrate import 0 "+sourceConf.ServerAddress)
+	if err != nil || response != "OK" {
+		t.Fatalf("MIGRATE IMPORT failed: %v, response: %s", err, response)
+	}
+
+	// the source serves the partition until it hands it over
+	response, err = sendRequest(conn, "get "+key)
+	if expected := fmt.Sprintf("%sMOVED %d %s", utils.ErrorLinePrefix, core.KeySlot(key), sourceConf.ServerAddress); err != nil || response != expected {
+		t.Errorf("Expected GET on an importing partition to be redirected, got %v, response: %s", err, response)
+	}
+	if response, err = sendRequest(conn, "asking"); err != nil || response != "OK" {
+		t.Fatalf("ASKING failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "set "+key+" value")
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"TRYAGAIN ") {
+		t.Errorf("Expected SET after ASKING to be retried later, got %v, response: %s", err, response)
+	}
+	if fields := partitionFields(t, conn, 0); fields["owner"] != sourceConf.ServerAddress || fields["state"] != "importing" {
+		t.Errorf("Unexpected importing partition: %v", fields)
+	}
+
+	// a partition that took writes of its own cannot be imported
+	other := keysOfPartition(1, 2, 1)[0]
+	if response, err = sendRequest(conn, "set "+other+" value"); err != nil || response != "OK" {
+		t.Fatalf("SET %s failed: %v, response: %s", other, err, response)
+	}
+	response, err = sendRequest(conn, "migrate import 1 "+sourceConf.ServerAddress)
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+		t.Errorf("Expected importing a partition holding writes to fail, got %v, response: %s", err, response)
+	}
+}
@@ -0,0 +1,246 @@
+package test
+
+import (
+	"creek/internal/commons"
+	"creek/internal/core"
+	"creek/internal/hlc"
+	"creek/internal/replication"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicationWait covers the delay for a write to reach every multi-master node
+const replicationWait = 1 * time.Second
+
+func TestClock_Monotonic(t *testing.T) {
+	clock := hlc.NewClock()
+	last := clock.Now()
+	for i := 0; i < 1000; i++ {
+		ts := clock.Now()
+		if ts <= last {
+			t.Fatalf("timestamp %d not after %d", ts, last)
+		}
+		last = ts
+	}
+
+	// a timestamp observed from a node with a clock ahead moves the local clock past it
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	clock.Observe(ahead)
+	if ts := clock.Now(); ts <= ahead {
+		t.Errorf("timestamp %d not after observed %d", ts, ahead)
+	}
+}
+
+func TestServer_MultiMasterConvergence(t *testing.T) {
+	configs := multiMasterConfigs()
+	for _, conf := range configs {
+		setupTest(conf)
+		defer cleanupAfterTest(conf)
+		srv := server.New(conf)
+		go srv.Start()
+		defer srv.Stop()
+	}
+	// nodes started before their peers connect to them on the next retry
+	time.Sleep(reconnectWait)
+
+	conns := make([]net.Conn, len(configs))
+	for i, conf := range configs {
+		conns[i] = dialServer(t, conf.ServerAddress)
+		defer conns[i].Close()
+	}
+
+	// every node writes the same keys concurrently, along with keys only it writes
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, request := range []string{
+					fmt.Sprintf("set conflict%d node%d-%d", j%4, i, j),
+					fmt.Sprintf("set node%d-key%d value%d", i, j, j),
+				} {
+					response, err := sendRequest(conn, request)
+					if err != nil || response != "OK" {
+						t.Errorf("%s on node %d failed: %v, response: %s", request, i, err, response)
+					}
+				}
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+	time.Sleep(replicationWait)
+
+	for j := 0; j < 4; j++ {
+		key := fmt.Sprintf("conflict%d", j)
+		values := getOnAll(t, conns, key)
+		for i, value := range values {
+			if value != values[0] || value == utils.NilLine {
+				t.Errorf("%s diverged: node %d has %s, node 0 has %s", key, i, value, values[0])
+			}
+		}
+	}
+	for i := range conns {
+		for j := 0; j < 20; j++ {
+			key := fmt.Sprintf("node%d-key%d", i, j)
+			for n, value := range getOnAll(t, conns, key) {
+				if value != fmt.Sprintf("value%d", j) {
+					t.Errorf("GET %s on node %d: %s", key, n, value)
+				}
+			}
+		}
+	}
+
+	// a later write wins on every node, whichever node it was made on
+	for i, request := range []string{"set conflict0 last", "delete conflict1"} {
+		response, err := sendRequest(conns[i+1], request)
+		if err != nil || response != "OK" {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	// batches are resolved key by key
+	for _, request := range []string{"mset conflict2 batch conflict3 batch", "mdel node1-key0 node2-key0"} {
+		response, err := sendRequest(conns[0], request)
+		if err != nil || strings.HasPrefix(response, utils.ErrorLinePrefix) {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	time.Sleep(replicationWait)
+	expected := map[string]string{"conflict0": "last", "conflict1": utils.NilLine, "conflict2": "batch", "conflict3": "batch",
+		"node1-key0": utils.NilLine, "node2-key0": utils.NilLine}
+	for key, expectedValue := range expected {
+		for i, value := range getOnAll(t, conns, key) {
+			if value != expectedValue {
+				t.Errorf("GET %s on node %d: %s expected %s", key, i, value, expectedValue)
+			}
+		}
+	}
+}
+
+func getOnAll(t *testing.T, conns []net.Conn, key string) []string {
+	values := make([]string, len(conns))
+	for i, conn := range conns {
+		response, err := sendRequest(conn, "get "+key)
+		if err != nil {
+			t.Fatalf("GET %s on node %d failed: %v", key, i, err)
+		}
+		values[i] = response
+	}
+	return values
+}
+
+func TestStateMachine_OutOfOrderDelete(t *testing.T) {
+	conf := multiMasterConfigs()[0]
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to start state machine: %v", err)
+	}
+	defer sm.Stop()
+
+	// the delete made on node B arrives before the older set made on node C
+	now := time.Now().UnixNano()
+	pid := sm.PartitionIdForKey("user")
+	for _, cmd := range []*replication.RepCmd{
+		{PartitionId: pid, Origin: "nodeB", Timestamp: now + 10, Version: 1, Operation: commons.CmdDataDel, Args: []string{"user"}},
+		{PartitionId: pid, Origin: "nodeC", Timestamp: now, Version: 1, Operation: commons.CmdDataSet, Args: []string{"user", "alice", "-1"}},
+	} {
+		if err := sm.ProcessRepCmd(cmd); err != nil {
+			t.Fatalf("Failed to apply %s: %v", cmd.Operation, err)
+		}
+	}
+	if value, err := sm.Get("user"); !errors.Is(err, core.ErrKeyNotFound) {
+		t.Errorf("Expected the tombstone to win over the older set, got %q: %v", value, err)
+	}
+	entry, err := sm.KeyInfo("user")
+	if err != nil || !entry.Deleted || entry.Origin != "nodeB" || entry.Timestamp != now+10 {
+		t.Errorf("Expected the tombstone of node B, got %+v: %v", entry, err)
+	}
+
+	// a set made after the delete brings the key back
+	cmd := &replication.RepCmd{PartitionId: pid, Origin: "nodeB", Writer: "nodeC", Timestamp: now + 20, Version: 2,
+		Operation: commons.CmdDataSet, Args: []string{"user", "bob", "-1"}}
+	if err := sm.ProcessRepCmd(cmd); err != nil {
+		t.Fatalf("Failed to apply SET: %v", err)
+	}
+	if value, err := sm.Get("user"); err != nil || value != "bob" {
+		t.Errorf("Expected the later set to win, got %q: %v", value, err)
+	}
+	if entry, _ := sm.KeyInfo("user"); entry.Origin != "nodeC" {
+		t.Errorf("Expected the set forwarded by node B to come from node C, got %q", entry.Origin)
+	}
+
+	// a write expired on arrival still wins over an older write received after it
+	past := now - int64(10*time.Second)
+	for _, cmd := range []*replication.RepCmd{
+		{PartitionId: pid, Origin: "nodeB", Timestamp: past + 5, Version: 3, Operation: commons.CmdDataSet, Args: []string{"session", "new", "1"}},
+		{PartitionId: pid, Origin: "nodeC", Timestamp: past, Version: 3, Operation: commons.CmdDataSet, Args: []string{"session", "old", "-1"}},
+		{PartitionId: pid, Origin: "nodeC", Timestamp: past, Version: 4, Operation: commons.CmdDataSet, Args: []string{"token", "old", "-1"}},
+		{PartitionId: pid, Origin: "nodeB", Timestamp: past + 10, Version: 4, Operation: commons.CmdDataEXP, Args: []string{"token", "1"}},
+		{PartitionId: pid, Origin: "nodeC", Timestamp: past + 5, Version: 5, Operation: commons.CmdDataSet, Args: []string{"token", "older", "-1"}},
+	} {
+		if err := sm.ProcessRepCmd(cmd); err != nil {
+			t.Fatalf("Failed to apply %s: %v", cmd.Operation, err)
+		}
+	}
+	for _, key := range []string{"session", "token"} {
+		if value, err := sm.Get(key); !errors.Is(err, core.ErrKeyNotFound) {
+			t.Errorf("Expected the expired write of %s to win over the older set, got %q: %v", key, value, err)
+		}
+	}
+}
+
+func TestStateMachine_ExpiredDeleteStampedAtExpiration(t *testing.T) {
+	conf := multiMasterConfigs()[0]
+	conf.GCInterval = 100 * time.Millisecond
+	conf.TombstoneGCGrace = time.Hour
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Failed to start state machine: %v", err)
+	}
+	defer sm.Stop()
+
+	// the key expired two seconds ago, the collection deletes it at its expiration
+	now := time.Now()
+	expiration := now.Add(-2 * time.Second).UnixMilli()
+	pid := sm.PartitionIdForKey("cache")
+	cmd := &replication.RepCmd{PartitionId: pid, Origin: "nodeB", Timestamp: now.Add(-3 * time.Second).UnixNano(), Version: 1,
+		Operation: commons.CmdDataSet, Args: []string{"cache", "old", commons.SetPXAT, fmt.Sprint(expiration)}}
+	if err := sm.ProcessRepCmd(cmd); err != nil {
+		t.Fatalf("Failed to apply SET: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entry, err := sm.KeyInfo("cache")
+		if err == nil && entry.Deleted {
+			if entry.Timestamp != expiration*int64(time.Millisecond) {
+				t.Errorf("Expected the expiry delete to be stamped at the expiration %d, got %d", expiration*int64(time.Millisecond), entry.Timestamp)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expired key was not collected: %+v, %v", entry, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a set made on node C after the key expired, but received after the collection, still wins
+	cmd = &replication.RepCmd{PartitionId: pid, Origin: "nodeC", Timestamp: now.Add(-time.Second).UnixNano(), Version: 1,
+		Operation: commons.CmdDataSet, Args: []string{"cache", "fresh", "-1"}}
+	if err := sm.ProcessRepCmd(cmd); err != nil {
+		t.Fatalf("Failed to apply SET: %v", err)
+	}
+	if value, err := sm.Get("cache"); err != nil || value != "fresh" {
+		t.Errorf("Expected the set made after the expiration to win over the expiry delete, got %q: %v", value, err)
+	}
+}
@@ -0,0 +1,194 @@
+package test
+
+import (
+	"context"
+	"creek/client"
+	"creek/internal/datastore"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataStore_Range(t *testing.T) {
+	conf := SimpleServerConfig
+	conf.OrderedIndex = true
+	ds := datastore.NewDataStore(&conf)
+
+	// the index follows random writes and deletes like a sorted map would
+	expected := make(map[string]string)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%03d", rnd.Intn(500))
+		if rnd.Intn(3) == 0 {
+			ds.Delete(key)
+			delete(expected, key)
+		} else {
+			ds.Set(key, fmt.Sprint(i), 0)
+			expected[key] = fmt.Sprint(i)
+		}
+	}
+	sorted := slices.Sorted(func(yield func(string) bool) {
+		for key := range expected {
+			if !yield(key) {
+				return
+			}
+		}
+	})
+	keys, values, next := ds.Range("", "", len(sorted)+1)
+	if !slices.Equal(keys, sorted) || next != "" {
+		t.Fatalf("Range listed %d keys, expected the %d keys in order", len(keys), len(sorted))
+	}
+	for i, key := range keys {
+		if values[i] != expected[key] {
+			t.Errorf("Range returned %s=%s, expected %s", key, values[i], expected[key])
+		}
+	}
+
+	var inRange []string
+	for _, key := range sorted {
+		if key >= "k100" && key < "k200" {
+			inRange = append(inRange, key)
+		}
+	}
+	if keys, _, _ := ds.Range("k100", "k200", len(sorted)); !slices.Equal(keys, inRange) {
+		t.Errorf("Range k100 k200 returned %v, expected %v", keys, inRange)
+	}
+	if keys, _, next := ds.Range("k100", "k200", 3); !slices.Equal(keys, inRange[:3]) || next != inRange[3] {
+		t.Errorf("Range with limit 3 returned %v then %q, expected %v then %s", keys, next, inRange[:3], inRange[3])
+	}
+
+	// tombstones and expired keys are skipped but count toward the limit, the walk stops at it
+	now := time.Now().UnixNano()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("z%03d", i)
+		ds.SetAt(key, "v", -1, datastore.Stamp{Timestamp: now, Version: 1})
+		ds.DeleteAt(key, datastore.Stamp{Timestamp: now + 1, Version: 2})
+	}
+	ds.SetAt("z100", "v", time.Now().Add(-time.Second).UnixMilli(), datastore.Stamp{})
+	ds.Set("z101", "live", 0)
+	if keys, _, next := ds.Range("z", "", 10); len(keys) != 0 || next != "z010" {
+		t.Errorf("Expected 10 tombstones to be walked, got %v then %q", keys, next)
+	}
+	var listed []string
+	for start, pages := "z", 0; ; pages++ {
+		keys, _, next := ds.Range(start, "", 10)
+		listed = append(listed, keys...)
+		if next == "" {
+			break
+		}
+		if pages > 11 {
+			t.Fatalf("Range did not end")
+		}
+		start = next
+	}
+	if !slices.Equal(listed, []string{"z101"}) {
+		t.Errorf("Expected deleted and expired keys to be skipped, got %v", listed)
+	}
+
+	if keys, _, _ := datastore.NewDataStore(&SimpleServerConfig).Range("", "", 10); keys != nil {
+		t.Errorf("Expected no keys without the ordered index, got %v", keys)
+	}
+}
+
+func TestServer_RangePrefix(t *testing.T) {
+	conf := PartitionedServerConfig
+	conf.OrderedIndex = true
+	conf.KeysLimit = 50
+	setupTest(&conf)
+	defer cleanupAfterTest(&conf)
+	srv := server.New(&conf)
+	go srv.Start()
+	defer func() { srv.Stop() }()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, conf.ServerAddress)
+	defer func() { conn.Close() }()
+	// written out of order, spread over every partition
+	for _, i := range rand.Perm(30) {
+		request := fmt.Sprintf("set metrics:%02d v%d", i, i)
+		if response, err := sendRequest(conn, request); err != nil || response != "OK" {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	for _, request := range []string{"set users:eu:bob 1", "set users:eu:amy 2", "set users:us:joe 3", "set temp v 1", "del metrics:05"} {
+		if response, err := sendRequest(conn, request); err != nil || (response != "OK" && response != "1") {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// the reply opens with where the range continues, "" once it is over
+	expected := `"" metrics:03 v3 metrics:04 v4 metrics:06 v6 metrics:07 v7`
+	if response, err := sendRequest(conn, "range metrics:03 metrics:08"); err != nil || response != expected {
+		t.Errorf("RANGE failed: %v, response: %s expected %s", err, response, expected)
+	}
+	expected = "users:eu:bob metrics:28 v28 metrics:29 v29 users:eu:amy 2"
+	if response, err := sendRequest(conn, `range metrics:28 "" limit 3`); err != nil || response != expected {
+		t.Errorf("RANGE to the end failed: %v, response: %s expected %s", err, response, expected)
+	}
+	expected = `"" users:eu:amy 2 users:eu:bob 1`
+	if response, err := sendRequest(conn, "prefix users:eu:"); err != nil || response != expected {
+		t.Errorf("PREFIX failed: %v, response: %s expected %s", err, response, expected)
+	}
+	for _, request := range []string{"range a", "range a b limit", "range a b limit 0", "range a b count 5", "range a b limit 51", "prefix", "prefix a limit x"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix) {
+			t.Errorf("Expected %s to fail, got %v, response: %s", request, err, response)
+		}
+	}
+
+	c, err := client.New(client.Options{Address: conf.ServerAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	pairs, err := c.Prefix(context.Background(), "metrics:", 0)
+	if err != nil || len(pairs) != 29 || pairs[0] != (client.KeyValue{Key: "metrics:00", Value: "v0"}) || pairs[28].Key != "metrics:29" {
+		t.Errorf("Client PREFIX failed: %v, got %v", err, pairs)
+	}
+	if pairs, err := c.Range(context.Background(), "users:", "users:f", 1); err != nil || len(pairs) != 1 || pairs[0].Key != "users:eu:amy" {
+		t.Errorf("Client RANGE failed: %v, got %v", err, pairs)
+	}
+
+	// the index is rebuilt from the snapshot and the commit log on restart
+	if response, err := sendRequest(conn, "snapshot"); err != nil || response != "OK" {
+		t.Fatalf("SNAPSHOT command failed: %v, response: %s", err, response)
+	}
+	if response, err := sendRequest(conn, "set metrics:99 v99"); err != nil || response != "OK" {
+		t.Fatalf("SET failed: %v, response: %s", err, response)
+	}
+	conn.Close()
+	srv.Stop()
+	time.Sleep(500 * time.Millisecond)
+	srv = server.New(&conf)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+	conn = dialServer(t, conf.ServerAddress)
+	expected = "users:eu:bob metrics:28 v28 metrics:29 v29 metrics:99 v99 users:eu:amy 2"
+	if response, err := sendRequest(conn, `range metrics:28 "" limit 4`); err != nil || response != expected {
+		t.Errorf("RANGE after a restart failed: %v, response: %s expected %s", err, response, expected)
+	}
+}
+
+func TestServer_RangeRequiresOrderedIndex(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, SimpleServerConfig.ServerAddress)
+	defer conn.Close()
+	for _, request := range []string{"range a b", "prefix a"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") || !strings.Contains(response, "ordered_index") {
+			t.Errorf("Expected %s to fail without the ordered index, got %v, response: %s", request, err, response)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"creek/internal/core"
+	"creek/internal/partition"
+	"creek/internal/server"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeySlot(t *testing.T) {
+	// Reference slots computed by redis cluster (CLUSTER KEYSLOT)
+	expected := map[string]int{
+		"foo":          12182,
+		"bar":          5061,
+		"{user1000}.a": 3443,
+		"{user1000}.b": 3443,
+		"user1000":     3443,
+		"foo{}{bar}":   8363,
+		"{}foo":        9500,
+		"":             0,
+		"123456789":    12739,
+	}
+	for key, slot := range expected {
+		if got := core.KeySlot(key); got != slot {
+			t.Errorf("KeySlot(%q) = %d, expected %d", key, got, slot)
+		}
+	}
+}
+
+func TestServer_PartitionedKeys(t *testing.T) {
+	setupTest(&PartitionedServerConfig)
+	defer cleanupAfterTest(&PartitionedServerConfig)
+	srv := server.New(&PartitionedServerConfig)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", PartitionedServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+
+	keyCount := 200
+	for i := 0; i < keyCount; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET command failed: %v, response: %s", err, response)
+		}
+	}
+	_ = conn.Close()
+
+	// Every partition owns a slice of the keyspace and writes its own commit log
+	for id := 0; id < PartitionedServerConfig.PartitionCount; id++ {
+		logPath := filepath.Join(partition.Dir(&PartitionedServerConfig, id), partition.LogFileName)
+		info, err := os.Stat(logPath)
+		if err != nil || info.Size() == 0 {
+			t.Errorf("Expected non empty commit log for partition %d: %v", id, err)
+		}
+	}
+
+	srv.Stop()
+	time.Sleep(1 * time.Second)
+	srv = server.New(&PartitionedServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err = net.Dial("tcp", PartitionedServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to reconnect to server: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < keyCount; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("get key%d", i))
+		if err != nil || response != fmt.Sprintf("value%d", i) {
+			t.Errorf("Recovery failed for key%d: %v, response: %s", i, err, response)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"creek/internal/config"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// peerStatuses sends PEERS and returns the fields of every peer by name, keyed by address
+func peerStatuses(t *testing.T, conn net.Conn) map[string]map[string]string {
+	response, err := sendRequest(conn, "peers")
+	if err != nil {
+		t.Fatalf("PEERS failed: %v", err)
+	}
+	args, err := utils.SplitArgs(response)
+	if err != nil || len(args)%16 != 0 {
+		t.Fatalf("Invalid PEERS reply %q: %v", response, err)
+	}
+	peers := make(map[string]map[string]string)
+	for i := 0; i < len(args); i += 16 {
+		fields := make(map[string]string, 8)
+		for j := i; j < i+16; j += 2 {
+			fields[args[j]] = args[j+1]
+		}
+		peers[fields["address"]] = fields
+	}
+	return peers
+}
+
+func expectPeer(t *testing.T, conn net.Conn, address string, expected map[string]string) {
+	fields := peerStatuses(t, conn)[address]
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("PEERS %s: %s is %q expected %q (%v)", address, name, fields[name], value, fields)
+		}
+	}
+}
+
+func TestServer_PeerHealth(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	for _, conf := range []*config.Config{leaderConf, followerConf} {
+		conf.HeartbeatInterval = 100 * time.Millisecond
+		conf.PeerTimeout = 500 * time.Millisecond
+	}
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+	leaderAddress, followerAddress := leaderConf.ServerAddress, followerConf.ServerAddress
+
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	time.Sleep(500 * time.Millisecond)
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	leaderStopped := false
+	defer func() {
+		if !leaderStopped {
+			leaderSrv.Stop()
+		}
+	}()
+	time.Sleep(1 * time.Second)
+
+	// the heartbeats of the leader keep both sides up
+	conn := dialServer(t, leaderAddress)
+	defer conn.Close()
+	followerConn := dialServer(t, followerAddress)
+	expectPeer(t, conn, followerAddress, map[string]string{"health": "up", "connected": "1", "lag": "0", "stale": "0"})
+	expectPeer(t, followerConn, leaderAddress, map[string]string{"health": "up", "connected": "0"})
+	_ = followerConn.Close()
+
+	// writes made while the follower is down wait in the commit log until it is back
+	followerSrv.Stop()
+	time.Sleep(1 * time.Second)
+	for i := 0; i < 10; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET key%d failed: %v, response: %s", i, err, response)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	expectPeer(t, conn, followerAddress, map[string]string{"health": "down", "connected": "0"})
+	expectPeer(t, conn, followerAddress, map[string]string{"lag": "10"})
+
+	followerSrv = server.New(followerConf)
+	go followerSrv.Start()
+	defer func() { followerSrv.Stop() }()
+	time.Sleep(3 * time.Second) // covers the backoff between reconnect attempts
+	expectPeer(t, conn, followerAddress, map[string]string{"health": "up", "connected": "1", "lag": "0", "reconnects": "1"})
+	followerConn = dialServer(t, followerAddress)
+	defer followerConn.Close()
+	for i := 0; i < 10; i++ {
+		response, err := sendRequest(followerConn, fmt.Sprintf("get key%d", i))
+		if err != nil || response != fmt.Sprintf("value%d", i) {
+			t.Errorf("GET key%d on the reconnected follower failed: %v, response: %s", i, err, response)
+		}
+	}
+
+	// once the leader is gone for longer than the peer timeout the follower stops redirecting to it
+	response, err := sendRequest(followerConn, "set redirected value")
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"MOVED ") {
+		t.Errorf("Expected a redirect to the live leader, got %v, response: %s", err, response)
+	}
+	leaderSrv.Stop()
+	leaderStopped = true
+	time.Sleep(1 * time.Second)
+	expectPeer(t, followerConn, leaderAddress, map[string]string{"health": "down"})
+	response, err = sendRequest(followerConn, "set redirected value")
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"READONLY ") {
+		t.Errorf("Expected READONLY without a live leader, got %v, response: %s", err, response)
+	}
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"creek/internal/server"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_WriteQuorum(t *testing.T) {
+	leaderConf, followerConf := quorumConfigs()
+
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	time.Sleep(1 * time.Second)
+
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", leaderConf.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	response, err := sendRequest(conn, "set quorumkey quorumvalue")
+	if err != nil || response != "OK" {
+		t.Fatalf("SET command failed: %v, response: %s", err, response)
+	}
+
+	// the follower acknowledged the write before the leader replied, no wait is needed
+	conn2, err := net.Dial("tcp", followerConf.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	response, err = sendRequest(conn2, "get quorumkey")
+	if err != nil || response != "quorumvalue" {
+		t.Errorf("GET command on follower failed: %v, response: %s", err, response)
+	}
+	_ = conn2.Close()
+
+	followerSrv.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	response, err = sendRequest(conn, "set quorumkey othervalue")
+	if err != nil || !strings.HasPrefix(response, "(error) NOREPLICAS ") || !strings.Contains(response, "write quorum") {
+		t.Errorf("SET without quorum should fail: %v, response: %s", err, response)
+	}
+	if elapsed := time.Since(start); elapsed < leaderConf.WriteQuorumTimeout {
+		t.Errorf("SET without quorum returned after %v, before the quorum timeout", elapsed)
+	}
+}
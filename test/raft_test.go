@@ -0,0 +1,367 @@
+package test
+
+import (
+	"bufio"
+	"creek/internal/logger"
+	"creek/internal/raft"
+	"creek/internal/resp"
+	"creek/internal/server"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRaftRPCMarshalling(t *testing.T) {
+	req := &raft.AppendEntriesRequest{
+		PartitionId:  2,
+		Term:         7,
+		LeaderId:     "localhost:7693",
+		PrevLogIndex: 41,
+		PrevLogTerm:  6,
+		LeaderCommit: 40,
+		Entries: []raft.Entry{
+			{Index: 42, Term: 7, Timestamp: 1234567890, Operation: "SET", Args: []string{"key", "hello world\n", "-1"}},
+			{Index: 43, Term: 7, Timestamp: 1234567891, Operation: "NOOP"},
+			{Index: 44, Term: 7, Timestamp: 1234567892, Operation: "DELETE", Args: []string{"key"}},
+		},
+	}
+	output, err := raft.ParseAppendEntries(req.Args()[2:])
+	if err != nil {
+		t.Fatalf("Failed to parse append entries: %v", err)
+	}
+	if !reflect.DeepEqual(req, output) {
+		t.Errorf("Expected %+v, got %+v", req, output)
+	}
+
+	vote := &raft.RequestVoteRequest{PartitionId: 1, Term: 3, CandidateId: "localhost:7694", LastLogIndex: 10, LastLogTerm: 2}
+	voteOutput, err := raft.ParseRequestVote(vote.Args()[2:])
+	if err != nil || !reflect.DeepEqual(vote, voteOutput) {
+		t.Errorf("Expected %+v, got %+v, %v", vote, voteOutput, err)
+	}
+
+	// entry counts off the wire are checked against the arguments before anything is allocated
+	for _, args := range [][]string{
+		{"0", "1", "x", "0", "0", "0", "-1"},
+		{"0", "1", "x", "0", "0", "0", "1000000000000"},
+		{"0", "1", "x", "0", "0", "0", "2", "1", "1", "0", "SET", "0"},
+	} {
+		if req, err := raft.ParseAppendEntries(args); err == nil {
+			t.Errorf("Expected append entries %v to be rejected, got %+v", args, req)
+		}
+	}
+
+	install := &raft.InstallSnapshotRequest{PartitionId: 0, Term: 4, LeaderId: "localhost:7693",
+		Snapshot: raft.Snapshot{Index: 120, Term: 3, Timestamp: 1234567890, Data: []string{"key", "hello world\n", "-1", "1", "7", "", "0"}}}
+	installOutput, err := raft.ParseInstallSnapshot(install.Args()[2:])
+	if err != nil || !reflect.DeepEqual(install, installOutput) {
+		t.Errorf("Expected %+v, got %+v, %v", install, installOutput, err)
+	}
+}
+
+// memoryRaftStorage keeps the raft log in memory and records the entries applied
+type memoryRaftStorage struct {
+	mu      sync.Mutex
+	applied int
+}
+
+func (s *memoryRaftStorage) AppendEntries(entries []raft.Entry) error { return nil }
+func (s *memoryRaftStorage) ReplaceLog(entries []raft.Entry) error    { return nil }
+func (s *memoryRaftStorage) Snapshot() (raft.Snapshot, error)         { return raft.Snapshot{}, nil }
+func (s *memoryRaftStorage) InstallSnapshot(snap raft.Snapshot, entries []raft.Entry) error {
+	return nil
+}
+
+func (s *memoryRaftStorage) Apply(entry raft.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied = entry.Index
+}
+
+func (s *memoryRaftStorage) appliedIndex() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applied
+}
+
+func TestRaft_WaitAppliedAfterCompaction(t *testing.T) {
+	storage := &memoryRaftStorage{}
+	r, err := raft.New(raft.Config{
+		SelfId:            "localhost:7693",
+		StatePath:         filepath.Join(t.TempDir(), raft.StateFileName),
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		Log:               logger.CreateLogger("warn"),
+	}, nil, storage, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create raft: %v", err)
+	}
+	r.Start()
+	defer r.Stop()
+	for deadline := time.Now().Add(2 * time.Second); !r.IsLeader(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Single node did not elect itself")
+		}
+	}
+
+	// a snapshot taken between the proposal and the wait drops the entries the writers wait for
+	var indexes, terms []int
+	for i := 0; i < 3; i++ {
+		index, term, err := r.Propose("SET", []string{"key", fmt.Sprint(i), "-1"}, time.Now().UnixNano())
+		if err != nil {
+			t.Fatalf("Propose failed: %v", err)
+		}
+		indexes, terms = append(indexes, index), append(terms, term)
+	}
+	for deadline := time.Now().Add(2 * time.Second); storage.appliedIndex() < indexes[2]; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Entries were not applied")
+		}
+	}
+	r.Compact(indexes[2])
+	for i, index := range indexes {
+		if err := r.WaitApplied(index, terms[i], time.Second); err != nil {
+			t.Errorf("Write %d applied before the compaction reported %v", index, err)
+		}
+	}
+	if err := r.WaitApplied(indexes[0], terms[0]+1, time.Second); !errors.Is(err, raft.ErrLeadershipLost) {
+		t.Errorf("Expected a write of another term at a compacted index to be lost, got %v", err)
+	}
+}
+
+// findRaftLeader polls the nodes until one of them accepts a write
+func findRaftLeader(t *testing.T, addresses []string, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, address := range addresses {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				continue
+			}
+			response, err := sendRESPCommand(conn, resp.NewReader(bufio.NewReader(conn)), "SET", "leader-probe", address)
+			_ = conn.Close()
+			if err == nil && response.Str == "OK" {
+				return address
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("No raft leader elected among %v", addresses)
+	return ""
+}
+
+func TestServer_RaftLeaderFailover(t *testing.T) {
+	configs := raftClusterConfigs()
+	servers := make(map[string]*server.Server)
+	for _, conf := range configs {
+		setupTest(conf)
+		defer cleanupAfterTest(conf)
+		srv := server.New(conf)
+		go srv.Start()
+		servers[conf.ServerAddress] = srv
+	}
+	defer func() {
+		for _, srv := range servers {
+			srv.Stop()
+		}
+	}()
+
+	leader := findRaftLeader(t, raftAddresses, 10*time.Second)
+
+	conn, err := net.Dial("tcp", leader)
+	if err != nil {
+		t.Fatalf("Failed to connect to leader: %v", err)
+	}
+	reader := resp.NewReader(bufio.NewReader(conn))
+	// malformed entry counts are answered with an error and the node keeps serving
+	for _, count := range []string{"-1", "1000000000000"} {
+		response, err := sendRESPCommand(conn, reader, "RAFT", "APPEND", "0", "1", "x", "0", "0", "0", count)
+		if err != nil || response.Type != resp.TypeError {
+			t.Errorf("RAFT APPEND with %s entries should fail: %v, response: %+v", count, err, response)
+		}
+	}
+	keyCount := 50
+	for i := 0; i < keyCount; i++ {
+		response, err := sendRESPCommand(conn, reader, "SET", fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil || response.Str != "OK" {
+			t.Fatalf("SET on leader failed: %v, response: %+v", err, response)
+		}
+	}
+	for i := 0; i < keyCount; i++ {
+		if response, err := sendRESPCommand(conn, reader, "INCR", "counter"); err != nil || response.Int != int64(i+1) {
+			t.Fatalf("INCR on leader failed: %v, response: %+v", err, response)
+		}
+	}
+	_ = conn.Close()
+
+	// Followers reject writes
+	for _, address := range raftAddresses {
+		if address == leader {
+			continue
+		}
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Failed to connect to follower: %v", err)
+		}
+		response, err := sendRESPCommand(conn, resp.NewReader(bufio.NewReader(conn)), "SET", "a", "b")
+		_ = conn.Close()
+		if err != nil || response.Type != resp.TypeError || !strings.HasPrefix(response.Str, "MOVED ") || !strings.HasSuffix(response.Str, " "+leader) {
+			t.Errorf("SET on follower %s should fail: %v, response: %+v", address, err, response)
+		}
+	}
+
+	// Kill the leader, one of the two remaining nodes must take over
+	servers[leader].Stop()
+	delete(servers, leader)
+
+	var survivors []string
+	for _, address := range raftAddresses {
+		if address != leader {
+			survivors = append(survivors, address)
+		}
+	}
+	newLeader := findRaftLeader(t, survivors, 10*time.Second)
+
+	conn, err = net.Dial("tcp", newLeader)
+	if err != nil {
+		t.Fatalf("Failed to connect to new leader: %v", err)
+	}
+	defer conn.Close()
+	reader = resp.NewReader(bufio.NewReader(conn))
+	// the first write of the new leader is computed from every write committed before it
+	if response, err := sendRESPCommand(conn, reader, "INCR", "counter"); err != nil || response.Int != int64(keyCount+1) {
+		t.Errorf("INCR on new leader lost increments: %v, response: %+v", err, response)
+	}
+	for i := 0; i < keyCount; i++ {
+		response, err := sendRESPCommand(conn, reader, "GET", fmt.Sprintf("key%d", i))
+		if err != nil || response.Str != fmt.Sprintf("value%d", i) {
+			t.Errorf("Acknowledged write key%d lost after failover: %v, response: %+v", i, err, response)
+		}
+	}
+
+	// The old leader rejoins as a follower and catches up with writes made while it was down
+	response, err := sendRESPCommand(conn, reader, "SET", "after-failover", "yes")
+	if err != nil || response.Str != "OK" {
+		t.Fatalf("SET on new leader failed: %v, response: %+v", err, response)
+	}
+	for _, conf := range configs {
+		if conf.ServerAddress == leader {
+			srv := server.New(conf)
+			go srv.Start()
+			servers[leader] = srv
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		oldConn, err := net.Dial("tcp", leader)
+		if err == nil {
+			response, err = sendRESPCommand(oldConn, resp.NewReader(bufio.NewReader(oldConn)), "GET", "after-failover")
+			_ = oldConn.Close()
+			if err == nil && response.Str == "yes" {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Restarted node did not catch up: %v, response: %+v", err, response)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestServer_RaftSnapshotCatchUp(t *testing.T) {
+	configs := raftClusterConfigs()
+	servers := make(map[string]*server.Server)
+	for _, conf := range configs {
+		setupTest(conf)
+		defer cleanupAfterTest(conf)
+		srv := server.New(conf)
+		go srv.Start()
+		servers[conf.ServerAddress] = srv
+	}
+	defer func() {
+		for _, srv := range servers {
+			srv.Stop()
+		}
+	}()
+
+	leader := findRaftLeader(t, raftAddresses, 10*time.Second)
+	// a follower goes down before the writes the snapshot of the leader replaces
+	var lagging string
+	for _, address := range raftAddresses {
+		if address != leader {
+			lagging = address
+			break
+		}
+	}
+	servers[lagging].Stop()
+	delete(servers, lagging)
+
+	conn, err := net.Dial("tcp", leader)
+	if err != nil {
+		t.Fatalf("Failed to connect to leader: %v", err)
+	}
+	defer conn.Close()
+	reader := resp.NewReader(bufio.NewReader(conn))
+	for i := 0; i < 30; i++ {
+		response, err := sendRESPCommand(conn, reader, "SET", fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil || response.Str != "OK" {
+			t.Fatalf("SET on leader failed: %v, response: %+v", err, response)
+		}
+	}
+	if response, err := sendRESPCommand(conn, reader, "SNAPSHOT"); err != nil || response.Str != "OK" {
+		t.Fatalf("SNAPSHOT on leader failed: %v, response: %+v", err, response)
+	}
+	for _, args := range [][]string{{"SET", "after-snapshot", "yes"}, {"DEL", "key0"}} {
+		if _, err := sendRESPCommand(conn, reader, args...); err != nil {
+			t.Fatalf("%s on leader failed: %v", args[0], err)
+		}
+	}
+
+	// the restarted follower gets the snapshot and the writes made after it, then restarts from them
+	for restart := 0; restart < 2; restart++ {
+		for _, conf := range configs {
+			if conf.ServerAddress == lagging {
+				if srv, ok := servers[lagging]; ok {
+					srv.Stop()
+				}
+				srv := server.New(conf)
+				go srv.Start()
+				servers[lagging] = srv
+			}
+		}
+		waitRaftCaughtUp(t, lagging)
+	}
+}
+
+// waitRaftCaughtUp polls a node restarted after the writes of TestServer_RaftSnapshotCatchUp until it has them
+func waitRaftCaughtUp(t *testing.T, address string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var values []resp.Value
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			reader := resp.NewReader(bufio.NewReader(conn))
+			for _, key := range []string{"after-snapshot", "key29", "key0"} {
+				var response resp.Value
+				if response, err = sendRESPCommand(conn, reader, "GET", key); err != nil {
+					break
+				}
+				values = append(values, response)
+			}
+			_ = conn.Close()
+		}
+		if err == nil && values[0].Str == "yes" && values[1].Str == "value29" && values[2].Null {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Lagging follower did not catch up through the snapshot: %v, values: %+v", err, values)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
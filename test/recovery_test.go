@@ -1,8 +1,8 @@
 package test
 
 import (
-	"bufio"
 	"creek/internal/server"
+	"creek/internal/utils"
 	"net"
 	"strconv"
 	"testing"
@@ -21,9 +21,6 @@ func TestServer_Recovery(t *testing.T) {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
 
-	reader := bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n') // Discard welcome message
-
 	// Set a key before stopping the server
 	response, err := sendRequest(conn, "set testkey testvalue")
 	if err != nil || response != "OK" {
@@ -57,9 +54,6 @@ func TestServer_Recovery(t *testing.T) {
 		}
 	}(conn)
 
-	reader = bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n') // Discard welcome message
-
 	// Verify key is still present after restart
 	response, err = sendRequest(conn, "get testkey")
 	if err != nil || response != "testvalue" {
@@ -78,9 +72,6 @@ func TestServer_RecoveryWithTTL(t *testing.T) {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
 
-	reader := bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n') // Discard welcome message
-
 	// Set keys with different TTLs
 	_, _ = sendRequest(conn, "set key1 value1")
 	_, _ = sendRequest(conn, "expire key1 3")
@@ -114,12 +105,9 @@ func TestServer_RecoveryWithTTL(t *testing.T) {
 		}
 	}(conn)
 
-	reader = bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n') // Discard welcome message
-
 	// Verify key1 is expired and no longer present
 	response, err := sendRequest(conn, "get key1")
-	if err != nil || response != "" {
+	if err != nil || response != utils.NilLine {
 		t.Errorf("Key1 should have expired but still exists, response: %s", response)
 	}
 
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"creek/client"
+	"creek/internal/resp"
+	"creek/internal/server"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_ReadOnlyWithoutLeader(t *testing.T) {
+	setupTest(&FollowerServerConfig)
+	defer cleanupAfterTest(&FollowerServerConfig)
+	followerSrv := server.New(&FollowerServerConfig)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", FollowerServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to follower: %v", err)
+	}
+	defer conn.Close()
+
+	// no leader synced with the follower yet, there is nowhere to redirect to
+	value, err := sendRESPCommand(conn, resp.NewReader(bufio.NewReader(conn)), "SET", "a", "b")
+	if err != nil || value.Type != resp.TypeError || !strings.HasPrefix(value.Str, "READONLY ") {
+		t.Errorf("SET on a follower without leader should be READONLY: %v, response: %+v", err, value)
+	}
+}
+
+func TestClient_FollowsRedirect(t *testing.T) {
+	setupTest(&FollowerServerConfig)
+	defer cleanupAfterTest(&FollowerServerConfig)
+	followerSrv := server.New(&FollowerServerConfig)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	setupTest(&LeaderServerConfig)
+	defer cleanupAfterTest(&LeaderServerConfig)
+	leaderSrv := server.New(&LeaderServerConfig)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	c, err := client.New(client.Options{Address: FollowerServerConfig.ServerAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the write is redirected to the leader and replicated back to the follower
+	if err := c.Set(ctx, "redirected", "value", 0); err != nil {
+		t.Fatalf("Set through a follower failed: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if value, err := c.Get(ctx, "redirected"); err != nil || value != "value" {
+		t.Errorf("Get from the follower failed: %v, value: %q", err, value)
+	}
+	if err := c.Delete(ctx, "redirected"); err != nil {
+		t.Errorf("Delete through a follower failed: %v", err)
+	}
+
+	noRedirects, err := client.New(client.Options{Address: FollowerServerConfig.ServerAddress, MaxRedirects: -1})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer noRedirects.Close()
+	err = noRedirects.Set(ctx, "redirected", "value", 0)
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "MOVED" || !strings.HasSuffix(serverErr.Message, " "+LeaderServerConfig.ServerAddress) {
+		t.Errorf("Expected a MOVED error with redirects disabled, got %v", err)
+	}
+}
@@ -11,6 +11,7 @@ func TestRepCmdMarshallingString(t *testing.T) {
 		{PartitionId: 1, Origin: "nodeA", Timestamp: 1234567890, Operation: "SET", Args: []string{"key1", "value1", "343"}},
 		{PartitionId: 2, Origin: "nodeB", Timestamp: 987654321, Operation: "DELETE", Args: []string{"key2"}},
 		{PartitionId: 3, Origin: "nodeC", Timestamp: 1111111111, Operation: "EXPIRE", Args: []string{"key3", "300"}},
+		{PartitionId: 4, Origin: "nodeA", Writer: "nodeD", Timestamp: 1234567890, Version: 7, Operation: "DELETE", Args: []string{"key4"}},
 	}
 
 	for _, test := range testCases {
@@ -48,3 +49,23 @@ func TestRepCmdMarshallingArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestRepCmdMarshallingBinaryArgs(t *testing.T) {
+	testCases := []replication.RepCmd{
+		{PartitionId: 1, Origin: "nodeA", Timestamp: 1234567890, Operation: "SET", Args: []string{"key 1", "hello world", "-1"}},
+		{PartitionId: 2, Origin: "nodeB", Timestamp: 987654321, Operation: "SET", Args: []string{"key2", "line1\nline2\r\n", "-1"}},
+		{PartitionId: 3, Origin: "nodeC", Timestamp: 1111111111, Operation: "SET", Args: []string{"nul\x00key", "\x00\x01\xff\"'\\", "-1"}},
+		{PartitionId: 4, Origin: "nodeD", Timestamp: 1111111111, Operation: "SET", Args: []string{"", "", "-1"}},
+	}
+
+	for _, test := range testCases {
+		output, err := replication.RepCmdFromString(test.String())
+		if err != nil {
+			t.Errorf("Failed to parse string: %v", err)
+			continue
+		}
+		if !test.Equals(output) {
+			t.Errorf("Expected %q, got %q", test.Args, output.Args)
+		}
+	}
+}
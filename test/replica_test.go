@@ -2,7 +2,11 @@ package test
 
 import (
 	"bufio"
+	"creek/internal/core"
+	"creek/internal/resp"
 	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -31,9 +35,6 @@ func TestServer_BasicReplica(t *testing.T) {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
 
-	reader := bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n') // Discard welcome message
-
 	response, err := sendRequest(conn, "set testkey testvalue")
 	if err != nil || response != "OK" {
 		t.Errorf("SET command failed: %v, response: %s", err, response)
@@ -46,14 +47,17 @@ func TestServer_BasicReplica(t *testing.T) {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
 
-	reader2 := bufio.NewReader(conn2)
-	_, _ = reader2.ReadString('\n') // Discard welcome message
-
 	response, err = sendRequest(conn2, "get testkey")
 	if err != nil || response != "testvalue" {
 		t.Errorf("GET command failed: %v, response: %s", err, response)
 	}
 
+	// the follower is read-only, writes are redirected to the leader
+	response, err = sendRequest(conn2, "set testkey othervalue")
+	if err != nil || response != fmt.Sprintf("(error) MOVED %d %s", core.KeySlot("testkey"), LeaderServerConfig.ServerAddress) {
+		t.Errorf("SET on the follower should be rejected: %v, response: %s", err, response)
+	}
+
 	response, err = sendRequest(conn, "delete testkey")
 	if err != nil || response != "OK" {
 		t.Errorf("DELETE command failed: %v, response: %s", err, response)
@@ -66,8 +70,8 @@ func TestServer_BasicReplica(t *testing.T) {
 	}
 
 	response, err = sendRequest(conn2, "get testkey")
-	if err != nil || response != "" {
-		t.Errorf("GET command failed: %v, response: %s expected empty value", err, response)
+	if err != nil || response != utils.NilLine {
+		t.Errorf("GET command failed: %v, response: %s expected nil", err, response)
 	}
 
 	err = conn2.Close()
@@ -100,18 +104,12 @@ func TestServer_ReplicaWrites(t *testing.T) {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
 
-	reader := bufio.NewReader(conn)
-	_, _ = reader.ReadString('\n') // Discard welcome message
-
 	// now connect to client and query the values
 	conn2, err := net.Dial("tcp", FollowerServerConfig.ServerAddress)
 	if err != nil {
 		t.Fatalf("Failed to connect to server: %v", err)
 	}
 
-	reader2 := bufio.NewReader(conn2)
-	_, _ = reader2.ReadString('\n') // Discard welcome message
-
 	response, err := sendRequest(conn2, "set testkey testvalue")
 	if err != nil || response == "OK" {
 		t.Errorf("SET command should fail: %v, response: %s", err, response)
@@ -143,3 +141,48 @@ func TestServer_ReplicaWrites(t *testing.T) {
 		return
 	}
 }
+
+func TestServer_ReplicaBinaryValues(t *testing.T) {
+	setupTest(&FollowerServerConfig)
+	defer cleanupAfterTest(&FollowerServerConfig)
+
+	followerSrv := server.New(&FollowerServerConfig)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	setupTest(&LeaderServerConfig)
+	defer cleanupAfterTest(&LeaderServerConfig)
+
+	leaderSrv := server.New(&LeaderServerConfig)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second) // Allow server to start
+
+	conn, err := net.Dial("tcp", LeaderServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := resp.NewReader(bufio.NewReader(conn))
+	for i, value := range binaryValues {
+		response, err := sendRESPCommand(conn, reader, "SET", "key "+value, value)
+		if err != nil || response.Str != "OK" {
+			t.Errorf("SET of value %d failed: %v, response: %+v", i, err, response)
+		}
+	}
+	time.Sleep(1 * time.Second)
+
+	conn2, err := net.Dial("tcp", FollowerServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn2.Close()
+	reader2 := resp.NewReader(bufio.NewReader(conn2))
+	for i, value := range binaryValues {
+		response, err := sendRESPCommand(conn2, reader2, "GET", "key "+value)
+		if err != nil || response.Str != value {
+			t.Errorf("Replicated value %d mismatch: %v, expected %q, got %q", i, err, value, response.Str)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package test
+
+import (
+	"bufio"
+	"creek/internal/resp"
+	"creek/internal/server"
+	"net"
+	"testing"
+	"time"
+)
+
+func sendRESPCommand(conn net.Conn, reader *resp.Reader, args ...string) (resp.Value, error) {
+	writer := resp.NewWriter(bufio.NewWriter(conn))
+	if err := writer.WriteCommand(args...); err != nil {
+		return resp.Value{}, err
+	}
+	if err := writer.Flush(); err != nil {
+		return resp.Value{}, err
+	}
+	return reader.ReadValue()
+}
+
+func TestServer_RESPCommands(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := resp.NewReader(bufio.NewReader(conn))
+
+	// RESP clients are not greeted, the first bytes read must be the reply to SET
+	value, err := sendRESPCommand(conn, reader, "SET", "a", "b")
+	if err != nil || value.Type != resp.TypeSimpleString || value.Str != "OK" {
+		t.Errorf("SET command failed: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "GET", "a")
+	if err != nil || value.Type != resp.TypeBulkString || value.Str != "b" {
+		t.Errorf("GET command failed: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "TTL", "a")
+	if err != nil || value.Type != resp.TypeInteger || value.Int != -1 {
+		t.Errorf("TTL command failed: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "EXPIRE", "a", "100")
+	if err != nil || value.Type != resp.TypeInteger || value.Int != 1 {
+		t.Errorf("EXPIRE command failed: %v, response: %+v", err, value)
+	}
+	value, err = sendRESPCommand(conn, reader, "EXPIRE", "missing", "100")
+	if err != nil || value.Type != resp.TypeInteger || value.Int != 0 {
+		t.Errorf("EXPIRE of a missing key should return 0: %v, response: %+v", err, value)
+	}
+
+	_, _ = sendRESPCommand(conn, reader, "SET", "c", "d")
+	value, err = sendRESPCommand(conn, reader, "DEL", "a", "missing", "c")
+	if err != nil || value.Type != resp.TypeInteger || value.Int != 2 {
+		t.Errorf("DEL command failed: %v, response: %+v", err, value)
+	}
+	value, err = sendRESPCommand(conn, reader, "DEL", "c")
+	if err != nil || value.Type != resp.TypeInteger || value.Int != 0 {
+		t.Errorf("DEL of a missing key should return 0: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "GET", "a")
+	if err != nil || value.Type != resp.TypeBulkString || !value.Null {
+		t.Errorf("GET of a missing key should return a null bulk string: %v, response: %+v", err, value)
+	}
+
+	_, _ = sendRESPCommand(conn, reader, "SET", "empty", "")
+	value, err = sendRESPCommand(conn, reader, "GET", "empty")
+	if err != nil || value.Type != resp.TypeBulkString || value.Null || value.Str != "" {
+		t.Errorf("GET of an empty value failed: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "PING")
+	if err != nil || value.Type != resp.TypeSimpleString || value.Str != "PONG" {
+		t.Errorf("PING command failed: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "NOPE")
+	if err != nil || value.Type != resp.TypeError || value.Str != "ERR unknown command" {
+		t.Errorf("Unknown command should return an error reply: %v, response: %+v", err, value)
+	}
+
+	// Inline commands are accepted on a RESP connection as well
+	_, err = conn.Write([]byte("ping\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write inline command: %v", err)
+	}
+	value, err = reader.ReadValue()
+	if err != nil || value.Str != "PONG" {
+		t.Errorf("Inline PING failed: %v, response: %+v", err, value)
+	}
+}
+
+func TestServer_RESPHello(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := resp.NewReader(bufio.NewReader(conn))
+
+	value, err := sendRESPCommand(conn, reader, "HELLO", "4")
+	if err != nil || value.Type != resp.TypeError {
+		t.Errorf("HELLO 4 should be rejected: %v, response: %+v", err, value)
+	}
+
+	value, err = sendRESPCommand(conn, reader, "HELLO", "3")
+	if err != nil || value.Type != resp.TypeMap {
+		t.Fatalf("HELLO 3 should reply with a map: %v, response: %+v", err, value)
+	}
+
+	// Switching back to RESP2 flattens maps into arrays
+	value, err = sendRESPCommand(conn, reader, "HELLO", "2")
+	if err != nil || value.Type != resp.TypeArray {
+		t.Errorf("HELLO 2 should reply with a flat array: %v, response: %+v", err, value)
+	}
+}
+
+func TestServer_QuietRESPClient(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := resp.NewReader(bufio.NewReader(conn))
+
+	// A pooled connection may stay idle before its first command, it must not fall back to text
+	// nor be greeted in the meantime
+	time.Sleep(500 * time.Millisecond)
+	value, err := sendRESPCommand(conn, reader, "SET", "a", "b")
+	if err != nil || value.Type != resp.TypeSimpleString || value.Str != "OK" {
+		t.Errorf("SET after an idle start failed: %v, response: %+v", err, value)
+	}
+	value, err = sendRESPCommand(conn, reader, "GET", "a")
+	if err != nil || value.Type != resp.TypeBulkString || value.Str != "b" {
+		t.Errorf("GET after an idle start failed: %v, response: %+v", err, value)
+	}
+}
+
+func TestServer_RESPErrorLineBreaks(t *testing.T) {
+	setupTest(&SimpleServerConfig)
+	srv := server.New(&SimpleServerConfig)
+	defer cleanupAfterTest(&SimpleServerConfig)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn, err := net.Dial("tcp", SimpleServerConfig.ServerAddress)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := resp.NewReader(bufio.NewReader(conn))
+
+	// the error quotes the version, its line breaks must not end the error and forge a reply
+	value, err := sendRESPCommand(conn, reader, "CAS", "a", "x\r\n+OK\r\n", "b")
+	if err != nil || value.Type != resp.TypeError || value.Str != "ERR invalid version: x  +OK  " {
+		t.Errorf("Expected a single line error, got %v, response: %+v", err, value)
+	}
+	value, err = sendRESPCommand(conn, reader, "PING")
+	if err != nil || value.Str != "PONG" {
+		t.Errorf("PING after the error failed: %v, response: %+v", err, value)
+	}
+}
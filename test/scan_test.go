@@ -0,0 +1,237 @@
+package test
+
+import (
+	"context"
+	"creek/client"
+	"creek/internal/datastore"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "", true},
+		{"*", "a/b", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*:*:end", "a:b:c:end", true},
+		{"a*b", "acbd", false},
+		{"*a*b", "xaxbab", true},
+		{"a*", "", false},
+		{"a\\", "a\\", true},
+		{"**", "abc", true},
+		{"[a-", "b", false},
+	}
+	for _, test := range tests {
+		if got := utils.MatchGlob(test.pattern, test.s); got != test.expected {
+			t.Errorf("MatchGlob(%q, %q) = %v, expected %v", test.pattern, test.s, got, test.expected)
+		}
+	}
+
+	// a pattern of many stars that does not match costs about len(pattern) * len(s)
+	pattern, s := strings.Repeat("a*", 30)+"b", strings.Repeat("a", 100)
+	start := time.Now()
+	if utils.MatchGlob(pattern, s) {
+		t.Errorf("MatchGlob(%q, %q) = true, expected false", pattern, s)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("MatchGlob took %v", elapsed)
+	}
+}
+
+func TestDataStore_Scan(t *testing.T) {
+	ds := datastore.NewDataStore(&SimpleServerConfig)
+	expected := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		ds.Set(key, "v", 0)
+		expected[key] = true
+	}
+	for i := 0; i < 2000; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		ds.Delete(key)
+		delete(expected, key)
+	}
+	ds.SetAt("expired", "v", time.Now().Add(-time.Second).UnixMilli(), datastore.Stamp{})
+
+	// pages follow the hash order, each walking count keys, the deleted and expired ones included
+	var from, lastHash uint64
+	listed := make(map[string]bool)
+	for pages := 0; ; pages++ {
+		keys, next, done := ds.Scan(from, 10)
+		if !done && (len(keys) > 10 || next <= from) {
+			t.Fatalf("SCAN from %d returned %d keys then %d, expected at most 10", from, len(keys), next)
+		}
+		for _, key := range keys {
+			if hash := datastore.ScanHash(key); hash < lastHash || hash < from {
+				t.Fatalf("SCAN from %d returned %s out of hash order", from, key)
+			} else {
+				lastHash = hash
+			}
+			if listed[key] {
+				t.Errorf("SCAN listed %s twice", key)
+			}
+			listed[key] = true
+		}
+		if done {
+			break
+		}
+		if pages > 2000 {
+			t.Fatalf("SCAN did not end")
+		}
+		from = next
+	}
+	if len(listed) != len(expected) {
+		t.Errorf("SCAN listed %d keys, expected %d", len(listed), len(expected))
+	}
+	for key := range expected {
+		if !listed[key] {
+			t.Errorf("SCAN missed %s", key)
+		}
+	}
+
+	// a page over tombstones stops after count of them instead of walking to the next live key
+	ds = datastore.NewDataStore(&SimpleServerConfig)
+	now := time.Now().UnixNano()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("gone%d", i)
+		ds.SetAt(key, "v", -1, datastore.Stamp{Timestamp: now, Version: 1})
+		ds.DeleteAt(key, datastore.Stamp{Timestamp: now + 1, Version: 2})
+	}
+	if keys, _, done := ds.Scan(0, 10); len(keys) != 0 || done {
+		t.Errorf("Expected an empty page that is not the last one, got %v, done %v", keys, done)
+	}
+}
+
+// scanAll follows SCAN cursors from 0 until the scan ends and returns every key listed
+func scanAll(t *testing.T, c *client.Client, match string, count int) []string {
+	var keys []string
+	var cursor uint64
+	for calls := 0; ; calls++ {
+		batch, next, err := c.Scan(context.Background(), cursor, match, count)
+		if err != nil {
+			t.Fatalf("SCAN %d failed: %v", cursor, err)
+		}
+		keys = append(keys, batch...)
+		if next == 0 {
+			return keys
+		}
+		if calls > 10000 {
+			t.Fatalf("SCAN did not end")
+		}
+		cursor = next
+	}
+}
+
+func TestServer_ScanKeysDBSize(t *testing.T) {
+	conf := PartitionedServerConfig
+	conf.KeysLimit = 150
+	setupTest(&conf)
+	defer cleanupAfterTest(&conf)
+	srv := server.New(&conf)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	c, err := client.New(client.Options{Address: conf.ServerAddress})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	var stable []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		stable = append(stable, key)
+		if err := c.Set(ctx, key, "v", client.NoExpiration); err != nil {
+			t.Fatalf("SET %s failed: %v", key, err)
+		}
+		if err := c.Set(ctx, fmt.Sprintf("order:%d", i), "v", client.NoExpiration); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+	}
+	if err := c.Set(ctx, "expiring", "v", time.Second); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	if size, err := c.DBSize(ctx); err != nil || size != 200 {
+		t.Errorf("Expected DBSIZE 200 without the expired key, got %d: %v", size, err)
+	}
+	keys := scanAll(t, c, "user:*", 7)
+	slices.Sort(keys)
+	if sortedStable := slices.Sorted(slices.Values(stable)); !slices.Equal(keys, slices.Compact(keys)) || !slices.Equal(keys, sortedStable) {
+		t.Errorf("SCAN MATCH user:* listed %d keys, expected the %d user keys once", len(keys), len(stable))
+	}
+	if all := scanAll(t, c, "", 0); len(all) != 200 {
+		t.Errorf("SCAN listed %d keys, expected 200", len(all))
+	}
+
+	// keys present during the whole scan are listed whatever the concurrent writes
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = c.Set(ctx, fmt.Sprintf("new:%d", i), "v", client.NoExpiration)
+			_ = c.Delete(ctx, fmt.Sprintf("order:%d", i%100))
+		}
+	}()
+	seen := make(map[string]bool)
+	for _, key := range scanAll(t, c, "", 5) {
+		seen[key] = true
+	}
+	close(stop)
+	wg.Wait()
+	for _, key := range stable {
+		if !seen[key] {
+			t.Errorf("SCAN missed %s during concurrent writes", key)
+		}
+	}
+
+	conn := dialServer(t, conf.ServerAddress)
+	defer conn.Close()
+	response, err := sendRequest(conn, "keys user:1?")
+	if listed, _ := utils.SplitArgs(response); err != nil || len(listed) != 10 {
+		t.Errorf("KEYS user:1? failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "keys *")
+	if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+		t.Errorf("Expected KEYS matching more than the limit to fail, got %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "scan 0 count 1000")
+	if listed, _ := utils.SplitArgs(response); err != nil || len(listed) < 101 || listed[0] != "0" {
+		t.Errorf("SCAN with a large COUNT should list every key at once: %v, response: %.80s", err, response)
+	}
+	for _, request := range []string{"scan", "scan x", "scan 0 count 0", "scan 0 match", "scan 0 limit 5", "scan 18446744073709551615"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || !strings.HasPrefix(response, utils.ErrorLinePrefix+"ERR ") {
+			t.Errorf("Expected %s to fail, got %v, response: %s", request, err, response)
+		}
+	}
+}
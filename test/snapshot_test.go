@@ -0,0 +1,167 @@
+package test
+
+import (
+	"creek/internal/partition"
+	"creek/internal/server"
+	"creek/internal/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// segmentCount returns how many sealed segments a partition keeps next to its active commit log
+func segmentCount(t *testing.T, dir string) int {
+	segments, err := filepath.Glob(filepath.Join(dir, "commit-*.log"))
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	return len(segments)
+}
+
+func TestServer_SnapshotRecovery(t *testing.T) {
+	conf := SimpleServerConfig
+	conf.DataStoreDirectory = testDataDir + "/snapshot"
+	conf.LogSegmentSize = 512
+	setupTest(&conf)
+	defer cleanupAfterTest(&conf)
+
+	srv := server.New(&conf)
+	go srv.Start()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, conf.ServerAddress)
+	for i := 0; i < 50; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET command failed: %v, response: %s", err, response)
+		}
+	}
+	response, err := sendRequest(conn, "delete key0")
+	if err != nil || response != "OK" {
+		t.Fatalf("DELETE command failed: %v, response: %s", err, response)
+	}
+
+	dir := partition.Dir(&conf, 0)
+	if segmentCount(t, dir) == 0 {
+		t.Fatalf("Expected the commit log to be rotated into segments")
+	}
+	response, err = sendRequest(conn, "snapshot")
+	if err != nil || response != "OK" {
+		t.Fatalf("SNAPSHOT command failed: %v, response: %s", err, response)
+	}
+	if count := segmentCount(t, dir); count != 0 {
+		t.Errorf("Expected segments covered by the snapshot to be removed, %d left", count)
+	}
+	if _, err := os.Stat(filepath.Join(dir, partition.SnapshotFileName)); err != nil {
+		t.Errorf("Expected a snapshot file: %v", err)
+	}
+
+	// writes after the snapshot are only in the log tail
+	for _, request := range []string{"set key1 changed", "delete key2", "set key50 value50"} {
+		response, err := sendRequest(conn, request)
+		if err != nil || response != "OK" {
+			t.Fatalf("%s failed: %v, response: %s", request, err, response)
+		}
+	}
+	_ = conn.Close()
+	srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	srv = server.New(&conf)
+	go srv.Start()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn = dialServer(t, conf.ServerAddress)
+	defer conn.Close()
+	expected := map[string]string{"key0": utils.NilLine, "key1": "changed", "key2": utils.NilLine, "key3": "value3", "key49": "value49", "key50": "value50"}
+	for key, value := range expected {
+		response, err := sendRequest(conn, "get "+key)
+		if err != nil || response != value {
+			t.Errorf("GET %s after recovery failed: %v, response: %s expected %s", key, err, response, value)
+		}
+	}
+}
+
+func TestServer_FollowerCatchUpFromSnapshot(t *testing.T) {
+	leaderConf, followerConf := catchUpConfigs()
+	leaderConf.LogSegmentSize = 256
+	setupTest(leaderConf)
+	defer cleanupAfterTest(leaderConf)
+	setupTest(followerConf)
+	defer cleanupAfterTest(followerConf)
+
+	leaderSrv := server.New(leaderConf)
+	go leaderSrv.Start()
+	defer leaderSrv.Stop()
+	time.Sleep(1 * time.Second)
+
+	conn := dialServer(t, leaderConf.ServerAddress)
+	defer conn.Close()
+	for i := 0; i < 30; i++ {
+		response, err := sendRequest(conn, fmt.Sprintf("set key%d value%d", i, i))
+		if err != nil || response != "OK" {
+			t.Fatalf("SET command failed: %v, response: %s", err, response)
+		}
+	}
+	response, err := sendRequest(conn, "snapshot")
+	if err != nil || response != "OK" {
+		t.Fatalf("SNAPSHOT command failed: %v, response: %s", err, response)
+	}
+	response, err = sendRequest(conn, "set key30 value30")
+	if err != nil || response != "OK" {
+		t.Fatalf("SET command failed: %v, response: %s", err, response)
+	}
+
+	// the first writes are gone from the leader log, the follower gets the snapshot instead
+	followerSrv := server.New(followerConf)
+	go followerSrv.Start()
+	defer followerSrv.Stop()
+	time.Sleep(reconnectWait)
+
+	followerConn := dialServer(t, followerConf.ServerAddress)
+	defer followerConn.Close()
+	for i := 0; i <= 30; i++ {
+		response, err := sendRequest(followerConn, fmt.Sprintf("get key%d", i))
+		if err != nil || response != fmt.Sprintf("value%d", i) {
+			t.Errorf("GET key%d on follower failed: %v, response: %s", i, err, response)
+		}
+	}
+}
+
+func TestSnapshot_OlderFormatIsRead(t *testing.T) {
+	conf := commitLogConfig()
+	setupTest(conf)
+	defer cleanupAfterTest(conf)
+
+	// format version 2 has no version, origin nor tombstone and expirations in seconds
+	dir := partition.Dir(conf, 0)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatalf("Failed to create partition directory: %v", err)
+	}
+	now := time.Now()
+	snapshot := fmt.Sprintf("CREEK-SNAPSHOT 2 2 %d 2\nkey0 value0 0 %d\nsession abc %d %d\n",
+		now.UnixNano(), now.UnixNano(), now.Unix()+100, now.UnixNano())
+	if err := os.WriteFile(filepath.Join(dir, partition.SnapshotFileName), []byte(snapshot), 0644); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	sm, err := startStateMachine(t, conf)
+	if err != nil {
+		t.Fatalf("Recovery from a snapshot of format version 2 failed: %v", err)
+	}
+	defer sm.Stop()
+	expectKeys(t, sm, 0, 1, true)
+	if ttl, err := sm.TTL("session"); err != nil || ttl < 99 || ttl > 100 {
+		t.Errorf("Expected session to expire in 100 seconds, got %d: %v", ttl, err)
+	}
+	// the next write follows the Version of the snapshot
+	if err := sm.Set("key1", "value1", 0); err != nil {
+		t.Fatalf("SET key1 failed: %v", err)
+	}
+	if entry, err := sm.KeyInfo("key1"); err != nil || entry.Version != 3 {
+		t.Errorf("Expected key1 to be written at version 3, got %+v: %v", entry, err)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"creek/internal/commons"
 	"creek/internal/config"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var dataDir = "../data_dir"
@@ -17,6 +19,8 @@ const hostAddress = "localhost:7690"
 const hostAddress1 = "localhost:7691"
 const hostAddress2 = "localhost:7692"
 
+var raftAddresses = []string{"localhost:7693", "localhost:7694", "localhost:7695"}
+
 var SimpleServerConfig = config.Config{
 	ServerAddress:        hostAddress,
 	DataStoreDirectory:   testDataDir,
@@ -24,6 +28,14 @@ var SimpleServerConfig = config.Config{
 	WriteConsistencyMode: commons.EventualConsistency,
 }
 
+var PartitionedServerConfig = config.Config{
+	ServerAddress:        hostAddress,
+	DataStoreDirectory:   testDataDir + "/partitioned",
+	LogLevel:             "info",
+	PartitionCount:       4,
+	WriteConsistencyMode: commons.EventualConsistency,
+}
+
 var LeaderServerConfig = config.Config{
 	ServerAddress:        hostAddress1,
 	DataStoreDirectory:   testDataDir + "/leader",
@@ -44,6 +56,30 @@ var FollowerServerConfig = config.Config{
 	ServerMode:           commons.Follower,
 }
 
+// raftClusterConfigs returns one config per raft node, every node lists the others as peers
+func raftClusterConfigs() []*config.Config {
+	configs := make([]*config.Config, len(raftAddresses))
+	for i, address := range raftAddresses {
+		var peers []string
+		for _, peer := range raftAddresses {
+			if peer != address {
+				peers = append(peers, peer)
+			}
+		}
+		configs[i] = &config.Config{
+			ServerAddress:        address,
+			DataStoreDirectory:   fmt.Sprintf("%s/raft%d", testDataDir, i),
+			LogLevel:             "warn",
+			PeerNodes:            peers,
+			WriteConsistencyMode: commons.StrongConsistency,
+			ElectionMode:         commons.RaftElection,
+			RaftElectionTimeout:  300 * time.Millisecond,
+			RaftHeartbeat:        50 * time.Millisecond,
+		}
+	}
+	return configs
+}
+
 func setupTest(conf *config.Config) {
 	if _, err := os.Stat(conf.DataStoreDirectory); os.IsNotExist(err) {
 		err := os.MkdirAll(conf.DataStoreDirectory, os.ModePerm)
@@ -86,3 +122,82 @@ func sendRequest(conn net.Conn, request string) (string, error) {
 
 	return strings.TrimSpace(response), nil
 }
+
+var quorumAddresses = []string{"localhost:7696", "localhost:7697"}
+
+// quorumConfigs returns a strong consistency leader waiting for the ack of its single follower
+func quorumConfigs() (*config.Config, *config.Config) {
+	leader := &config.Config{
+		ServerAddress:        quorumAddresses[0],
+		DataStoreDirectory:   testDataDir + "/quorum_leader",
+		LogLevel:             "warn",
+		PeerNodes:            []string{quorumAddresses[1]},
+		WriteConsistencyMode: commons.StrongConsistency,
+		ReplicationMode:      commons.ReadAndWriteReplication,
+		ServerMode:           commons.Leader,
+		WriteQuorum:          2,
+		WriteQuorumTimeout:   500 * time.Millisecond,
+	}
+	follower := &config.Config{
+		ServerAddress:        quorumAddresses[1],
+		DataStoreDirectory:   testDataDir + "/quorum_follower",
+		LogLevel:             "warn",
+		PeerNodes:            []string{quorumAddresses[0]},
+		WriteConsistencyMode: commons.StrongConsistency,
+		ReplicationMode:      commons.ReadOnlyReplication,
+		ServerMode:           commons.Follower,
+	}
+	return leader, follower
+}
+
+var catchUpAddresses = []string{"localhost:7698", "localhost:7699"}
+
+// catchUpConfigs returns an eventual consistency leader and follower used to test resyncs
+func catchUpConfigs() (*config.Config, *config.Config) {
+	leader := &config.Config{
+		ServerAddress:        catchUpAddresses[0],
+		DataStoreDirectory:   testDataDir + "/catchup_leader",
+		LogLevel:             "warn",
+		PeerNodes:            []string{catchUpAddresses[1]},
+		WriteConsistencyMode: commons.EventualConsistency,
+		ReplicationMode:      commons.ReadAndWriteReplication,
+		ServerMode:           commons.Leader,
+		PartitionCount:       2,
+	}
+	follower := &config.Config{
+		ServerAddress:        catchUpAddresses[1],
+		DataStoreDirectory:   testDataDir + "/catchup_follower",
+		LogLevel:             "warn",
+		PeerNodes:            []string{catchUpAddresses[0]},
+		WriteConsistencyMode: commons.EventualConsistency,
+		ReplicationMode:      commons.ReadOnlyReplication,
+		ServerMode:           commons.Follower,
+		PartitionCount:       2,
+	}
+	return leader, follower
+}
+
+var multiMasterAddresses = []string{"localhost:7700", "localhost:7701", "localhost:7702"}
+
+// multiMasterConfigs returns one config per multi-master node, every node lists the others as peers
+func multiMasterConfigs() []*config.Config {
+	configs := make([]*config.Config, len(multiMasterAddresses))
+	for i, address := range multiMasterAddresses {
+		var peers []string
+		for _, peer := range multiMasterAddresses {
+			if peer != address {
+				peers = append(peers, peer)
+			}
+		}
+		configs[i] = &config.Config{
+			ServerAddress:        address,
+			DataStoreDirectory:   fmt.Sprintf("%s/multimaster%d", testDataDir, i),
+			LogLevel:             "warn",
+			PeerNodes:            peers,
+			WriteConsistencyMode: commons.EventualConsistency,
+			ReplicationMode:      commons.ReadAndWriteReplication,
+			PartitionCount:       2,
+		}
+	}
+	return configs
+}